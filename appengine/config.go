@@ -5,10 +5,14 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
 	"os"
+	"regexp"
 	"time"
 
 	"github.com/derat/home/appengine/storage"
+	"github.com/derat/home/common"
 
 	"google.golang.org/appengine/v2"
 )
@@ -18,12 +22,31 @@ const (
 	devSecret = "secret"
 
 	// Default values used in configs.
-	defaultGraphSec        = 7200
-	defaultReportSec       = 300
-	defaultFullDayDelaySec = 24 * 3600
-	defaultDaysToKeep      = 3
+	defaultGraphSec         = 7200
+	defaultReportSec        = 300 // used if the interval can't be estimated
+	defaultFullDayDelaySec  = 24 * 3600
+	defaultDaysToKeep       = 3
+	defaultOrphanedDays     = 90
+	defaultMaxFutureSkewSec = 3600
+	defaultNonceWindowSec   = 900
+	defaultMaxQueryDays     = 5 * 365
+
+	// Maximum number of decimal places that values can be rounded to. float32
+	// only has about 7 significant digits.
+	maxValuePrecision = 7
+
+	// Default Content-Security-Policy header. The Google Charts library is
+	// loaded from www.gstatic.com and injects its own stylesheets, and the
+	// page's template contains inline scripts and styles.
+	defaultContentSecurityPolicy = "default-src 'self'; " +
+		"script-src 'self' 'unsafe-inline' https://www.gstatic.com; " +
+		"style-src 'self' 'unsafe-inline' https://www.gstatic.com; " +
+		"img-src 'self' data:; connect-src 'self'; frame-ancestors 'none'"
 )
 
+// colorRegexp matches valid line colors.
+var colorRegexp = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
 // graphLineConfig describes a line within a graph.
 type graphLineConfig struct {
 	// Label displayed on graph.
@@ -32,6 +55,16 @@ type graphLineConfig struct {
 	// Source and name associated with samples.
 	Source string `json:"source"`
 	Name   string `json:"name"`
+
+	// Index of the vertical axis used by the line. Axis 0 is on the left and
+	// axis 1 on the right.
+	Axis int `json:"axis"`
+
+	// Optional color used to draw the line, e.g. "#f00" or "#ff0000".
+	Color string `json:"color"`
+
+	// If true, the line is dashed instead of solid.
+	Dashed bool `json:"dashed"`
 }
 
 // graphConfig holds configuration for an individual graph.
@@ -53,28 +86,114 @@ type graphConfig struct {
 	// If true, graph uses less vertical space than usual.
 	Short bool `json:"short"`
 
+	// If positive, the graph's height in pixels. Overrides Short.
+	Height int `json:"height"`
+
+	// If true, lines' values are stacked on top of each other.
+	Stacked bool `json:"stacked"`
+
 	// Reporting interval in seconds. If accurate, aids in choosing when to
-	// graph hourly or daily averages instead of individual samples.
+	// graph hourly or daily averages instead of individual samples. If unset,
+	// the interval is estimated from the lines' recent samples.
 	ReportSeconds int `json:"reportSeconds"`
 
+	// If non-empty, forces the graph to use the specified granularity ("sample",
+	// "hour", or "day") regardless of the time range being displayed.
+	ForceGranularity string `json:"forceGranularity"`
+
+	// If positive, missing values are filled with each line's previous value
+	// if it was seen at most this many seconds earlier. This is useful for
+	// stacked graphs, which otherwise have holes where a line lacks a value.
+	FillGapSeconds int `json:"fillGapSeconds"`
+
 	// Lines within the graph.
 	Lines []graphLineConfig `json:"lines"`
 }
 
+// check returns an error if g is invalid.
+func (g *graphConfig) check() error {
+	if g.Height < 0 {
+		return fmt.Errorf("Graph %q has negative height %v", g.Title, g.Height)
+	}
+
+	// Axes must be numbered sequentially starting at 0.
+	used := make(map[int]bool)
+	for _, l := range g.Lines {
+		if l.Axis < 0 {
+			return fmt.Errorf("Line %q in graph %q has negative axis %v", l.Label, g.Title, l.Axis)
+		}
+		used[l.Axis] = true
+		if l.Color != "" && !colorRegexp.MatchString(l.Color) {
+			return fmt.Errorf("Line %q in graph %q has invalid color %q", l.Label, g.Title, l.Color)
+		}
+	}
+	for i := 0; i < len(used); i++ {
+		if !used[i] {
+			return fmt.Errorf("Graph %q doesn't use axis %v", g.Title, i)
+		}
+	}
+	return nil
+}
+
+// seriesConfig identifies a series of samples.
+type seriesConfig struct {
+	Source string `json:"source"`
+	Name   string `json:"name"`
+}
+
+// seriesPrecisionConfig overrides config.ValuePrecision for a series.
+type seriesPrecisionConfig struct {
+	Source    string `json:"source"`
+	Name      string `json:"name"`
+	Precision int    `json:"precision"`
+}
+
 // config holds user-configurable top-level settings.
 type config struct {
 	// Google Cloud project ID.
 	ProjectID string `json:"projectId"`
 
+	// Datastore namespace in which all entities are stored, e.g. "dev" or
+	// "staging". The default namespace is used if empty.
+	Namespace string `json:"namespace"`
+
 	// Secret used by collector to sign reports.
 	ReportSecret string `json:"reportSecret"`
 
-	// Email addresses of authorized users.
+	// Additional secrets that reports may be signed with. This permits
+	// rotating secrets by adding a new one here, updating collectors to use
+	// it, and then removing the old one.
+	ReportSecrets []string `json:"reportSecrets"`
+
+	// If true, reports signed using the old SHA256(data|nonce|secret) scheme
+	// are accepted in addition to ones signed with HMAC-SHA256. This should
+	// only be enabled while collectors are being updated.
+	AcceptLegacyReportSignatures bool `json:"acceptLegacyReportSignatures"`
+
+	// Maximum difference in seconds between the server's clock and the time
+	// embedded in a report's nonce. Reports outside of this window are
+	// rejected, as are reports reusing a nonce from within it.
+	ReportNonceWindowSeconds int `json:"reportNonceWindowSeconds"`
+
+	// Email addresses of authorized users. Entries starting with '@' (e.g.
+	// "@example.org") authorize all users in the domain. Users can only view
+	// data.
 	Users []string `json:"users"`
 
+	// Email addresses of users who can additionally perform actions that
+	// modify data or send messages, e.g. purging samples. Entries use the
+	// same format as Users.
+	Admins []string `json:"admins"`
+
 	// Time zone, e.g. "America/Los_Angeles".
 	TimeZone string `json:"timeZone"`
 
+	// Hour in TimeZone at which days start for daily summaries, in the range
+	// [0, 23]. The default of 0 starts days at midnight, while e.g. 6 makes
+	// overnight samples belong to the preceding day. Days that have already
+	// been summarized aren't regenerated if this is changed.
+	DayStartHour int `json:"dayStartHour"`
+
 	// Email address from which alerts will be sent. See
 	// https://cloud.google.com/appengine/docs/standard/python/mail/#who_can_send_mail
 	// for allowed addresses.
@@ -83,23 +202,181 @@ type config struct {
 	// Email addresses to which alerts will be sent.
 	AlertRecipients []string `json:"alertRecipients"`
 
+	// Optional text/template templates used to generate alert emails' subjects
+	// and bodies. See storage.AlertMessageData for the available fields.
+	AlertSubjectTemplate string `json:"alertSubjectTemplate"`
+	AlertBodyTemplate    string `json:"alertBodyTemplate"`
+
 	// Conditions that trigger alerts.
 	AlertConditions []storage.Condition `json:"alertConditions"`
 
+	// Maximum number of alert emails to send per hour. Changes that occur
+	// after the limit is reached are reported in the next email. 0 disables
+	// the limit.
+	MaxEmailsPerHour int `json:"maxEmailsPerHour"`
+
 	// Page title.
 	Title string `json:"title"`
 
 	// Graphs to display on page.
 	Graphs []graphConfig `json:"graphs"`
 
+	// Interval in seconds at which the page should reload its graphs. 0 (the
+	// default) disables auto-refresh.
+	RefreshSeconds int `json:"refreshSeconds"`
+
 	// Days of fully-summarized samples to keep. Older samples are deleted
 	// periodically.
 	DaysToKeep int `json:"daysToKeep"`
 
+	// Per-series overrides of DaysToKeep, e.g. to retain high-resolution
+	// samples from some series for longer while deleting others' samples as
+	// soon as they're summarized. Summaries are retained regardless.
+	SampleRetention []storage.SeriesRetention `json:"sampleRetention"`
+
+	// Number of days since a series without any samples was last summarized
+	// before /gc deletes its summaries.
+	OrphanedSummaryDays int `json:"orphanedSummaryDays"`
+
 	// Number of seconds to wait after the end of a day before assuming that we
 	// won't get any new samples for it (and don't need to continue
 	// re-summarizing it).
 	FullDayDelaySeconds int `json:"fullDayDelaySeconds"`
+
+	// Maximum number of batches of summaries to write to datastore in
+	// parallel. Set to 1 to write batches sequentially if parallel writes hit
+	// contention errors.
+	SummaryWriteConcurrency int `json:"summaryWriteConcurrency"`
+
+	// Maximum number of series to query in parallel while evaluating alert
+	// conditions.
+	AlertQueryConcurrency int `json:"alertQueryConcurrency"`
+
+	// Minimum number of seconds between evaluations of alert conditions.
+	// Requests to evaluate conditions sooner than this after the previous
+	// evaluation (e.g. due to overlapping cron and manual requests) are
+	// ignored.
+	MinEvalIntervalSeconds int `json:"minEvalIntervalSeconds"`
+
+	// Series whose samples are never overwritten, e.g. for events that may be
+	// reported multiple times per second. See storage.WriteSamples for the
+	// consequences.
+	AppendOnlySeries []seriesConfig `json:"appendOnlySeries"`
+
+	// Maximum number of days that a query may span. Wider queries are rejected
+	// to avoid accidentally scanning huge amounts of data.
+	MaxQueryDays int `json:"maxQueryDays"`
+
+	// Maximum number of seconds that a reported sample's timestamp may be
+	// ahead of the server's clock. Reports containing samples further in the
+	// future are rejected.
+	MaxFutureSkewSeconds int `json:"maxFutureSkewSeconds"`
+
+	// Content-Security-Policy header sent with all responses, e.g. to permit
+	// additional script origins. A default policy permitting the Google
+	// Charts library is used if empty.
+	ContentSecurityPolicy string `json:"contentSecurityPolicy"`
+
+	// Optional number of decimal places that reported samples' values are
+	// rounded to before they're stored (and summarized), e.g. 2 to store
+	// 23.4871263 as 23.49. Values aren't rounded if this is unset.
+	ValuePrecision *int `json:"valuePrecision"`
+
+	// Per-series overrides of ValuePrecision.
+	SeriesValuePrecision []seriesPrecisionConfig `json:"seriesValuePrecision"`
+}
+
+// roundSamples rounds the values of samples in-place as described by
+// ValuePrecision and SeriesValuePrecision.
+func (c *config) roundSamples(samples []common.Sample) {
+	if c.ValuePrecision == nil && len(c.SeriesValuePrecision) == 0 {
+		return
+	}
+	series := make(map[string]int, len(c.SeriesValuePrecision))
+	for _, sp := range c.SeriesValuePrecision {
+		series[sp.Source+"|"+sp.Name] = sp.Precision
+	}
+	for i := range samples {
+		s := &samples[i]
+		prec, ok := series[s.Source+"|"+s.Name]
+		if !ok {
+			if c.ValuePrecision == nil {
+				continue
+			}
+			prec = *c.ValuePrecision
+		}
+		mult := math.Pow10(prec)
+		s.Value = float32(math.Round(float64(s.Value)*mult) / mult)
+	}
+}
+
+// appendOnlySeries returns AppendOnlySeries as a set keyed by "source|name".
+func (c *config) appendOnlySeries() map[string]bool {
+	m := make(map[string]bool)
+	for _, sc := range c.AppendOnlySeries {
+		m[sc.Source+"|"+sc.Name] = true
+	}
+	return m
+}
+
+// publicConfig contains the parts of config that are returned by /config so
+// other front ends can display the same graphs. It must not include secrets or
+// email addresses.
+type publicConfig struct {
+	Title    string        `json:"title"`
+	TimeZone string        `json:"timeZone"`
+	Graphs   []graphConfig `json:"graphs"`
+}
+
+// checkReportSignature checks that sig is a valid signature for a report
+// containing data and nonce using any of the configured secrets. legacy is
+// true if the report was signed using the legacy scheme.
+func (c *config) checkReportSignature(data, nonce, sig string) (ok, legacy bool) {
+	secrets := c.ReportSecrets
+	if c.ReportSecret != "" {
+		secrets = append([]string{c.ReportSecret}, secrets...)
+	}
+	for _, s := range secrets {
+		if common.VerifyReport(data, nonce, s, sig) {
+			return true, false
+		}
+	}
+	if c.AcceptLegacyReportSignatures {
+		for _, s := range secrets {
+			if common.VerifyLegacyReport(data, nonce, s, sig) {
+				return true, true
+			}
+		}
+	}
+	return false, false
+}
+
+// hasRole returns true if the user with the supplied email address has role.
+func (c *config) hasRole(email string, role authRole) bool {
+	if isAuthorizedEmail(email, c.Admins) {
+		return true
+	}
+	return role == viewerRole && isAuthorizedEmail(email, c.Users)
+}
+
+// publicConfig returns the parts of c that can be shared with front ends.
+func (c *config) publicConfig() *publicConfig {
+	return &publicConfig{
+		Title:    c.Title,
+		TimeZone: c.TimeZone,
+		Graphs:   c.Graphs,
+	}
+}
+
+// alertMessageConfig returns the settings used to construct alert emails.
+func (c *config) alertMessageConfig() *storage.AlertMessageConfig {
+	return &storage.AlertMessageConfig{
+		Sender:           c.AlertSender,
+		Recipients:       c.AlertRecipients,
+		SubjectTemplate:  c.AlertSubjectTemplate,
+		BodyTemplate:     c.AlertBodyTemplate,
+		MaxEmailsPerHour: c.MaxEmailsPerHour,
+	}
 }
 
 func loadConfig(path string) (*config, *time.Location, error) {
@@ -126,17 +403,78 @@ func loadConfig(path string) (*config, *time.Location, error) {
 	if c.DaysToKeep <= 0 {
 		c.DaysToKeep = defaultDaysToKeep
 	}
+	if c.OrphanedSummaryDays <= 0 {
+		c.OrphanedSummaryDays = defaultOrphanedDays
+	}
+	if p := c.ValuePrecision; p != nil && (*p < 0 || *p > maxValuePrecision) {
+		return nil, nil, fmt.Errorf("Value precision %v not in [0, %v]", *p, maxValuePrecision)
+	}
+	for _, sp := range c.SeriesValuePrecision {
+		if sp.Precision < 0 || sp.Precision > maxValuePrecision {
+			return nil, nil, fmt.Errorf("Value precision %v for %v|%v not in [0, %v]",
+				sp.Precision, sp.Source, sp.Name, maxValuePrecision)
+		}
+	}
+	for _, sr := range c.SampleRetention {
+		if sr.Source == "" || sr.Name == "" {
+			return nil, nil, fmt.Errorf("Sample retention for %q|%q missing source or name", sr.Source, sr.Name)
+		}
+		if sr.DaysToKeep < 0 {
+			return nil, nil, fmt.Errorf("Negative sample retention %v for %v|%v",
+				sr.DaysToKeep, sr.Source, sr.Name)
+		}
+	}
 	if c.FullDayDelaySeconds <= 0 {
 		c.FullDayDelaySeconds = defaultFullDayDelaySec
 	}
+	if c.SummaryWriteConcurrency <= 0 {
+		c.SummaryWriteConcurrency = storage.DefaultSummaryWriteConcurrency
+	}
+	if c.AlertQueryConcurrency <= 0 {
+		c.AlertQueryConcurrency = storage.DefaultAlertQueryConcurrency
+	}
+	if c.ReportNonceWindowSeconds <= 0 {
+		c.ReportNonceWindowSeconds = defaultNonceWindowSec
+	}
+	if c.MaxFutureSkewSeconds <= 0 {
+		c.MaxFutureSkewSeconds = defaultMaxFutureSkewSec
+	}
+	if c.DayStartHour < 0 || c.DayStartHour > 23 {
+		return nil, nil, fmt.Errorf("Day start hour %v not in [0, 23]", c.DayStartHour)
+	}
+	if c.MinEvalIntervalSeconds < 0 {
+		return nil, nil, fmt.Errorf("Negative evaluation interval %v", c.MinEvalIntervalSeconds)
+	}
+	if c.RefreshSeconds < 0 {
+		return nil, nil, fmt.Errorf("Negative refresh interval %v", c.RefreshSeconds)
+	}
+	if c.MaxQueryDays <= 0 {
+		c.MaxQueryDays = defaultMaxQueryDays
+	}
+	if c.ContentSecurityPolicy == "" {
+		c.ContentSecurityPolicy = defaultContentSecurityPolicy
+	}
 	for i := range c.Graphs {
 		if c.Graphs[i].Seconds <= 0 {
 			c.Graphs[i].Seconds = defaultGraphSec
 		}
-		if c.Graphs[i].ReportSeconds <= 0 {
-			c.Graphs[i].ReportSeconds = defaultReportSec
+		if err := c.Graphs[i].check(); err != nil {
+			return nil, nil, err
+		}
+		if g := c.Graphs[i].ForceGranularity; g != "" {
+			if _, err := storage.ParseQueryGranularity(g); err != nil {
+				return nil, nil, err
+			}
 		}
 	}
+	for i := range c.AlertConditions {
+		if err := c.AlertConditions[i].Check(); err != nil {
+			return nil, nil, fmt.Errorf("Bad alert condition: %v", err)
+		}
+	}
+	if err := c.alertMessageConfig().CheckTemplates(); err != nil {
+		return nil, nil, fmt.Errorf("Bad alert template: %v", err)
+	}
 	var loc *time.Location
 	if loc, err = time.LoadLocation(c.TimeZone); err != nil {
 		return nil, nil, err
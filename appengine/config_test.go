@@ -0,0 +1,205 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/home/appengine/storage"
+	"github.com/derat/home/common"
+)
+
+func TestGraphConfigCheck(t *testing.T) {
+	for _, tc := range []struct {
+		axes []int
+		ok   bool
+	}{
+		{[]int{}, true},
+		{[]int{0}, true},
+		{[]int{0, 0}, true},
+		{[]int{0, 1}, true},
+		{[]int{1, 0, 1}, true},
+		{[]int{1}, false},
+		{[]int{0, 2}, false},
+		{[]int{0, -1}, false},
+	} {
+		g := graphConfig{Title: "graph"}
+		for _, a := range tc.axes {
+			g.Lines = append(g.Lines, graphLineConfig{Label: "line", Axis: a})
+		}
+		if err := g.check(); err != nil && tc.ok {
+			t.Errorf("Axes %v unexpectedly rejected: %v", tc.axes, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("Axes %v unexpectedly accepted", tc.axes)
+		}
+	}
+}
+
+func TestGraphConfigCheckColor(t *testing.T) {
+	for _, tc := range []struct {
+		color string
+		ok    bool
+	}{
+		{"", true},
+		{"#f00", true},
+		{"#A0b1C2", true},
+		{"f00", false},
+		{"#ff00", false},
+		{"#ggg", false},
+		{"red", false},
+	} {
+		g := graphConfig{Title: "graph", Lines: []graphLineConfig{{Label: "line", Color: tc.color}}}
+		if err := g.check(); err != nil && tc.ok {
+			t.Errorf("Color %q unexpectedly rejected: %v", tc.color, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("Color %q unexpectedly accepted", tc.color)
+		}
+	}
+}
+
+func TestGraphConfigCheckHeight(t *testing.T) {
+	for _, tc := range []struct {
+		height int
+		ok     bool
+	}{
+		{0, true},
+		{400, true},
+		{-1, false},
+	} {
+		g := graphConfig{Title: "graph", Height: tc.height}
+		if err := g.check(); err != nil && tc.ok {
+			t.Errorf("Height %v unexpectedly rejected: %v", tc.height, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("Height %v unexpectedly accepted", tc.height)
+		}
+	}
+}
+
+func TestConfigHasRole(t *testing.T) {
+	c := config{
+		Users:  []string{"user@example.org", "@example.com"},
+		Admins: []string{"admin@example.org"},
+	}
+	for _, tc := range []struct {
+		email  string
+		viewer bool
+		admin  bool
+	}{
+		{"user@example.org", true, false},
+		{"someone@example.com", true, false},
+		{"admin@example.org", true, true},
+		{"other@example.org", false, false},
+	} {
+		if act := c.hasRole(tc.email, viewerRole); act != tc.viewer {
+			t.Errorf("Viewer role for %q is %v; expected %v", tc.email, act, tc.viewer)
+		}
+		if act := c.hasRole(tc.email, adminRole); act != tc.admin {
+			t.Errorf("Admin role for %q is %v; expected %v", tc.email, act, tc.admin)
+		}
+	}
+}
+
+func TestConfigCheckReportSignature(t *testing.T) {
+	const (
+		data  = "123|src|name|4.0"
+		nonce = "123-abcd"
+	)
+	c := config{ReportSecret: "old", ReportSecrets: []string{"new"}}
+	for _, tc := range []struct {
+		sig        string
+		acceptOld  bool
+		ok, legacy bool
+	}{
+		{common.SignReport(data, nonce, "old"), false, true, false},
+		{common.SignReport(data, nonce, "new"), false, true, false},
+		{common.SignReport(data, nonce, "bogus"), false, false, false},
+		{common.SignLegacyReport(data, nonce, "new"), false, false, false},
+		{common.SignLegacyReport(data, nonce, "new"), true, true, true},
+		{"", true, false, false},
+	} {
+		c.AcceptLegacyReportSignatures = tc.acceptOld
+		if ok, legacy := c.checkReportSignature(data, nonce, tc.sig); ok != tc.ok || legacy != tc.legacy {
+			t.Errorf("checkReportSignature(%q) with legacy=%v returned (%v, %v); expected (%v, %v)",
+				tc.sig, tc.acceptOld, ok, legacy, tc.ok, tc.legacy)
+		}
+	}
+
+	// ReportSecret should be optional.
+	c = config{ReportSecrets: []string{"a", "b"}}
+	if ok, _ := c.checkReportSignature(data, nonce, common.SignReport(data, nonce, "b")); !ok {
+		t.Errorf("Report signed with second secret was rejected")
+	}
+}
+
+func TestConfigRoundSamples(t *testing.T) {
+	ts := time.Unix(100, 0)
+	in := []common.Sample{
+		{ts, "a", "b", 23.4871263},
+		{ts, "a", "c", 23.4871263},
+		{ts, "a", "d", -1.25},
+	}
+	two := 2
+	c := &config{
+		ValuePrecision:       &two,
+		SeriesValuePrecision: []seriesPrecisionConfig{{Source: "a", Name: "c", Precision: 0}},
+	}
+	// Compare the values directly, since String only includes a single
+	// decimal place.
+	values := func(samples []common.Sample) []float32 {
+		vals := make([]float32, len(samples))
+		for i, s := range samples {
+			vals[i] = s.Value
+		}
+		return vals
+	}
+	samples := append([]common.Sample{}, in...)
+	c.roundSamples(samples)
+	if act, exp := values(samples), []float32{23.49, 23, -1.25}; !reflect.DeepEqual(act, exp) {
+		t.Errorf("roundSamples produced %v; expected %v", act, exp)
+	}
+
+	// Values shouldn't be modified if precision isn't configured.
+	samples = append([]common.Sample{}, in...)
+	(&config{}).roundSamples(samples)
+	if act, exp := values(samples), values(in); !reflect.DeepEqual(act, exp) {
+		t.Errorf("roundSamples without precision produced %v; expected %v", act, exp)
+	}
+}
+
+func TestPublicConfig(t *testing.T) {
+	c := config{
+		ReportSecret:    "secret-value",
+		Users:           []string{"user@example.org"},
+		AlertSender:     "sender@example.org",
+		AlertRecipients: []string{"recipient@example.org"},
+		AlertConditions: []storage.Condition{{Source: "cond-source", Name: "cond-name", Op: "gt"}},
+		Title:           "My Title",
+		Graphs: []graphConfig{{
+			Title:   "Graph",
+			Units:   "units",
+			Seconds: 3600,
+			Range:   []float32{0, 10},
+			Lines:   []graphLineConfig{{Label: "Line", Source: "src", Name: "name"}},
+		}},
+	}
+	b, err := json.Marshal(c.publicConfig())
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+	out := string(b)
+	for _, s := range []string{"My Title", "Graph", "units", "3600", "Line", "src", "name"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("%q not included in %s", s, out)
+		}
+	}
+	for _, s := range []string{"secret-value", "example.org", "cond-source"} {
+		if strings.Contains(out, s) {
+			t.Errorf("%q included in %s", s, out)
+		}
+	}
+}
@@ -6,15 +6,19 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/derat/home/appengine/render"
 	"github.com/derat/home/appengine/storage"
 	"github.com/derat/home/common"
 
@@ -29,8 +33,25 @@ const (
 
 	// Path of template file relative to base app directory.
 	templatePath = "appengine/template.html"
+
+	// Default maximum number of events returned by /alerts/history.
+	defaultAlertHistoryEvents = 100
+
+	// Default and maximum numbers of samples returned by /debug/samples.
+	defaultDebugSamples = 20
+	maxDebugSamples     = 1000
+
+	// Maximum width or height in pixels of images returned by /render.
+	maxRenderDim = 2000
 )
 
+// templateLine is used to pass line information to the template.
+type templateLine struct {
+	Axis   int
+	Color  string
+	Dashed bool
+}
+
 // templateGraph is used to pass graph information to the template.
 type templateGraph struct {
 	Id             string
@@ -39,9 +60,12 @@ type templateGraph struct {
 	HasMin, HasMax bool
 	Min, Max       float32
 	Short          bool
+	Height         int
+	Stacked        bool
 	QueryPath      string
 	Seconds        int
 	ReportSeconds  int
+	Lines          []templateLine
 }
 
 var cfg *config
@@ -62,27 +86,57 @@ func main() {
 		panic(err)
 	}
 
-	http.HandleFunc("/eval", wrapError(handleEval))
-	http.HandleFunc("/purge", wrapError(handlePurge))
-	http.HandleFunc("/query", wrapError(handleQuery))
-	http.HandleFunc("/report", wrapError(handleReport))
-	http.HandleFunc("/summarize", wrapError(handleSummarize))
-	http.HandleFunc("/", wrapError(handleIndex))
+	handle := func(path string, f func(context.Context, http.ResponseWriter, *http.Request) *handlerError) {
+		http.HandleFunc(path, addSecurityHeaders(wrapError(f), cfg.ContentSecurityPolicy))
+	}
+	handle("/alerts/history", handleAlertsHistory)
+	handle("/alerts/preview", handleAlertsPreview)
+	handle("/alerts/test", handleAlertsTest)
+	handle("/config", handleConfig)
+	handle("/debug/samples", handleDebugSamples)
+	handle("/eval", handleEval)
+	handle("/gc", handleGC)
+	handle("/purge", handlePurge)
+	handle("/query", handleQuery)
+	handle("/render", handleRender)
+	handle("/report", handleReport)
+	handle("/sample", handleSample)
+	handle("/status", handleStatus)
+	handle("/summarize", handleSummarize)
+	handle("/version", handleVersion)
+	handle("/", handleIndex)
 
 	appengine.Main()
 }
 
-// checkAuth verifies that r is from an authorized user. If redirect is true,
+// authRole describes the access that a handler requires.
+type authRole int
+
+const (
+	// viewerRole permits viewing data.
+	viewerRole authRole = iota
+	// adminRole additionally permits modifying data and sending messages.
+	adminRole
+)
+
+// checkAuth verifies that r is from a user with role. If redirect is true,
 // requests lacking any user info are redirected to the login URL. Returns false
 // and writes an error/redirect to w if the request is not allowed.
 // Returns true without writing anything to w if the request is allowed.
-func checkAuth(c context.Context, w http.ResponseWriter, r *http.Request, redirect bool) bool {
+//
+// Requests from App Engine's cron service and from App Engine administrators
+// are always allowed.
+func checkAuth(c context.Context, w http.ResponseWriter, r *http.Request,
+	role authRole, redirect bool) bool {
+	// App Engine strips this header from external requests.
+	if r.Header.Get("X-Appengine-Cron") == "true" {
+		return true
+	}
+
 	u := user.Current(c)
 	if u != nil {
-		for _, e := range cfg.Users {
-			if u.Email == e {
-				return true
-			}
+		if u.Admin || cfg.hasRole(u.Email, role) {
+			return true
 		}
 		log.Warningf(c, "Got request from invalid user %q", u.Email)
 		http.Error(w, "Forbidden", http.StatusForbidden)
@@ -99,6 +153,22 @@ func checkAuth(c context.Context, w http.ResponseWriter, r *http.Request, redire
 	return false
 }
 
+// isAuthorizedEmail returns true if email is matched by an entry in users.
+// Entries starting with '@' (e.g. "@example.org") match all addresses in
+// that domain; other entries must match email exactly.
+func isAuthorizedEmail(email string, users []string) bool {
+	for _, e := range users {
+		if strings.HasPrefix(e, "@") {
+			if i := strings.LastIndex(email, "@"); i > 0 && strings.EqualFold(email[i:], e) {
+				return true
+			}
+		} else if email == e {
+			return true
+		}
+	}
+	return false
+}
+
 type handlerError struct {
 	// HTTP status code.
 	status int
@@ -114,149 +184,828 @@ type handlerError struct {
 func wrapError(f func(c context.Context, w http.ResponseWriter,
 	r *http.Request) *handlerError) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c := appengine.NewContext(r)
-		if herr := f(c, w, r); herr != nil {
+		c, err := appengine.Namespace(appengine.NewContext(r), cfg.Namespace)
+		if err != nil {
+			log.Errorf(c, "Bad namespace %q: %v", cfg.Namespace, err)
+			http.Error(w, "Bad namespace", http.StatusInternalServerError)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		if herr := f(c, sw, r); herr != nil {
 			log.Errorf(c, "%s: %v", herr.msg, herr.err)
-			http.Error(w, herr.msg, herr.status)
+			http.Error(sw, herr.msg, herr.status)
 		}
+		log.Debugf(c, "%s %s returned %d in %v", r.Method, r.URL.Path, sw.getStatus(),
+			time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// addSecurityHeaders wraps h to set security-related headers in all replies,
+// including a Content-Security-Policy header containing csp.
+func addSecurityHeaders(h http.HandlerFunc, csp string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hdr := w.Header()
+		hdr.Set("Content-Security-Policy", csp)
+		hdr.Set("X-Content-Type-Options", "nosniff")
+		hdr.Set("X-Frame-Options", "DENY")
+		hdr.Set("Referrer-Policy", "same-origin")
+		h(w, r)
+	}
+}
+
+// statusWriter wraps an http.ResponseWriter to record the reply's status code.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
 	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// getStatus returns the status code sent in the reply. http.StatusOK is
+// returned if nothing was written, since that's what the server sends.
+func (sw *statusWriter) getStatus() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
+
+func handleConfig(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
+	if !checkAuth(c, w, r, viewerRole, false) {
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cfg.publicConfig()); err != nil {
+		return &handlerError{500, "Failed writing config", err}
+	}
+	return nil
 }
 
 func handleEval(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
+	if !checkAuth(c, w, r, adminRole, false) {
+		return nil
+	}
 	if err := storage.EvaluateConds(c, cfg.AlertConditions, time.Now().In(location),
-		cfg.AlertSender, cfg.AlertRecipients); err != nil {
+		cfg.alertMessageConfig(), time.Duration(cfg.MinEvalIntervalSeconds)*time.Second,
+		cfg.AlertQueryConcurrency); err != nil {
 		return &handlerError{500, "Evaluating alert conditions failed", err}
 	}
 	return nil
 }
 
+func handleAlertsTest(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
+	if !checkAuth(c, w, r, adminRole, true) {
+		return nil
+	}
+	if err := storage.SendTestAlert(c, cfg.alertMessageConfig(), time.Now().In(location)); err != nil {
+		return &handlerError{500, "Sending test alert failed", err}
+	}
+	io.WriteString(w, "test alert sent\n")
+	return nil
+}
+
+// handleAlertsPreview evaluates the JSON array of storage.Condition objects in
+// the request body against current data and returns their states as a JSON
+// array of storage.ConditionPreview objects. The stored alert state isn't
+// modified and no email is sent.
+func handleAlertsPreview(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
+	if !checkAuth(c, w, r, adminRole, false) {
+		return nil
+	}
+	if r.Method != "POST" {
+		return &handlerError{405, "Invalid method", nil}
+	}
+
+	var conds []storage.Condition
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&conds); err != nil {
+		return &handlerError{400, "Bad conditions", err}
+	}
+	for i := range conds {
+		if err := conds[i].Check(); err != nil {
+			return &handlerError{400, "Bad condition", err}
+		}
+	}
+
+	previews, err := storage.PreviewConds(c, conds, time.Now().In(location),
+		cfg.AlertQueryConcurrency)
+	if err != nil {
+		return &handlerError{500, "Evaluating conditions failed", err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(previews); err != nil {
+		return &handlerError{500, "Failed writing previews", err}
+	}
+	return nil
+}
+
+func handleAlertsHistory(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
+	if !checkAuth(c, w, r, viewerRole, false) {
+		return nil
+	}
+	max := defaultAlertHistoryEvents
+	if ms := r.FormValue("max"); ms != "" {
+		var err error
+		if max, err = strconv.Atoi(ms); err != nil || max <= 0 {
+			return &handlerError{400, "Bad max", err}
+		}
+	}
+	events, err := storage.GetAlertEvents(c, max)
+	if err != nil {
+		return &handlerError{500, "Getting alert history failed", err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		return &handlerError{500, "Failed writing alert history", err}
+	}
+	return nil
+}
+
 func handlePurge(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
-	if err := storage.DeleteSummarizedSamples(c, location, cfg.DaysToKeep); err != nil {
+	if !checkAuth(c, w, r, adminRole, false) {
+		return nil
+	}
+	if err := storage.DeleteSummarizedSamples(c, location, cfg.DayStartHour, cfg.DaysToKeep,
+		cfg.SampleRetention); err != nil {
 		return &handlerError{500, "Purging samples failed", err}
 	}
+	if err := storage.DeleteExpiredNonces(c, time.Now()); err != nil {
+		return &handlerError{500, "Deleting expired nonces failed", err}
+	}
 	io.WriteString(w, "purging done\n")
 	return nil
 }
 
+func handleGC(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
+	if !checkAuth(c, w, r, adminRole, false) {
+		return nil
+	}
+	// Only report the orphaned series unless deletion was requested.
+	dryRun := r.FormValue("delete") != "1"
+	cutoff := time.Now().AddDate(0, 0, -cfg.OrphanedSummaryDays)
+	series, err := storage.DeleteOrphanedSummaries(c, cutoff, dryRun)
+	if err != nil {
+		return &handlerError{500, "Deleting orphaned summaries failed", err}
+	}
+	verb := "deleted"
+	if dryRun {
+		verb = "would delete"
+	}
+	for _, sn := range series {
+		fmt.Fprintf(w, "%s summaries for %s\n", verb, sn)
+	}
+	io.WriteString(w, "gc done\n")
+	return nil
+}
+
 func handleQuery(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
-	if !checkAuth(c, w, r, false) {
+	if !checkAuth(c, w, r, viewerRole, false) {
+		return nil
+	}
+
+	p, herr := parseQueryParams(c, r)
+	if herr != nil {
+		return herr
+	}
+
+	p.Extremes = r.FormValue("extremes") == "1"
+	p.Counts = r.FormValue("counts") == "1"
+
+	ctype := "application/json"
+	switch getQueryFormat(r.FormValue("format"), r.Header.Get("Accept")) {
+	case "datatable":
+	case "values":
+		if len(p.SourceNames) != 1 {
+			return &handlerError{400, "Values format requires a single line", nil}
+		}
+		p.ValuesOnly = true
+	case "rows":
+		p.Rows = true
+	case "csv":
+		p.CSV = true
+		ctype = "text/csv; charset=utf-8"
+	default:
+		return &handlerError{400, "Bad format", nil}
+	}
+
+	var b bytes.Buffer
+	if err := storage.DoQuery(c, &b, *p); err != nil {
+		return &handlerError{500, "Query failed", err}
+	}
+	w.Header().Set("Content-Type", ctype)
+	if _, err := io.Copy(w, &b); err != nil {
+		return &handlerError{500, "Failed copying query results", err}
+	}
+	return nil
+}
+
+// getQueryFormat returns the output format for a query given the "format"
+// parameter and the request's Accept header. The parameter takes precedence;
+// if it's empty, CSV is used if the client accepts text/csv but not JSON.
+// Otherwise, "datatable" is returned.
+func getQueryFormat(param, accept string) string {
+	if param != "" {
+		return param
+	}
+	var wantCSV, wantJSON bool
+	for _, mr := range strings.Split(accept, ",") {
+		switch strings.TrimSpace(strings.SplitN(mr, ";", 2)[0]) {
+		case "text/csv":
+			wantCSV = true
+		case "application/json":
+			wantJSON = true
+		}
+	}
+	if wantCSV && !wantJSON {
+		return "csv"
+	}
+	return "datatable"
+}
+
+func handleRender(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
+	if !checkAuth(c, w, r, viewerRole, false) {
 		return nil
 	}
 
-	p := storage.QueryParams{}
+	p, herr := parseQueryParams(c, r)
+	if herr != nil {
+		return herr
+	}
+	ch := render.Chart{
+		Start:  p.Start,
+		End:    p.End,
+		Labels: append([]string{}, p.Labels...),
+		Units:  findGraphUnits(cfg.Graphs, p.SourceNames),
+	}
+	for _, e := range p.Exprs {
+		ch.Labels = append(ch.Labels, e.Label)
+	}
+	for _, d := range []struct {
+		name string
+		dst  *int
+	}{
+		{"width", &ch.Width},
+		{"height", &ch.Height},
+	} {
+		if v := r.FormValue(d.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > maxRenderDim {
+				return &handlerError{400, "Bad " + d.name, err}
+			}
+			*d.dst = n
+		}
+	}
+
+	// Summaries' minimum and maximum values are shaded behind the lines.
+	ranges, err := storage.RunQuery(c, *p, true, ch.AddPoint)
+	if err != nil {
+		return &handlerError{500, "Query failed", err}
+	}
+	for i, lr := range ranges {
+		for _, vr := range lr {
+			ch.AddRange(i, render.Range{Time: vr.Timestamp, Min: vr.Min, Max: vr.Max})
+		}
+	}
+	var b bytes.Buffer
+	if err := ch.WritePNG(&b); err != nil {
+		return &handlerError{500, "Rendering failed", err}
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if _, err := io.Copy(w, &b); err != nil {
+		return &handlerError{500, "Failed copying image", err}
+	}
+	return nil
+}
+
+// findGraphUnits returns the units of the first graph in graphs whose lines are
+// described by sourceNames ("source|name" strings). An empty string is
+// returned if there's no such graph.
+func findGraphUnits(graphs []graphConfig, sourceNames []string) string {
+	for _, g := range graphs {
+		if len(g.Lines) != len(sourceNames) {
+			continue
+		}
+		match := true
+		for i, l := range g.Lines {
+			if l.Source+"|"+l.Name != sourceNames[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return g.Units
+		}
+	}
+	return ""
+}
+
+// parseQueryParams parses the query-related parameters shared by /query and
+// /render.
+func parseQueryParams(c context.Context, r *http.Request) (*storage.QueryParams, *handlerError) {
+	p := &storage.QueryParams{DayStartHour: cfg.DayStartHour}
 	p.Labels = strings.Split(r.FormValue("labels"), ",")
 	p.SourceNames = strings.Split(r.FormValue("names"), ",")
 
-	var herr *handlerError
-	parseTime := func(s string) time.Time {
-		if t, err := strconv.ParseInt(s, 10, 64); err != nil {
-			herr = &handlerError{400, "Bad time", err}
-			return time.Time{}
+	// The time zone used for output can be overridden. This only applies to
+	// individual samples; see below.
+	loc := location
+	if tz := r.FormValue("tz"); tz != "" {
+		if l, err := time.LoadLocation(tz); err != nil {
+			log.Warningf(c, "Ignoring bad time zone %q: %v", tz, err)
 		} else {
-			return time.Unix(t, 0).In(location)
+			loc = l
 		}
 	}
-	p.Start = parseTime(r.FormValue("start"))
-	p.End = parseTime(r.FormValue("end"))
-	if herr != nil {
-		return herr
+
+	var err error
+	if p.Start, p.End, err = parseQueryTimes(r.FormValue("start"), r.FormValue("end"),
+		r.FormValue("range"), time.Now(), loc); err != nil {
+		return nil, &handlerError{400, "Bad time", err}
+	}
+	if err := checkQueryRange(p.Start, p.End, cfg.MaxQueryDays); err != nil {
+		return nil, &handlerError{400, "Bad time range", err}
 	}
 
-	is := r.FormValue("interval")
-	if is != "" {
+	// Dashboard graphs pass "auto" if their reporting interval isn't
+	// configured.
+	var interval time.Duration
+	autoInterval := false
+	if is := r.FormValue("interval"); is == "auto" {
+		autoInterval = true
+	} else if is != "" {
 		if d, err := strconv.ParseInt(is, 10, 64); err != nil || d <= 0 {
-			return &handlerError{400, "Bad interval", err}
+			return nil, &handlerError{400, "Bad interval", err}
 		} else {
-			// This is an pessimistic approximation since we're not checking how
-			// far summarization has actually progressed.
-			st := time.Now().In(location).AddDate(0, 0, -1*cfg.DaysToKeep)
-			p.UpdateGranularityAndAggregation(
-				time.Duration(d)*time.Second,
-				time.Date(st.Year(), st.Month(), st.Day(), 0, 0, 0, 0, location))
+			interval = time.Duration(d) * time.Second
 		}
 	}
 
-	var b bytes.Buffer
-	if err := storage.DoQuery(c, &b, p); err != nil {
-		return &handlerError{500, "Query failed", err}
+	if fs := r.FormValue("fill"); fs != "" {
+		if d, err := time.ParseDuration(fs); err != nil || d <= 0 {
+			return nil, &handlerError{400, "Bad fill gap", err}
+		} else {
+			p.MaxGap = d
+		}
 	}
-	if _, err := io.Copy(w, &b); err != nil {
-		return &handlerError{500, "Failed copying query results", err}
+
+	if as := r.FormValue("align"); as != "" {
+		if d, err := time.ParseDuration(as); err != nil || d <= 0 {
+			return nil, &handlerError{400, "Bad alignment period", err}
+		} else {
+			p.AlignPeriod = d
+		}
+	}
+
+	if ss := r.FormValue("since"); ss != "" {
+		if p.Since, err = common.ParseTimestamp(ss); err != nil {
+			return nil, &handlerError{400, "Bad since time", err}
+		}
+	}
+
+	if rs := r.FormValue("reduce"); rs != "" {
+		if p.Reducer, err = storage.ParseQueryReducer(rs); err != nil {
+			return nil, &handlerError{400, "Bad reducer", err}
+		}
+	}
+
+	for _, es := range r.Form["expr"] {
+		e, err := storage.ParseQueryExpr(es)
+		if err != nil {
+			return nil, &handlerError{400, "Bad expression", err}
+		}
+		p.Exprs = append(p.Exprs, e)
+	}
+
+	if ss := r.FormValue("smooth"); ss != "" {
+		if n, err := strconv.Atoi(ss); err != nil || n <= 0 {
+			return nil, &handlerError{400, "Bad smoothing window", err}
+		} else {
+			p.Smooth = n
+		}
+	}
+
+	if autoInterval {
+		// Estimate the interval from recent samples.
+		d, err := storage.EstimateSampleInterval(c, p.SourceNames)
+		if err != nil {
+			return nil, &handlerError{500, "Estimating interval failed", err}
+		} else if d > 0 {
+			interval = d
+		} else {
+			interval = time.Duration(defaultReportSec) * time.Second
+		}
+	}
+
+	// This is an pessimistic approximation since we're not checking how far
+	// summarization has actually progressed.
+	st := time.Now().In(location).AddDate(0, 0, -1*cfg.DaysToKeep)
+	sampleStart := time.Date(st.Year(), st.Month(), st.Day(), cfg.DayStartHour, 0, 0, 0, location)
+	if err := setQueryGranularity(p, r.FormValue("granularity"), interval, sampleStart); err != nil {
+		return nil, &handlerError{400, "Bad granularity", err}
+	}
+
+	// Summaries' periods start at day boundaries in the configured time zone,
+	// so their points are always reported in it.
+	if p.Granularity != storage.IndividualSample {
+		p.Start, p.End = p.Start.In(location), p.End.In(location)
+	}
+	return p, nil
+}
+
+// setQueryGranularity updates p's granularity and aggregation. If granularity
+// (a storage.ParseQueryGranularity string) is non-empty, it's used. Otherwise,
+// if interval (the typical interval between samples) is positive, the
+// granularity is chosen automatically based on the query's duration, with
+// sampleStart describing the oldest samples that are available. If neither is
+// supplied, p is left unchanged.
+func setQueryGranularity(p *storage.QueryParams, granularity string,
+	interval time.Duration, sampleStart time.Time) error {
+	if granularity != "" {
+		g, err := storage.ParseQueryGranularity(granularity)
+		if err != nil {
+			return err
+		}
+		p.SetGranularity(g, interval)
+	} else if interval > 0 {
+		p.UpdateGranularityAndAggregation(interval, sampleStart)
 	}
 	return nil
 }
 
+// parseGraphSeconds returns the number of seconds that graphs should span as
+// described by secs (an optional integer) or rng (an optional
+// time.ParseDuration string). 0 is returned if both are empty.
+func parseGraphSeconds(secs, rng string, maxDays int) (int, error) {
+	var d time.Duration
+	if secs != "" {
+		n, err := strconv.Atoi(secs)
+		if err != nil {
+			return 0, err
+		}
+		d = time.Duration(n) * time.Second
+	} else if rng != "" {
+		var err error
+		if d, err = time.ParseDuration(rng); err != nil {
+			return 0, err
+		}
+	} else {
+		return 0, nil
+	}
+
+	if d < time.Second {
+		return 0, fmt.Errorf("span %v too short", d)
+	}
+	if maxDays > 0 && d > time.Duration(maxDays)*24*time.Hour {
+		return 0, fmt.Errorf("span exceeds %d days", maxDays)
+	}
+	return int(d / time.Second), nil
+}
+
+// checkQueryRange returns an error if the range [start, end] is reversed or
+// spans more than maxDays days.
+func checkQueryRange(start, end time.Time, maxDays int) error {
+	if end.Before(start) {
+		return errors.New("end before start")
+	}
+	if maxDays > 0 && end.Sub(start) > time.Duration(maxDays)*24*time.Hour {
+		return fmt.Errorf("range exceeds %d days", maxDays)
+	}
+	return nil
+}
+
+// parseQueryTimes returns the start and end times for a query. start and end
+// contain optional Unix timestamps, while rng contains an optional
+// time.ParseDuration string: end defaults to now and start defaults to rng
+// before end. Absolute times take precedence over rng.
+func parseQueryTimes(start, end, rng string, now time.Time, loc *time.Location) (
+	st, et time.Time, err error) {
+	var d time.Duration
+	if rng != "" {
+		if d, err = time.ParseDuration(rng); err != nil {
+			return st, et, err
+		} else if d <= 0 {
+			return st, et, fmt.Errorf("non-positive range %q", rng)
+		}
+	}
+
+	if end != "" {
+		t, err := strconv.ParseInt(end, 10, 64)
+		if err != nil {
+			return st, et, err
+		}
+		et = time.Unix(t, 0).In(loc)
+	} else if rng != "" {
+		et = now.In(loc)
+	} else {
+		return st, et, errors.New("missing end")
+	}
+
+	if start != "" {
+		t, err := strconv.ParseInt(start, 10, 64)
+		if err != nil {
+			return st, et, err
+		}
+		st = time.Unix(t, 0).In(loc)
+	} else if rng != "" {
+		st = et.Add(-d)
+	} else {
+		return st, et, errors.New("missing start")
+	}
+	return st, et, nil
+}
+
 func handleReport(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
 	if r.Method != "POST" {
 		return &handlerError{405, "Invalid method", nil}
 	}
 
-	data := r.PostFormValue("d")
+	log.Debugf(c, "Report request %q from %q", r.Header.Get(common.ReportRequestIdHeader),
+		r.Header.Get("User-Agent"))
+
+	// Binary reports contain encoded samples in the body and pass the nonce and
+	// signature as query parameters.
+	now := time.Now()
+	binary := r.Header.Get("Content-Type") == common.BinaryReportContentType
+	var data, nonce, sig string
+	if binary {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return &handlerError{400, "Failed reading report", err}
+		}
+		q := r.URL.Query()
+		data, nonce, sig = string(b), q.Get("n"), q.Get("s")
+	} else {
+		data, nonce, sig = r.PostFormValue("d"), r.PostFormValue("n"), r.PostFormValue("s")
+	}
 	if !appengine.IsDevAppServer() {
-		sig := r.PostFormValue("s")
-		if sig != common.HashStringWithSHA256(fmt.Sprintf("%s|%s", data, cfg.ReportSecret)) {
+		if ok, legacy := cfg.checkReportSignature(data, nonce, sig); !ok {
 			return &handlerError{400, "Bad signature", nil}
+		} else if legacy {
+			log.Warningf(c, "Accepted report with legacy signature")
+		}
+		window := time.Duration(cfg.ReportNonceWindowSeconds) * time.Second
+		if err := storage.CheckReportNonce(c, nonce, now, window); err != nil {
+			if err == storage.ErrStaleNonce || err == storage.ErrReusedNonce {
+				return &handlerError{400, "Bad nonce", err}
+			}
+			return &handlerError{500, "Checking nonce failed", err}
 		}
 	}
 
-	now := time.Now()
+	maxSkew := time.Duration(cfg.MaxFutureSkewSeconds) * time.Second
+	var samples []common.Sample
+	var rejected, invalid []int
+	var errs []error
+	if binary {
+		decoded, err := common.DecodeSamples([]byte(data))
+		if err != nil {
+			return &handlerError{400, "Bad samples", err}
+		}
+		samples, rejected, invalid, errs = checkReportSamples(decoded, now, maxSkew)
+	} else {
+		samples, rejected, invalid, errs = parseReportSamples(data, now, maxSkew)
+	}
+	for _, err := range errs {
+		log.Warningf(c, "Rejecting sample %v", err)
+	}
+
+	log.Debugf(c, "Got report with %v sample(s)", len(samples)+len(rejected))
+	if len(samples) > 0 {
+		cfg.roundSamples(samples)
+		if err := storage.WriteSamples(c, samples, cfg.appendOnlySeries()); err != nil {
+			return &handlerError{500, "Write failed", err}
+		}
+	}
+	reply := common.ReportReply{Accepted: len(samples), Rejected: rejected, Invalid: invalid}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		return &handlerError{500, "Failed writing reply", err}
+	}
+	return nil
+}
+
+// parseReportSamples parses the newline-separated samples in data, a report
+// received at now. The indexes of lines containing unacceptable samples are
+// returned in rejected, with corresponding errors in errs. The subset of
+// rejected samples that can never be accepted is returned in invalid. Blank
+// lines (e.g. after a trailing newline) are skipped.
+func parseReportSamples(data string, now time.Time, maxSkew time.Duration) (
+	samples []common.Sample, rejected, invalid []int, errs []error) {
 	lines := strings.Split(data, "\n")
-	samples := make([]common.Sample, len(lines))
+	samples = make([]common.Sample, 0, len(lines))
 	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
 		s := common.Sample{}
-		if err := s.Parse(line, now); err != nil {
-			return &handlerError{400, "Bad sample", err}
+		err := s.Parse(line, now)
+		if err == nil {
+			err = s.CheckSeries()
+		}
+		if err == nil {
+			err = storage.CheckSampleTime(&s, now, maxSkew)
+		}
+		if err != nil {
+			rejected = append(rejected, i)
+			if isInvalidSampleError(err) {
+				invalid = append(invalid, i)
+			}
+			errs = append(errs, fmt.Errorf("%q: %v", line, err))
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, rejected, invalid, errs
+}
+
+// checkReportSamples is like parseReportSamples but for samples decoded from a
+// binary report. The returned indexes are those of the invalid samples.
+func checkReportSamples(in []common.Sample, now time.Time, maxSkew time.Duration) (
+	samples []common.Sample, rejected, invalid []int, errs []error) {
+	for i, s := range in {
+		err := s.CheckSeries()
+		if err == nil {
+			err = storage.CheckSampleTime(&s, now, maxSkew)
+		}
+		if v := float64(s.Value); math.IsNaN(v) || math.IsInf(v, 0) {
+			err = fmt.Errorf("Non-finite value")
+		}
+		if err != nil {
+			rejected = append(rejected, i)
+			if isInvalidSampleError(err) {
+				invalid = append(invalid, i)
+			}
+			errs = append(errs, fmt.Errorf("%q: %v", s.String(), err))
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, rejected, invalid, errs
+}
+
+// isInvalidSampleError returns true if err, returned while checking a reported
+// sample, indicates that the sample will never be accepted. Samples that are
+// too far in the future may be accepted later.
+func isInvalidSampleError(err error) bool {
+	_, future := err.(*storage.FutureTimeError)
+	return !future
+}
+
+func handleSample(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
+	if !checkAuth(c, w, r, viewerRole, false) {
+		return nil
+	}
+	ts, err := common.ParseTimestamp(r.FormValue("timestamp"))
+	if err != nil {
+		return &handlerError{400, "Bad timestamp", err}
+	}
+	s, err := storage.GetSample(c, r.FormValue("source"), r.FormValue("name"), ts)
+	if err != nil {
+		return &handlerError{500, "Getting sample failed", err}
+	} else if s == nil {
+		return &handlerError{404, "Sample not found", nil}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		return &handlerError{500, "Failed writing sample", err}
+	}
+	return nil
+}
+
+// handleDebugSamples returns the most-recent samples from the series described
+// by the "source" and "name" parameters as JSON, sorted by descending time.
+func handleDebugSamples(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
+	if !checkAuth(c, w, r, viewerRole, false) {
+		return nil
+	}
+	source, name := r.FormValue("source"), r.FormValue("name")
+	if source == "" || name == "" {
+		return &handlerError{400, "Missing source or name", nil}
+	}
+	limit := defaultDebugSamples
+	if ls := r.FormValue("limit"); ls != "" {
+		var err error
+		if limit, err = strconv.Atoi(ls); err != nil || limit <= 0 || limit > maxDebugSamples {
+			return &handlerError{400, "Bad limit", err}
 		}
-		samples[i] = s
 	}
+	samples, err := storage.GetRecentSamples(c, source, name, limit)
+	if err != nil {
+		return &handlerError{500, "Getting samples failed", err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(samples); err != nil {
+		return &handlerError{500, "Failed writing samples", err}
+	}
+	return nil
+}
 
-	log.Debugf(c, "Got report with %v sample(s)", len(samples))
-	if err := storage.WriteSamples(c, samples); err != nil {
-		return &handlerError{500, "Write failed", err}
+func handleStatus(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
+	if !checkAuth(c, w, r, viewerRole, false) {
+		return nil
+	}
+	st, err := storage.GetStatus(c)
+	if err != nil {
+		return &handlerError{500, "Getting status failed", err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		return &handlerError{500, "Failed writing status", err}
 	}
-	io.WriteString(w, "got it\n")
 	return nil
 }
 
 func handleSummarize(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
+	if !checkAuth(c, w, r, adminRole, false) {
+		return nil
+	}
 	if err := storage.GenerateSummaries(c, time.Now().In(location),
-		time.Duration(cfg.FullDayDelaySeconds)*time.Second); err != nil {
+		time.Duration(cfg.FullDayDelaySeconds)*time.Second,
+		cfg.SummaryWriteConcurrency, cfg.DayStartHour); err == storage.ErrSummaryLeaseHeld {
+		io.WriteString(w, "summarizing already in progress\n")
+		return nil
+	} else if err != nil {
 		return &handlerError{500, "Generating summaries failed", err}
 	}
 	io.WriteString(w, "summarizing done\n")
 	return nil
 }
 
+func handleVersion(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
+	if !checkAuth(c, w, r, viewerRole, false) {
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, common.Version+"\n")
+	return nil
+}
+
 func handleIndex(c context.Context, w http.ResponseWriter, r *http.Request) *handlerError {
-	if !checkAuth(c, w, r, true) {
+	if !checkAuth(c, w, r, viewerRole, true) {
 		return nil
 	}
 
+	// Let all graphs' spans be overridden for deep-linking.
+	seconds, err := parseGraphSeconds(r.FormValue("seconds"), r.FormValue("range"), cfg.MaxQueryDays)
+	if err != nil {
+		return &handlerError{400, "Bad graph span", err}
+	}
+
 	d := struct {
-		Title  string
-		Graphs []templateGraph
+		Title          string
+		RefreshSeconds int
+		Graphs         []templateGraph
 	}{
-		Title:  cfg.Title,
-		Graphs: make([]templateGraph, len(cfg.Graphs)),
+		Title:          cfg.Title,
+		RefreshSeconds: cfg.RefreshSeconds,
+		Graphs:         make([]templateGraph, len(cfg.Graphs)),
 	}
 	for i, g := range cfg.Graphs {
 		sns := make([]string, len(g.Lines))
 		labels := make([]string, len(g.Lines))
+		lines := make([]templateLine, len(g.Lines))
 		for j, l := range g.Lines {
 			sns[j] = fmt.Sprintf("%s|%s", l.Source, l.Name)
 			labels[j] = l.Label
+			lines[j] = templateLine{Axis: l.Axis, Color: l.Color, Dashed: l.Dashed}
 		}
 		queryPath := fmt.Sprintf("/query?labels=%s&names=%s",
 			strings.Join(labels, ","), strings.Join(sns, ","))
+		if g.ForceGranularity != "" {
+			queryPath += "&granularity=" + g.ForceGranularity
+		}
+		if g.FillGapSeconds > 0 {
+			queryPath += fmt.Sprintf("&fill=%ds", g.FillGapSeconds)
+		}
 
 		d.Graphs[i] = templateGraph{
 			Id:            fmt.Sprintf("graph%d", i),
 			Title:         g.Title,
 			Units:         g.Units,
 			Short:         g.Short,
+			Height:        g.Height,
+			Stacked:       g.Stacked,
 			QueryPath:     queryPath,
 			Seconds:       g.Seconds,
 			ReportSeconds: g.ReportSeconds,
+			Lines:         lines,
+		}
+		if seconds > 0 {
+			d.Graphs[i].Seconds = seconds
 		}
 
 		if g.Range != nil && len(g.Range) > 0 {
@@ -0,0 +1,349 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/home/appengine/storage"
+	"github.com/derat/home/common"
+)
+
+func TestParseQueryTimes(t *testing.T) {
+	now := time.Unix(100000, 0)
+	for _, tc := range []struct {
+		start, end, rng string
+		expStart        int64
+		expEnd          int64
+		ok              bool
+	}{
+		{"100", "200", "", 100, 200, true},
+		{"", "", "24h", 100000 - 86400, 100000, true},
+		{"", "", "90m", 100000 - 5400, 100000, true},
+		{"", "50000", "1h", 50000 - 3600, 50000, true},
+		{"100", "", "1h", 100, 100000, true},
+		{"100", "200", "1h", 100, 200, true},
+		{"", "", "", 0, 0, false},
+		{"100", "", "", 0, 0, false},
+		{"", "200", "", 0, 0, false},
+		{"", "", "24", 0, 0, false},
+		{"", "", "-1h", 0, 0, false},
+		{"", "", "0s", 0, 0, false},
+		{"abc", "", "1h", 0, 0, false},
+		{"", "abc", "1h", 0, 0, false},
+	} {
+		st, et, err := parseQueryTimes(tc.start, tc.end, tc.rng, now, time.UTC)
+		if err != nil {
+			if tc.ok {
+				t.Errorf("parseQueryTimes(%q, %q, %q) failed: %v", tc.start, tc.end, tc.rng, err)
+			}
+		} else if !tc.ok {
+			t.Errorf("parseQueryTimes(%q, %q, %q) unexpectedly succeeded", tc.start, tc.end, tc.rng)
+		} else if st.Unix() != tc.expStart || et.Unix() != tc.expEnd {
+			t.Errorf("parseQueryTimes(%q, %q, %q) returned [%v, %v]; expected [%v, %v]",
+				tc.start, tc.end, tc.rng, st.Unix(), et.Unix(), tc.expStart, tc.expEnd)
+		}
+	}
+}
+
+func TestParseGraphSeconds(t *testing.T) {
+	for _, tc := range []struct {
+		secs, rng string
+		exp       int
+		ok        bool
+	}{
+		{"", "", 0, true},
+		{"3600", "", 3600, true},
+		{"", "168h", 604800, true},
+		{"60", "24h", 60, true},
+		{"864000", "", 864000, true},
+		{"864001", "", 0, false},
+		{"", "241h", 0, false},
+		{"0", "", 0, false},
+		{"-60", "", 0, false},
+		{"", "-1h", 0, false},
+		{"", "1ms", 0, false},
+		{"abc", "", 0, false},
+		{"", "abc", 0, false},
+	} {
+		act, err := parseGraphSeconds(tc.secs, tc.rng, 10)
+		if err != nil {
+			if tc.ok {
+				t.Errorf("parseGraphSeconds(%q, %q) failed: %v", tc.secs, tc.rng, err)
+			}
+		} else if !tc.ok {
+			t.Errorf("parseGraphSeconds(%q, %q) unexpectedly succeeded", tc.secs, tc.rng)
+		} else if act != tc.exp {
+			t.Errorf("parseGraphSeconds(%q, %q) returned %v; expected %v", tc.secs, tc.rng, act, tc.exp)
+		}
+	}
+}
+
+func TestGetQueryFormat(t *testing.T) {
+	for _, tc := range []struct {
+		param, accept string
+		exp           string
+	}{
+		{"", "", "datatable"},
+		{"", "*/*", "datatable"},
+		{"", "application/json", "datatable"},
+		{"", "text/csv", "csv"},
+		{"", "text/csv;q=0.9, text/plain", "csv"},
+		{"", "text/csv, application/json", "datatable"},
+		{"rows", "text/csv", "rows"},
+		{"values", "", "values"},
+		{"bogus", "", "bogus"},
+	} {
+		if act := getQueryFormat(tc.param, tc.accept); act != tc.exp {
+			t.Errorf("getQueryFormat(%q, %q) = %q; expected %q", tc.param, tc.accept, act, tc.exp)
+		}
+	}
+}
+
+func TestFindGraphUnits(t *testing.T) {
+	graphs := []graphConfig{
+		{Units: "°F", Lines: []graphLineConfig{{Source: "a", Name: "temp"}}},
+		{Units: "%", Lines: []graphLineConfig{{Source: "a", Name: "hum"}, {Source: "b", Name: "hum"}}},
+	}
+	for _, tc := range []struct {
+		names string
+		exp   string
+	}{
+		{"a|temp", "°F"},
+		{"a|hum,b|hum", "%"},
+		{"b|hum,a|hum", ""},
+		{"a|hum", ""},
+		{"a|temp,a|hum", ""},
+	} {
+		if act := findGraphUnits(graphs, strings.Split(tc.names, ",")); act != tc.exp {
+			t.Errorf("findGraphUnits(%q) = %q; expected %q", tc.names, act, tc.exp)
+		}
+	}
+}
+
+func TestSetQueryGranularity(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	min5 := 5 * time.Minute
+	for _, tc := range []struct {
+		days           int // query duration
+		granularity    string
+		interval       time.Duration
+		expGranularity storage.QueryGranularity
+		expAggregation int
+	}{
+		// Nothing should be changed if neither a granularity nor an interval
+		// is supplied.
+		{30, "", 0, storage.IndividualSample, 0},
+		{1, "", min5, storage.IndividualSample, 2},
+		{30, "", min5, storage.HourlyAverage, 7},
+		{365, "", min5, storage.DailyAverage, 3},
+		{30, "day", 0, storage.DailyAverage, 1},
+		{1, "sample", min5, storage.IndividualSample, 2},
+	} {
+		p := storage.QueryParams{Start: start, End: start.AddDate(0, 0, tc.days)}
+		if err := setQueryGranularity(&p, tc.granularity, tc.interval, start); err != nil {
+			t.Errorf("setQueryGranularity(%v days, %q, %v) failed: %v",
+				tc.days, tc.granularity, tc.interval, err)
+		} else if p.Granularity != tc.expGranularity || p.Aggregation != tc.expAggregation {
+			t.Errorf("setQueryGranularity(%v days, %q, %v) set %v/%v; expected %v/%v",
+				tc.days, tc.granularity, tc.interval, p.Granularity, p.Aggregation,
+				tc.expGranularity, tc.expAggregation)
+		}
+	}
+
+	p := storage.QueryParams{Start: start, End: start.AddDate(0, 0, 1)}
+	if err := setQueryGranularity(&p, "bogus", min5, start); err == nil {
+		t.Errorf("setQueryGranularity unexpectedly accepted bad granularity")
+	}
+}
+
+func TestParseQueryParamsTimeZone(t *testing.T) {
+	defer func(c *config, l *time.Location) { cfg, location = c, l }(cfg, location)
+	cfg = &config{DaysToKeep: 3, MaxQueryDays: 365}
+	location = time.UTC
+
+	for _, tc := range []struct {
+		params string
+		exp    string // expected location of Start and End
+	}{
+		{"", "UTC"},
+		{"&tz=America/New_York", "America/New_York"},
+		{"&tz=America/New_York&granularity=sample", "America/New_York"},
+		// The zone used for summaries' day boundaries can't be overridden.
+		{"&tz=America/New_York&granularity=hour", "UTC"},
+		{"&tz=America/New_York&granularity=day", "UTC"},
+	} {
+		r := httptest.NewRequest("GET", "/query?labels=a&names=a|b&start=0&end=3600"+tc.params, nil)
+		p, herr := parseQueryParams(context.Background(), r)
+		if herr != nil {
+			t.Errorf("Failed parsing %q: %v", tc.params, herr.msg)
+			continue
+		}
+		if act := p.Start.Location().String(); act != tc.exp {
+			t.Errorf("Got start in %v for %q; expected %v", act, tc.params, tc.exp)
+		}
+		if act := p.End.Location().String(); act != tc.exp {
+			t.Errorf("Got end in %v for %q; expected %v", act, tc.params, tc.exp)
+		}
+	}
+}
+
+func TestCheckQueryRange(t *testing.T) {
+	start := time.Unix(0, 0)
+	day := 24 * time.Hour
+	for _, tc := range []struct {
+		end     time.Time
+		maxDays int
+		ok      bool
+	}{
+		{start, 1, true},
+		{start.Add(day), 1, true},
+		{start.Add(day + time.Second), 1, false},
+		{start.Add(-time.Second), 1, false},
+		{start.Add(1000 * day), 0, true},
+	} {
+		if err := checkQueryRange(start, tc.end, tc.maxDays); err != nil && tc.ok {
+			t.Errorf("Range ending at %v with max %v days unexpectedly rejected: %v",
+				tc.end.Unix(), tc.maxDays, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("Range ending at %v with max %v days unexpectedly accepted",
+				tc.end.Unix(), tc.maxDays)
+		}
+	}
+}
+
+func TestIsAuthorizedEmail(t *testing.T) {
+	users := []string{"user@example.org", "@example.com"}
+	for _, tc := range []struct {
+		email string
+		exp   bool
+	}{
+		{"user@example.org", true},
+		{"other@example.org", false},
+		{"someone@example.com", true},
+		{"someone@EXAMPLE.COM", true},
+		{"someone@sub.example.com", false},
+		{"someone@badexample.com", false},
+		{"@example.com", false},
+		{"", false},
+	} {
+		if act := isAuthorizedEmail(tc.email, users); act != tc.exp {
+			t.Errorf("isAuthorizedEmail(%q) returned %v; expected %v", tc.email, act, tc.exp)
+		}
+	}
+}
+
+func TestStatusWriter(t *testing.T) {
+	for _, tc := range []struct {
+		write func(w http.ResponseWriter)
+		exp   int
+	}{
+		{func(w http.ResponseWriter) {}, http.StatusOK},
+		{func(w http.ResponseWriter) { io.WriteString(w, "hi") }, http.StatusOK},
+		{func(w http.ResponseWriter) { http.Error(w, "bad", http.StatusBadRequest) }, http.StatusBadRequest},
+		{func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(http.StatusOK)
+		}, http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		sw := &statusWriter{ResponseWriter: rec}
+		tc.write(sw)
+		if act := sw.getStatus(); act != tc.exp {
+			t.Errorf("Got status %v; expected %v", act, tc.exp)
+		} else if rec.Code != tc.exp {
+			t.Errorf("Recorder got status %v; expected %v", rec.Code, tc.exp)
+		}
+	}
+}
+
+func TestAddSecurityHeaders(t *testing.T) {
+	const csp = "default-src 'self'"
+	h := addSecurityHeaders(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad", http.StatusBadRequest)
+	}, csp)
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Got status %v; expected %v", rec.Code, http.StatusBadRequest)
+	}
+	for name, exp := range map[string]string{
+		"Content-Security-Policy": csp,
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+	} {
+		if act := rec.Header().Get(name); act != exp {
+			t.Errorf("%v header is %q; expected %q", name, act, exp)
+		}
+	}
+}
+
+func TestParseReportSamples(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	for _, tc := range []struct {
+		data     string
+		samples  string // joined accepted samples
+		rejected []int
+		invalid  []int
+	}{
+		{"", "", nil, nil},
+		{"1499999000|s|n|1.0", "1499999000|s|n|1.0", nil, nil},
+		{"1499999000|s|n|1.0\n", "1499999000|s|n|1.0", nil, nil},
+		{"1499999000|s|n|1.0\n\n1499999100|s|n|2.0\n",
+			"1499999000|s|n|1.0\n1499999100|s|n|2.0", nil, nil},
+		{"1499999000|s|n|1.0\nbogus\n1499999100|s|n|2.0",
+			"1499999000|s|n|1.0\n1499999100|s|n|2.0", []int{1}, []int{1}},
+		{"1500001000|s|n|1.0\n1499999000|s|n|1.0", "1499999000|s|n|1.0", []int{0}, nil},
+		{"0|s|n|1.0\n1499999000|s|n|1.0", "1499999000|s|n|1.0", []int{0}, []int{0}},
+		{"1499999000|s\rx|n|1.0\n1499999000|s|n|1.0", "1499999000|s|n|1.0", []int{0}, []int{0}},
+	} {
+		samples, rejected, invalid, errs := parseReportSamples(tc.data, now, time.Minute)
+		if act := common.JoinSamples(samples); act != tc.samples {
+			t.Errorf("Report %q accepted %q; expected %q", tc.data, act, tc.samples)
+		}
+		if !reflect.DeepEqual(rejected, tc.rejected) {
+			t.Errorf("Report %q rejected %v; expected %v", tc.data, rejected, tc.rejected)
+		}
+		if !reflect.DeepEqual(invalid, tc.invalid) {
+			t.Errorf("Report %q marked %v invalid; expected %v", tc.data, invalid, tc.invalid)
+		}
+		if len(errs) != len(rejected) {
+			t.Errorf("Report %q returned %v error(s) for %v rejected sample(s)",
+				tc.data, len(errs), len(rejected))
+		}
+	}
+}
+
+func TestCheckReportSamples(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	in := []common.Sample{
+		{time.Unix(1499999000, 0), "s x", "n", 1.0},
+		{time.Unix(1500001000, 0), "s", "n", 2.0},
+		{time.Unix(1499999100, 0), "s", "n", float32(math.NaN())},
+		{time.Unix(1499999200, 0), "s", "n", 3.0},
+		{time.Unix(1499999300, 0), "s|x", "n", 4.0},
+		{time.Unix(1499999400, 0), "s", "n\n", 5.0},
+	}
+	samples, rejected, invalid, errs := checkReportSamples(in, now, time.Minute)
+	if act, exp := common.JoinSamples(samples), common.JoinSamples([]common.Sample{in[0], in[3]}); act != exp {
+		t.Errorf("Accepted %q; expected %q", act, exp)
+	}
+	if exp := []int{1, 2, 4, 5}; !reflect.DeepEqual(rejected, exp) {
+		t.Errorf("Rejected %v; expected %v", rejected, exp)
+	}
+	if exp := []int{2, 4, 5}; !reflect.DeepEqual(invalid, exp) {
+		t.Errorf("Marked %v invalid; expected %v", invalid, exp)
+	}
+	if len(errs) != len(rejected) {
+		t.Errorf("Got %v error(s) for %v rejected sample(s)", len(errs), len(rejected))
+	}
+}
@@ -0,0 +1,425 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+// Package render draws line charts of query results.
+package render
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default dimensions of images in pixels.
+	DefaultWidth  = 800
+	DefaultHeight = 400
+
+	// Margins in pixels between the image's edges and the plot area.
+	imageMarginLeft   = 60
+	imageMarginRight  = 16
+	imageMarginTop    = 28
+	imageMarginBottom = 24
+
+	// Approximate number of ticks to draw along each axis.
+	imageYTicks = 5
+	imageXTicks = 8
+
+	// Factor by which imageFont glyphs are scaled when drawn.
+	imageFontScale = 2
+
+	// Opacity of the shaded range drawn behind each line.
+	imageRangeOpacity = 0.25
+)
+
+var (
+	imageBackgroundColor = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	imageGridColor       = color.RGBA{0xee, 0xee, 0xee, 0xff}
+	imageTextColor       = color.RGBA{0x42, 0x42, 0x42, 0xff}
+
+	// Colors used for successive lines. These match the Google Charts defaults.
+	imageLineColors = []color.RGBA{
+		{0x33, 0x66, 0xcc, 0xff},
+		{0xdc, 0x39, 0x12, 0xff},
+		{0xff, 0x99, 0x00, 0xff},
+		{0x10, 0x96, 0x18, 0xff},
+		{0x99, 0x00, 0x99, 0xff},
+		{0x00, 0x99, 0xc6, 0xff},
+	}
+
+	// Candidate intervals between ticks on the horizontal axis.
+	imageTimeSteps = []time.Duration{
+		time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+		time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour,
+		24 * time.Hour, 2 * 24 * time.Hour, 7 * 24 * time.Hour, 14 * 24 * time.Hour,
+		28 * 24 * time.Hour, 91 * 24 * time.Hour, 364 * 24 * time.Hour,
+	}
+)
+
+// imageFont contains 3x5 glyphs used to label images. Each row's low three
+// bits describe its pixels, with the leftmost pixel in the highest bit.
+// Lowercase letters are drawn using uppercase glyphs.
+var imageFont = map[rune][5]uint8{
+	'0': {0b111, 0b101, 0b101, 0b101, 0b111},
+	'1': {0b010, 0b110, 0b010, 0b010, 0b111},
+	'2': {0b111, 0b001, 0b111, 0b100, 0b111},
+	'3': {0b111, 0b001, 0b111, 0b001, 0b111},
+	'4': {0b101, 0b101, 0b111, 0b001, 0b001},
+	'5': {0b111, 0b100, 0b111, 0b001, 0b111},
+	'6': {0b111, 0b100, 0b111, 0b101, 0b111},
+	'7': {0b111, 0b001, 0b001, 0b001, 0b001},
+	'8': {0b111, 0b101, 0b111, 0b101, 0b111},
+	'9': {0b111, 0b101, 0b111, 0b001, 0b111},
+	'-': {0b000, 0b000, 0b111, 0b000, 0b000},
+	'+': {0b000, 0b010, 0b111, 0b010, 0b000},
+	'.': {0b000, 0b000, 0b000, 0b000, 0b010},
+	',': {0b000, 0b000, 0b000, 0b010, 0b100},
+	':': {0b000, 0b010, 0b000, 0b010, 0b000},
+	'/': {0b001, 0b001, 0b010, 0b100, 0b100},
+	'%': {0b101, 0b001, 0b010, 0b100, 0b101},
+	'(': {0b010, 0b100, 0b100, 0b100, 0b010},
+	')': {0b010, 0b001, 0b001, 0b001, 0b010},
+	'°': {0b010, 0b101, 0b010, 0b000, 0b000},
+	'A': {0b010, 0b101, 0b111, 0b101, 0b101},
+	'B': {0b110, 0b101, 0b110, 0b101, 0b110},
+	'C': {0b011, 0b100, 0b100, 0b100, 0b011},
+	'D': {0b110, 0b101, 0b101, 0b101, 0b110},
+	'E': {0b111, 0b100, 0b110, 0b100, 0b111},
+	'F': {0b111, 0b100, 0b110, 0b100, 0b100},
+	'G': {0b011, 0b100, 0b101, 0b101, 0b011},
+	'H': {0b101, 0b101, 0b111, 0b101, 0b101},
+	'I': {0b111, 0b010, 0b010, 0b010, 0b111},
+	'J': {0b001, 0b001, 0b001, 0b101, 0b010},
+	'K': {0b101, 0b101, 0b110, 0b101, 0b101},
+	'L': {0b100, 0b100, 0b100, 0b100, 0b111},
+	'M': {0b101, 0b111, 0b111, 0b101, 0b101},
+	'N': {0b110, 0b101, 0b101, 0b101, 0b101},
+	'O': {0b010, 0b101, 0b101, 0b101, 0b010},
+	'P': {0b110, 0b101, 0b110, 0b100, 0b100},
+	'Q': {0b010, 0b101, 0b101, 0b110, 0b011},
+	'R': {0b110, 0b101, 0b110, 0b101, 0b101},
+	'S': {0b011, 0b100, 0b010, 0b001, 0b110},
+	'T': {0b111, 0b010, 0b010, 0b010, 0b010},
+	'U': {0b101, 0b101, 0b101, 0b101, 0b111},
+	'V': {0b101, 0b101, 0b101, 0b101, 0b010},
+	'W': {0b101, 0b101, 0b111, 0b111, 0b101},
+	'X': {0b101, 0b101, 0b010, 0b101, 0b101},
+	'Y': {0b101, 0b101, 0b010, 0b010, 0b010},
+	'Z': {0b111, 0b001, 0b010, 0b100, 0b111},
+}
+
+// drawText draws s with its top-left corner at (x, y).
+func drawText(img *image.RGBA, x, y int, s string, c color.RGBA) {
+	for _, r := range strings.ToUpper(s) {
+		if g, ok := imageFont[r]; ok {
+			for row, bits := range g {
+				for col := 0; col < 3; col++ {
+					if bits&(0x4>>uint(col)) != 0 {
+						px := x + col*imageFontScale
+						py := y + row*imageFontScale
+						draw.Draw(img, image.Rect(px, py, px+imageFontScale, py+imageFontScale),
+							image.NewUniform(c), image.Point{}, draw.Src)
+					}
+				}
+			}
+		}
+		x += 4 * imageFontScale
+	}
+}
+
+// textWidth returns the width in pixels of s as drawn by drawText.
+func textWidth(s string) int {
+	n := len([]rune(s))
+	if n == 0 {
+		return 0
+	}
+	return (4*n - 1) * imageFontScale
+}
+
+// textHeight is the height in pixels of text drawn by drawText.
+const textHeight = 5 * imageFontScale
+
+// drawLine draws a two-pixel-thick line from (x0, y0) to (x1, y1).
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.RGBA) {
+	dx, dy := x1-x0, y1-y0
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx - dy
+	for {
+		img.SetRGBA(x0, y0, c)
+		if dx > dy {
+			img.SetRGBA(x0, y0+1, c)
+		} else {
+			img.SetRGBA(x0+1, y0, c)
+		}
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		if e2 := 2 * e; e2 > -dy {
+			e -= dy
+			x0 += sx
+		} else if e2 < dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+// drawRange fills the area between two vertical spans at x0 (from y0min to
+// y0max) and x1 (from y1min to y1max), interpolating between them.
+func drawRange(img *image.RGBA, x0, y0min, y0max, x1, y1min, y1max int, c color.RGBA) {
+	for x := x0; x <= x1; x++ {
+		f := 0.0
+		if x1 > x0 {
+			f = float64(x-x0) / float64(x1-x0)
+		}
+		ymin := y0min + int(math.Round(f*float64(y1min-y0min)))
+		ymax := y0max + int(math.Round(f*float64(y1max-y0max)))
+		// Larger values are drawn higher, i.e. with smaller Y coordinates.
+		for y := ymax; y <= ymin; y++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+// lightenColor returns c drawn with the supplied opacity over
+// imageBackgroundColor.
+func lightenColor(c color.RGBA, opacity float64) color.RGBA {
+	mix := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a)*opacity + float64(b)*(1-opacity)))
+	}
+	bg := imageBackgroundColor
+	return color.RGBA{mix(c.R, bg.R), mix(c.G, bg.G), mix(c.B, bg.B), 0xff}
+}
+
+// niceTickStep returns a round interval between ticks that divides span into
+// approximately n parts.
+func niceTickStep(span float64, n int) float64 {
+	raw := span / float64(n)
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	switch f := raw / mag; {
+	case f <= 1:
+		return mag
+	case f <= 2:
+		return 2 * mag
+	case f <= 5:
+		return 5 * mag
+	default:
+		return 10 * mag
+	}
+}
+
+// timeTicks returns times at which to draw ticks between start and end and the
+// layout used to format them.
+func timeTicks(start, end time.Time) ([]time.Time, string) {
+	step := imageTimeSteps[len(imageTimeSteps)-1]
+	for _, s := range imageTimeSteps {
+		if end.Sub(start)/s <= imageXTicks {
+			step = s
+			break
+		}
+	}
+
+	var t time.Time
+	layout := "15:04"
+	if step < 24*time.Hour {
+		t = start.Truncate(step)
+	} else {
+		// Start at local midnight. Steps are whole numbers of days.
+		layout = "1/2"
+		t = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location())
+	}
+	var ticks []time.Time
+	for ; !t.After(end); t = t.Add(step) {
+		if step >= 24*time.Hour {
+			// Keep ticks at midnight across DST transitions.
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, start.Location())
+		}
+		if !t.Before(start) {
+			ticks = append(ticks, t)
+		}
+	}
+	return ticks, layout
+}
+
+// Chart describes a line chart.
+type Chart struct {
+	// Start and End describe the range of times along the horizontal axis.
+	// Tick labels are formatted in Start's location.
+	Start, End time.Time
+
+	// Labels contains the lines' labels, drawn in a legend.
+	Labels []string
+
+	// Units is used to label the vertical axis.
+	Units string
+
+	// Width and Height give the image's dimensions in pixels. Defaults are
+	// used if they're zero.
+	Width, Height int
+
+	points []point   // added by AddPoint
+	ranges [][]Range // added by AddRange
+}
+
+// point contains the lines' values at a single time.
+type point struct {
+	t      time.Time
+	values []float32
+}
+
+// Range describes the minimum and maximum values summarized by a line's value.
+type Range struct {
+	Time     time.Time
+	Min, Max float32
+}
+
+// AddPoint adds the lines' values at t. Missing values should be NaN, and
+// trailing NaN values may be omitted. Points must be added in ascending time
+// order.
+func (ch *Chart) AddPoint(t time.Time, values []float32) {
+	ch.points = append(ch.points, point{t, append([]float32(nil), values...)})
+}
+
+// AddRange adds the minimum and maximum values summarized by a value of the
+// line at index line. Ranges are shaded behind the line and must be added in
+// ascending time order.
+func (ch *Chart) AddRange(line int, r Range) {
+	for len(ch.ranges) <= line {
+		ch.ranges = append(ch.ranges, nil)
+	}
+	ch.ranges[line] = append(ch.ranges[line], r)
+}
+
+// WritePNG draws the chart and writes it to w as a PNG image.
+func (ch *Chart) WritePNG(w io.Writer) error {
+	minVal, maxVal := math.Inf(1), math.Inf(-1)
+	for _, p := range ch.points {
+		for _, v := range p.values {
+			if !math.IsNaN(float64(v)) {
+				minVal = math.Min(minVal, float64(v))
+				maxVal = math.Max(maxVal, float64(v))
+			}
+		}
+	}
+	for _, lr := range ch.ranges {
+		for _, r := range lr {
+			minVal = math.Min(minVal, float64(r.Min))
+			maxVal = math.Max(maxVal, float64(r.Max))
+		}
+	}
+	if math.IsInf(minVal, 0) {
+		minVal, maxVal = 0, 1
+	} else if minVal == maxVal {
+		minVal, maxVal = minVal-1, maxVal+1
+	}
+	step := niceTickStep(maxVal-minVal, imageYTicks)
+	minVal = math.Floor(minVal/step) * step
+	maxVal = math.Ceil(maxVal/step) * step
+
+	width, height := ch.Width, ch.Height
+	if width <= 0 {
+		width = DefaultWidth
+	}
+	if height <= 0 {
+		height = DefaultHeight
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(imageBackgroundColor), image.Point{}, draw.Src)
+
+	plot := image.Rect(imageMarginLeft, imageMarginTop, width-imageMarginRight, height-imageMarginBottom)
+	if plot.Empty() {
+		return png.Encode(w, img)
+	}
+	start, end := ch.Start, ch.End
+	if !end.After(start) {
+		end = start.Add(time.Second)
+	}
+	xPos := func(t time.Time) int {
+		return plot.Min.X + int(float64(plot.Dx()-1)*float64(t.Sub(start))/float64(end.Sub(start)))
+	}
+	yPos := func(v float64) int {
+		return plot.Max.Y - 1 - int(float64(plot.Dy()-1)*(v-minVal)/(maxVal-minVal))
+	}
+
+	// Draw grid lines and their labels.
+	prec := 0
+	if step < 1 {
+		prec = int(math.Ceil(-math.Log10(step)))
+	}
+	for v := minVal; v <= maxVal+step/2; v += step {
+		y := yPos(v)
+		drawLine(img, plot.Min.X, y, plot.Max.X-1, y, imageGridColor)
+		label := strconv.FormatFloat(v, 'f', prec, 64)
+		drawText(img, plot.Min.X-textWidth(label)-6, y-textHeight/2, label, imageTextColor)
+	}
+	ticks, layout := timeTicks(start, end)
+	for _, t := range ticks {
+		x := xPos(t)
+		drawLine(img, x, plot.Min.Y, x, plot.Max.Y-1, imageGridColor)
+		label := t.Format(layout)
+		drawText(img, x-textWidth(label)/2, plot.Max.Y+6, label, imageTextColor)
+	}
+	drawText(img, 4, (imageMarginTop-textHeight)/2, ch.Units, imageTextColor)
+
+	// Draw a legend in the top-right corner.
+	x := width - imageMarginRight
+	for i := len(ch.Labels) - 1; i >= 0; i-- {
+		c := imageLineColors[i%len(imageLineColors)]
+		x -= textWidth(ch.Labels[i])
+		y := (imageMarginTop - textHeight) / 2
+		drawText(img, x, y, ch.Labels[i], imageTextColor)
+		x -= textHeight + 4
+		draw.Draw(img, image.Rect(x, y, x+textHeight, y+textHeight),
+			image.NewUniform(c), image.Point{}, draw.Src)
+		x -= 12
+	}
+
+	// Draw each line, connecting its consecutive values. Points outside of the
+	// plot area (e.g. summaries that started before the query) are clipped.
+	plotImg := img.SubImage(plot).(*image.RGBA)
+	for i, lr := range ch.ranges {
+		c := lightenColor(imageLineColors[i%len(imageLineColors)], imageRangeOpacity)
+		for j := 1; j < len(lr); j++ {
+			drawRange(plotImg, xPos(lr[j-1].Time), yPos(float64(lr[j-1].Min)),
+				yPos(float64(lr[j-1].Max)), xPos(lr[j].Time), yPos(float64(lr[j].Min)),
+				yPos(float64(lr[j].Max)), c)
+		}
+	}
+	for i := range ch.Labels {
+		c := imageLineColors[i%len(imageLineColors)]
+		hasLast := false
+		var lastX, lastY int
+		for _, p := range ch.points {
+			if i >= len(p.values) || math.IsNaN(float64(p.values[i])) {
+				continue
+			}
+			x, y := xPos(p.t), yPos(float64(p.values[i]))
+			if hasLast {
+				drawLine(plotImg, lastX, lastY, x, y, c)
+			} else {
+				drawLine(plotImg, x, y, x, y, c)
+			}
+			lastX, lastY, hasLast = x, y, true
+		}
+	}
+
+	return png.Encode(w, img)
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package render
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countColor returns the number of pixels in img with color c.
+func countColor(img image.Image, r, g, b uint8) int {
+	n := 0
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pr, pg, pb, _ := img.At(x, y).RGBA()
+			if uint8(pr>>8) == r && uint8(pg>>8) == g && uint8(pb>>8) == b {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestWritePNG(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	ch := Chart{
+		Start:  start,
+		End:    start.Add(4 * time.Hour),
+		Labels: []string{"first", "second"},
+		Units:  "°F",
+		Width:  320,
+		Height: 200,
+	}
+	nan := float32(math.NaN())
+	ch.AddPoint(start, []float32{1, 10})
+	ch.AddPoint(start.Add(time.Hour), []float32{2})
+	ch.AddPoint(start.Add(2*time.Hour), []float32{nan, 5})
+	ch.AddPoint(start.Add(4*time.Hour), []float32{3, 7})
+
+	var b bytes.Buffer
+	if err := ch.WritePNG(&b); err != nil {
+		t.Fatalf("WritePNG failed: %v", err)
+	}
+	img, err := png.Decode(&b)
+	if err != nil {
+		t.Fatalf("Failed to decode image: %v", err)
+	}
+	if s := img.Bounds().Size(); s.X != ch.Width || s.Y != ch.Height {
+		t.Errorf("Got %vx%v image; expected %vx%v", s.X, s.Y, ch.Width, ch.Height)
+	}
+	for i := range ch.Labels {
+		c := imageLineColors[i]
+		if n := countColor(img, c.R, c.G, c.B); n < 100 {
+			t.Errorf("Only found %v pixel(s) for line %v", n, i)
+		}
+	}
+	if c := imageLineColors[2]; countColor(img, c.R, c.G, c.B) != 0 {
+		t.Errorf("Found pixels for nonexistent third line")
+	}
+	if c := lightenColor(imageLineColors[0], imageRangeOpacity); countColor(img, c.R, c.G, c.B) != 0 {
+		t.Errorf("Found range pixels without ranges")
+	}
+}
+
+func TestWritePNGRanges(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	ch := Chart{
+		Start:  start,
+		End:    start.Add(2 * time.Hour),
+		Labels: []string{"first"},
+		Width:  320,
+		Height: 200,
+	}
+	ch.AddPoint(start, []float32{5})
+	ch.AddPoint(start.Add(time.Hour), []float32{6})
+	ch.AddPoint(start.Add(2*time.Hour), []float32{5})
+	ch.AddRange(0, Range{start, 0, 10})
+	ch.AddRange(0, Range{start.Add(time.Hour), 2, 12})
+	ch.AddRange(0, Range{start.Add(2 * time.Hour), 1, 9})
+
+	var b bytes.Buffer
+	if err := ch.WritePNG(&b); err != nil {
+		t.Fatalf("WritePNG failed: %v", err)
+	}
+	img, err := png.Decode(&b)
+	if err != nil {
+		t.Fatalf("Failed to decode image: %v", err)
+	}
+	c := lightenColor(imageLineColors[0], imageRangeOpacity)
+	if n := countColor(img, c.R, c.G, c.B); n < 1000 {
+		t.Errorf("Only found %v range pixel(s)", n)
+	}
+	lc := imageLineColors[0]
+	if n := countColor(img, lc.R, lc.G, lc.B); n < 100 {
+		t.Errorf("Only found %v line pixel(s)", n)
+	}
+}
+
+func TestTimeTicks(t *testing.T) {
+	loc := time.UTC
+	for _, tc := range []struct {
+		start, end time.Time
+		exp        []string
+	}{
+		{
+			time.Date(2015, 7, 1, 0, 10, 0, 0, loc), time.Date(2015, 7, 1, 4, 0, 0, 0, loc),
+			[]string{"00:30", "01:00", "01:30", "02:00", "02:30", "03:00", "03:30", "04:00"},
+		},
+		{
+			time.Date(2015, 7, 1, 12, 0, 0, 0, loc), time.Date(2015, 7, 6, 0, 0, 0, 0, loc),
+			[]string{"7/2", "7/3", "7/4", "7/5", "7/6"},
+		},
+	} {
+		ticks, layout := timeTicks(tc.start, tc.end)
+		var act []string
+		for _, t := range ticks {
+			act = append(act, t.Format(layout))
+		}
+		if a, e := strings.Join(act, ","), strings.Join(tc.exp, ","); a != e {
+			t.Errorf("Expected ticks %q; got %q", e, a)
+		}
+	}
+}
+
+func TestNiceTickStep(t *testing.T) {
+	for _, tc := range []struct {
+		span float64
+		exp  float64
+	}{
+		{10, 2},
+		{100, 20},
+		{7, 2},
+		{0.3, 0.1},
+		{40, 10},
+	} {
+		if act := niceTickStep(tc.span, 5); math.Abs(act-tc.exp) > 1e-9 {
+			t.Errorf("niceTickStep(%v, 5) = %v; expected %v", tc.span, act, tc.exp)
+		}
+	}
+}
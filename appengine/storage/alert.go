@@ -5,8 +5,11 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/derat/home/common"
@@ -17,28 +20,158 @@ import (
 )
 
 const (
+	// DefaultAlertQueryConcurrency is a reasonable maximum number of datastore
+	// queries to run in parallel while evaluating alert conditions.
+	DefaultAlertQueryConcurrency = 5
+
 	// Datastore kind and ID for storing the alert state.
 	alertStateKind = "AlertState"
 	alertStateId   = 1
+
+	// Datastore kind for storing AlertEvent entities.
+	alertEventKind = "AlertEvent"
+
+	// Subject used for alert emails if AlertMessageConfig.SubjectTemplate is
+	// empty.
+	defaultAlertSubject = "Alerts updated"
 )
 
+// errEvalSkipped is returned by updateAlertState if conditions were evaluated
+// too recently.
+var errEvalSkipped = errors.New("Conditions were evaluated recently")
+
+// alertHTMLTemplate is used to generate alert emails' HTML bodies. It is
+// executed against an AlertMessageData struct.
+var alertHTMLTemplate = htmltemplate.Must(htmltemplate.New("").Parse(`
+<table style="border-collapse:collapse;font-family:sans-serif">
+{{- range .Started}}
+<tr><td style="color:#c62828;font-weight:bold;padding-right:1em">New</td><td>{{.Msg}}</td></tr>
+{{- end}}
+{{- range .Ended}}
+<tr><td style="color:#2e7d32;font-weight:bold;padding-right:1em">Ended</td><td>{{.Msg}}</td></tr>
+{{- end}}
+{{- range .Continuing}}
+<tr><td style="color:#ef6c00;font-weight:bold;padding-right:1em">Continuing</td><td>{{.Msg}}</td></tr>
+{{- end}}
+</table>
+`))
+
+// AlertMessageConfig describes how alert emails are constructed.
+type AlertMessageConfig struct {
+	// Email address from which alerts are sent.
+	Sender string
+
+	// Email addresses to which alerts are sent.
+	Recipients []string
+
+	// Optional text/template templates used to generate the message's subject
+	// and body. They are executed against an AlertMessageData struct. If empty,
+	// defaults are used. The default HTML body is omitted when BodyTemplate is
+	// set.
+	SubjectTemplate string
+	BodyTemplate    string
+
+	// Maximum number of alert emails to send in any one-hour period. Changes
+	// that occur after the limit has been reached are included in the next
+	// email. 0 disables the limit.
+	MaxEmailsPerHour int
+}
+
+// AlertMessageData is passed to the templates in AlertMessageConfig.
+type AlertMessageData struct {
+	// Conditions that became active, remain active, and are no longer active.
+	// Each element has a Msg field containing a human-readable description, along
+	// with Source, Name, Op, Threshold, Value, and SampleTime fields.
+	Started    []conditionState
+	Continuing []conditionState
+	Ended      []conditionState
+}
+
+// CheckTemplates returns an error if mc's templates can't be parsed.
+func (mc *AlertMessageConfig) CheckTemplates() error {
+	for _, t := range []string{mc.SubjectTemplate, mc.BodyTemplate} {
+		if _, err := template.New("").Parse(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Condition describes a condition responsible for triggering an alert.
 type Condition struct {
 	// Source and name associated with sample.
 	Source string
 	Name   string
 
-	// Operator: one of "eq", "ne", "lt", "gt", "le", "ge", or "ot".
-	// "ot" is "older than"; Value is then in seconds.
+	// Operator: one of "eq", "ne", "lt", "gt", "le", "ge", "ot", "stuck", or
+	// "dev". "ot" is "older than"; Value is then in seconds. "stuck" is active
+	// when the series' value hasn't changed for more than Value seconds. "dev"
+	// is active when the most-recent sample differs from the series' average
+	// in its most-recent day summary by more than Value.
 	Op string
 
 	// Value to compare samples against.
 	Value float32
+
+	// Optional aggregate to compare against Value instead of the most-recent
+	// sample: one of "min", "max", or "avg". The value is taken from the
+	// most-recent summary for the period described by AggregatePeriod.
+	Aggregate string
+
+	// Period over which Aggregate is computed: either "hour" (the default) or
+	// "day".
+	AggregatePeriod string
 }
 
 // id returns a string uniquely identifying this condition.
 func (c *Condition) id() string {
-	return fmt.Sprintf("%s|%s|%s|%.1f", c.Source, c.Name, c.Op, c.Value)
+	id := fmt.Sprintf("%s|%s|%s|%.1f", c.Source, c.Name, c.Op, c.Value)
+	if c.Aggregate != "" {
+		id += "|" + c.summaryKind() + "|" + c.Aggregate
+	}
+	return id
+}
+
+// sampleKey returns the key used for c's sample in maps returned by
+// getSamplesForConditions.
+func (c *Condition) sampleKey() string {
+	if c.Op == "stuck" {
+		return fmt.Sprintf("%s|%s|stuck|%d", c.Source, c.Name, int(c.Value))
+	}
+	if c.Op == "dev" {
+		return c.Source + "|" + c.Name + "|dev"
+	}
+	if c.Aggregate == "" {
+		return c.Source + "|" + c.Name
+	}
+	return c.Source + "|" + c.Name + "|" + c.summaryKind() + "|" + c.Aggregate
+}
+
+// summaryKind returns the kind of summary entity used to evaluate c's
+// aggregate.
+func (c *Condition) summaryKind() string {
+	if c.AggregatePeriod == "day" {
+		return daySummaryKind
+	}
+	return hourSummaryKind
+}
+
+// Check returns an error if c is invalid.
+func (c *Condition) Check() error {
+	switch c.Aggregate {
+	case "", "min", "max", "avg":
+	default:
+		return fmt.Errorf("Invalid aggregate %q", c.Aggregate)
+	}
+	switch c.AggregatePeriod {
+	case "", "hour", "day":
+	default:
+		return fmt.Errorf("Invalid aggregate period %q", c.AggregatePeriod)
+	}
+	if (c.Op == "stuck" || c.Op == "dev") && c.Aggregate != "" {
+		return fmt.Errorf("Aggregate %q can't be used with %q", c.Aggregate, c.Op)
+	}
+	return nil
 }
 
 // active returns true if s is active.
@@ -58,6 +191,13 @@ func (c *Condition) active(s *common.Sample, now time.Time) (bool, error) {
 		return s != nil && s.Value >= c.Value, nil
 	case "ot":
 		return s == nil || now.Sub(s.Timestamp) > time.Duration(c.Value)*time.Second, nil
+	case "stuck":
+		// s's timestamp is the time at which the series' current value was
+		// first reported.
+		return s != nil && now.Sub(s.Timestamp) > time.Duration(c.Value)*time.Second, nil
+	case "dev":
+		// s's value is the deviation from the daily average.
+		return s != nil && (s.Value > c.Value || -s.Value > c.Value), nil
 	default:
 		return false, fmt.Errorf("Invalid condition %q", c.Op)
 	}
@@ -66,6 +206,14 @@ func (c *Condition) active(s *common.Sample, now time.Time) (bool, error) {
 // msg returns a human-readable string describing the condition and the current
 // value of its sample.
 func (c *Condition) msg(s *common.Sample, now time.Time) string {
+	name := c.Source + "." + c.Name
+	if c.Aggregate != "" {
+		period := c.AggregatePeriod
+		if period == "" {
+			period = "hour"
+		}
+		name += fmt.Sprintf(" %s(%s)", c.Aggregate, period)
+	}
 	if c.Op == "ot" {
 		var age string
 		if s == nil {
@@ -73,28 +221,53 @@ func (c *Condition) msg(s *common.Sample, now time.Time) string {
 		} else {
 			age = fmt.Sprintf("%ds", int(now.Sub(s.Timestamp)/time.Second))
 		}
-		return fmt.Sprintf("%s.%s %s %ds: %s", c.Source, c.Name, c.Op, int(c.Value), age)
+		return fmt.Sprintf("%s %s %ds: %s", name, c.Op, int(c.Value), age)
+	}
+	if c.Op == "stuck" {
+		var age string
+		if s == nil {
+			age = "missing"
+		} else {
+			age = fmt.Sprintf("%.1f for %ds", s.Value, int(now.Sub(s.Timestamp)/time.Second))
+		}
+		return fmt.Sprintf("%s %s %ds: %s", name, c.Op, int(c.Value), age)
 	}
 	var val string
 	if s == nil {
 		val = "missing"
+	} else if c.Op == "dev" {
+		val = fmt.Sprintf("%+.1f", s.Value)
 	} else {
 		val = fmt.Sprintf("%.1f", s.Value)
 	}
-	return fmt.Sprintf("%s.%s %s %.1f: %s", c.Source, c.Name, c.Op, c.Value, val)
+	return fmt.Sprintf("%s %s %.1f: %s", name, c.Op, c.Value, val)
 }
 
 // conditionState contains information about a condition's current state.
 type conditionState struct {
 	// ID uniquely identifying the condition.
-	Id string
+	Id string `json:"id"`
 
 	// True the condition became active, or zero if inactive.
-	ActiveTime time.Time
+	ActiveTime time.Time `json:"activeTime"`
 
 	// Human-readable string describing the condition and its sample's current
 	// value.
-	Msg string
+	Msg string `json:"msg"`
+
+	// The condition's source, name, and operator, and the value that samples
+	// are compared against (in seconds for "ot" and "stuck").
+	Source    string  `json:"source"`
+	Name      string  `json:"name"`
+	Op        string  `json:"op"`
+	Threshold float32 `json:"threshold"`
+
+	// Value and timestamp of the most-recent sample, or zero if no sample was
+	// found. For "stuck", the timestamp is when the current value was first
+	// reported. For "dev", the value is the sample's deviation from the daily
+	// average.
+	Value      float32   `json:"value"`
+	SampleTime time.Time `json:"sampleTime"`
 }
 
 // alertState describes the current alerting state.
@@ -103,12 +276,63 @@ type alertState struct {
 
 	// Last time at which conditions were evaluated.
 	LastEvalTime time.Time
+
+	// Times at which alert emails were sent within the past hour.
+	EmailTimes []time.Time
+
+	// Conditions that started or ended while emails were being throttled.
+	// They're included in the next email.
+	PendingStarted []conditionState
+	PendingEnded   []conditionState
+}
+
+// AlertEvent records a condition becoming active or inactive.
+type AlertEvent struct {
+	// Time at which the change was detected.
+	Time time.Time `json:"time"`
+
+	// ID uniquely identifying the condition.
+	Id string `json:"id" datastore:",noindex"`
+
+	// True if the condition became active, or false if it became inactive.
+	Active bool `json:"active" datastore:",noindex"`
+
+	// Human-readable string describing the condition and its sample's value
+	// at the time of the change.
+	Msg string `json:"msg" datastore:",noindex"`
+}
+
+// GetAlertEvents returns up to max of the most-recent alert events, sorted by
+// descending time.
+func GetAlertEvents(c context.Context, max int) ([]AlertEvent, error) {
+	events := make([]AlertEvent, 0)
+	q := datastore.NewQuery(alertEventKind).Order("-Time").Limit(max)
+	if _, err := q.GetAll(c, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
 }
 
+// EvaluateConds evaluates conds at now, updates the stored alert state, and
+// sends an email if any conditions started or ended. Evaluation is skipped if
+// conditions were already evaluated less than minInterval before now.
+// queryConcurrency is passed to getSamplesForConditions.
 func EvaluateConds(c context.Context, conds []Condition, now time.Time,
-	sender string, recipients []string) error {
+	mc *AlertMessageConfig, minInterval time.Duration, queryConcurrency int) error {
+	// Check the last evaluation time before doing any work. It's checked again
+	// by updateAlertState in case another evaluation finishes in the meantime.
+	as := alertState{}
+	k := datastore.NewKey(c, alertStateKind, "", alertStateId, nil)
+	if err := datastore.Get(c, k, &as); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if evaluatedSince(&as, now, minInterval) {
+		log.Debugf(c, "Skipping evaluation since conditions were evaluated at %v", as.LastEvalTime)
+		return nil
+	}
+
 	log.Debugf(c, "Getting samples for %v condition(s)", len(conds))
-	samples, err := getSamplesForConditions(c, conds)
+	samples, err := getSamplesForConditions(c, conds, now, queryConcurrency)
 	if err != nil {
 		return err
 	}
@@ -118,72 +342,237 @@ func EvaluateConds(c context.Context, conds []Condition, now time.Time,
 		return err
 	}
 	log.Debugf(c, "Updating alert state")
-	start, cont, end, err := updateAlertState(c, states, now)
-	if err != nil {
+	start, cont, end, err := updateAlertState(c, states, now, mc.MaxEmailsPerHour, minInterval)
+	if err == errEvalSkipped {
+		log.Debugf(c, "Skipping alert state update since conditions were evaluated concurrently")
+		return nil
+	} else if err != nil {
 		return err
 	}
-	if msg := createAlertMessage(sender, recipients, start, cont, end); msg != nil {
+	msg, err := createAlertMessage(mc, start, cont, end)
+	if err != nil {
+		return err
+	} else if msg != nil {
 		log.Debugf(c, "Sending email: %v", msg.Body)
 		return mail.Send(c, msg)
 	}
 	return nil
 }
 
+// ConditionPreview describes a condition's current state as returned by
+// PreviewConds.
+type ConditionPreview struct {
+	// ID uniquely identifying the condition.
+	Id string `json:"id"`
+
+	// True if the condition is currently active.
+	Active bool `json:"active"`
+
+	// Human-readable string describing the condition and its sample's current
+	// value.
+	Msg string `json:"msg"`
+
+	// Value and timestamp of the sample that the condition was evaluated
+	// against, or zero if no sample was found. See conditionState.
+	Value      float32   `json:"value"`
+	SampleTime time.Time `json:"sampleTime"`
+}
+
+// PreviewConds evaluates conds at now and returns their states in the same
+// order. Unlike EvaluateConds, the stored alert state is neither read nor
+// updated and no email is sent, so it can be used to test new conditions
+// against current data. queryConcurrency is passed to getSamplesForConditions.
+func PreviewConds(c context.Context, conds []Condition, now time.Time,
+	queryConcurrency int) ([]ConditionPreview, error) {
+	samples, err := getSamplesForConditions(c, conds, now, queryConcurrency)
+	if err != nil {
+		return nil, err
+	}
+	states, err := getConditionStates(conds, samples, now)
+	if err != nil {
+		return nil, err
+	}
+	previews := make([]ConditionPreview, len(states))
+	for i, st := range states {
+		previews[i] = ConditionPreview{
+			Id:         st.Id,
+			Active:     !st.ActiveTime.IsZero(),
+			Msg:        st.Msg,
+			Value:      st.Value,
+			SampleTime: st.SampleTime,
+		}
+	}
+	return previews, nil
+}
+
+// SendTestAlert sends an alert email describing a fake condition. It can be
+// used to verify that mail is configured correctly. The stored alert state is
+// not modified.
+func SendTestAlert(c context.Context, mc *AlertMessageConfig, now time.Time) error {
+	st := conditionState{
+		Id:         "test",
+		ActiveTime: now,
+		Msg:        "Test alert",
+		Source:     "test",
+		Name:       "test",
+	}
+	msg, err := createAlertMessage(mc, []conditionState{st}, nil, nil)
+	if err != nil {
+		return err
+	}
+	log.Debugf(c, "Sending test email to %v", msg.To)
+	return mail.Send(c, msg)
+}
+
 // getSamplesForConditions queries for and returns the most recent samples
-// needed to evaluate conds. The returned map is keyed by "source|name" and
-// values may be nil if corresponding samples weren't found in the datastore.
-func getSamplesForConditions(c context.Context, conds []Condition) (
-	map[string]*common.Sample, error) {
-	samples := make(map[string]*common.Sample)
+// needed to evaluate conds. The returned map is keyed by each condition's
+// sampleKey and values may be nil if corresponding samples weren't found in
+// the datastore. For conditions with aggregates, the returned samples contain
+// the requested aggregate value and the start time of the summarized period.
+// For "stuck" conditions, the returned samples contain the series' current
+// value and the time at which it was first reported (or the time of the last
+// sample before the condition's window, if the value was unchanged then).
+// For "dev" conditions, the returned samples contain the most-recent sample's
+// timestamp and its deviation from the average in the latest day summary.
+//
+// Each series is queried separately, with up to concurrency series being
+// queried in parallel.
+func getSamplesForConditions(c context.Context, conds []Condition, now time.Time,
+	concurrency int) (map[string]*common.Sample, error) {
+	keyConds := make(map[string]Condition)
 	for _, cond := range conds {
-		samples[cond.Source+"|"+cond.Name] = nil
+		keyConds[cond.sampleKey()] = cond
 	}
 
 	type sampleError struct {
+		key string
 		s   *common.Sample
 		err error
 	}
-	chans := make([]chan sampleError, 0, len(samples))
+	ch := make(chan sampleError, len(keyConds))
 
-	bq := datastore.NewQuery(sampleKind).Limit(1).Order("-Timestamp")
-	for sn := range samples {
-		chans = append(chans, make(chan sampleError))
-		parts := strings.Split(sn, "|")
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("Invalid 'source|name' string %q", sn)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	for key, cond := range keyConds {
+		sem <- struct{}{}
+		go func(key string, cond Condition) {
+			defer func() { <-sem }()
+			s, err := getSampleForCondition(c, &cond, now)
+			ch <- sampleError{key, s, err}
+		}(key, cond)
+	}
+
+	samples := make(map[string]*common.Sample)
+	var err error
+	for range keyConds {
+		se := <-ch
+		if se.err != nil && err == nil {
+			err = se.err
 		}
+		samples[se.key] = se.s
+	}
+	if err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
 
-		q := bq.Filter("Source =", parts[0]).Filter("Name =", parts[1])
-		go func(q *datastore.Query, ch chan sampleError) {
-			s := make([]common.Sample, 0)
-			if _, err := q.GetAll(c, &s); err != nil {
-				ch <- sampleError{nil, err}
-			} else if len(s) == 0 {
-				ch <- sampleError{nil, nil}
-			} else {
-				ch <- sampleError{&s[0], nil}
+// getSampleForCondition returns the sample needed to evaluate cond, or nil if
+// it wasn't found. See getSamplesForConditions.
+func getSampleForCondition(c context.Context, cond *Condition, now time.Time) (
+	*common.Sample, error) {
+	if cond.Aggregate == "" {
+		q := datastore.NewQuery(sampleKind).Filter("Source =", cond.Source).
+			Filter("Name =", cond.Name).Order("-Timestamp").Limit(1)
+		s := make([]common.Sample, 0)
+		if _, err := q.GetAll(c, &s); err != nil || len(s) == 0 {
+			return nil, err
+		}
+		if cond.Op == "stuck" {
+			return getUnchangedSince(c, &s[0], now.Add(-time.Duration(cond.Value)*time.Second))
+		}
+		if cond.Op == "dev" {
+			q := datastore.NewQuery(daySummaryKind).Filter("Source =", cond.Source).
+				Filter("Name =", cond.Name).Order("-Timestamp").Limit(1)
+			sums := make([]summary, 0)
+			if _, err := q.GetAll(c, &sums); err != nil || len(sums) == 0 {
+				return nil, err
 			}
-		}(q, chans[len(chans)-1])
+			s[0].Value -= sums[0].AvgValue
+		}
+		return &s[0], nil
+	}
+
+	q := datastore.NewQuery(cond.summaryKind()).Filter("Source =", cond.Source).
+		Filter("Name =", cond.Name).Order("-Timestamp").Limit(1)
+	sums := make([]summary, 0)
+	if _, err := q.GetAll(c, &sums); err != nil || len(sums) == 0 {
+		return nil, err
+	}
+	sum := &sums[0]
+	s := &common.Sample{Timestamp: sum.Timestamp, Source: sum.Source, Name: sum.Name}
+	switch cond.Aggregate {
+	case "min":
+		s.Value = sum.MinValue
+	case "max":
+		s.Value = sum.MaxValue
+	case "avg":
+		s.Value = sum.AvgValue
+	default:
+		return nil, fmt.Errorf("Invalid aggregate %q", cond.Aggregate)
 	}
+	return s, nil
+}
 
-	for _, ch := range chans {
-		ce := <-ch
-		if ce.err != nil {
-			return nil, ce.err
-		} else if ce.s != nil {
-			samples[ce.s.Source+"|"+ce.s.Name] = ce.s
+// getUnchangedSince returns a copy of latest, the most-recent sample in its
+// series, with its timestamp set to the time at which the series' value
+// changed to latest's value. Only samples back to windowStart and the single
+// sample preceding windowStart are examined; if that sample also has latest's
+// value, its timestamp is used.
+func getUnchangedSince(c context.Context, latest *common.Sample, windowStart time.Time) (
+	*common.Sample, error) {
+	if windowStart.After(latest.Timestamp) {
+		windowStart = latest.Timestamp
+	}
+	first := *latest
+	it := datastore.NewQuery(sampleKind).Filter("Source =", latest.Source).
+		Filter("Name =", latest.Name).Filter("Timestamp >=", windowStart).
+		Filter("Timestamp <", latest.Timestamp).Order("-Timestamp").Run(c)
+	for {
+		var s common.Sample
+		if _, err := it.Next(&s); err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
 		}
+		if s.Value != latest.Value {
+			return &first, nil
+		}
+		first.Timestamp = s.Timestamp
 	}
-	return samples, nil
+
+	q := datastore.NewQuery(sampleKind).Filter("Source =", latest.Source).
+		Filter("Name =", latest.Name).Filter("Timestamp <", windowStart).
+		Order("-Timestamp").Limit(1)
+	prev := make([]common.Sample, 0)
+	if _, err := q.GetAll(c, &prev); err != nil {
+		return nil, err
+	}
+	if len(prev) > 0 && prev[0].Value == latest.Value {
+		first.Timestamp = prev[0].Timestamp
+	}
+	return &first, nil
 }
 
 // getConditionStates returns the current states of conditions. samples is keyed
-// by "source|name" and values may be nil.
+// by each condition's sampleKey and values may be nil.
 func getConditionStates(conds []Condition, samples map[string]*common.Sample,
 	now time.Time) ([]conditionState, error) {
 	states := make([]conditionState, len(conds))
 	for i, cond := range conds {
-		s := samples[cond.Source+"|"+cond.Name]
+		s := samples[cond.sampleKey()]
 		if active, err := cond.active(s, now); err != nil {
 			return nil, err
 		} else {
@@ -191,22 +580,85 @@ func getConditionStates(conds []Condition, samples map[string]*common.Sample,
 			if active {
 				activeTime = now
 			}
-			states[i] = conditionState{cond.id(), activeTime, cond.msg(s, now)}
+			states[i] = conditionState{
+				Id:         cond.id(),
+				ActiveTime: activeTime,
+				Msg:        cond.msg(s, now),
+				Source:     cond.Source,
+				Name:       cond.Name,
+				Op:         cond.Op,
+				Threshold:  cond.Value,
+			}
+			if s != nil {
+				states[i].Value = s.Value
+				states[i].SampleTime = s.Timestamp
+			}
 		}
 	}
 	return states, nil
 }
 
+// evaluatedSince returns true if as was updated by an evaluation less than
+// minInterval before now, or by an evaluation after now.
+func evaluatedSince(as *alertState, now time.Time, minInterval time.Duration) bool {
+	if as.LastEvalTime.IsZero() {
+		return false
+	}
+	return as.LastEvalTime.After(now) || now.Sub(as.LastEvalTime) < minInterval
+}
+
 // updateAlertState gets the current alerting state, identifies newly-active,
 // continuing-to-be-active, and no-longer-active conditions, and saves the
-// updated state.
-func updateAlertState(c context.Context, ns []conditionState, now time.Time) (
+// updated state. The returned conditions are limited by throttleAlerts: start
+// and end are empty if no email should be sent, and otherwise also include
+// changes that were withheld earlier.
+//
+// The state is read and written within a transaction (retried on contention)
+// so concurrent evaluations don't overwrite each other's changes.
+// errEvalSkipped is returned if the state was updated by an evaluation less
+// than minInterval before now or by an evaluation after now.
+func updateAlertState(c context.Context, ns []conditionState, now time.Time,
+	maxEmailsPerHour int, minInterval time.Duration) (
 	start, cont, end []conditionState, err error) {
-	as := alertState{}
 	k := datastore.NewKey(c, alertStateKind, "", alertStateId, nil)
+	if err = retryDatastoreOp(c, "alert state update", func() error {
+		return datastore.RunInTransaction(c, func(tc context.Context) error {
+			var err error
+			start, cont, end, err = updateAlertStateInTransaction(tc, k, ns, now,
+				maxEmailsPerHour, minInterval)
+			return err
+		}, nil)
+	}); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Conditions that started earlier but weren't emailed are reported as
+	// new rather than continuing.
+	started := make(map[string]bool)
+	for _, s := range start {
+		started[s.Id] = true
+	}
+	filtered := make([]conditionState, 0, len(cont))
+	for _, s := range cont {
+		if !started[s.Id] {
+			filtered = append(filtered, s)
+		}
+	}
+	return start, filtered, end, nil
+}
+
+// updateAlertStateInTransaction performs updateAlertState's work within a
+// transaction. k is the key of the alertState entity.
+func updateAlertStateInTransaction(c context.Context, k *datastore.Key, ns []conditionState,
+	now time.Time, maxEmailsPerHour int, minInterval time.Duration) (
+	start, cont, end []conditionState, err error) {
+	as := alertState{}
 	if err = datastore.Get(c, k, &as); err != nil && err != datastore.ErrNoSuchEntity {
 		return nil, nil, nil, err
 	}
+	if evaluatedSince(&as, now, minInterval) {
+		return nil, nil, nil, errEvalSkipped
+	}
 	om := make(map[string]conditionState)
 	if as.ActiveConditions != nil {
 		for _, s := range as.ActiveConditions {
@@ -234,20 +686,148 @@ func updateAlertState(c context.Context, ns []conditionState, now time.Time) (
 		}
 	}
 
+	if err = writeAlertEvents(c, k, start, end, now); err != nil {
+		return nil, nil, nil, err
+	}
+
 	as.ActiveConditions = append(start, cont...)
 	as.LastEvalTime = now
+	if start, end = throttleAlerts(&as, start, end, now, maxEmailsPerHour); start == nil {
+		start = make([]conditionState, 0)
+		end = make([]conditionState, 0)
+	}
 	if _, err = datastore.Put(c, k, &as); err != nil {
 		return nil, nil, nil, err
 	}
 	return start, cont, end, nil
 }
 
-func createAlertMessage(sender string, recipients []string, start, cont, end []conditionState) *mail.Message {
-	// If nothing's changed, bail out.
+// writeAlertEvents writes AlertEvent entities describing conditions that
+// started or ended at now. The entities are children of parent so they can be
+// written in the same transaction as the alert state.
+func writeAlertEvents(c context.Context, parent *datastore.Key, start, end []conditionState,
+	now time.Time) error {
 	if len(start) == 0 && len(end) == 0 {
 		return nil
 	}
+	keys := make([]*datastore.Key, 0, len(start)+len(end))
+	events := make([]AlertEvent, 0, len(start)+len(end))
+	for _, s := range start {
+		keys = append(keys, datastore.NewIncompleteKey(c, alertEventKind, parent))
+		events = append(events, AlertEvent{now, s.Id, true, s.Msg})
+	}
+	for _, s := range end {
+		keys = append(keys, datastore.NewIncompleteKey(c, alertEventKind, parent))
+		events = append(events, AlertEvent{now, s.Id, false, s.Msg})
+	}
+	_, err := datastore.PutMulti(c, keys, events)
+	return err
+}
+
+// throttleAlerts limits the number of alert emails to maxPerHour (if
+// positive). start and end contain conditions that just started and ended. If
+// an email should be sent, the conditions that it should report as started and
+// ended (including ones withheld earlier) are returned and the send time is
+// recorded in as. Otherwise, nil slices are returned and the changes are saved
+// in as for the next email.
+func throttleAlerts(as *alertState, start, end []conditionState, now time.Time,
+	maxPerHour int) (sendStart, sendEnd []conditionState) {
+	var times []time.Time
+	for _, t := range as.EmailTimes {
+		if now.Sub(t) < time.Hour {
+			times = append(times, t)
+		}
+	}
+	as.EmailTimes = times
 
+	sendStart = mergeConditionStates(as.PendingStarted, start)
+	sendEnd = mergeConditionStates(as.PendingEnded, end)
+	if len(sendStart) == 0 && len(sendEnd) == 0 {
+		return nil, nil
+	}
+	if maxPerHour > 0 && len(as.EmailTimes) >= maxPerHour {
+		as.PendingStarted = sendStart
+		as.PendingEnded = sendEnd
+		return nil, nil
+	}
+	as.PendingStarted = nil
+	as.PendingEnded = nil
+	as.EmailTimes = append(as.EmailTimes, now)
+	return sendStart, sendEnd
+}
+
+// mergeConditionStates returns the union of a and b. If a condition appears in
+// both, the state from b is used.
+func mergeConditionStates(a, b []conditionState) []conditionState {
+	merged := make([]conditionState, 0, len(a)+len(b))
+	inB := make(map[string]bool)
+	for _, s := range b {
+		inB[s.Id] = true
+	}
+	for _, s := range a {
+		if !inB[s.Id] {
+			merged = append(merged, s)
+		}
+	}
+	return append(merged, b...)
+}
+
+// createAlertMessage returns a message describing changes to active
+// conditions, or nil if no conditions started or ended.
+func createAlertMessage(mc *AlertMessageConfig, start, cont, end []conditionState) (
+	*mail.Message, error) {
+	// If nothing's changed, bail out.
+	if len(start) == 0 && len(end) == 0 {
+		return nil, nil
+	}
+
+	d := AlertMessageData{start, cont, end}
+	subject := defaultAlertSubject
+	if mc.SubjectTemplate != "" {
+		var err error
+		if subject, err = execAlertTemplate(mc.SubjectTemplate, &d); err != nil {
+			return nil, fmt.Errorf("Failed to generate subject: %v", err)
+		}
+	}
+	// Mail clients display the HTML body when it's present, so it's only
+	// included when the default plain-text body is used.
+	msg := &mail.Message{
+		Sender:  mc.Sender,
+		To:      mc.Recipients,
+		Subject: subject,
+	}
+	if mc.BodyTemplate != "" {
+		var err error
+		if msg.Body, err = execAlertTemplate(mc.BodyTemplate, &d); err != nil {
+			return nil, fmt.Errorf("Failed to generate body: %v", err)
+		}
+	} else {
+		msg.Body = getDefaultAlertBody(&d)
+		var html strings.Builder
+		if err := alertHTMLTemplate.Execute(&html, &d); err != nil {
+			return nil, fmt.Errorf("Failed to generate HTML body: %v", err)
+		}
+		msg.HTMLBody = strings.TrimSpace(html.String())
+	}
+	return msg, nil
+}
+
+// execAlertTemplate parses and executes the text/template tmpl against d.
+func execAlertTemplate(tmpl string, d *AlertMessageData) (string, error) {
+	t, err := template.New("").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, d); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// getDefaultAlertBody returns the message body used when no template is
+// configured.
+func getDefaultAlertBody(d *AlertMessageData) string {
 	fc := func(heading string, states []conditionState) string {
 		strs := make([]string, len(states))
 		for i, s := range states {
@@ -257,21 +837,14 @@ func createAlertMessage(sender string, recipients []string, start, cont, end []c
 	}
 
 	lines := make([]string, 0)
-	if len(start) > 0 {
-		lines = append(lines, fc("New alerts:", start))
+	if len(d.Started) > 0 {
+		lines = append(lines, fc("New alerts:", d.Started))
 	}
-	if len(end) > 0 {
-		lines = append(lines, fc("Ended alerts:", end))
+	if len(d.Ended) > 0 {
+		lines = append(lines, fc("Ended alerts:", d.Ended))
 	}
-	if len(cont) > 0 {
-		lines = append(lines, fc("Continuing alerts:", cont))
-	}
-	body := strings.Join(lines, "\n\n")
-
-	return &mail.Message{
-		Sender:  sender,
-		To:      recipients,
-		Subject: "Alerts updated",
-		Body:    body,
+	if len(d.Continuing) > 0 {
+		lines = append(lines, fc("Continuing alerts:", d.Continuing))
 	}
+	return strings.Join(lines, "\n\n")
 }
@@ -5,6 +5,7 @@ package storage
 
 import (
 	"fmt"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
@@ -12,7 +13,7 @@ import (
 
 	"github.com/derat/home/common"
 
-	"google.golang.org/appengine/v2/mail"
+	"google.golang.org/appengine/v2/datastore"
 )
 
 func TestGetSamplesForConditions(t *testing.T) {
@@ -23,15 +24,15 @@ func TestGetSamplesForConditions(t *testing.T) {
 		common.Sample{lt(2015, 7, 1, 0, 2, 0), "a", "b", 3.0},
 		common.Sample{lt(2015, 7, 1, 0, 0, 0), "a", "c", 4.0},
 	}
-	if err := WriteSamples(c, samples); err != nil {
+	if err := WriteSamples(c, samples, nil); err != nil {
 		t.Fatalf("Failed inserting samples: %v", err)
 	}
 
 	m, err := getSamplesForConditions(c, []Condition{
-		Condition{"a", "b", "gt", 1.0},
-		Condition{"a", "c", "lt", 1.0},
-		Condition{"a", "d", "eq", 1.0},
-	})
+		Condition{Source: "a", Name: "b", Op: "gt", Value: 1.0},
+		Condition{Source: "a", Name: "c", Op: "lt", Value: 1.0},
+		Condition{Source: "a", Name: "d", Op: "eq", Value: 1.0},
+	}, lt(2015, 7, 1, 0, 3, 0), 1)
 	if err != nil {
 		t.Fatalf("Failed to get recent samples: %v", err)
 	}
@@ -49,12 +50,229 @@ func TestGetSamplesForConditions(t *testing.T) {
 	}
 }
 
+func TestGetSamplesForConditionsAggregate(t *testing.T) {
+	c := initTest()
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2015, 7, 1, 0, 0, 0), "a", "b", 1.0},
+		common.Sample{lt(2015, 7, 1, 0, 30, 0), "a", "b", 5.0},
+		common.Sample{lt(2015, 7, 1, 1, 0, 0), "a", "b", 2.0},
+		common.Sample{lt(2015, 7, 1, 1, 30, 0), "a", "b", 4.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+	if err := GenerateSummaries(c, lt(2015, 7, 3, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+
+	hourMax := Condition{Source: "a", Name: "b", Op: "gt", Value: 3, Aggregate: "max"}
+	hourMin := Condition{Source: "a", Name: "b", Op: "gt", Value: 3, Aggregate: "min"}
+	dayMax := Condition{Source: "a", Name: "b", Op: "gt", Value: 3, Aggregate: "max",
+		AggregatePeriod: "day"}
+	dayAvg := Condition{Source: "a", Name: "b", Op: "gt", Value: 3, Aggregate: "avg",
+		AggregatePeriod: "day"}
+	latest := Condition{Source: "a", Name: "b", Op: "gt", Value: 3}
+	m, err := getSamplesForConditions(c, []Condition{hourMax, hourMin, dayMax, dayAvg, latest},
+		lt(2015, 7, 3, 0, 0, 0), DefaultAlertQueryConcurrency)
+	if err != nil {
+		t.Fatalf("Failed to get samples: %v", err)
+	}
+	for _, tc := range []struct {
+		cond Condition
+		exp  common.Sample
+	}{
+		{hourMax, common.Sample{lt(2015, 7, 1, 1, 0, 0), "a", "b", 4.0}},
+		{hourMin, common.Sample{lt(2015, 7, 1, 1, 0, 0), "a", "b", 2.0}},
+		{dayMax, common.Sample{ld(2015, 7, 1), "a", "b", 5.0}},
+		{dayAvg, common.Sample{ld(2015, 7, 1), "a", "b", 3.0}},
+		{latest, common.Sample{lt(2015, 7, 1, 1, 30, 0), "a", "b", 4.0}},
+	} {
+		s := m[tc.cond.sampleKey()]
+		if s == nil {
+			t.Errorf("No sample for %v", tc.cond.id())
+		} else if s.String() != tc.exp.String() {
+			t.Errorf("Expected %q for %v; got %q", tc.exp.String(), tc.cond.id(), s.String())
+		}
+	}
+}
+
+func TestGetSamplesForConditionsStuck(t *testing.T) {
+	c := initTest()
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2015, 7, 1, 0, 0, 0), "a", "b", 1.0},
+		common.Sample{lt(2015, 7, 1, 0, 10, 0), "a", "b", 2.0},
+		common.Sample{lt(2015, 7, 1, 0, 20, 0), "a", "b", 2.0},
+		common.Sample{lt(2015, 7, 1, 0, 30, 0), "a", "b", 2.0},
+		common.Sample{lt(2015, 7, 1, 0, 0, 0), "a", "c", 3.0},
+		common.Sample{lt(2015, 7, 1, 0, 10, 0), "a", "c", 3.0},
+		common.Sample{lt(2015, 7, 1, 0, 20, 0), "a", "c", 3.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+
+	// b changed to 2 at 00:10. c has been 3 since before its 10-minute window.
+	now := lt(2015, 7, 1, 0, 35, 0)
+	bLong := Condition{Source: "a", Name: "b", Op: "stuck", Value: 3600}
+	bShort := Condition{Source: "a", Name: "b", Op: "stuck", Value: 600}
+	cShort := Condition{Source: "a", Name: "c", Op: "stuck", Value: 600}
+	missing := Condition{Source: "a", Name: "d", Op: "stuck", Value: 600}
+	m, err := getSamplesForConditions(c, []Condition{bLong, bShort, cShort, missing}, now,
+		DefaultAlertQueryConcurrency)
+	if err != nil {
+		t.Fatalf("Failed to get samples: %v", err)
+	}
+	for _, tc := range []struct {
+		cond   Condition
+		exp    common.Sample
+		active bool
+	}{
+		{bLong, common.Sample{lt(2015, 7, 1, 0, 10, 0), "a", "b", 2.0}, false},
+		{bShort, common.Sample{lt(2015, 7, 1, 0, 20, 0), "a", "b", 2.0}, true},
+		{cShort, common.Sample{lt(2015, 7, 1, 0, 10, 0), "a", "c", 3.0}, true},
+	} {
+		s := m[tc.cond.sampleKey()]
+		if s == nil {
+			t.Errorf("No sample for %v", tc.cond.id())
+			continue
+		} else if s.String() != tc.exp.String() {
+			t.Errorf("Expected %q for %v; got %q", tc.exp.String(), tc.cond.id(), s.String())
+		}
+		if active, err := tc.cond.active(s, now); err != nil {
+			t.Errorf("Failed to evaluate %v: %v", tc.cond.id(), err)
+		} else if active != tc.active {
+			t.Errorf("Expected %v to be active=%v", tc.cond.id(), tc.active)
+		}
+	}
+	if s := m[missing.sampleKey()]; s != nil {
+		t.Errorf("Got unexpected sample %q for %v", s.String(), missing.id())
+	}
+}
+
+func TestConditionStuck(t *testing.T) {
+	c := Condition{Source: "a", Name: "b", Op: "stuck", Value: 60}
+	if err := c.Check(); err != nil {
+		t.Errorf("Check failed for valid condition: %v", err)
+	}
+	s := &common.Sample{time.Unix(0, 0), "a", "b", 4}
+	for _, tc := range []struct {
+		s      *common.Sample
+		now    time.Time
+		active bool
+		msg    string
+	}{
+		{nil, time.Unix(100, 0), false, "a.b stuck 60s: missing"},
+		{s, time.Unix(60, 0), false, "a.b stuck 60s: 4.0 for 60s"},
+		{s, time.Unix(61, 0), true, "a.b stuck 60s: 4.0 for 61s"},
+	} {
+		if active, err := c.active(tc.s, tc.now); err != nil {
+			t.Errorf("Got error at %v: %v", tc.now.Unix(), err)
+		} else if active != tc.active {
+			t.Errorf("Expected active=%v at %v; got %v", tc.active, tc.now.Unix(), active)
+		}
+		if msg := c.msg(tc.s, tc.now); msg != tc.msg {
+			t.Errorf("Expected %q; got %q", tc.msg, msg)
+		}
+	}
+
+	c.Aggregate = "max"
+	if err := c.Check(); err == nil {
+		t.Errorf("Check succeeded for stuck condition with aggregate")
+	}
+}
+
+func TestGetSamplesForConditionsDeviation(t *testing.T) {
+	c := initTest()
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2015, 7, 1, 0, 0, 0), "a", "b", 1.0},
+		common.Sample{lt(2015, 7, 1, 12, 0, 0), "a", "b", 3.0},
+		common.Sample{lt(2015, 7, 2, 6, 0, 0), "a", "b", 6.5},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+	if err := GenerateSummaries(c, lt(2015, 7, 2, 12, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+
+	// The latest sample is 4.5 above the July 1 average of 2.0.
+	now := lt(2015, 7, 2, 12, 0, 0)
+	dev := Condition{Source: "a", Name: "b", Op: "dev", Value: 4}
+	missing := Condition{Source: "a", Name: "c", Op: "dev", Value: 4}
+	m, err := getSamplesForConditions(c, []Condition{dev, missing}, now,
+		DefaultAlertQueryConcurrency)
+	if err != nil {
+		t.Fatalf("Failed to get samples: %v", err)
+	}
+	exp := common.Sample{lt(2015, 7, 2, 6, 0, 0), "a", "b", 4.5}
+	if s := m[dev.sampleKey()]; s == nil {
+		t.Errorf("No sample for %v", dev.id())
+	} else if s.String() != exp.String() {
+		t.Errorf("Expected %q; got %q", exp.String(), s.String())
+	}
+	if s := m[missing.sampleKey()]; s != nil {
+		t.Errorf("Got unexpected sample %q for %v", s.String(), missing.id())
+	}
+}
+
+func TestConditionDeviation(t *testing.T) {
+	c := Condition{Source: "a", Name: "b", Op: "dev", Value: 2}
+	if err := c.Check(); err != nil {
+		t.Errorf("Check failed for valid condition: %v", err)
+	}
+	now := time.Unix(0, 0)
+	for _, tc := range []struct {
+		s      *common.Sample
+		active bool
+		msg    string
+	}{
+		{nil, false, "a.b dev 2.0: missing"},
+		{&common.Sample{now, "a", "b", 1.5}, false, "a.b dev 2.0: +1.5"},
+		{&common.Sample{now, "a", "b", 2.5}, true, "a.b dev 2.0: +2.5"},
+		{&common.Sample{now, "a", "b", -2}, false, "a.b dev 2.0: -2.0"},
+		{&common.Sample{now, "a", "b", -3}, true, "a.b dev 2.0: -3.0"},
+	} {
+		if active, err := c.active(tc.s, now); err != nil {
+			t.Errorf("Got error for %q: %v", tc.msg, err)
+		} else if active != tc.active {
+			t.Errorf("Expected active=%v for %q; got %v", tc.active, tc.msg, active)
+		}
+		if msg := c.msg(tc.s, now); msg != tc.msg {
+			t.Errorf("Expected %q; got %q", tc.msg, msg)
+		}
+	}
+}
+
+func TestConditionAggregate(t *testing.T) {
+	c := Condition{Source: "a", Name: "b", Op: "gt", Value: 3, Aggregate: "max"}
+	if err := c.Check(); err != nil {
+		t.Errorf("Check failed for valid condition: %v", err)
+	}
+	if a, e := c.msg(&common.Sample{time.Unix(0, 0), "a", "b", 4}, time.Unix(0, 0)),
+		"a.b max(hour) gt 3.0: 4.0"; a != e {
+		t.Errorf("Expected %q; got %q", e, a)
+	}
+	plain := Condition{Source: "a", Name: "b", Op: "gt", Value: 3}
+	if c.id() == plain.id() || c.sampleKey() == plain.sampleKey() {
+		t.Errorf("Aggregate condition has same ID or key as plain condition")
+	}
+
+	c.AggregatePeriod = "week"
+	if err := c.Check(); err == nil {
+		t.Errorf("Check succeeded for invalid period %q", c.AggregatePeriod)
+	}
+	c.AggregatePeriod = "day"
+	c.Aggregate = "median"
+	if err := c.Check(); err == nil {
+		t.Errorf("Check succeeded for invalid aggregate %q", c.Aggregate)
+	}
+}
+
 func TestGetConditionStates(t *testing.T) {
 	ms := func(t time.Time, s, n string, v float32) common.Sample {
 		return common.Sample{t, s, n, v}
 	}
 	mcs := func(cond Condition, at time.Time) conditionState {
-		return conditionState{cond.id(), at, ""}
+		return conditionState{Id: cond.id(), ActiveTime: at}
 	}
 
 	type as []common.Sample
@@ -72,13 +290,13 @@ func TestGetConditionStates(t *testing.T) {
 	t5 := time.Unix(5, 0)
 	t6 := time.Unix(6, 0)
 
-	ceq := Condition{a, b, "eq", 1}
-	cne := Condition{a, b, "ne", 1}
-	clt := Condition{a, b, "lt", 1}
-	cgt := Condition{a, b, "gt", 1}
-	cle := Condition{a, b, "le", 1}
-	cge := Condition{a, b, "ge", 1}
-	cot := Condition{a, b, "ot", 5}
+	ceq := Condition{Source: a, Name: b, Op: "eq", Value: 1}
+	cne := Condition{Source: a, Name: b, Op: "ne", Value: 1}
+	clt := Condition{Source: a, Name: b, Op: "lt", Value: 1}
+	cgt := Condition{Source: a, Name: b, Op: "gt", Value: 1}
+	cle := Condition{Source: a, Name: b, Op: "le", Value: 1}
+	cge := Condition{Source: a, Name: b, Op: "ge", Value: 1}
+	cot := Condition{Source: a, Name: b, Op: "ot", Value: 5}
 
 	for i, tc := range []struct {
 		now     time.Time
@@ -143,13 +361,52 @@ func TestGetConditionStates(t *testing.T) {
 	}
 }
 
+func TestGetConditionStatesFields(t *testing.T) {
+	now := time.Unix(100, 0)
+	st := time.Unix(90, 0)
+	conds := []Condition{
+		Condition{Source: "a", Name: "b", Op: "gt", Value: 5},
+		Condition{Source: "a", Name: "c", Op: "ot", Value: 60},
+	}
+	samples := map[string]*common.Sample{"a|b": &common.Sample{st, "a", "b", 7}}
+	states, err := getConditionStates(conds, samples, now)
+	if err != nil {
+		t.Fatalf("Failed getting states: %v", err)
+	}
+	exp := []conditionState{
+		conditionState{
+			Id:         conds[0].id(),
+			ActiveTime: now,
+			Msg:        "a.b gt 5.0: 7.0",
+			Source:     "a",
+			Name:       "b",
+			Op:         "gt",
+			Threshold:  5,
+			Value:      7,
+			SampleTime: st,
+		},
+		conditionState{
+			Id:         conds[1].id(),
+			ActiveTime: now,
+			Msg:        "a.c ot 60s: missing",
+			Source:     "a",
+			Name:       "c",
+			Op:         "ot",
+			Threshold:  60,
+		},
+	}
+	if !reflect.DeepEqual(states, exp) {
+		t.Errorf("Didn't get expected states:\nexpected: %+v\n  actual: %+v", exp, states)
+	}
+}
+
 func TestUpdateAlertState(t *testing.T) {
 	c := initTest()
 
 	type acs []conditionState
 
 	checkStates := func(now time.Time, states, expStart, expCont, expEnd acs) {
-		start, cont, end, err := updateAlertState(c, []conditionState(states), now)
+		start, cont, end, err := updateAlertState(c, []conditionState(states), now, 0, 0)
 		if err != nil {
 			t.Errorf("Got error at %v: %v", now.Unix(), err)
 			return
@@ -179,37 +436,37 @@ func TestUpdateAlertState(t *testing.T) {
 
 	// At t0, a is active and b isn't.
 	t0 := time.Unix(0, 0)
-	a0 := conditionState{aid, t0, ""}
-	b0 := conditionState{bid, tz, ""}
+	a0 := conditionState{Id: aid, ActiveTime: t0}
+	b0 := conditionState{Id: bid, ActiveTime: tz}
 	checkStates(t0, acs{a0, b0}, acs{a0}, acs{}, acs{})
 
 	// At t1, a remains active and b becomes active.
 	t1 := time.Unix(1, 0)
-	a1 := conditionState{aid, t1, ""}
-	b1 := conditionState{bid, t1, ""}
+	a1 := conditionState{Id: aid, ActiveTime: t1}
+	b1 := conditionState{Id: bid, ActiveTime: t1}
 	checkStates(t1, acs{a1, b1}, acs{b1}, acs{a0}, acs{})
 
 	// At t2, a becomes inactive and b remains active.
 	t2 := time.Unix(2, 0)
-	a2 := conditionState{aid, tz, ""}
-	b2 := conditionState{bid, t2, ""}
+	a2 := conditionState{Id: aid, ActiveTime: tz}
+	b2 := conditionState{Id: bid, ActiveTime: t2}
 	checkStates(t2, acs{a2, b2}, acs{}, acs{b1}, acs{a0})
 
 	// At t3, b also becomes inactive.
 	t3 := time.Unix(3, 0)
-	a3 := conditionState{aid, tz, ""}
-	b3 := conditionState{bid, tz, ""}
+	a3 := conditionState{Id: aid, ActiveTime: tz}
+	b3 := conditionState{Id: bid, ActiveTime: tz}
 	checkStates(t3, acs{a3, b3}, acs{}, acs{}, acs{b1})
 
 	// At t4, both remain inactive.
 	t4 := time.Unix(4, 0)
-	a4 := conditionState{aid, tz, ""}
-	b4 := conditionState{bid, tz, ""}
+	a4 := conditionState{Id: aid, ActiveTime: tz}
+	b4 := conditionState{Id: bid, ActiveTime: tz}
 	checkStates(t4, acs{a4, b4}, acs{}, acs{}, acs{})
 
 	// At t5, replace the existing conditions with a new one that's active.
 	t5 := time.Unix(5, 0)
-	c5 := conditionState{cid, t5, ""}
+	c5 := conditionState{Id: cid, ActiveTime: t5}
 	checkStates(t5, acs{c5}, acs{c5}, acs{}, acs{})
 
 	// At t6, remove the new condition.
@@ -217,6 +474,157 @@ func TestUpdateAlertState(t *testing.T) {
 	checkStates(t6, acs{}, acs{}, acs{}, acs{})
 }
 
+func TestUpdateAlertStateMinInterval(t *testing.T) {
+	c := initTest()
+
+	a := conditionState{Id: "a", ActiveTime: time.Unix(100, 0)}
+	for _, tc := range []struct {
+		now         int64
+		minInterval time.Duration
+		expErr      error
+	}{
+		{100, time.Minute, nil},
+		{130, time.Minute, errEvalSkipped}, // too soon
+		{50, 0, errEvalSkipped},            // older than the last evaluation
+		{130, 0, nil},
+		{200, time.Minute, nil},
+	} {
+		_, _, _, err := updateAlertState(c, []conditionState{a}, time.Unix(tc.now, 0), 0, tc.minInterval)
+		if err != tc.expErr {
+			t.Errorf("Update at %v with interval %v returned %v; expected %v",
+				tc.now, tc.minInterval, err, tc.expErr)
+		}
+	}
+}
+
+func TestEvaluatedSince(t *testing.T) {
+	as := alertState{}
+	if evaluatedSince(&as, time.Unix(100, 0), time.Minute) {
+		t.Errorf("Never-evaluated state reported as recently evaluated")
+	}
+	as.LastEvalTime = time.Unix(100, 0)
+	for _, tc := range []struct {
+		now         int64
+		minInterval time.Duration
+		exp         bool
+	}{
+		{100, 0, false},
+		{130, time.Minute, true},
+		{160, time.Minute, false},
+		{50, 0, true},
+	} {
+		if act := evaluatedSince(&as, time.Unix(tc.now, 0), tc.minInterval); act != tc.exp {
+			t.Errorf("evaluatedSince(%v, %v) = %v; expected %v", tc.now, tc.minInterval, act, tc.exp)
+		}
+	}
+}
+
+func TestPreviewConds(t *testing.T) {
+	c := initTest()
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2015, 7, 1, 0, 0, 0), "a", "b", 1.0},
+		common.Sample{lt(2015, 7, 1, 0, 1, 0), "a", "b", 2.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+
+	now := lt(2015, 7, 1, 0, 2, 0)
+	conds := []Condition{
+		Condition{Source: "a", Name: "b", Op: "gt", Value: 1.0},
+		Condition{Source: "a", Name: "b", Op: "lt", Value: 1.0},
+		Condition{Source: "a", Name: "c", Op: "eq", Value: 1.0},
+	}
+	previews, err := PreviewConds(c, conds, now, 1)
+	if err != nil {
+		t.Fatalf("Failed to preview conditions: %v", err)
+	}
+	if len(previews) != len(conds) {
+		t.Fatalf("Got %v preview(s); expected %v", len(previews), len(conds))
+	}
+	for i, exp := range []bool{true, false, false} {
+		if p := previews[i]; p.Active != exp || p.Id != conds[i].id() || p.Msg == "" {
+			t.Errorf("Preview %v is %+v; expected active=%v", i, p, exp)
+		}
+	}
+	if p := previews[0]; p.Value != 2.0 || !p.SampleTime.Equal(lt(2015, 7, 1, 0, 1, 0)) {
+		t.Errorf("Preview 0 has sample %v at %v", p.Value, p.SampleTime)
+	}
+
+	// The stored alert state shouldn't be created.
+	k := datastore.NewKey(c, alertStateKind, "", alertStateId, nil)
+	if err := datastore.Get(c, k, &alertState{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Getting alert state returned %v; expected %v", err, datastore.ErrNoSuchEntity)
+	}
+}
+
+func TestAlertEvents(t *testing.T) {
+	c := initTest()
+
+	a := conditionState{Id: "a", ActiveTime: time.Unix(1, 0), Msg: "a msg"}
+	if _, _, _, err := updateAlertState(c, []conditionState{a}, time.Unix(1, 0), 0, 0); err != nil {
+		t.Fatalf("Failed to update state at 1: %v", err)
+	}
+	if _, _, _, err := updateAlertState(c, []conditionState{a}, time.Unix(2, 0), 0, 0); err != nil {
+		t.Fatalf("Failed to update state at 2: %v", err)
+	}
+	a.ActiveTime = time.Time{}
+	a.Msg = "a ended"
+	if _, _, _, err := updateAlertState(c, []conditionState{a}, time.Unix(3, 0), 0, 0); err != nil {
+		t.Fatalf("Failed to update state at 3: %v", err)
+	}
+
+	events, err := GetAlertEvents(c, 10)
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	exp := []AlertEvent{
+		AlertEvent{time.Unix(3, 0), "a", false, "a ended"},
+		AlertEvent{time.Unix(1, 0), "a", true, "a msg"},
+	}
+	if len(events) != len(exp) {
+		t.Fatalf("Expected %v event(s); got %v", len(exp), events)
+	}
+	for i := range exp {
+		if !events[i].Time.Equal(exp[i].Time) || events[i].Id != exp[i].Id ||
+			events[i].Active != exp[i].Active || events[i].Msg != exp[i].Msg {
+			t.Errorf("Expected event %v to be %+v; got %+v", i, exp[i], events[i])
+		}
+	}
+}
+
+func TestThrottleAlerts(t *testing.T) {
+	var as alertState
+	a := conditionState{Id: "a", ActiveTime: time.Unix(1, 0)}
+	b := conditionState{Id: "b", ActiveTime: time.Unix(2, 0)}
+
+	check := func(now time.Time, start, end, expStart, expEnd []conditionState) {
+		ss, se := throttleAlerts(&as, start, end, now, 2)
+		if as, es := joinConditionStates(ss), joinConditionStates(expStart); as != es {
+			t.Errorf("Expected started %q at %v; got %q", es, now.Unix(), as)
+		}
+		if ae, ee := joinConditionStates(se), joinConditionStates(expEnd); ae != ee {
+			t.Errorf("Expected ended %q at %v; got %q", ee, now.Unix(), ae)
+		}
+	}
+
+	none := []conditionState{}
+	check(time.Unix(0, 0), []conditionState{a}, none, []conditionState{a}, none)
+	check(time.Unix(10, 0), none, none, none, none)
+	check(time.Unix(20, 0), none, []conditionState{a}, none, []conditionState{a})
+
+	// The limit has been reached, so the next changes should be withheld until
+	// an hour has passed since the first email.
+	check(time.Unix(30, 0), []conditionState{b}, none, none, none)
+	check(time.Unix(40, 0), []conditionState{a}, none, none, none)
+	check(time.Unix(3600, 0), none, none, []conditionState{a, b}, none)
+	if len(as.PendingStarted) != 0 || len(as.PendingEnded) != 0 {
+		t.Errorf("Pending conditions not cleared: %v %v", as.PendingStarted, as.PendingEnded)
+	}
+	if len(as.EmailTimes) != 2 {
+		t.Errorf("Expected 2 email times; got %v", as.EmailTimes)
+	}
+}
+
 func TestCreateAlertMessage(t *testing.T) {
 	const (
 		recipient = "recipiet@example.com"
@@ -224,20 +632,23 @@ func TestCreateAlertMessage(t *testing.T) {
 		cm        = "foo"
 	)
 
-	recipients := []string{recipient}
+	mc := &AlertMessageConfig{Sender: sender, Recipients: []string{recipient}}
 	empty := []conditionState{}
-	nonempty := []conditionState{conditionState{"", time.Time{}, cm}}
+	nonempty := []conditionState{conditionState{Msg: cm}}
 
-	if msg := createAlertMessage(sender, recipients, empty, empty, empty); msg != nil {
-		t.Errorf("Created unexpected message")
+	if msg, err := createAlertMessage(mc, empty, empty, empty); err != nil || msg != nil {
+		t.Errorf("Created unexpected message (err: %v)", err)
 	}
-	if msg := createAlertMessage(sender, recipients, empty, nonempty, empty); msg != nil {
-		t.Errorf("Created unexpected message")
+	if msg, err := createAlertMessage(mc, empty, nonempty, empty); err != nil || msg != nil {
+		t.Errorf("Created unexpected message (err: %v)", err)
 	}
 
-	checkMsg := func(start, cont, end []conditionState, body string) {
-		var msg *mail.Message
-		if msg = createAlertMessage(sender, recipients, start, cont, end); msg == nil {
+	checkMsg := func(start, cont, end []conditionState, subject, body string) {
+		msg, err := createAlertMessage(mc, start, cont, end)
+		if err != nil {
+			t.Errorf("Failed creating message: %v", err)
+			return
+		} else if msg == nil {
 			t.Errorf("Message wasn't created")
 			return
 		}
@@ -247,15 +658,58 @@ func TestCreateAlertMessage(t *testing.T) {
 		if strings.Join(msg.To, ",") != recipient {
 			t.Errorf("Expected recipient %q, got %q", recipient, strings.Join(msg.To, ","))
 		}
+		if msg.Subject != subject {
+			t.Errorf("Expected subject %q, got %q", subject, msg.Subject)
+		}
 		if msg.Body != body {
 			t.Errorf("Expected body %q, got %q", body, msg.Body)
 		}
 	}
 
-	checkMsg(nonempty, empty, empty, "New alerts:\nfoo")
-	checkMsg(empty, empty, nonempty, "Ended alerts:\nfoo")
-	checkMsg(nonempty, nonempty, empty, "New alerts:\nfoo\n\nContinuing alerts:\nfoo")
-	checkMsg(nonempty, nonempty, nonempty, "New alerts:\nfoo\n\nEnded alerts:\nfoo\n\nContinuing alerts:\nfoo")
+	const ds = defaultAlertSubject
+	checkMsg(nonempty, empty, empty, ds, "New alerts:\nfoo")
+	checkMsg(empty, empty, nonempty, ds, "Ended alerts:\nfoo")
+	checkMsg(nonempty, nonempty, empty, ds, "New alerts:\nfoo\n\nContinuing alerts:\nfoo")
+	checkMsg(nonempty, nonempty, nonempty, ds,
+		"New alerts:\nfoo\n\nEnded alerts:\nfoo\n\nContinuing alerts:\nfoo")
+
+	// The HTML body should list conditions in the same order as the plain-text
+	// body and escape their messages.
+	msg, err := createAlertMessage(mc,
+		[]conditionState{conditionState{Msg: "a < 5"}}, nonempty, []conditionState{conditionState{Msg: "b"}})
+	if err != nil {
+		t.Fatalf("Failed creating message: %v", err)
+	}
+	expHTML := `<table style="border-collapse:collapse;font-family:sans-serif">
+<tr><td style="color:#c62828;font-weight:bold;padding-right:1em">New</td><td>a &lt; 5</td></tr>
+<tr><td style="color:#2e7d32;font-weight:bold;padding-right:1em">Ended</td><td>b</td></tr>
+<tr><td style="color:#ef6c00;font-weight:bold;padding-right:1em">Continuing</td><td>foo</td></tr>
+</table>`
+	if msg.HTMLBody != expHTML {
+		t.Errorf("Expected HTML body %q, got %q", expHTML, msg.HTMLBody)
+	}
+
+	mc.SubjectTemplate = "[home] {{len .Started}} new alerts"
+	mc.BodyTemplate = "{{range .Started}}+{{.Msg}}\n{{end}}{{range .Ended}}-{{.Msg}}\n{{end}}"
+	if err := mc.CheckTemplates(); err != nil {
+		t.Errorf("Templates unexpectedly invalid: %v", err)
+	}
+	two := []conditionState{conditionState{Msg: "a"}, conditionState{Msg: "b"}}
+	checkMsg(two, empty, nonempty, "[home] 2 new alerts", "+a\n+b\n-foo\n")
+	if msg, err := createAlertMessage(mc, two, empty, nonempty); err != nil {
+		t.Errorf("Failed creating message: %v", err)
+	} else if msg.HTMLBody != "" {
+		t.Errorf("Got HTML body %q with custom body template", msg.HTMLBody)
+	}
+
+	mc.BodyTemplate = "{{.Bogus}}"
+	if _, err := createAlertMessage(mc, nonempty, empty, empty); err == nil {
+		t.Errorf("Didn't get expected error for bad body template")
+	}
+	mc.BodyTemplate = "{{range}}"
+	if err := mc.CheckTemplates(); err == nil {
+		t.Errorf("Didn't get expected error for unparseable template")
+	}
 }
 
 func joinConditionStates(states []conditionState) string {
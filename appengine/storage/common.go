@@ -4,7 +4,12 @@
 package storage
 
 import (
+	"context"
 	"time"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
 )
 
 const (
@@ -14,6 +19,16 @@ const (
 	// Datastore kinds for summary entities.
 	hourSummaryKind = "HourSummary"
 	daySummaryKind  = "DaySummary"
+
+	// App Engine imposes a limit of 500 entities per write operation.
+	maxEntitiesPerWrite = 500
+
+	// Maximum number of times that retryDatastoreOp will run an operation.
+	maxDatastoreAttempts = 3
+
+	// Delay before retrying a failed datastore operation. It's doubled after
+	// each failure.
+	datastoreRetryDelay = 100 * time.Millisecond
 )
 
 // summary contains information about a range of samples.
@@ -25,18 +40,67 @@ type summary struct {
 	Source string
 	Name   string
 
-	// NumValues contains the total count of summarized samples. It is only used
-	// to generate AvgValue.
-	NumValues int `datastore:"-"`
+	// NumValues contains the total count of summarized samples. It was not
+	// persisted before, so it is zero in summaries that were written by older
+	// versions of the code.
+	NumValues int `datastore:",noindex"`
 
 	// MinValue, MaxValue, and AvgValue contain the minimum, maximum, and
 	// average values from the summarized samples.
 	MinValue float32 `datastore:",noindex"`
 	MaxValue float32 `datastore:",noindex"`
 	AvgValue float32 `datastore:",noindex"`
+
+	// MinTime and MaxTime contain the timestamps of the (first) samples with
+	// MinValue and MaxValue. They are zero in summaries that were written
+	// before these fields were added.
+	MinTime time.Time `datastore:",noindex"`
+	MaxTime time.Time `datastore:",noindex"`
 }
 
 // getMsecSinceTime returns the number of elapsed milliseconds since t.
 func getMsecSinceTime(t time.Time) int64 {
 	return time.Now().Sub(t).Nanoseconds() / int64(time.Millisecond/time.Nanosecond)
 }
+
+// isTransientError returns true if err, returned by a datastore operation,
+// seems likely to go away if the operation is retried. appengine.MultiError
+// (returned by batch operations) is transient if any of its errors are.
+func isTransientError(err error) bool {
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, e := range me {
+			if e != nil && isTransientError(e) {
+				return true
+			}
+		}
+		return false
+	}
+	return appengine.IsTimeoutError(err) || err == datastore.ErrConcurrentTransaction
+}
+
+// logRetry logs that retryDatastoreOp is retrying the operation described by
+// desc after err. Tests replace it to run retryDatastoreOp without an App
+// Engine context.
+var logRetry = func(c context.Context, desc string, err error) {
+	log.Warningf(c, "Retrying %v after error: %v", desc, err)
+}
+
+// retryDatastoreOp runs f, retrying it with backoff if it returns a transient
+// error. desc describes the operation in log messages. The last error returned
+// by f is returned.
+func retryDatastoreOp(c context.Context, desc string, f func() error) error {
+	delay := datastoreRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !isTransientError(err) || attempt >= maxDatastoreAttempts {
+			return err
+		}
+		logRetry(c, desc, err)
+		select {
+		case <-time.After(delay):
+		case <-c.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"google.golang.org/appengine/v2"
 	"google.golang.org/appengine/v2/aetest"
 	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/memcache"
 )
 
 var testLoc *time.Location
@@ -33,15 +34,24 @@ func initTest() context.Context {
 	}
 	c := appengine.NewContext(req)
 
-	// Clear the datastore.
-	keys, err := datastore.NewQuery("").KeysOnly().GetAll(c, nil)
-	if err != nil {
-		panic(err)
+	// Clear the datastore, including namespaces used by tests.
+	for _, ns := range []string{"", "test"} {
+		nc, err := appengine.Namespace(c, ns)
+		if err != nil {
+			panic(err)
+		}
+		keys, err := datastore.NewQuery("").KeysOnly().GetAll(nc, nil)
+		if err != nil {
+			panic(err)
+		}
+		if err = datastore.DeleteMulti(nc, keys); err != nil {
+			panic(err)
+		}
 	}
-	if err = datastore.DeleteMulti(c, keys); err != nil {
+
+	if err := memcache.Flush(c); err != nil {
 		panic(err)
 	}
-
 	return c
 }
 
@@ -70,6 +80,66 @@ func checkSamples(t *testing.T, c context.Context, expected []common.Sample) {
 	}
 }
 
+func TestRetryDatastoreOp(t *testing.T) {
+	c := context.Background()
+	retries := 0
+	defer func(f func(context.Context, string, error)) { logRetry = f }(logRetry)
+	logRetry = func(context.Context, string, error) { retries++ }
+
+	// Transient errors should be retried.
+	calls := 0
+	if err := retryDatastoreOp(c, "op", func() error {
+		calls++
+		if calls < maxDatastoreAttempts {
+			return datastore.ErrConcurrentTransaction
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("Got error after transient failures: %v", err)
+	} else if retries != maxDatastoreAttempts-1 {
+		t.Errorf("Logged %v retries; expected %v", retries, maxDatastoreAttempts-1)
+	}
+
+	// Give up after too many attempts.
+	calls = 0
+	if err := retryDatastoreOp(c, "op", func() error {
+		calls++
+		return datastore.ErrConcurrentTransaction
+	}); err != datastore.ErrConcurrentTransaction {
+		t.Errorf("Got %v instead of transient error", err)
+	} else if calls != maxDatastoreAttempts {
+		t.Errorf("Operation ran %v time(s); expected %v", calls, maxDatastoreAttempts)
+	}
+
+	// Other errors shouldn't be retried.
+	calls = 0
+	if err := retryDatastoreOp(c, "op", func() error {
+		calls++
+		return datastore.ErrInvalidKey
+	}); err != datastore.ErrInvalidKey {
+		t.Errorf("Got %v instead of permanent error", err)
+	} else if calls != 1 {
+		t.Errorf("Operation ran %v time(s); expected 1", calls)
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{datastore.ErrConcurrentTransaction, true},
+		{datastore.ErrInvalidKey, false},
+		{appengine.MultiError{nil, datastore.ErrConcurrentTransaction}, true},
+		{appengine.MultiError{datastore.ErrNoSuchEntity, nil}, false},
+		{appengine.MultiError{nil, nil}, false},
+	} {
+		if got := isTransientError(tc.err); got != tc.transient {
+			t.Errorf("isTransientError(%v) = %v; expected %v", tc.err, got, tc.transient)
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	result := func() int {
 		var err error
@@ -0,0 +1,121 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+// DeleteOrphanedSummaries deletes hourly and daily summaries belonging to
+// series that no longer have any samples and whose newest summary starts
+// before cutoff, e.g. because the series was renamed or its sensor was
+// removed. Note that samples are also deleted by DeleteSummarizedSamples, so
+// cutoff should be old enough that series that are only temporarily failing
+// to report samples aren't included.
+//
+// The "source|name" strings of the orphaned series are returned in sorted
+// order. If dryRun is true, nothing is deleted.
+func DeleteOrphanedSummaries(c context.Context, cutoff time.Time, dryRun bool) ([]string, error) {
+	series, err := getSummarizedSeries(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphaned []string
+	for _, sn := range series {
+		parts := strings.SplitN(sn, "|", 2)
+		keys, err := datastore.NewQuery(sampleKind).KeysOnly().
+			Filter("Source =", parts[0]).Filter("Name =", parts[1]).Limit(1).GetAll(c, nil)
+		if err != nil {
+			return nil, err
+		} else if len(keys) > 0 {
+			continue
+		}
+		if newest, err := getNewestSummaryTime(c, parts[0], parts[1]); err != nil {
+			return nil, err
+		} else if !newest.Before(cutoff) {
+			continue
+		}
+
+		orphaned = append(orphaned, sn)
+		if dryRun {
+			continue
+		}
+		log.Debugf(c, "Deleting summaries for %v", sn)
+		for _, kind := range []string{hourSummaryKind, daySummaryKind} {
+			if err := deleteSeriesEntities(c, kind, parts[0], parts[1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return orphaned, nil
+}
+
+// getSummarizedSeries returns the sorted "source|name" strings of all series
+// with hourly or daily summaries.
+func getSummarizedSeries(c context.Context) ([]string, error) {
+	seen := make(map[string]struct{})
+	for _, kind := range []string{hourSummaryKind, daySummaryKind} {
+		// Use a distinct projection to avoid reading every summary's key.
+		var sums []summary
+		if _, err := datastore.NewQuery(kind).Project("Name", "Source").Distinct().
+			GetAll(c, &sums); err != nil {
+			return nil, err
+		}
+		for _, s := range sums {
+			seen[s.Source+"|"+s.Name] = struct{}{}
+		}
+	}
+
+	series := make([]string, 0, len(seen))
+	for sn := range seen {
+		series = append(series, sn)
+	}
+	sort.Strings(series)
+	return series, nil
+}
+
+// getNewestSummaryTime returns the start time of the newest hourly or daily
+// summary belonging to the supplied series.
+func getNewestSummaryTime(c context.Context, source, name string) (time.Time, error) {
+	var newest time.Time
+	for _, kind := range []string{hourSummaryKind, daySummaryKind} {
+		var sums []summary
+		if _, err := datastore.NewQuery(kind).Filter("Source =", source).
+			Filter("Name =", name).Order("-Timestamp").Limit(1).GetAll(c, &sums); err != nil {
+			return time.Time{}, err
+		}
+		if len(sums) > 0 && sums[0].Timestamp.After(newest) {
+			newest = sums[0].Timestamp
+		}
+	}
+	return newest, nil
+}
+
+// deleteSeriesEntities deletes all entities of the supplied kind belonging to
+// a series in batches.
+func deleteSeriesEntities(c context.Context, kind, source, name string) error {
+	q := getSeriesBatchQuery(kind, source, name).KeysOnly()
+	for {
+		keys, err := q.GetAll(c, nil)
+		if err != nil {
+			return err
+		} else if len(keys) == 0 {
+			return nil
+		}
+		log.Debugf(c, "Deleting %v %v entities", len(keys), kind)
+		if err := datastore.DeleteMulti(c, keys); err != nil {
+			return err
+		}
+		if len(keys) < summaryDeleteBatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/derat/home/common"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+func TestDeleteOrphanedSummaries(t *testing.T) {
+	c := initTest()
+
+	s0 := common.Sample{lt(2017, 1, 1, 0, 0, 0), "a", "b", 1.0}
+	s1 := common.Sample{lt(2017, 1, 1, 0, 0, 0), "a", "c", 2.0}
+	if err := WriteSamples(c, []common.Sample{s0, s1}, nil); err != nil {
+		t.Fatalf("Failed to insert samples: %v", err)
+	}
+	if err := GenerateSummaries(c, lt(2017, 1, 3, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+	if err := datastore.Delete(c, datastore.NewKey(c, sampleKind, getSampleId(&s1), 0, nil)); err != nil {
+		t.Fatalf("Failed to delete sample: %v", err)
+	}
+
+	hourSums := []summary{
+		newSummary(lt(2017, 1, 1, 0, 0, 0), "a", "b", 1.0, 1.0, 1.0),
+		newSummary(lt(2017, 1, 1, 0, 0, 0), "a", "c", 2.0, 2.0, 2.0),
+	}
+	daySums := []summary{
+		newSummary(ld(2017, 1, 1), "a", "b", 1.0, 1.0, 1.0),
+		newSummary(ld(2017, 1, 1), "a", "c", 2.0, 2.0, 2.0),
+	}
+
+	// Series that were summarized recently shouldn't be considered orphaned.
+	if act, err := DeleteOrphanedSummaries(c, lt(2017, 1, 1, 0, 0, 0), true); err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	} else if len(act) != 0 {
+		t.Errorf("Dry run returned %q; expected nothing", act)
+	}
+
+	// A dry run should report the orphaned series without deleting anything.
+	cutoff := lt(2017, 1, 2, 0, 0, 0)
+	exp := []string{"a|c"}
+	if act, err := DeleteOrphanedSummaries(c, cutoff, true); err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	} else if !reflect.DeepEqual(act, exp) {
+		t.Errorf("Dry run returned %q; expected %q", act, exp)
+	}
+	checkSummaries(t, c, hourSummaryKind, hourSums)
+	checkSummaries(t, c, daySummaryKind, daySums)
+
+	if act, err := DeleteOrphanedSummaries(c, cutoff, false); err != nil {
+		t.Fatalf("Deleting orphaned summaries failed: %v", err)
+	} else if !reflect.DeepEqual(act, exp) {
+		t.Errorf("Deletion returned %q; expected %q", act, exp)
+	}
+	checkSummaries(t, c, hourSummaryKind, hourSums[:1])
+	checkSummaries(t, c, daySummaryKind, daySums[:1])
+	checkSamples(t, c, []common.Sample{s0})
+}
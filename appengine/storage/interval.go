@@ -0,0 +1,109 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derat/home/common"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+const (
+	// Number of recent samples used to estimate a series's interval.
+	intervalEstimateSamples = 20
+
+	// Expiration for estimated intervals cached in memcache.
+	intervalCacheExpiration = time.Hour
+	intervalCacheKeyPrefix  = "interval|"
+)
+
+// medianInterval returns the median gap between consecutive elements of times,
+// which must be sorted (in either direction). 0 is returned if fewer than two
+// times are supplied.
+func medianInterval(times []time.Time) time.Duration {
+	if len(times) < 2 {
+		return 0
+	}
+	gaps := make([]time.Duration, len(times)-1)
+	for i := range gaps {
+		gaps[i] = times[i+1].Sub(times[i])
+		if gaps[i] < 0 {
+			gaps[i] = -gaps[i]
+		}
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+	n := len(gaps)
+	if n%2 == 1 {
+		return gaps[n/2]
+	}
+	return (gaps[n/2-1] + gaps[n/2]) / 2
+}
+
+// EstimateSampleInterval estimates the typical interval between samples in
+// the series described by sourceNames ("source|name" strings) using the
+// median gap between each series's most-recent samples. The smallest
+// per-series estimate is returned, or 0 if no series has enough samples.
+// Estimates are cached in memcache.
+func EstimateSampleInterval(c context.Context, sourceNames []string) (time.Duration, error) {
+	var min time.Duration
+	for _, sn := range sourceNames {
+		parts := strings.Split(sn, "|")
+		if len(parts) != 2 {
+			return 0, fmt.Errorf("Invalid 'source|name' string %q", sn)
+		}
+		d, err := estimateSeriesInterval(c, parts[0], parts[1])
+		if err != nil {
+			return 0, err
+		}
+		if d > 0 && (min == 0 || d < min) {
+			min = d
+		}
+	}
+	return min, nil
+}
+
+// estimateSeriesInterval returns the estimated interval for a single series.
+// See EstimateSampleInterval.
+func estimateSeriesInterval(c context.Context, source, name string) (time.Duration, error) {
+	key := intervalCacheKeyPrefix + source + "|" + name
+	if item, err := memcache.Get(c, key); err == nil {
+		if ns, err := strconv.ParseInt(string(item.Value), 10, 64); err == nil {
+			return time.Duration(ns), nil
+		}
+		log.Warningf(c, "Ignoring bad cached interval %q for %v", item.Value, key)
+	} else if err != memcache.ErrCacheMiss {
+		log.Warningf(c, "Failed to get cached interval for %v: %v", key, err)
+	}
+
+	q := datastore.NewQuery(sampleKind).Filter("Source =", source).Filter("Name =", name).
+		Order("-Timestamp").Limit(intervalEstimateSamples)
+	var samples []common.Sample
+	if _, err := q.GetAll(c, &samples); err != nil {
+		return 0, err
+	}
+	times := make([]time.Time, len(samples))
+	for i, s := range samples {
+		times[i] = s.Timestamp
+	}
+	d := medianInterval(times)
+	if d > 0 {
+		if err := memcache.Set(c, &memcache.Item{
+			Key:        key,
+			Value:      []byte(strconv.FormatInt(int64(d), 10)),
+			Expiration: intervalCacheExpiration,
+		}); err != nil {
+			log.Warningf(c, "Failed to cache interval for %v: %v", key, err)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/derat/home/common"
+)
+
+func TestMedianInterval(t *testing.T) {
+	ts := func(secs ...int64) []time.Time {
+		times := make([]time.Time, len(secs))
+		for i, s := range secs {
+			times[i] = time.Unix(s, 0)
+		}
+		return times
+	}
+	for _, tc := range []struct {
+		times []time.Time
+		exp   time.Duration
+	}{
+		{ts(), 0},
+		{ts(10), 0},
+		{ts(10, 70), time.Minute},
+		{ts(300, 240, 180, 120), time.Minute},
+		// A single long gap (e.g. an outage) shouldn't affect the estimate.
+		{ts(0, 60, 120, 3600, 3660), time.Minute},
+		{ts(0, 10, 30, 60), 20 * time.Second},
+	} {
+		if act := medianInterval(tc.times); act != tc.exp {
+			t.Errorf("medianInterval(%v) = %v; want %v", tc.times, act, tc.exp)
+		}
+	}
+}
+
+func TestEstimateSampleInterval(t *testing.T) {
+	c := initTest()
+	var samples []common.Sample
+	start := lt(2015, 7, 1, 0, 0, 0)
+	for i := 0; i < 2*intervalEstimateSamples; i++ {
+		ts := start.Add(time.Duration(i) * time.Minute)
+		samples = append(samples, common.Sample{ts, "a", "fast", 1.0})
+		if i%5 == 0 {
+			samples = append(samples, common.Sample{ts, "a", "slow", 1.0})
+		}
+	}
+	samples = append(samples, common.Sample{start, "a", "single", 1.0})
+	if err := WriteSamples(c, samples, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+
+	for _, tc := range []struct {
+		sourceNames []string
+		exp         time.Duration
+	}{
+		{[]string{"a|slow"}, 5 * time.Minute},
+		{[]string{"a|fast"}, time.Minute},
+		{[]string{"a|slow", "a|fast"}, time.Minute},
+		{[]string{"a|single", "a|missing"}, 0},
+		{[]string{"a|single", "a|slow"}, 5 * time.Minute},
+	} {
+		// Check twice to exercise the cache.
+		for i := 0; i < 2; i++ {
+			if act, err := EstimateSampleInterval(c, tc.sourceNames); err != nil {
+				t.Errorf("EstimateSampleInterval(%v) failed: %v", tc.sourceNames, err)
+			} else if act != tc.exp {
+				t.Errorf("EstimateSampleInterval(%v) = %v; want %v", tc.sourceNames, act, tc.exp)
+			}
+		}
+	}
+	if _, err := EstimateSampleInterval(c, []string{"bogus"}); err == nil {
+		t.Errorf("EstimateSampleInterval unexpectedly succeeded for bad series")
+	}
+
+	// The estimate should be usable for choosing the query's granularity: three
+	// days of five-minute samples should be hourly, while a single day of them
+	// should be individual samples.
+	interval, _ := EstimateSampleInterval(c, []string{"a|slow"})
+	qp := QueryParams{Start: start, End: start.Add(3 * 24 * time.Hour)}
+	qp.UpdateGranularityAndAggregation(interval, time.Time{})
+	if qp.Granularity != HourlyAverage {
+		t.Errorf("Three-day query has granularity %v; want %v", qp.Granularity, HourlyAverage)
+	}
+	qp.End = start.Add(24 * time.Hour)
+	qp.UpdateGranularityAndAggregation(interval, time.Time{})
+	if qp.Granularity != IndividualSample {
+		t.Errorf("Day-long query has granularity %v; want %v", qp.Granularity, IndividualSample)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/derat/home/common"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+const (
+	// Datastore kind for entities recording used nonces. Entity IDs are the
+	// nonces themselves.
+	reportNonceKind = "ReportNonce"
+
+	// Maximum number of expired nonces to delete in each batch.
+	nonceDeleteBatchSize = 500
+)
+
+var (
+	// ErrStaleNonce is returned by CheckReportNonce for nonces that are
+	// malformed or contain times too far from the current time.
+	ErrStaleNonce = errors.New("stale nonce")
+
+	// ErrReusedNonce is returned by CheckReportNonce for nonces that were
+	// already used.
+	ErrReusedNonce = errors.New("reused nonce")
+)
+
+// reportNonce records the use of a nonce.
+type reportNonce struct {
+	// Expiration contains the time after which the nonce is stale and can be
+	// deleted by DeleteExpiredNonces.
+	Expiration time.Time
+}
+
+// CheckReportNonce records that nonce, created by common.NewReportNonce, has
+// been used. ErrStaleNonce is returned if nonce's time is more than window
+// away from now, and ErrReusedNonce is returned if nonce was already used.
+// Other errors indicate that the nonce couldn't be checked.
+//
+// Nonces are stored in datastore, since a captured report could be replayed
+// after its nonce was evicted from memcache. Memcache is only used to reject
+// reused nonces without a datastore transaction.
+func CheckReportNonce(c context.Context, nonce string, now time.Time, window time.Duration) error {
+	ts, err := common.ParseReportNonce(nonce)
+	if err != nil {
+		return ErrStaleNonce
+	}
+	if d := now.Sub(ts); d > window || d < -window {
+		return ErrStaleNonce
+	}
+
+	// Keep the nonce until its time is outside of the window.
+	exp := ts.Add(window).Add(time.Second)
+	item := &memcache.Item{
+		Key:        "nonce|" + nonce,
+		Value:      []byte{},
+		Expiration: exp.Sub(now),
+	}
+	if err := memcache.Add(c, item); err == memcache.ErrNotStored {
+		return ErrReusedNonce
+	} else if err != nil {
+		log.Warningf(c, "Failed to cache nonce: %v", err)
+	}
+
+	k := datastore.NewKey(c, reportNonceKind, nonce, 0, nil)
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		var rn reportNonce
+		if err := datastore.Get(tc, k, &rn); err == nil {
+			return ErrReusedNonce
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err := datastore.Put(tc, k, &reportNonce{exp})
+		return err
+	}, nil)
+}
+
+// DeleteExpiredNonces deletes nonces recorded by CheckReportNonce whose times
+// were more than their windows before now.
+func DeleteExpiredNonces(c context.Context, now time.Time) error {
+	q := datastore.NewQuery(reportNonceKind).KeysOnly().Filter("Expiration <", now).
+		Limit(nonceDeleteBatchSize)
+	for {
+		keys, err := q.GetAll(c, nil)
+		if err != nil {
+			return err
+		} else if len(keys) == 0 {
+			return nil
+		}
+		log.Debugf(c, "Deleting %v expired nonce(s)", len(keys))
+		if err := datastore.DeleteMulti(c, keys); err != nil {
+			return err
+		}
+		if len(keys) < nonceDeleteBatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/derat/home/common"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+func TestCheckReportNonce(t *testing.T) {
+	c := initTest()
+
+	now := time.Now()
+	const window = time.Minute
+	n := common.NewReportNonce(now)
+	if err := CheckReportNonce(c, n, now, window); err != nil {
+		t.Errorf("First use of nonce failed: %v", err)
+	}
+	if err := CheckReportNonce(c, n, now, window); err != ErrReusedNonce {
+		t.Errorf("Reused nonce returned %v", err)
+	}
+
+	// The nonce should still be rejected after it's evicted from memcache.
+	if err := memcache.Flush(c); err != nil {
+		t.Fatalf("Failed flushing memcache: %v", err)
+	}
+	if err := CheckReportNonce(c, n, now, window); err != ErrReusedNonce {
+		t.Errorf("Reused nonce returned %v after flushing memcache", err)
+	}
+
+	for _, n := range []string{
+		common.NewReportNonce(now.Add(-2 * window)),
+		common.NewReportNonce(now.Add(2 * window)),
+		"bogus",
+	} {
+		if err := CheckReportNonce(c, n, now, window); err != ErrStaleNonce {
+			t.Errorf("Nonce %q returned %v", n, err)
+		}
+	}
+}
+
+func TestDeleteExpiredNonces(t *testing.T) {
+	c := initTest()
+
+	now := time.Now()
+	const window = time.Minute
+	n0 := common.NewReportNonce(now)
+	n1 := common.NewReportNonce(now.Add(window))
+	for _, n := range []string{n0, n1} {
+		if err := CheckReportNonce(c, n, now, window); err != nil {
+			t.Fatalf("First use of nonce %q failed: %v", n, err)
+		}
+	}
+
+	// Only the first nonce should be deleted.
+	if err := DeleteExpiredNonces(c, now.Add(window+time.Minute)); err != nil {
+		t.Fatalf("Failed deleting expired nonces: %v", err)
+	}
+	keys, err := datastore.NewQuery(reportNonceKind).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		t.Fatalf("Failed querying nonces: %v", err)
+	}
+	if len(keys) != 1 || keys[0].StringID() != n1 {
+		t.Errorf("Got nonce keys %v; expected only %q", keys, n1)
+	}
+}
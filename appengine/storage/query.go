@@ -5,6 +5,8 @@ package storage
 
 import (
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
@@ -37,6 +39,83 @@ const (
 	DailyAverage
 )
 
+// String returns the name used for g in configs and URLs.
+func (g QueryGranularity) String() string {
+	switch g {
+	case IndividualSample:
+		return "sample"
+	case HourlyAverage:
+		return "hour"
+	case DailyAverage:
+		return "day"
+	default:
+		return fmt.Sprintf("QueryGranularity(%d)", int(g))
+	}
+}
+
+// ParseQueryGranularity parses a granularity name ("sample", "hour", or "day")
+// as returned by QueryGranularity.String.
+func ParseQueryGranularity(s string) (QueryGranularity, error) {
+	for _, g := range []QueryGranularity{IndividualSample, HourlyAverage, DailyAverage} {
+		if s == g.String() {
+			return g, nil
+		}
+	}
+	return IndividualSample, fmt.Errorf("Invalid granularity %q", s)
+}
+
+// QueryExpr describes a line computed by combining the values of two of a
+// query's other lines. Values are only combined when both lines have values at
+// the same timestamp (after aggregation and filling but before smoothing), so
+// lines whose samples are reported at different times may need to be aligned
+// using QueryParams.MaxGap. The computed value is NaN otherwise.
+type QueryExpr struct {
+	// Label contains a human-readable label for the computed line.
+	Label string
+
+	// Op contains the operation to perform: "add", "sub", "mul", or "div".
+	Op string
+
+	// A and B contain the indexes into QueryParams.SourceNames of the lines
+	// to combine, e.g. A-B for "sub".
+	A, B int
+}
+
+// ParseQueryExpr parses a string of the form "label:op:a:b" (e.g.
+// "Difference:sub:0:1") into a QueryExpr.
+func ParseQueryExpr(s string) (QueryExpr, error) {
+	var e QueryExpr
+	parts := strings.Split(s, ":")
+	if len(parts) != 4 {
+		return e, fmt.Errorf("Expected 4 parts in expression %q", s)
+	}
+	e.Label, e.Op = parts[0], parts[1]
+	var err error
+	if e.A, err = strconv.Atoi(parts[2]); err != nil {
+		return e, fmt.Errorf("Bad first line in expression %q", s)
+	}
+	if e.B, err = strconv.Atoi(parts[3]); err != nil {
+		return e, fmt.Errorf("Bad second line in expression %q", s)
+	}
+	if _, ok := exprOps[e.Op]; !ok {
+		return e, fmt.Errorf("Invalid operation %q in expression %q", e.Op, s)
+	}
+	return e, nil
+}
+
+// exprOps maps from QueryExpr.Op values to functions implementing them.
+var exprOps = map[string]func(a, b float32) float32{
+	"add": func(a, b float32) float32 { return a + b },
+	"sub": func(a, b float32) float32 { return a - b },
+	"mul": func(a, b float32) float32 { return a * b },
+	"div": func(a, b float32) float32 {
+		if b == 0 {
+			return float32(math.NaN())
+		}
+		return a / b
+	},
+}
+
 // QueryParams describes a query to be performed.
 type QueryParams struct {
 	// Labels contains human-readable labels for lines.
@@ -53,9 +132,82 @@ type QueryParams struct {
 	// Granularity describes the type of points to use.
 	Granularity QueryGranularity
 
-	// Aggregation describes how many sequential points to average together for
-	// each returned point. It has no effect if less than or equal to 1.
+	// DayStartHour is the hour in Start's location at which daily summaries
+	// start. It must match the value passed to GenerateSummaries.
+	DayStartHour int
+
+	// Aggregation describes how many sequential points to combine for each
+	// returned point. It has no effect if less than or equal to 1.
 	Aggregation int
+
+	// AlignPeriod, if positive, aligns aggregated points to clock boundaries.
+	// Instead of combining fixed numbers of sequential points as described by
+	// Aggregation (in which case the points' boundaries depend on the query's
+	// start), points are grouped into periods of this length (e.g. every five
+	// minutes starting on the hour) and each combined point is reported at the
+	// start of its period. Aggregation is ignored. Periods are aligned relative
+	// to UTC, so e.g. daily periods may not start at local midnight.
+	AlignPeriod time.Duration
+
+	// Reducer describes how aggregated points are combined.
+	Reducer QueryReducer
+
+	// MaxGap enables forward-filling of missing values when positive: a line
+	// without a value at a timestamp reuses its previous value if it was seen
+	// at most MaxGap earlier. This keeps stacked graphs continuous but is
+	// misleading for some metrics. It is applied after aggregation and before
+	// smoothing.
+	MaxGap time.Duration
+
+	// If non-zero, only rows with timestamps at or after Since are returned.
+	// This lets clients that are polling for new data request only the rows
+	// that they don't already have: DataTable output includes a "maxTimestamp"
+	// property containing the latest row's timestamp (or Since, if there are
+	// no rows) that can be supplied as Since in the next query. The row at
+	// Since is returned again since its value may have changed (e.g. if it
+	// summarizes a partial period), so clients should replace their existing
+	// row with the same timestamp.
+	Since time.Time
+
+	// Exprs describes additional lines computed from the queried lines. They
+	// appear after all other lines (including count lines).
+	Exprs []QueryExpr
+
+	// Smooth describes the number of returned points to include in a moving
+	// average that replaces each line's values. It is applied after
+	// aggregation and has no effect if less than or equal to 1. Missing values
+	// remain missing, and averages don't span them. Count lines (see Counts)
+	// aren't smoothed.
+	Smooth int
+
+	// Extremes indicates that the minimum and maximum values of each line
+	// across the queried range (before aggregation) and the times at which
+	// they occurred should be included in the output.
+	Extremes bool
+
+	// Counts indicates that DataTable output for hourly or daily summaries
+	// should include an additional column for each line (after all of the
+	// lines' value columns) containing the number of samples that were
+	// summarized for each point. Older summaries report 0.
+	Counts bool
+
+	// ValuesOnly indicates that a compact JSON array containing only the
+	// values of a single line (with null for missing values) should be
+	// written instead of a DataTable. SourceNames must contain a single line.
+	ValuesOnly bool
+
+	// Rows indicates that a JSON object containing the lines' labels and
+	// their values should be written instead of a DataTable, e.g.
+	// {"labels":["A","B"],"rows":[[1500000000,1.5,null],...]}. Each row
+	// contains its Unix timestamp followed by the lines' values, with null
+	// for missing values.
+	Rows bool
+
+	// CSV indicates that CSV data should be written instead of a DataTable.
+	// The header row contains "time" followed by the lines' labels. Times
+	// are formatted as RFC 3339 timestamps in Start's location, and missing
+	// values are left empty.
+	CSV bool
 }
 
 // UpdateGranularityAndAggregation updates the Granularity and Aggregation
@@ -93,105 +245,464 @@ func (qp *QueryParams) UpdateGranularityAndAggregation(
 	}
 }
 
+// SetGranularity sets the Granularity field to g and updates Aggregation to
+// limit the number of returned points. sampleInterval is the typical interval
+// between samples; if zero, individual samples are never aggregated.
+func (qp *QueryParams) SetGranularity(g QueryGranularity, sampleInterval time.Duration) {
+	var pointInterval time.Duration
+	switch g {
+	case IndividualSample:
+		pointInterval = sampleInterval
+	case HourlyAverage:
+		pointInterval = time.Hour
+	case DailyAverage:
+		pointInterval = 24 * time.Hour
+	}
+
+	qp.Granularity = g
+	qp.Aggregation = 1
+	if pointInterval > 0 {
+		if count := int(qp.End.Sub(qp.Start) / pointInterval); count > maxQueryPoints {
+			qp.Aggregation = count / maxQueryPoints
+		}
+	}
+}
+
 // runQuery runs the query described by qp synchronously and writes a Google
 // Chart API DataTable object to w.
 func DoQuery(c context.Context, w io.Writer, qp QueryParams) error {
+	out, extremes, _, err := startQuery(c, &qp, false)
+	if err != nil {
+		return err
+	}
+	if qp.ValuesOnly {
+		return writeValuesOutput(w, out)
+	}
+	if qp.Rows {
+		return writeRowsOutput(w, qp.Labels, out)
+	}
+	if qp.CSV {
+		return writeCSVOutput(w, qp.Labels, qp.Start.Location(), out)
+	}
+	if !qp.Extremes {
+		extremes = nil
+	}
+	return writeQueryOutput(w, &qp, out, extremes)
+}
+
+// RunQuery runs the query described by qp synchronously and passes each
+// timestamp's values to fn in ascending order. Missing values are NaN, and
+// trailing NaN values may be omitted. Output-related fields in qp are ignored.
+//
+// If ranges is true and qp.Granularity isn't IndividualSample, the minimum and
+// maximum values summarized by each line's points are also returned.
+func RunQuery(c context.Context, qp QueryParams, ranges bool,
+	fn func(t time.Time, values []float32)) ([][]ValueRange, error) {
+	qp.Counts = false
+	out, _, rngs, err := startQuery(c, &qp, ranges)
+	if err != nil {
+		return nil, err
+	}
+	for td := range out {
+		if td.err != nil {
+			return nil, td.err
+		}
+		fn(td.timestamp, td.values)
+	}
+	return rngs, nil
+}
+
+// startQuery starts running the query described by qp and returns a channel
+// that will receive its data. qp.Labels is updated to describe the data's
+// lines. The returned extremes and ranges (if withRanges is true) must not be
+// read until the channel has been closed.
+func startQuery(c context.Context, qp *QueryParams, withRanges bool) (
+	chan timeData, []lineExtremes, [][]ValueRange, error) {
 	if len(qp.Labels) != len(qp.SourceNames) {
-		return fmt.Errorf("Different numbers of labels and sourcenames")
+		return nil, nil, nil, fmt.Errorf("Different numbers of labels and sourcenames")
+	}
+	if qp.ValuesOnly && len(qp.SourceNames) != 1 {
+		return nil, nil, nil, fmt.Errorf("Values-only queries require a single line")
+	}
+	for _, e := range qp.Exprs {
+		if _, ok := exprOps[e.Op]; !ok {
+			return nil, nil, nil, fmt.Errorf("Invalid expression operation %q", e.Op)
+		}
+		if e.A < 0 || e.A >= len(qp.SourceNames) || e.B < 0 || e.B >= len(qp.SourceNames) {
+			return nil, nil, nil, fmt.Errorf("Expression %q refers to nonexistent line", e.Label)
+		}
 	}
 
+	// Summaries' timestamps contain the starts of the summarized periods, so
+	// move the query's start back to include a partial first period. Daily
+	// summaries start at a local hour (usually midnight), which isn't
+	// necessarily a multiple of 24 hours away from other days' starts due to
+	// DST.
 	kind := sampleKind
+	start := qp.Start
+	loc := qp.Start.Location()
 	if qp.Granularity == HourlyAverage {
 		kind = hourSummaryKind
+		start = start.Truncate(time.Hour)
 	} else if qp.Granularity == DailyAverage {
 		kind = daySummaryKind
+		start = getDayStart(start, loc, qp.DayStartHour)
+	}
+
+	// Combines aggregated points. Daily summaries' timestamps are averaged
+	// using wall-clock time so that e.g. the middle of three days is always
+	// reported at midnight.
+	reducer := qp.Reducer.reducer()
+	reduce := func(points []point) point {
+		p := reducer(points)
+		if qp.Granularity == DailyAverage && len(points) > 1 {
+			p.timestamp = wallClockMidpoint(points[0].timestamp, points[len(points)-1].timestamp, loc)
+		}
+		return p
+	}
+
+	// Individual samples before Since don't need to be read unless they affect
+	// later rows.
+	if qp.Granularity == IndividualSample && qp.Aggregation <= 1 && qp.AlignPeriod <= 0 &&
+		qp.Smooth <= 1 && qp.MaxGap <= 0 && qp.Since.After(start) {
+		start = qp.Since
 	}
 
 	baseQuery := datastore.NewQuery(kind).Limit(maxQueryDatastoreResults).Order("Timestamp")
-	baseQuery = baseQuery.Filter("Timestamp >=", qp.Start).Filter("Timestamp <=", qp.End)
+	baseQuery = baseQuery.Filter("Timestamp >=", start).Filter("Timestamp <=", qp.End)
+	now := time.Now()
+
+	// Days after the last fully-summarized one may be missing summaries (or
+	// have stale ones, since they're only regenerated when summarization
+	// runs), so they're summarized from samples on the fly instead. rawStart
+	// is the start of the first such period, or zero if the query doesn't
+	// include any.
+	var rawStart time.Time
+	var periodStart func(t time.Time) time.Time
+	if qp.Granularity == HourlyAverage || qp.Granularity == DailyAverage {
+		lfd, err := getSummaryLastFullDay(c)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		rawStart = start
+		if !lfd.IsZero() {
+			lfd = lfd.In(loc)
+			d := addDays(lfd, 1, qp.DayStartHour)
+			if qp.Granularity == HourlyAverage {
+				d = d.Truncate(time.Hour)
+			}
+			if d.After(start) {
+				rawStart = d
+			}
+		}
+		if rawStart.After(qp.End) {
+			rawStart = time.Time{}
+		} else {
+			baseQuery = baseQuery.Filter("Timestamp <", rawStart)
+		}
+		if qp.Granularity == HourlyAverage {
+			periodStart = func(t time.Time) time.Time { return t.Truncate(time.Hour) }
+		} else {
+			periodStart = func(t time.Time) time.Time { return getDayStart(t, loc, qp.DayStartHour) }
+		}
+	}
 
 	chans := make([]chan point, len(qp.SourceNames))
+	extremes := make([]lineExtremes, len(qp.SourceNames))
+
+	// Per-line channels receiving summaries' sample counts.
+	var countChans []chan point
+	if qp.Counts && qp.Granularity != IndividualSample && !qp.ValuesOnly {
+		countChans = make([]chan point, len(qp.SourceNames))
+		for i := range countChans {
+			countChans[i] = make(chan point)
+		}
+	}
+
+	var ranges [][]ValueRange
+	if withRanges && qp.Granularity != IndividualSample {
+		ranges = make([][]ValueRange, len(qp.SourceNames))
+	}
 	for i, sn := range qp.SourceNames {
 		chans[i] = make(chan point)
 		parts := strings.Split(sn, "|")
 		if len(parts) != 2 {
-			return fmt.Errorf("Invalid 'source|name' string %q", sn)
+			return nil, nil, nil, fmt.Errorf("Invalid 'source|name' string %q", sn)
 		}
-		q := baseQuery.Filter("Source =", parts[0]).Filter("Name =", parts[1])
 
-		go func(q *datastore.Query, ch chan point) {
-			var s interface{}
-			var mp func(s interface{}) point
+		var rng *[]ValueRange
+		if ranges != nil {
+			rng = &ranges[i]
+		}
+		var countCh chan point
+		if countChans != nil {
+			countCh = countChans[i]
+		}
+
+		go func(source, name string, ch chan point, ext *lineExtremes, rng *[]ValueRange,
+			countCh chan point) {
+			// Minimum and maximum values and the total number of samples of the
+			// summaries returned by next since the last point was sent.
+			var curMin, curMax float32
+			var curCount int
+			var hasCur bool
+
+			// Summary corresponding to the last point returned by next. It's
+			// added to curMin, curMax, and curCount by track, which is called
+			// after any previously-returned points have been sent.
+			var last *summary
+			track := func() {
+				if last == nil {
+					return
+				}
+				if !hasCur || last.MinValue < curMin {
+					curMin = last.MinValue
+				}
+				if !hasCur || last.MaxValue > curMax {
+					curMax = last.MaxValue
+				}
+				curCount += last.NumValues
+				hasCur = true
+				last = nil
+			}
 
+			// next returns the line's next point, or datastore.Done.
+			var next func() (point, error)
 			if qp.Granularity == IndividualSample {
-				s = &common.Sample{}
-				mp = func(s interface{}) point {
-					return point{s.(*common.Sample).Timestamp, s.(*common.Sample).Value, nil}
+				points, err := getSamplePoints(c, source, name, start, qp.End, now,
+					maxQueryDatastoreResults)
+				next = func() (point, error) {
+					if err != nil {
+						return point{}, err
+					} else if len(points) == 0 {
+						return point{}, datastore.Done
+					}
+					p := points[0]
+					points = points[1:]
+					ext.update(p, p)
+					return p, nil
 				}
 			} else {
-				s = &summary{}
-				mp = func(s interface{}) point {
-					return point{s.(*summary).Timestamp, s.(*summary).AvgValue, nil}
+				it := baseQuery.Filter("Source =", source).Filter("Name =", name).Run(c)
+				var raw []summary // summaries generated from samples
+				var rawRead bool
+				next = func() (point, error) {
+					var s summary
+					if _, err := it.Next(&s); err == datastore.Done && !rawStart.IsZero() {
+						if !rawRead {
+							// All of the samples need to be read to avoid
+							// omitting the query's most-recent periods.
+							points, err := getSamplePoints(c, source, name, rawStart, qp.End, now, 0)
+							if err != nil {
+								return point{}, err
+							}
+							raw = summarizePoints(source, name, points, periodStart)
+							rawRead = true
+						}
+						if len(raw) == 0 {
+							return point{}, datastore.Done
+						}
+						s = raw[0]
+						raw = raw[1:]
+					} else if err != nil {
+						return point{}, err
+					}
+					ext.update(summaryExtreme(s.MinTime, s.Timestamp, s.MinValue),
+						summaryExtreme(s.MaxTime, s.Timestamp, s.MaxValue))
+					last = &s
+					return point{s.Timestamp, s.AvgValue, nil}, nil
+				}
+			}
+
+			// send sends p to ch, first recording the range of values that it
+			// summarizes if requested. If requested, the number of summarized
+			// samples is then sent to countCh.
+			send := func(p point) {
+				if rng != nil && hasCur {
+					*rng = append(*rng, ValueRange{p.timestamp, curMin, curMax})
+				}
+				count := curCount
+				hasCur = false
+				curCount = 0
+				ch <- p
+				if countCh != nil {
+					countCh <- point{p.timestamp, float32(count), nil}
 				}
 			}
 
 			var points []point
-			if qp.Aggregation > 1 {
+			if qp.AlignPeriod > 0 {
+				points = make([]point, 0)
+			} else if qp.Aggregation > 1 {
 				points = make([]point, 0, qp.Aggregation)
 			}
 
-			it := q.Run(c)
+			// Start of the aligned period containing points.
+			var period time.Time
+
+			// flush sends a point combining points.
+			flush := func() {
+				p := reduce(points)
+				if qp.AlignPeriod > 0 {
+					p.timestamp = period
+				}
+				send(p)
+				points = points[:0]
+			}
+
 			for {
-				if _, err := it.Next(s); err == datastore.Done {
+				p, err := next()
+				if err == datastore.Done {
 					if points != nil && len(points) > 0 {
-						ch <- averagePoints(points)
+						flush()
 					}
 					close(ch)
+					if countCh != nil {
+						close(countCh)
+					}
 					break
 				} else if err != nil {
 					ch <- point{time.Time{}, 0, err}
 					break
 				}
 
-				p := mp(s)
 				if points == nil {
-					ch <- p
+					track()
+					send(p)
+				} else if qp.AlignPeriod > 0 {
+					ps := p.timestamp.Truncate(qp.AlignPeriod)
+					if len(points) > 0 && !ps.Equal(period) {
+						flush()
+					}
+					track()
+					period = ps
+					points = append(points, p)
 				} else {
+					track()
 					points = append(points, p)
 					if len(points) == qp.Aggregation {
-						ch <- averagePoints(points)
-						points = points[:0]
+						flush()
 					}
 				}
-
 			}
-		}(q, chans[i])
+		}(parts[0], parts[1], chans[i], &extremes[i], rng, countCh)
+	}
+
+	if countChans != nil {
+		chans = append(chans, countChans...)
+		labels := make([]string, 0, 2*len(qp.Labels))
+		labels = append(labels, qp.Labels...)
+		for _, l := range qp.Labels {
+			labels = append(labels, l+" count")
+		}
+		qp.Labels = labels
 	}
 
 	out := make(chan timeData)
 	go mergeQueryData(chans, out)
-	return writeQueryOutput(w, qp.Labels, out, qp.Start.Location())
+	if qp.MaxGap > 0 {
+		in := out
+		out = make(chan timeData)
+		go fillQueryData(in, out, len(chans), qp.MaxGap)
+	}
+	if len(qp.Exprs) > 0 {
+		in := out
+		out = make(chan timeData)
+		go exprQueryData(in, out, len(chans), qp.Exprs)
+		labels := append([]string{}, qp.Labels...)
+		for _, e := range qp.Exprs {
+			labels = append(labels, e.Label)
+		}
+		qp.Labels = labels
+	}
+	if qp.Smooth > 1 {
+		in := out
+		out = make(chan timeData)
+		raw := make(map[int]bool)
+		for i := range countChans {
+			raw[len(qp.SourceNames)+i] = true
+		}
+		go smoothQueryData(in, out, qp.Smooth, raw)
+	}
+	if !qp.Since.IsZero() {
+		in := out
+		out = make(chan timeData)
+		go filterQueryData(in, out, qp.Since)
+	}
+	return out, extremes, ranges, nil
+}
+
+// summarizePoints summarizes points from the series identified by source and
+// name. periodStart returns the start of the period containing a timestamp.
+// points must be sorted by ascending time, and the returned summaries are
+// likewise sorted.
+func summarizePoints(source, name string, points []point,
+	periodStart func(t time.Time) time.Time) []summary {
+	var sums []summary
+	cur := make(map[string]*summary)
+	key := source + "|" + name
+	for _, p := range points {
+		ts := periodStart(p.timestamp)
+		if s, ok := cur[key]; ok && !s.Timestamp.Equal(ts) {
+			sums = append(sums, *s)
+			delete(cur, key)
+		}
+		updateSummary(cur, &common.Sample{Timestamp: p.timestamp, Source: source, Name: name,
+			Value: p.value}, ts)
+	}
+	if s, ok := cur[key]; ok {
+		sums = append(sums, *s)
+	}
+	return sums
+}
+
+// ValueRange describes the minimum and maximum values summarized by a point.
+type ValueRange struct {
+	Timestamp time.Time
+	Min, Max  float32
+}
+
+// lineExtremes describes the minimum and maximum values within a line.
+type lineExtremes struct {
+	min, max point
+	found    bool
 }
 
-// averagePoints returns a point containing the midpoint time and average value
-// of points, which must be sorted by ascending time.
-func averagePoints(points []point) point {
-	if len(points) == 0 {
-		return point{}
-	} else if len(points) == 1 {
-		return points[0]
+// update updates e to include the supplied minimum and maximum points.
+// Earlier points are preferred when values are equal.
+func (e *lineExtremes) update(min, max point) {
+	if !e.found || min.value < e.min.value {
+		e.min = min
 	}
+	if !e.found || max.value > e.max.value {
+		e.max = max
+	}
+	e.found = true
+}
 
-	var total float32
-	for i, _ := range points {
-		total += points[i].value
+// summaryExtreme returns a point for one of a summary's extreme values. If the
+// summary predates the extremes' times being recorded, ts (the start of the
+// summarized period) is used instead.
+func summaryExtreme(t, ts time.Time, v float32) point {
+	if t.IsZero() {
+		t = ts
 	}
-	elapsed := points[len(points)-1].timestamp.Sub(points[0].timestamp)
-	return point{
-		timestamp: points[0].timestamp.Add(elapsed / time.Duration(2)),
-		value:     total / float32(len(points)),
-		err:       nil,
+	return point{t, v, nil}
+}
+
+// wallClockMidpoint returns the time halfway between a and b as measured by a
+// wall clock in loc. This differs from the actual midpoint when a DST
+// transition occurs between a and b.
+func wallClockMidpoint(a, b time.Time, loc *time.Location) time.Time {
+	wall := func(t time.Time) time.Time {
+		t = t.In(loc)
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(),
+			t.Nanosecond(), time.UTC)
 	}
+	wa, wb := wall(a), wall(b)
+	m := wa.Add(wb.Sub(wa) / 2)
+	return time.Date(m.Year(), m.Month(), m.Day(), m.Hour(), m.Minute(), m.Second(),
+		m.Nanosecond(), loc)
 }
 
 // timeData contains values associated with a given timestamp. If a line did not
@@ -247,13 +758,140 @@ func mergeQueryData(in []chan point, out chan timeData) {
 	close(out)
 }
 
+// smoothQueryData reads per-timestamp sets of values from in and writes them
+// to out after replacing each line's values with the average of its last
+// window values. NaN values are passed through unchanged, and averages don't
+// include values from before NaNs. Values in columns whose indexes are in raw
+// (e.g. sample counts) are passed through unchanged.
+func smoothQueryData(in chan timeData, out chan timeData, window int, raw map[int]bool) {
+	// Recent non-NaN values for each line, oldest first.
+	var recent [][]float32
+	for d := range in {
+		if d.err != nil {
+			out <- d
+			break
+		}
+		for len(recent) < len(d.values) {
+			recent = append(recent, make([]float32, 0, window))
+		}
+
+		values := make([]float32, len(d.values))
+		for i, v := range d.values {
+			if raw[i] {
+				values[i] = v
+				continue
+			}
+			if v != v {
+				recent[i] = recent[i][:0]
+				values[i] = v
+				continue
+			}
+			if len(recent[i]) == window {
+				recent[i] = append(recent[i][:0], recent[i][1:]...)
+			}
+			recent[i] = append(recent[i], v)
+			var total float32
+			for _, rv := range recent[i] {
+				total += rv
+			}
+			values[i] = total / float32(len(recent[i]))
+		}
+		// Omitted trailing values are also missing.
+		for i := len(d.values); i < len(recent); i++ {
+			recent[i] = recent[i][:0]
+		}
+		out <- timeData{d.timestamp, values, nil}
+	}
+	close(out)
+}
+
+// fillQueryData reads per-timestamp sets of values for numLines lines from in
+// and writes them to out after replacing each line's missing values with its
+// previous value, as long as that value was seen at most maxGap earlier.
+func fillQueryData(in chan timeData, out chan timeData, numLines int, maxGap time.Duration) {
+	last := make([]float32, numLines)
+	lastTimes := make([]time.Time, numLines)
+	for d := range in {
+		if d.err != nil {
+			out <- d
+			break
+		}
+		values := make([]float32, numLines)
+		for i := range values {
+			if i < len(d.values) && d.values[i] == d.values[i] {
+				values[i] = d.values[i]
+				last[i] = values[i]
+				lastTimes[i] = d.timestamp
+			} else if !lastTimes[i].IsZero() && d.timestamp.Sub(lastTimes[i]) <= maxGap {
+				values[i] = last[i]
+			} else {
+				values[i] = float32(math.NaN())
+			}
+		}
+		out <- timeData{d.timestamp, values, nil}
+	}
+	close(out)
+}
+
+// exprQueryData reads per-timestamp sets of values for numLines lines from in
+// and writes them to out after appending the values computed by exprs.
+func exprQueryData(in chan timeData, out chan timeData, numLines int, exprs []QueryExpr) {
+	nan := float32(math.NaN())
+	for d := range in {
+		if d.err != nil {
+			out <- d
+			break
+		}
+		values := make([]float32, numLines, numLines+len(exprs))
+		for i := range values {
+			if i < len(d.values) {
+				values[i] = d.values[i]
+			} else {
+				values[i] = nan
+			}
+		}
+		for _, e := range exprs {
+			a, b := values[e.A], values[e.B]
+			if a != a || b != b {
+				values = append(values, nan)
+			} else {
+				values = append(values, exprOps[e.Op](a, b))
+			}
+		}
+		out <- timeData{d.timestamp, values, nil}
+	}
+	close(out)
+}
+
+// filterQueryData copies per-timestamp sets of values from in to out, dropping
+// ones with timestamps before since.
+func filterQueryData(in chan timeData, out chan timeData, since time.Time) {
+	for d := range in {
+		if d.err == nil && d.timestamp.Before(since) {
+			continue
+		}
+		out <- d
+		if d.err != nil {
+			break
+		}
+	}
+	close(out)
+}
+
 // writeQueryOutput reads per-timestamp sets of values from ch and writes them
 // to w as a JSON object that can be used to construct a Google Chart API
 // DataTable object
 // (https://developers.google.com/chart/interactive/docs/reference#dataparam).
-// labels provides labels for each line, and loc provides the time zone that is
-// used when converting timeData's timestamps to symbolic times.
-func writeQueryOutput(w io.Writer, labels []string, ch chan timeData, loc *time.Location) error {
+// qp's labels are used for each line, and its start time's location provides
+// the time zone that is used when converting timeData's timestamps to symbolic
+// times. The query's granularity and aggregation are included as additional
+// top-level "granularity" and "aggregation" properties, and the latest row's
+// timestamp (see QueryParams.Since) is included as "maxTimestamp" if known. If
+// extremes is non-nil, it is written as an "extremes" property containing each
+// line's minimum and maximum points (or null if the line had no data).
+func writeQueryOutput(w io.Writer, qp *QueryParams, ch chan timeData,
+	extremes []lineExtremes) error {
+	loc := qp.Start.Location()
 	var err error
 	write := func(s string) {
 		if err != nil {
@@ -264,28 +902,29 @@ func writeQueryOutput(w io.Writer, labels []string, ch chan timeData, loc *time.
 
 	write("{\"cols\":[")
 	write("{\"type\":\"datetime\"}")
-	for _, l := range labels {
+	for _, l := range qp.Labels {
 		write(",{\"label\":\"")
 		write(l)
 		write("\",\"type\":\"number\"}")
 	}
 	write("],\"rows\":[")
 	rowNum := 0
+	maxTime := qp.Since
 	for d := range ch {
 		if d.err != nil {
 			return d.err
 		}
+		if d.timestamp.After(maxTime) {
+			maxTime = d.timestamp
+		}
 
 		if rowNum > 0 {
 			write(",")
 		}
 
-		// Well, this is awesome.
-		t := d.timestamp.In(loc)
-		write("{\"c\":[{\"v\":\"Date(")
-		write(fmt.Sprintf("%d,%d,%d,%d,%d,%d",
-			t.Year(), int(t.Month())-1, t.Day(), t.Hour(), t.Minute(), t.Second()))
-		write(")\"}")
+		write("{\"c\":[{\"v\":\"")
+		write(formatDataTableTime(d.timestamp.In(loc)))
+		write("\"}")
 
 		// Find the index of the last non-NaN value.
 		lastCol := -1
@@ -309,6 +948,134 @@ func writeQueryOutput(w io.Writer, labels []string, ch chan timeData, loc *time.
 		write("]}")
 		rowNum++
 	}
-	write("]}")
+	write("],")
+
+	agg := qp.Aggregation
+	if agg < 1 {
+		agg = 1
+	}
+	write(fmt.Sprintf("\"granularity\":\"%s\",\"aggregation\":%d", qp.Granularity, agg))
+
+	// Let clients distinguish a lack of data from a graph that hasn't loaded.
+	write(fmt.Sprintf(",\"numRows\":%d,\"empty\":%v", rowNum, rowNum == 0))
+	if !maxTime.IsZero() {
+		write(fmt.Sprintf(",\"maxTimestamp\":\"%s\"", common.FormatTimestamp(maxTime)))
+	}
+
+	if extremes != nil {
+		write(",\"extremes\":[")
+		for i, e := range extremes {
+			if i > 0 {
+				write(",")
+			}
+			if !e.found {
+				write("null")
+				continue
+			}
+			write(fmt.Sprintf("{\"min\":{\"t\":\"%s\",\"v\":%s},\"max\":{\"t\":\"%s\",\"v\":%s}}",
+				formatDataTableTime(e.min.timestamp.In(loc)),
+				strconv.FormatFloat(float64(e.min.value), 'f', -1, 32),
+				formatDataTableTime(e.max.timestamp.In(loc)),
+				strconv.FormatFloat(float64(e.max.value), 'f', -1, 32)))
+		}
+		write("]")
+	}
+	write("}")
+	return err
+}
+
+// formatDataTableTime formats t as a Google Chart API DataTable date string,
+// e.g. "Date(2017,0,31,13,45,0)". Well, this is awesome.
+func formatDataTableTime(t time.Time) string {
+	s := fmt.Sprintf("Date(%d,%d,%d,%d,%d,%d",
+		t.Year(), int(t.Month())-1, t.Day(), t.Hour(), t.Minute(), t.Second())
+	if ms := t.Nanosecond() / int(time.Millisecond); ms != 0 {
+		s += fmt.Sprintf(",%d", ms)
+	}
+	return s + ")"
+}
+
+// writeValuesOutput writes a JSON array containing the first value from each
+// timeData read from ch. Missing values are written as null.
+func writeValuesOutput(w io.Writer, ch chan timeData) error {
+	b := []byte{'['}
+	n := 0
+	for d := range ch {
+		if d.err != nil {
+			return d.err
+		}
+		if n > 0 {
+			b = append(b, ',')
+		}
+		if len(d.values) == 0 || d.values[0] != d.values[0] {
+			b = append(b, "null"...)
+		} else {
+			b = strconv.AppendFloat(b, float64(d.values[0]), 'f', -1, 32)
+		}
+		n++
+	}
+	b = append(b, ']')
+	_, err := w.Write(b)
+	return err
+}
+
+// writeRowsOutput writes the data from ch to w as a JSON object containing
+// labels and an array of rows. See QueryParams.Rows.
+func writeRowsOutput(w io.Writer, labels []string, ch chan timeData) error {
+	lb, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	b := append([]byte(`{"labels":`), lb...)
+	b = append(b, `,"rows":[`...)
+	n := 0
+	for d := range ch {
+		if d.err != nil {
+			return d.err
+		}
+		if n > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, '[')
+		b = append(b, common.FormatTimestamp(d.timestamp)...)
+		for _, v := range d.values {
+			b = append(b, ',')
+			if v != v {
+				b = append(b, "null"...)
+			} else {
+				b = strconv.AppendFloat(b, float64(v), 'f', -1, 32)
+			}
+		}
+		b = append(b, ']')
+		n++
+	}
+	b = append(b, "]}"...)
+	_, err = w.Write(b)
 	return err
 }
+
+// writeCSVOutput writes the data from ch to w as CSV, using loc to format
+// timestamps. See QueryParams.CSV.
+func writeCSVOutput(w io.Writer, labels []string, loc *time.Location, ch chan timeData) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{"time"}, labels...)); err != nil {
+		return err
+	}
+	for d := range ch {
+		if d.err != nil {
+			return d.err
+		}
+		rec := make([]string, 1+len(d.values))
+		rec[0] = d.timestamp.In(loc).Format(time.RFC3339Nano)
+		for i, v := range d.values {
+			if v == v {
+				rec[i+1] = strconv.FormatFloat(float64(v), 'f', -1, 32)
+			}
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,219 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/derat/home/common"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+// Individual samples returned by queries are cached in memcache in aligned
+// buckets of queryCacheBucket per series. Only buckets that ended before the
+// query was run are cached. WriteSamples and RenameSeries invalidate the
+// buckets that they modify, and cached buckets expire after
+// queryCacheExpiration so that samples deleted by DeleteSummarizedSamples
+// eventually disappear.
+//
+// A query that read a bucket from datastore just before (or, due to eventual
+// consistency, just after) the bucket was modified could otherwise cache stale
+// samples after the bucket was invalidated. To prevent this, invalidation
+// replaces buckets with markers that expire after queryCacheInvalidation, and
+// queries only add buckets that aren't already present.
+const (
+	queryCacheBucket       = time.Hour
+	queryCacheExpiration   = 24 * time.Hour
+	queryCacheInvalidation = 2 * time.Minute
+	queryCacheKeyPrefix    = "query|"
+
+	// Flags set on memcache items marking invalidated buckets.
+	queryCacheInvalidFlags = 1
+
+	// Size of each point encoded by encodePoints.
+	encodedPointSize = 12
+)
+
+// getQueryCacheKey returns the memcache key for the bucket starting at start
+// in the series identified by source and name.
+func getQueryCacheKey(source, name string, start time.Time) string {
+	return fmt.Sprintf("%s%d|%s|%s", queryCacheKeyPrefix, start.Unix(), source, name)
+}
+
+// encodePoints encodes the timestamps and values of points for storage in
+// memcache.
+func encodePoints(points []point) []byte {
+	b := make([]byte, len(points)*encodedPointSize)
+	for i, p := range points {
+		binary.BigEndian.PutUint64(b[i*encodedPointSize:], uint64(p.timestamp.UnixNano()))
+		binary.BigEndian.PutUint32(b[i*encodedPointSize+8:], math.Float32bits(p.value))
+	}
+	return b
+}
+
+// decodePoints decodes points encoded by encodePoints. The returned slice is
+// non-nil.
+func decodePoints(b []byte) ([]point, error) {
+	if len(b)%encodedPointSize != 0 {
+		return nil, fmt.Errorf("Encoded points have invalid length %v", len(b))
+	}
+	points := make([]point, len(b)/encodedPointSize)
+	for i := range points {
+		points[i].timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(b[i*encodedPointSize:])))
+		points[i].value = math.Float32frombits(binary.BigEndian.Uint32(b[i*encodedPointSize+8:]))
+	}
+	return points, nil
+}
+
+// getSamplePoints returns up to limit points describing the samples in the
+// series identified by source and name with timestamps in the inclusive range
+// [start, end], sorted by ascending time. If limit is 0, all of the samples
+// are returned. Cached buckets are used when available, and buckets that ended
+// before now are cached after being read from datastore.
+func getSamplePoints(c context.Context, source, name string, start, end, now time.Time,
+	limit int) ([]point, error) {
+	var buckets []time.Time
+	for b := start.Truncate(queryCacheBucket); !b.After(end); b = b.Add(queryCacheBucket) {
+		buckets = append(buckets, b)
+	}
+	keys := make([]string, len(buckets))
+	for i, b := range buckets {
+		keys[i] = getQueryCacheKey(source, name, b)
+	}
+
+	// Points in each bucket, or nil if the bucket hasn't been loaded.
+	bucketPoints := make([][]point, len(buckets))
+	items, err := memcache.GetMulti(c, keys)
+	if err != nil {
+		log.Warningf(c, "Failed to get cached samples: %v", err)
+	}
+	for i, k := range keys {
+		if item, ok := items[k]; ok && item.Flags != queryCacheInvalidFlags {
+			if bucketPoints[i], err = decodePoints(item.Value); err != nil {
+				log.Warningf(c, "Failed to decode cached samples: %v", err)
+			}
+		}
+	}
+
+	// Read runs of uncached buckets from datastore using a single query each.
+	var newItems []*memcache.Item
+	for i := 0; i < len(buckets); {
+		if bucketPoints[i] != nil {
+			i++
+			continue
+		}
+		j := i
+		for j < len(buckets) && bucketPoints[j] == nil {
+			bucketPoints[j] = make([]point, 0)
+			j++
+		}
+		runStart := buckets[i]
+		q := datastore.NewQuery(sampleKind).Filter("Source =", source).Filter("Name =", name).
+			Filter("Timestamp >=", runStart).Filter("Timestamp <", buckets[j-1].Add(queryCacheBucket)).
+			Order("Timestamp")
+		// The iterator fetches additional batches of results as needed. The
+		// first and last buckets may contain samples outside of [start, end],
+		// which don't count toward limit.
+		var samples []common.Sample
+		matched := 0
+		it := q.Run(c)
+		for limit <= 0 || matched < limit {
+			var s common.Sample
+			if _, err := it.Next(&s); err == datastore.Done {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			samples = append(samples, s)
+			if !s.Timestamp.Before(start) && !s.Timestamp.After(end) {
+				matched++
+			}
+		}
+		for _, s := range samples {
+			k := i + int(s.Timestamp.Sub(runStart)/queryCacheBucket)
+			bucketPoints[k] = append(bucketPoints[k], point{s.Timestamp, s.Value, nil})
+		}
+
+		// If the query hit its limit, the bucket containing the last sample may
+		// be incomplete and later buckets weren't read at all.
+		full := j
+		if limit > 0 && matched == limit {
+			full = i + int(samples[len(samples)-1].Timestamp.Sub(runStart)/queryCacheBucket)
+			buckets = buckets[:full+1]
+			bucketPoints = bucketPoints[:full+1]
+		}
+		for k := i; k < full; k++ {
+			if !buckets[k].Add(queryCacheBucket).After(now) {
+				newItems = append(newItems, &memcache.Item{
+					Key:        keys[k],
+					Value:      encodePoints(bucketPoints[k]),
+					Expiration: queryCacheExpiration,
+				})
+			}
+		}
+		i = j
+	}
+	if len(newItems) > 0 {
+		// Items that are already present were either cached by another query
+		// or recently invalidated.
+		err := memcache.AddMulti(c, newItems)
+		if me, ok := err.(appengine.MultiError); ok {
+			for _, e := range me {
+				if e != nil && e != memcache.ErrNotStored {
+					log.Warningf(c, "Failed to cache samples: %v", e)
+					break
+				}
+			}
+		} else if err != nil {
+			log.Warningf(c, "Failed to cache samples: %v", err)
+		}
+	}
+
+	points := make([]point, 0)
+	for _, bp := range bucketPoints {
+		for _, p := range bp {
+			if !p.timestamp.Before(start) && !p.timestamp.After(end) {
+				points = append(points, p)
+			}
+		}
+	}
+	if limit > 0 && len(points) > limit {
+		points = points[:limit]
+	}
+	return points, nil
+}
+
+// invalidateQueryCache replaces cached buckets containing samples with
+// markers that prevent the buckets from being cached again until
+// queryCacheInvalidation has passed. Errors are logged but otherwise ignored.
+func invalidateQueryCache(c context.Context, samples []common.Sample) {
+	seen := make(map[string]bool)
+	var items []*memcache.Item
+	for _, s := range samples {
+		k := getQueryCacheKey(s.Source, s.Name, s.Timestamp.Truncate(queryCacheBucket))
+		if !seen[k] {
+			seen[k] = true
+			items = append(items, &memcache.Item{
+				Key:        k,
+				Value:      []byte{},
+				Flags:      queryCacheInvalidFlags,
+				Expiration: queryCacheInvalidation,
+			})
+		}
+	}
+	if len(items) == 0 {
+		return
+	}
+	if err := memcache.SetMulti(c, items); err != nil {
+		log.Warningf(c, "Failed to invalidate cached samples: %v", err)
+	}
+}
@@ -8,11 +8,19 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/derat/home/common"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/memcache"
 )
 
 func makePoint(t int, value float32) point {
@@ -52,8 +60,12 @@ func checkQuery(t *testing.T, c context.Context, p QueryParams, rows []datarow)
 		Cells []cell `json:"c"`
 	}
 	type table struct {
-		Cols []col `json:"cols"`
-		Rows []row `json:"rows"`
+		Cols        []col  `json:"cols"`
+		Rows        []row  `json:"rows"`
+		Granularity string `json:"granularity"`
+		Aggregation int    `json:"aggregation"`
+		NumRows     int    `json:"numRows"`
+		Empty       bool   `json:"empty"`
 	}
 
 	b := &bytes.Buffer{}
@@ -65,16 +77,39 @@ func checkQuery(t *testing.T, c context.Context, p QueryParams, rows []datarow)
 		t.Fatalf("Failed to unmarshal response: %v", err)
 	}
 
-	nc := len(p.SourceNames) + 1
+	if tb.Granularity != p.Granularity.String() {
+		t.Errorf("Got granularity %q instead of %q", tb.Granularity, p.Granularity)
+	}
+	expAgg := p.Aggregation
+	if expAgg < 1 {
+		expAgg = 1
+	}
+	if tb.Aggregation != expAgg {
+		t.Errorf("Got aggregation %v instead of %v", tb.Aggregation, expAgg)
+	}
+	if tb.NumRows != len(tb.Rows) {
+		t.Errorf("Got numRows %v with %v row(s)", tb.NumRows, len(tb.Rows))
+	}
+	if tb.Empty != (len(rows) == 0) {
+		t.Errorf("Got empty %v with %v expected row(s)", tb.Empty, len(rows))
+	}
+
+	labels := p.Labels
+	if p.Counts && p.Granularity != IndividualSample {
+		for _, l := range p.Labels {
+			labels = append(labels, l+" count")
+		}
+	}
+	nc := len(labels) + 1
 	if len(tb.Cols) != nc {
 		t.Errorf("Got %v column(s) instead of %v", len(tb.Cols), nc)
 	} else {
 		if tb.Cols[0].Type != "datetime" {
 			t.Errorf("Column 0 has type %q instead of %q", tb.Cols[0].Type, "datetime")
 		}
-		for i := range p.SourceNames {
-			if tb.Cols[i+1].Label != p.Labels[i] {
-				t.Errorf("Column %d has label %q instead of %q", i+1, tb.Cols[i+1].Label, p.Labels[i])
+		for i := range labels {
+			if tb.Cols[i+1].Label != labels[i] {
+				t.Errorf("Column %d has label %q instead of %q", i+1, tb.Cols[i+1].Label, labels[i])
 			}
 			if tb.Cols[i+1].Type != "number" {
 				t.Errorf("Column %d has type %q instead of %q", i+1, tb.Cols[i+1].Type, "number")
@@ -112,31 +147,24 @@ func checkQuery(t *testing.T, c context.Context, p QueryParams, rows []datarow)
 	}
 }
 
-func TestAveragePoints(t *testing.T) {
-	f := func(p point) string {
-		return fmt.Sprintf("%v|%.1f", p.timestamp.Unix(), p.value)
-	}
+func TestSummarizePoints(t *testing.T) {
+	periodStart := func(t time.Time) time.Time { return t.Truncate(100 * time.Second) }
+	sums := summarizePoints("a", "b", []point{
+		makePoint(110, 4.0),
+		makePoint(120, 2.0),
+		makePoint(150, 6.0),
+		makePoint(310, 1.0),
+	}, periodStart)
 
-	for _, tc := range []struct {
-		in  []point
-		exp point
-	}{
-		{[]point{}, point{}},
-		{[]point{point{time.Unix(10, 0), 5.0, nil}}, point{time.Unix(10, 0), 5.0, nil}},
-		{[]point{
-			point{time.Unix(10, 0), 1.0, nil},
-			point{time.Unix(20, 0), 2.0, nil},
-			point{time.Unix(30, 0), 3.0, nil},
-			point{time.Unix(40, 0), 4.0, nil},
-		}, point{time.Unix(25, 0), 2.5, nil}},
-	} {
-		a := f(averagePoints(tc.in))
-		e := f(tc.exp)
-		if a != e {
-			t.Errorf("Expected %v, got %v", e, a)
-		}
+	var act []string
+	for _, s := range sums {
+		act = append(act, fmt.Sprintf("%v|%v|%v|%.1f|%.1f|%.1f", s.Timestamp.Unix(),
+			s.Source+"|"+s.Name, s.NumValues, s.MinValue, s.MaxValue, s.AvgValue))
+	}
+	exp := []string{"100|a|b|3|2.0|6.0|4.0", "300|a|b|1|1.0|1.0|1.0"}
+	if !reflect.DeepEqual(act, exp) {
+		t.Errorf("Expected %q; got %q", exp, act)
 	}
-
 }
 
 func TestMergeQueryData(t *testing.T) {
@@ -190,6 +218,405 @@ func TestMergeQueryData(t *testing.T) {
 	}
 }
 
+func TestRunQueryExtremes(t *testing.T) {
+	c := initTest()
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2015, 7, 1, 0, 10, 0), "a", "b", 4.0},
+		common.Sample{lt(2015, 7, 1, 0, 20, 0), "a", "b", 1.0},
+		common.Sample{lt(2015, 7, 1, 1, 30, 0), "a", "b", 9.0},
+		common.Sample{lt(2015, 7, 1, 1, 40, 0), "a", "b", 2.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+	if err := GenerateSummaries(c, lt(2015, 7, 3, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+
+	type extreme struct {
+		Time  string  `json:"t"`
+		Value float64 `json:"v"`
+	}
+	type extremes struct {
+		Min extreme `json:"min"`
+		Max extreme `json:"max"`
+	}
+	exp := []*extremes{
+		&extremes{
+			Min: extreme{"Date(2015,6,1,0,20,0)", 1.0},
+			Max: extreme{"Date(2015,6,1,1,30,0)", 9.0},
+		},
+		nil,
+	}
+	for _, g := range []QueryGranularity{IndividualSample, HourlyAverage, DailyAverage} {
+		var b bytes.Buffer
+		if err := DoQuery(c, &b, QueryParams{
+			Labels:      []string{"B", "C"},
+			SourceNames: []string{"a|b", "a|c"},
+			Start:       lt(2015, 7, 1, 0, 0, 0),
+			End:         lt(2015, 7, 1, 23, 59, 59),
+			Granularity: g,
+			Aggregation: 1,
+			Extremes:    true,
+		}); err != nil {
+			t.Fatalf("Query failed for %v: %v", g, err)
+		}
+		var out struct {
+			Extremes []*extremes `json:"extremes"`
+		}
+		if err := json.Unmarshal(b.Bytes(), &out); err != nil {
+			t.Fatalf("Failed to unmarshal %q for %v: %v", b.String(), g, err)
+		}
+		if !reflect.DeepEqual(out.Extremes, exp) {
+			t.Errorf("Got extremes %q for %v; want %v", b.String(), g, exp)
+		}
+	}
+}
+
+func TestWriteValuesOutput(t *testing.T) {
+	nan := float32(math.NaN())
+	ch := make(chan timeData)
+	go func() {
+		for i, v := range [][]float32{{1.5}, {nan}, {}, {-2}} {
+			ch <- timeData{time.Unix(int64(i), 0), v, nil}
+		}
+		close(ch)
+	}()
+	var b bytes.Buffer
+	if err := writeValuesOutput(&b, ch); err != nil {
+		t.Fatalf("Failed writing values: %v", err)
+	}
+	if exp := "[1.5,null,null,-2]"; b.String() != exp {
+		t.Errorf("Expected %q; got %q", exp, b.String())
+	}
+}
+
+func TestWriteRowsOutput(t *testing.T) {
+	nan := float32(math.NaN())
+	ch := make(chan timeData)
+	go func() {
+		ch <- timeData{time.Unix(100, 0), []float32{1.5, nan}, nil}
+		ch <- timeData{time.Unix(200, 500000000), []float32{nan, -2}, nil}
+		close(ch)
+	}()
+	var b bytes.Buffer
+	if err := writeRowsOutput(&b, []string{"A", `"B"`}, ch); err != nil {
+		t.Fatalf("Failed writing rows: %v", err)
+	}
+	if exp := `{"labels":["A","\"B\""],"rows":[[100,1.5,null],[200.5,null,-2]]}`; b.String() != exp {
+		t.Errorf("Expected %q; got %q", exp, b.String())
+	}
+}
+
+func TestWriteCSVOutput(t *testing.T) {
+	nan := float32(math.NaN())
+	ch := make(chan timeData)
+	go func() {
+		ch <- timeData{time.Unix(100, 0), []float32{1.5, nan}, nil}
+		ch <- timeData{time.Unix(200, 500000000), []float32{nan, -2}, nil}
+		close(ch)
+	}()
+	var b bytes.Buffer
+	if err := writeCSVOutput(&b, []string{"A", "B,C"}, time.UTC, ch); err != nil {
+		t.Fatalf("Failed writing CSV: %v", err)
+	}
+	exp := "time,A,\"B,C\"\n" +
+		"1970-01-01T00:01:40Z,1.5,\n" +
+		"1970-01-01T00:03:20.5Z,,-2\n"
+	if b.String() != exp {
+		t.Errorf("Expected %q; got %q", exp, b.String())
+	}
+}
+
+func TestWriteQueryOutputEmpty(t *testing.T) {
+	qp := QueryParams{
+		Labels:      []string{"B"},
+		SourceNames: []string{"a|b"},
+		Start:       time.Unix(0, 0).UTC(),
+	}
+	ch := make(chan timeData)
+	close(ch)
+	var b bytes.Buffer
+	if err := writeQueryOutput(&b, &qp, ch, nil); err != nil {
+		t.Fatalf("Failed writing output: %v", err)
+	}
+	exp := `{"cols":[{"type":"datetime"},{"label":"B","type":"number"}],"rows":[],` +
+		`"granularity":"sample","aggregation":1,"numRows":0,"empty":true}`
+	if b.String() != exp {
+		t.Errorf("Expected %q; got %q", exp, b.String())
+	}
+}
+
+func TestWriteQueryOutputMaxTimestamp(t *testing.T) {
+	qp := QueryParams{
+		Labels:      []string{"B"},
+		SourceNames: []string{"a|b"},
+		Start:       time.Unix(0, 0).UTC(),
+		Since:       time.Unix(5, 0),
+	}
+	for _, tc := range []struct {
+		times []int64
+		exp   string
+	}{
+		{nil, "5"},
+		{[]int64{6, 8}, "8"},
+	} {
+		ch := make(chan timeData, len(tc.times))
+		for _, t := range tc.times {
+			ch <- timeData{time.Unix(t, 0), []float32{1}, nil}
+		}
+		close(ch)
+		var b bytes.Buffer
+		if err := writeQueryOutput(&b, &qp, ch, nil); err != nil {
+			t.Fatalf("Failed writing output: %v", err)
+		}
+		var out struct {
+			MaxTimestamp string `json:"maxTimestamp"`
+		}
+		if err := json.Unmarshal(b.Bytes(), &out); err != nil {
+			t.Fatalf("Failed to unmarshal %q: %v", b.String(), err)
+		}
+		if out.MaxTimestamp != tc.exp {
+			t.Errorf("Expected max timestamp %q for %v; got %q", tc.exp, tc.times, out.MaxTimestamp)
+		}
+	}
+}
+
+func TestRunQueryValues(t *testing.T) {
+	c := initTest()
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{time.Unix(1, 0), "a", "b", 1.0},
+		common.Sample{time.Unix(2, 0), "a", "b", 2.0},
+		common.Sample{time.Unix(3, 0), "a", "b", 4.0},
+		common.Sample{time.Unix(4, 0), "a", "b", 8.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+	qp := QueryParams{
+		Labels:      []string{"B"},
+		SourceNames: []string{"a|b"},
+		Start:       time.Unix(1, 0),
+		End:         time.Unix(4, 0),
+		Granularity: IndividualSample,
+		Aggregation: 2,
+		ValuesOnly:  true,
+	}
+	var b bytes.Buffer
+	if err := DoQuery(c, &b, qp); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if exp := "[1.5,6]"; b.String() != exp {
+		t.Errorf("Expected %q; got %q", exp, b.String())
+	}
+
+	qp.Labels = []string{"B", "C"}
+	qp.SourceNames = []string{"a|b", "a|c"}
+	if err := DoQuery(c, &b, qp); err == nil {
+		t.Errorf("Values-only query with multiple lines unexpectedly succeeded")
+	}
+}
+
+func TestSmoothQueryData(t *testing.T) {
+	nan := float32(math.NaN())
+	rows := [][]float32{
+		{1, 10, 1},
+		{3, nan, 2},
+		{5, 20, 3},
+		{7, 30, 4},
+		{nan, 40, 5},
+		{9, 50, 6},
+	}
+	for _, tc := range []struct {
+		window int
+		exp    [][]float32
+	}{
+		{2, [][]float32{
+			{1, 10, 1},
+			{2, nan, 2},
+			{4, 20, 3},
+			{6, 25, 4},
+			{nan, 35, 5},
+			{9, 45, 6},
+		}},
+		// Averages shouldn't span missing values.
+		{3, [][]float32{
+			{1, 10, 1},
+			{2, nan, 2},
+			{3, 20, 3},
+			{5, 25, 4},
+			{nan, 30, 5},
+			{9, 40, 6},
+		}},
+	} {
+		in := make(chan timeData)
+		go func() {
+			for i, v := range rows {
+				in <- timeData{time.Unix(int64(i), 0), v, nil}
+			}
+			close(in)
+		}()
+
+		out := make(chan timeData)
+		// The third column contains counts, which shouldn't be smoothed.
+		go smoothQueryData(in, out, tc.window, map[int]bool{2: true})
+
+		for i, exp := range tc.exp {
+			act, more := <-out
+			if !more {
+				t.Fatalf("Channel closed unexpectedly at index %v with window %v", i, tc.window)
+			}
+			if act.err != nil {
+				t.Fatalf("Got error at index %v with window %v: %v", i, tc.window, act.err)
+			}
+			if !act.timestamp.Equal(time.Unix(int64(i), 0)) {
+				t.Errorf("Got time %v at index %v with window %v", act.timestamp, i, tc.window)
+			}
+			if !floatSlicesEqual(exp, act.values) {
+				t.Errorf("Expected values %v at index %v with window %v; saw %v",
+					exp, i, tc.window, act.values)
+			}
+		}
+		if _, more := <-out; more {
+			t.Errorf("Channel not closed with window %v", tc.window)
+		}
+	}
+}
+
+func TestFillQueryData(t *testing.T) {
+	nan := float32(math.NaN())
+	in := make(chan timeData)
+	go func() {
+		for i, v := range [][]float32{
+			{nan, 10},
+			{1, nan},
+			{nan, nan},
+			{3},
+			{},
+			{},
+			{nan, 20},
+		} {
+			in <- timeData{time.Unix(int64(i), 0), v, nil}
+		}
+		close(in)
+	}()
+
+	out := make(chan timeData)
+	go fillQueryData(in, out, 2, 2*time.Second)
+
+	for i, exp := range [][]float32{
+		{nan, 10},
+		{1, 10},
+		{1, 10},
+		{3, nan},
+		{3, nan},
+		{3, nan},
+		{nan, 20},
+	} {
+		act, more := <-out
+		if !more {
+			t.Fatalf("Channel closed unexpectedly at index %v", i)
+		}
+		if act.err != nil {
+			t.Fatalf("Got error at index %v: %v", i, act.err)
+		}
+		if !floatSlicesEqual(exp, act.values) {
+			t.Errorf("Expected values %v at index %v; saw %v", exp, i, act.values)
+		}
+	}
+	if _, more := <-out; more {
+		t.Errorf("Channel not closed")
+	}
+}
+
+func TestFilterQueryData(t *testing.T) {
+	in := make(chan timeData)
+	go func() {
+		for i := 0; i < 5; i++ {
+			in <- timeData{time.Unix(int64(i), 0), []float32{float32(i)}, nil}
+		}
+		close(in)
+	}()
+
+	out := make(chan timeData)
+	go filterQueryData(in, out, time.Unix(2, 0))
+	var act []int64
+	for d := range out {
+		if d.err != nil {
+			t.Fatalf("Got error: %v", d.err)
+		}
+		act = append(act, d.timestamp.Unix())
+	}
+	if exp := []int64{2, 3, 4}; !reflect.DeepEqual(act, exp) {
+		t.Errorf("Expected timestamps %v; got %v", exp, act)
+	}
+}
+
+func TestExprQueryData(t *testing.T) {
+	nan := float32(math.NaN())
+	in := make(chan timeData)
+	go func() {
+		in <- timeData{time.Unix(0, 0), []float32{6, 2}, nil}
+		in <- timeData{time.Unix(1, 0), []float32{4, nan}, nil}
+		in <- timeData{time.Unix(2, 0), []float32{3, 0}, nil}
+		close(in)
+	}()
+
+	out := make(chan timeData)
+	go exprQueryData(in, out, 2, []QueryExpr{
+		QueryExpr{"diff", "sub", 0, 1},
+		QueryExpr{"ratio", "div", 0, 1},
+	})
+	var act []string
+	for d := range out {
+		if d.err != nil {
+			t.Fatalf("Got error: %v", d.err)
+		}
+		act = append(act, fmt.Sprint(d.values))
+	}
+	exp := []string{"[6 2 4 3]", "[4 NaN NaN NaN]", "[3 0 3 NaN]"}
+	if !reflect.DeepEqual(act, exp) {
+		t.Errorf("Expected %q; got %q", exp, act)
+	}
+}
+
+func TestParseQueryExpr(t *testing.T) {
+	if e, err := ParseQueryExpr("Diff:sub:0:1"); err != nil {
+		t.Errorf("Failed to parse valid expression: %v", err)
+	} else if exp := (QueryExpr{"Diff", "sub", 0, 1}); e != exp {
+		t.Errorf("Expected %+v; got %+v", exp, e)
+	}
+	for _, s := range []string{"", "Diff:sub:0", "Diff:pow:0:1", "Diff:sub:a:1", "Diff:sub:0:b"} {
+		if _, err := ParseQueryExpr(s); err == nil {
+			t.Errorf("Didn't get error for invalid expression %q", s)
+		}
+	}
+}
+
+func TestRunQuerySince(t *testing.T) {
+	c := initTest()
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2015, 7, 1, 0, 0, 0), "a", "b", 1.0},
+		common.Sample{lt(2015, 7, 1, 0, 5, 0), "a", "b", 2.0},
+		common.Sample{lt(2015, 7, 1, 0, 10, 0), "a", "b", 3.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+	checkQuery(t, c,
+		QueryParams{
+			Labels:      []string{"A"},
+			SourceNames: []string{"a|b"},
+			Start:       lt(2015, 7, 1, 0, 0, 0),
+			End:         lt(2015, 7, 1, 1, 0, 0),
+			Granularity: IndividualSample,
+			Aggregation: 1,
+			Since:       lt(2015, 7, 1, 0, 5, 0),
+		},
+		[]datarow{
+			{"Date(2015,6,1,0,5,0)", []float64{2.0}},
+			{"Date(2015,6,1,0,10,0)", []float64{3.0}},
+		})
+}
+
 func TestRunQuery(t *testing.T) {
 	c := initTest()
 
@@ -199,7 +626,14 @@ func TestRunQuery(t *testing.T) {
 	t4 := time.Unix(4, 0).UTC()
 	t5 := time.Unix(5, 0).UTC()
 	checkQuery(t, c,
-		QueryParams{[]string{"B"}, []string{"a|b"}, t2, t4, IndividualSample, 1}, []datarow{})
+		QueryParams{
+			Labels:      []string{"B"},
+			SourceNames: []string{"a|b"},
+			Start:       t2,
+			End:         t4,
+			Granularity: IndividualSample,
+			Aggregation: 1,
+		}, []datarow{})
 
 	if err := WriteSamples(c, []common.Sample{
 		common.Sample{t1, "a", "b", 0.25},
@@ -210,11 +644,18 @@ func TestRunQuery(t *testing.T) {
 		common.Sample{t3, "a", "b", 1.0},
 		common.Sample{t4, "a", "c", 1.25},
 		common.Sample{t5, "a", "b", 1.5},
-	}); err != nil {
+	}, nil); err != nil {
 		t.Fatalf("Failed inserting samples: %v", err)
 	}
 	checkQuery(t, c,
-		QueryParams{[]string{"B", "C"}, []string{"a|b", "a|c"}, t2, t4, IndividualSample, 1},
+		QueryParams{
+			Labels:      []string{"B", "C"},
+			SourceNames: []string{"a|b", "a|c"},
+			Start:       t2,
+			End:         t4,
+			Granularity: IndividualSample,
+			Aggregation: 1,
+		},
 		[]datarow{
 			{"Date(1970,0,1,0,0,2)", []float64{0.5, 0.75}},
 			{"Date(1970,0,1,0,0,3)", []float64{1.0}},
@@ -223,8 +664,14 @@ func TestRunQuery(t *testing.T) {
 
 	// The start time's location should be used to determine the output's time zone.
 	checkQuery(t, c,
-		QueryParams{[]string{"B", "C"}, []string{"a|b", "a|c"},
-			t2.In(testLoc), t4.In(testLoc), IndividualSample, 1},
+		QueryParams{
+			Labels:      []string{"B", "C"},
+			SourceNames: []string{"a|b", "a|c"},
+			Start:       t2.In(testLoc),
+			End:         t4.In(testLoc),
+			Granularity: IndividualSample,
+			Aggregation: 1,
+		},
 		[]datarow{
 			{"Date(1969,11,31,16,0,2)", []float64{0.5, 0.75}},
 			{"Date(1969,11,31,16,0,3)", []float64{1.0}},
@@ -241,21 +688,22 @@ func TestRunQuerySummary(t *testing.T) {
 		common.Sample{lt(2015, 7, 3, 0, 30, 0), "a", "b", 4.0},
 		common.Sample{lt(2015, 7, 3, 1, 0, 0), "a", "b", 5.0},
 		common.Sample{lt(2015, 7, 3, 1, 30, 0), "a", "b", 6.0},
-	}); err != nil {
+	}, nil); err != nil {
 		t.Fatalf("Failed inserting samples: %v", err)
 	}
-	if err := GenerateSummaries(c, lt(2015, 7, 4, 0, 0, 0), time.Hour); err != nil {
+	if err := GenerateSummaries(c, lt(2015, 7, 4, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
 		t.Fatalf("Failed to generate summaries: %v", err)
 	}
 
 	checkQuery(t, c,
 		QueryParams{
-			[]string{"A"},
-			[]string{"a|b"},
-			lt(2015, 7, 3, 0, 0, 0),
-			lt(2015, 7, 3, 2, 0, 0),
-			IndividualSample,
-			1,
+			Labels:      []string{"A"},
+			SourceNames: []string{"a|b"},
+			Start:       lt(2015, 7, 3, 0, 0, 0),
+			End:         lt(2015, 7, 3, 2, 0, 0),
+			Granularity: IndividualSample,
+			Aggregation: 1,
 		},
 		[]datarow{
 			{"Date(2015,6,3,0,0,0)", []float64{3.0}},
@@ -266,12 +714,12 @@ func TestRunQuerySummary(t *testing.T) {
 
 	checkQuery(t, c,
 		QueryParams{
-			[]string{"A"},
-			[]string{"a|b"},
-			lt(2015, 7, 3, 0, 0, 0),
-			lt(2015, 7, 3, 4, 0, 0),
-			HourlyAverage,
-			1,
+			Labels:      []string{"A"},
+			SourceNames: []string{"a|b"},
+			Start:       lt(2015, 7, 3, 0, 0, 0),
+			End:         lt(2015, 7, 3, 4, 0, 0),
+			Granularity: HourlyAverage,
+			Aggregation: 1,
 		},
 		[]datarow{
 			{"Date(2015,6,3,0,0,0)", []float64{3.5}},
@@ -280,12 +728,12 @@ func TestRunQuerySummary(t *testing.T) {
 
 	checkQuery(t, c,
 		QueryParams{
-			[]string{"A"},
-			[]string{"a|b"},
-			lt(2015, 7, 1, 0, 0, 0),
-			lt(2015, 7, 4, 0, 0, 0),
-			DailyAverage,
-			1,
+			Labels:      []string{"A"},
+			SourceNames: []string{"a|b"},
+			Start:       lt(2015, 7, 1, 0, 0, 0),
+			End:         lt(2015, 7, 4, 0, 0, 0),
+			Granularity: DailyAverage,
+			Aggregation: 1,
 		},
 		[]datarow{
 			{"Date(2015,6,1,0,0,0)", []float64{1.0}},
@@ -294,6 +742,297 @@ func TestRunQuerySummary(t *testing.T) {
 		})
 }
 
+func TestRunQueryUnsummarized(t *testing.T) {
+	c := initTest()
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2015, 7, 1, 0, 0, 0), "a", "b", 1.0},
+		common.Sample{lt(2015, 7, 2, 0, 0, 0), "a", "b", 2.0},
+		common.Sample{lt(2015, 7, 3, 0, 0, 0), "a", "b", 3.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+	// July 2 is the last fully-summarized day, and July 3 is only partially
+	// summarized.
+	if err := GenerateSummaries(c, lt(2015, 7, 3, 1, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2015, 7, 3, 12, 0, 0), "a", "b", 5.0},
+		common.Sample{lt(2015, 7, 4, 0, 0, 0), "a", "b", 6.0},
+		common.Sample{lt(2015, 7, 4, 12, 0, 0), "a", "b", 8.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+
+	// Days after the last fully-summarized one should be computed from
+	// samples.
+	checkQuery(t, c,
+		QueryParams{
+			Labels:      []string{"A"},
+			SourceNames: []string{"a|b"},
+			Start:       lt(2015, 7, 1, 0, 0, 0),
+			End:         lt(2015, 7, 5, 0, 0, 0),
+			Granularity: DailyAverage,
+			Aggregation: 1,
+			Counts:      true,
+		},
+		[]datarow{
+			{"Date(2015,6,1,0,0,0)", []float64{1.0, 1}},
+			{"Date(2015,6,2,0,0,0)", []float64{2.0, 1}},
+			{"Date(2015,6,3,0,0,0)", []float64{4.0, 2}},
+			{"Date(2015,6,4,0,0,0)", []float64{7.0, 2}},
+		})
+
+	// A query entirely within the unsummarized days should also work.
+	checkQuery(t, c,
+		QueryParams{
+			Labels:      []string{"A"},
+			SourceNames: []string{"a|b"},
+			Start:       lt(2015, 7, 4, 6, 0, 0),
+			End:         lt(2015, 7, 5, 0, 0, 0),
+			Granularity: DailyAverage,
+			Aggregation: 1,
+		},
+		[]datarow{
+			{"Date(2015,6,4,0,0,0)", []float64{7.0}},
+		})
+}
+
+func TestRunQueryUnsummarizedManySamples(t *testing.T) {
+	c := initTest()
+
+	// Write more minutely samples than are returned by a single datastore
+	// query. Nothing has been summarized, so all of them are read directly.
+	var samples []common.Sample
+	for i := 0; i < 2000; i++ {
+		v := float32(1.0)
+		if i >= 24*60 {
+			v = 3.0
+		}
+		samples = append(samples, common.Sample{
+			lt(2015, 7, 1, 0, 0, 0).Add(time.Duration(i) * time.Minute), "a", "b", v})
+	}
+	if err := WriteSamples(c, samples, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+
+	checkQuery(t, c,
+		QueryParams{
+			Labels:      []string{"A"},
+			SourceNames: []string{"a|b"},
+			Start:       lt(2015, 7, 1, 0, 0, 0),
+			End:         lt(2015, 7, 3, 0, 0, 0),
+			Granularity: DailyAverage,
+			Aggregation: 1,
+			Counts:      true,
+		},
+		[]datarow{
+			{"Date(2015,6,1,0,0,0)", []float64{1.0, 1440}},
+			{"Date(2015,6,2,0,0,0)", []float64{3.0, 560}},
+		})
+}
+
+func TestRunQueryUnsummarizedHourly(t *testing.T) {
+	c := initTest()
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2015, 7, 2, 0, 0, 0), "a", "b", 2.0},
+		common.Sample{lt(2015, 7, 3, 0, 0, 0), "a", "b", 3.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+	// July 2 is the last fully-summarized day. The hourly summaries for July 3
+	// will be stale after more samples are written.
+	if err := GenerateSummaries(c, lt(2015, 7, 3, 1, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2015, 7, 3, 0, 30, 0), "a", "b", 4.0},
+		common.Sample{lt(2015, 7, 3, 12, 0, 0), "a", "b", 5.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+
+	checkQuery(t, c,
+		QueryParams{
+			Labels:      []string{"A"},
+			SourceNames: []string{"a|b"},
+			Start:       lt(2015, 7, 2, 0, 0, 0),
+			End:         lt(2015, 7, 4, 0, 0, 0),
+			Granularity: HourlyAverage,
+			Aggregation: 1,
+			Counts:      true,
+		},
+		[]datarow{
+			{"Date(2015,6,2,0,0,0)", []float64{2.0, 1}},
+			{"Date(2015,6,3,0,0,0)", []float64{3.5, 2}},
+			{"Date(2015,6,3,12,0,0)", []float64{5.0, 1}},
+		})
+}
+
+func TestRunQueryUnsummarizedHourlyManySamples(t *testing.T) {
+	c := initTest()
+
+	// The newest hours shouldn't be omitted when the unsummarized period
+	// contains more samples than are returned by a single datastore query.
+	var samples []common.Sample
+	for i := 0; i < 2000; i++ {
+		samples = append(samples, common.Sample{
+			lt(2015, 7, 1, 0, 0, 0).Add(time.Duration(i) * time.Minute), "a", "b", float32(i / 60)})
+	}
+	if err := WriteSamples(c, samples, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+
+	b := &bytes.Buffer{}
+	if err := DoQuery(c, b, QueryParams{
+		Labels:      []string{"A"},
+		SourceNames: []string{"a|b"},
+		Start:       lt(2015, 7, 1, 0, 0, 0),
+		End:         lt(2015, 7, 3, 0, 0, 0),
+		Granularity: HourlyAverage,
+		Aggregation: 1,
+		Rows:        true,
+	}); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	var out struct {
+		Rows [][]float64 `json:"rows"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &out); err != nil {
+		t.Fatalf("Failed to unmarshal %q: %v", b.String(), err)
+	}
+	// 2000 minutes is 33 full hours plus 20 minutes.
+	if len(out.Rows) != 34 {
+		t.Fatalf("Query returned %v row(s); expected 34", len(out.Rows))
+	}
+	last := out.Rows[len(out.Rows)-1]
+	if exp := []float64{float64(lt(2015, 7, 2, 9, 0, 0).Unix()), 33}; !reflect.DeepEqual(last, exp) {
+		t.Errorf("Last row is %v; expected %v", last, exp)
+	}
+}
+
+func TestRunQueryCounts(t *testing.T) {
+	c := initTest()
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2015, 7, 3, 0, 0, 0), "a", "b", 3.0},
+		common.Sample{lt(2015, 7, 3, 0, 30, 0), "a", "b", 4.0},
+		common.Sample{lt(2015, 7, 3, 1, 0, 0), "a", "b", 5.0},
+		common.Sample{lt(2015, 7, 3, 1, 0, 0), "a", "c", 1.0},
+		common.Sample{lt(2015, 7, 3, 2, 0, 0), "a", "c", 2.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+	if err := GenerateSummaries(c, lt(2015, 7, 4, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+
+	nan := math.NaN()
+	checkQuery(t, c,
+		QueryParams{
+			Labels:      []string{"B", "C"},
+			SourceNames: []string{"a|b", "a|c"},
+			Start:       lt(2015, 7, 3, 0, 0, 0),
+			End:         lt(2015, 7, 3, 4, 0, 0),
+			Granularity: HourlyAverage,
+			Aggregation: 1,
+			Counts:      true,
+		},
+		[]datarow{
+			{"Date(2015,6,3,0,0,0)", []float64{3.5, nan, 2}},
+			{"Date(2015,6,3,1,0,0)", []float64{5, 1, 1, 1}},
+			{"Date(2015,6,3,2,0,0)", []float64{nan, 2, nan, 1}},
+		})
+
+	// Counts should be summed when points are aggregated.
+	checkQuery(t, c,
+		QueryParams{
+			Labels:      []string{"B"},
+			SourceNames: []string{"a|b"},
+			Start:       lt(2015, 7, 3, 0, 0, 0),
+			End:         lt(2015, 7, 3, 4, 0, 0),
+			Granularity: HourlyAverage,
+			Aggregation: 2,
+			Counts:      true,
+		},
+		[]datarow{
+			{"Date(2015,6,3,0,30,0)", []float64{4.25, 3}},
+		})
+
+	// Counts aren't included for individual samples.
+	checkQuery(t, c,
+		QueryParams{
+			Labels:      []string{"B"},
+			SourceNames: []string{"a|b"},
+			Start:       lt(2015, 7, 3, 0, 0, 0),
+			End:         lt(2015, 7, 3, 0, 0, 0),
+			Granularity: IndividualSample,
+			Aggregation: 1,
+			Counts:      true,
+		},
+		[]datarow{
+			{"Date(2015,6,3,0,0,0)", []float64{3.0}},
+		})
+}
+
+func TestRunQueryRanges(t *testing.T) {
+	c := initTest()
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2015, 7, 3, 0, 0, 0), "a", "b", 3.0},
+		common.Sample{lt(2015, 7, 3, 0, 30, 0), "a", "b", 4.0},
+		common.Sample{lt(2015, 7, 3, 1, 0, 0), "a", "b", 5.0},
+		common.Sample{lt(2015, 7, 3, 1, 30, 0), "a", "b", 9.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+	if err := GenerateSummaries(c, lt(2015, 7, 4, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+
+	qp := QueryParams{
+		Labels:      []string{"B"},
+		SourceNames: []string{"a|b"},
+		Start:       lt(2015, 7, 3, 0, 0, 0),
+		End:         lt(2015, 7, 3, 4, 0, 0),
+		Granularity: HourlyAverage,
+		Aggregation: 1,
+	}
+	var values []float32
+	ranges, err := RunQuery(c, qp, true, func(t time.Time, vals []float32) {
+		values = append(values, vals...)
+	})
+	if err != nil {
+		t.Fatalf("RunQuery failed: %v", err)
+	}
+	if exp := []float32{3.5, 7}; !floatSlicesEqual(values, exp) {
+		t.Errorf("RunQuery passed %v; expected %v", values, exp)
+	}
+	exp := []ValueRange{
+		{lt(2015, 7, 3, 0, 0, 0), 3, 4},
+		{lt(2015, 7, 3, 1, 0, 0), 5, 9},
+	}
+	if len(ranges) != 1 || len(ranges[0]) != len(exp) {
+		t.Errorf("RunQuery returned ranges %v; expected %v", ranges, exp)
+	} else {
+		for i, r := range ranges[0] {
+			if !r.Timestamp.Equal(exp[i].Timestamp) || r.Min != exp[i].Min || r.Max != exp[i].Max {
+				t.Errorf("RunQuery returned range %v; expected %v", r, exp[i])
+			}
+		}
+	}
+
+	// Ranges aren't returned for individual samples.
+	qp.Granularity = IndividualSample
+	if ranges, err := RunQuery(c, qp, true, func(time.Time, []float32) {}); err != nil {
+		t.Fatalf("RunQuery failed: %v", err)
+	} else if ranges != nil {
+		t.Errorf("RunQuery returned ranges %v for individual samples", ranges)
+	}
+}
+
 func TestRunQueryAggregation(t *testing.T) {
 	c := initTest()
 
@@ -304,7 +1043,7 @@ func TestRunQueryAggregation(t *testing.T) {
 		common.Sample{lt(2015, 7, 1, 0, 3, 0), "a", "b", 4.0},
 		common.Sample{lt(2015, 7, 1, 0, 4, 0), "a", "b", 5.0},
 		common.Sample{lt(2015, 7, 1, 0, 5, 0), "a", "b", 6.0},
-	}); err != nil {
+	}, nil); err != nil {
 		t.Fatalf("Failed inserting samples: %v", err)
 	}
 
@@ -313,28 +1052,196 @@ func TestRunQueryAggregation(t *testing.T) {
 	start := lt(2015, 7, 1, 0, 0, 0)
 	end := lt(2015, 7, 2, 0, 0, 0)
 
-	checkQuery(t, c, QueryParams{l, sn, start, end, IndividualSample, 2},
+	checkQuery(t, c, QueryParams{
+		Labels:      l,
+		SourceNames: sn,
+		Start:       start,
+		End:         end,
+		Granularity: IndividualSample,
+		Aggregation: 2,
+	},
 		[]datarow{
 			{"Date(2015,6,1,0,0,30)", []float64{1.5}},
 			{"Date(2015,6,1,0,2,30)", []float64{3.5}},
 			{"Date(2015,6,1,0,4,30)", []float64{5.5}},
 		})
-	checkQuery(t, c, QueryParams{l, sn, start, end, IndividualSample, 3},
+	checkQuery(t, c, QueryParams{
+		Labels:      l,
+		SourceNames: sn,
+		Start:       start,
+		End:         end,
+		Granularity: IndividualSample,
+		Aggregation: 3,
+	},
 		[]datarow{
 			{"Date(2015,6,1,0,1,0)", []float64{2.0}},
 			{"Date(2015,6,1,0,4,0)", []float64{5.0}},
 		})
-	checkQuery(t, c, QueryParams{l, sn, start, end, IndividualSample, 4},
+	checkQuery(t, c, QueryParams{
+		Labels:      l,
+		SourceNames: sn,
+		Start:       start,
+		End:         end,
+		Granularity: IndividualSample,
+		Aggregation: 4,
+	},
 		[]datarow{
 			{"Date(2015,6,1,0,1,30)", []float64{2.5}},
 			{"Date(2015,6,1,0,4,30)", []float64{5.5}},
 		})
-	checkQuery(t, c, QueryParams{l, sn, start, end, IndividualSample, 6},
+	checkQuery(t, c, QueryParams{
+		Labels:      l,
+		SourceNames: sn,
+		Start:       start,
+		End:         end,
+		Granularity: IndividualSample,
+		Aggregation: 6,
+	},
 		[]datarow{
 			{"Date(2015,6,1,0,2,30)", []float64{3.5}},
 		})
 }
 
+func TestRunQueryAlignedAggregation(t *testing.T) {
+	c := initTest()
+
+	var samples []common.Sample
+	for i := 0; i < 12; i++ {
+		samples = append(samples, common.Sample{lt(2015, 7, 1, 0, i, 0), "a", "b", float32(i)})
+	}
+	if err := WriteSamples(c, samples, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+
+	l := []string{"A"}
+	sn := []string{"a|b"}
+	end := lt(2015, 7, 2, 0, 0, 0)
+
+	// Count-based aggregation groups points starting at the beginning of the
+	// results, so the boundaries move with the query's start.
+	checkQuery(t, c, QueryParams{
+		Labels:      l,
+		SourceNames: sn,
+		Start:       lt(2015, 7, 1, 0, 2, 0),
+		End:         end,
+		Granularity: IndividualSample,
+		Aggregation: 5,
+	},
+		[]datarow{
+			{"Date(2015,6,1,0,4,0)", []float64{4.0}},
+			{"Date(2015,6,1,0,9,0)", []float64{9.0}},
+		})
+
+	// Aligned aggregation should use the same five-minute periods regardless
+	// of the query's start, and should report each point at the start of its
+	// period.
+	for _, start := range []time.Time{lt(2015, 7, 1, 0, 0, 0), lt(2015, 7, 1, 0, 2, 0)} {
+		exp := []datarow{
+			{"Date(2015,6,1,0,0,0)", []float64{2.0}},
+			{"Date(2015,6,1,0,5,0)", []float64{7.0}},
+			{"Date(2015,6,1,0,10,0)", []float64{10.5}},
+		}
+		if start.Minute() == 2 {
+			exp[0].v = []float64{3.0}
+		}
+		checkQuery(t, c, QueryParams{
+			Labels:      l,
+			SourceNames: sn,
+			Start:       start,
+			End:         end,
+			Granularity: IndividualSample,
+			AlignPeriod: 5 * time.Minute,
+		}, exp)
+	}
+}
+
+func TestRunQueryDailyDST(t *testing.T) {
+	c := initTest()
+
+	// In 2016, DST started on March 13 and ended on November 6.
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2016, 3, 12, 12, 0, 0), "a", "b", 1.0},
+		common.Sample{lt(2016, 3, 13, 12, 0, 0), "a", "b", 2.0},
+		common.Sample{lt(2016, 3, 14, 12, 0, 0), "a", "b", 3.0},
+		common.Sample{lt(2016, 11, 5, 12, 0, 0), "a", "b", 4.0},
+		common.Sample{lt(2016, 11, 6, 12, 0, 0), "a", "b", 5.0},
+		common.Sample{lt(2016, 11, 7, 12, 0, 0), "a", "b", 6.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+	if err := GenerateSummaries(c, lt(2016, 11, 9, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+
+	// Days should be reported at local midnight, and a query starting partway
+	// through a day should include that day.
+	for _, tc := range []struct {
+		start, end time.Time
+		rows       []datarow
+	}{
+		{lt(2016, 3, 12, 10, 0, 0), lt(2016, 3, 15, 0, 0, 0), []datarow{
+			{"Date(2016,2,12,0,0,0)", []float64{1.0}},
+			{"Date(2016,2,13,0,0,0)", []float64{2.0}},
+			{"Date(2016,2,14,0,0,0)", []float64{3.0}},
+		}},
+		{lt(2016, 11, 5, 10, 0, 0), lt(2016, 11, 8, 0, 0, 0), []datarow{
+			{"Date(2016,10,5,0,0,0)", []float64{4.0}},
+			{"Date(2016,10,6,0,0,0)", []float64{5.0}},
+			{"Date(2016,10,7,0,0,0)", []float64{6.0}},
+		}},
+	} {
+		checkQuery(t, c, QueryParams{
+			Labels:      []string{"A"},
+			SourceNames: []string{"a|b"},
+			Start:       tc.start,
+			End:         tc.end,
+			Granularity: DailyAverage,
+			Aggregation: 1,
+		},
+			tc.rows)
+	}
+
+	// When aggregating three days, the average should be reported at the
+	// middle day's midnight.
+	checkQuery(t, c,
+		QueryParams{
+			Labels:      []string{"A"},
+			SourceNames: []string{"a|b"},
+			Start:       lt(2016, 3, 12, 0, 0, 0),
+			End:         lt(2016, 3, 15, 0, 0, 0),
+			Granularity: DailyAverage,
+			Aggregation: 3,
+		},
+		[]datarow{{"Date(2016,2,13,0,0,0)", []float64{2.0}}})
+	checkQuery(t, c,
+		QueryParams{
+			Labels:      []string{"A"},
+			SourceNames: []string{"a|b"},
+			Start:       lt(2016, 11, 5, 0, 0, 0),
+			End:         lt(2016, 11, 8, 0, 0, 0),
+			Granularity: DailyAverage,
+			Aggregation: 3,
+		},
+		[]datarow{{"Date(2016,10,6,0,0,0)", []float64{5.0}}})
+}
+
+func TestWallClockMidpoint(t *testing.T) {
+	for _, tc := range []struct {
+		a, b, exp time.Time
+	}{
+		{lt(2016, 1, 1, 0, 0, 0), lt(2016, 1, 3, 0, 0, 0), lt(2016, 1, 2, 0, 0, 0)},
+		{lt(2016, 3, 12, 0, 0, 0), lt(2016, 3, 14, 0, 0, 0), lt(2016, 3, 13, 0, 0, 0)},
+		{lt(2016, 11, 5, 0, 0, 0), lt(2016, 11, 7, 0, 0, 0), lt(2016, 11, 6, 0, 0, 0)},
+		{lt(2016, 3, 13, 0, 0, 0), lt(2016, 3, 14, 0, 0, 0), lt(2016, 3, 13, 12, 0, 0)},
+	} {
+		// Pass UTC times to check that they're converted to the location.
+		if act := wallClockMidpoint(tc.a.UTC(), tc.b.UTC(), testLoc); !act.Equal(tc.exp) {
+			t.Errorf("Midpoint of %v and %v is %v; expected %v", tc.a, tc.b, act, tc.exp)
+		}
+	}
+}
+
 func TestQueryParamsUpdateGranularityAndAggregation(t *testing.T) {
 	min := func(n int) time.Duration {
 		return time.Minute * time.Duration(n)
@@ -366,3 +1273,233 @@ func TestQueryParamsUpdateGranularityAndAggregation(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryParamsSetGranularity(t *testing.T) {
+	min := func(n int) time.Duration {
+		return time.Minute * time.Duration(n)
+	}
+
+	for _, tc := range []struct {
+		start, end     time.Time
+		granularity    QueryGranularity
+		sampleInterval time.Duration
+		expAggregation int
+	}{
+		{ld(2015, 1, 1), ld(2015, 1, 2), IndividualSample, min(5), 2},
+		{ld(2015, 1, 1), ld(2015, 1, 2), IndividualSample, 0, 1},
+		{ld(2015, 1, 1), ld(2015, 1, 2), HourlyAverage, min(5), 1},
+		{ld(2015, 1, 1), ld(2015, 1, 31), HourlyAverage, min(5), 7},
+		{ld(2015, 1, 1), ld(2015, 1, 2), DailyAverage, min(5), 1},
+		{ld(2015, 1, 1), ld(2016, 1, 1), DailyAverage, min(5), 3},
+	} {
+		qp := QueryParams{Start: tc.start, End: tc.end}
+		qp.SetGranularity(tc.granularity, tc.sampleInterval)
+		if qp.Granularity != tc.granularity || qp.Aggregation != tc.expAggregation {
+			t.Errorf("Bad result(s) for %v-%v: granularity %v (exp %v), aggregation %v (exp %v)",
+				formatDate(tc.start), formatDate(tc.end), qp.Granularity, tc.granularity,
+				qp.Aggregation, tc.expAggregation)
+		}
+	}
+}
+
+func TestParseQueryGranularity(t *testing.T) {
+	for _, g := range []QueryGranularity{IndividualSample, HourlyAverage, DailyAverage} {
+		if pg, err := ParseQueryGranularity(g.String()); err != nil {
+			t.Errorf("Failed parsing %q: %v", g.String(), err)
+		} else if pg != g {
+			t.Errorf("Parsing %q returned %v", g.String(), pg)
+		}
+	}
+	for _, s := range []string{"", "minute", "Hour"} {
+		if _, err := ParseQueryGranularity(s); err == nil {
+			t.Errorf("Didn't get expected error when parsing %q", s)
+		}
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	c := initTest()
+	s0 := common.Sample{lt(2015, 7, 1, 0, 0, 0), "a", "b", 1.0}
+	s1 := common.Sample{lt(2015, 7, 1, 0, 30, 0), "a", "b", 2.0}
+	s2 := common.Sample{lt(2015, 7, 1, 1, 15, 0), "a", "b", 3.0}
+	if err := WriteSamples(c, []common.Sample{s0, s1, s2}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+
+	// put writes s to datastore without invalidating the cache, making it
+	// possible to tell whether a bucket was read from the cache.
+	put := func(s common.Sample) {
+		if _, err := datastore.Put(c, datastore.NewKey(c, sampleKind, getSampleId(&s), 0, nil),
+			&s); err != nil {
+			t.Fatalf("Failed putting sample: %v", err)
+		}
+	}
+
+	now := lt(2015, 7, 2, 0, 0, 0)
+	check := func(start, end time.Time, exp []common.Sample) {
+		points, err := getSamplePoints(c, "a", "b", start, end, now, maxQueryDatastoreResults)
+		if err != nil {
+			t.Fatalf("Failed getting points: %v", err)
+		}
+		act := make([]common.Sample, len(points))
+		for i, p := range points {
+			act[i] = common.Sample{p.timestamp.In(testLoc), "a", "b", p.value}
+		}
+		if as, es := common.JoinSamples(act), common.JoinSamples(exp); as != es {
+			t.Errorf("Got %q for %v-%v; expected %q", as, start, end, es)
+		}
+	}
+
+	// The first query reads both hours' buckets from datastore and caches
+	// them. Subsequent queries in the same range should use the cache.
+	check(lt(2015, 7, 1, 0, 15, 0), lt(2015, 7, 1, 1, 30, 0), []common.Sample{s1, s2})
+	put(common.Sample{lt(2015, 7, 1, 0, 45, 0), "a", "b", 9.0})
+	check(lt(2015, 7, 1, 0, 0, 0), lt(2015, 7, 1, 1, 59, 0), []common.Sample{s0, s1, s2})
+
+	// Writing a sample should invalidate its bucket.
+	s3 := common.Sample{lt(2015, 7, 1, 1, 45, 0), "a", "b", 4.0}
+	if err := WriteSamples(c, []common.Sample{s3}, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+	check(lt(2015, 7, 1, 0, 0, 0), lt(2015, 7, 1, 1, 59, 0), []common.Sample{s0, s1, s2, s3})
+
+	// The invalidated bucket shouldn't be cached again immediately, since the
+	// query that read it could've missed the write.
+	s4 := common.Sample{lt(2015, 7, 1, 1, 50, 0), "a", "b", 5.0}
+	put(s4)
+	check(lt(2015, 7, 1, 0, 0, 0), lt(2015, 7, 1, 1, 59, 0), []common.Sample{s0, s1, s2, s3, s4})
+
+	// Buckets that haven't ended yet shouldn't be cached.
+	if err := memcache.Flush(c); err != nil {
+		t.Fatalf("Failed flushing memcache: %v", err)
+	}
+	s5 := common.Sample{lt(2015, 7, 2, 0, 30, 0), "a", "b", 6.0}
+	put(s5)
+	now = lt(2015, 7, 2, 0, 45, 0)
+	check(lt(2015, 7, 2, 0, 0, 0), lt(2015, 7, 2, 0, 59, 0), []common.Sample{s5})
+	s6 := common.Sample{lt(2015, 7, 2, 0, 40, 0), "a", "b", 7.0}
+	put(s6)
+	check(lt(2015, 7, 2, 0, 0, 0), lt(2015, 7, 2, 0, 59, 0), []common.Sample{s5, s6})
+}
+
+func TestGetSamplePointsLimit(t *testing.T) {
+	c := initTest()
+	var samples []common.Sample
+	for _, min := range []int{0, 10, 20, 40, 70, 80, 90} {
+		samples = append(samples, common.Sample{lt(2015, 7, 1, 0, min, 0), "a", "b", float32(min)})
+	}
+	if err := WriteSamples(c, samples, nil); err != nil {
+		t.Fatalf("Failed inserting samples: %v", err)
+	}
+
+	// Samples in the first bucket from before the start time shouldn't count
+	// toward the limit.
+	points, err := getSamplePoints(c, "a", "b", lt(2015, 7, 1, 0, 30, 0),
+		lt(2015, 7, 1, 2, 0, 0), lt(2015, 7, 2, 0, 0, 0), 3)
+	if err != nil {
+		t.Fatalf("Failed getting points: %v", err)
+	}
+	var act []float32
+	for _, p := range points {
+		act = append(act, p.value)
+	}
+	if exp := []float32{40, 70, 80}; !floatSlicesEqual(act, exp) {
+		t.Errorf("Got values %v; expected %v", act, exp)
+	}
+}
+
+func TestEncodePoints(t *testing.T) {
+	points := []point{
+		point{time.Unix(123, 456000), 1.5, nil},
+		point{time.Unix(789, 0), -2.25, nil},
+	}
+	dec, err := decodePoints(encodePoints(points))
+	if err != nil {
+		t.Fatalf("Failed decoding points: %v", err)
+	}
+	if len(dec) != len(points) {
+		t.Fatalf("Decoded %v point(s); expected %v", len(dec), len(points))
+	}
+	for i := range points {
+		if !dec[i].timestamp.Equal(points[i].timestamp) || dec[i].value != points[i].value {
+			t.Errorf("Point %v decoded as %v; expected %v", i, dec[i], points[i])
+		}
+	}
+	if dec, err := decodePoints(nil); err != nil || dec == nil || len(dec) != 0 {
+		t.Errorf("Decoding empty points returned %v, %v", dec, err)
+	}
+	if _, err := decodePoints([]byte{1, 2, 3}); err == nil {
+		t.Errorf("Decoding truncated points unexpectedly succeeded")
+	}
+}
+
+// BenchmarkDoQuery measures the datastore reads performed by a day-long query
+// of individual samples with and without the query cache. The numbers of
+// datastore read calls and entities returned per query are reported as
+// "reads/op" and "entities/op".
+func BenchmarkDoQuery(b *testing.B) {
+	c := initTest()
+
+	// Count datastore reads made by the query.
+	var reads, entities int64
+	c = appengine.WithAPICallFunc(c, func(ctx context.Context, service, method string,
+		in, out proto.Message) error {
+		err := appengine.APICall(ctx, service, method, in, out)
+		if service == "datastore_v3" && (method == "Get" || method == "RunQuery" || method == "Next") {
+			atomic.AddInt64(&reads, 1)
+			// GetResponse and QueryResult hold their entities in these fields.
+			for _, f := range []string{"Entity", "Result"} {
+				if v := reflect.ValueOf(out).Elem().FieldByName(f); v.Kind() == reflect.Slice {
+					atomic.AddInt64(&entities, int64(v.Len()))
+				}
+			}
+		}
+		return err
+	})
+
+	start := lt(2015, 7, 1, 0, 0, 0)
+	samples := make([]common.Sample, 0, 24*60)
+	for i := 0; i < 24*60; i++ {
+		samples = append(samples, common.Sample{start.Add(time.Duration(i) * time.Minute), "a", "b", float32(i)})
+	}
+	if err := WriteSamples(c, samples, nil); err != nil {
+		b.Fatalf("Failed inserting samples: %v", err)
+	}
+	qp := QueryParams{
+		Labels:      []string{"B"},
+		SourceNames: []string{"a|b"},
+		Start:       start,
+		End:         start.Add(24*time.Hour - time.Second),
+		Granularity: IndividualSample,
+		Aggregation: 15,
+	}
+
+	for _, tc := range []struct {
+		name  string
+		flush bool
+	}{
+		{"uncached", true},
+		{"cached", false},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			if err := DoQuery(c, ioutil.Discard, qp); err != nil {
+				b.Fatalf("Query failed: %v", err)
+			}
+			atomic.StoreInt64(&reads, 0)
+			atomic.StoreInt64(&entities, 0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if tc.flush {
+					b.StopTimer()
+					memcache.Flush(c)
+					b.StartTimer()
+				}
+				if err := DoQuery(c, ioutil.Discard, qp); err != nil {
+					b.Fatalf("Query failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&reads))/float64(b.N), "reads/op")
+			b.ReportMetric(float64(atomic.LoadInt64(&entities))/float64(b.N), "entities/op")
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// QueryReducer describes how sequential points are combined when a query
+// aggregates them.
+type QueryReducer int
+
+const (
+	AverageReducer QueryReducer = iota
+	MinReducer
+	MaxReducer
+	MedianReducer
+)
+
+// String returns the name used for r in URLs.
+func (r QueryReducer) String() string {
+	switch r {
+	case AverageReducer:
+		return "avg"
+	case MinReducer:
+		return "min"
+	case MaxReducer:
+		return "max"
+	case MedianReducer:
+		return "median"
+	default:
+		return fmt.Sprintf("QueryReducer(%d)", int(r))
+	}
+}
+
+// ParseQueryReducer parses a reducer name ("avg", "min", "max", or "median")
+// as returned by QueryReducer.String.
+func ParseQueryReducer(s string) (QueryReducer, error) {
+	for _, r := range []QueryReducer{AverageReducer, MinReducer, MaxReducer, MedianReducer} {
+		if s == r.String() {
+			return r, nil
+		}
+	}
+	return AverageReducer, fmt.Errorf("Invalid reducer %q", s)
+}
+
+// reducer returns the function implementing r.
+func (r QueryReducer) reducer() func(points []point) point {
+	switch r {
+	case MinReducer:
+		return minPoints
+	case MaxReducer:
+		return maxPoints
+	case MedianReducer:
+		return medianPoints
+	default:
+		return averagePoints
+	}
+}
+
+// reducePoints returns a point containing the midpoint time of points, which
+// must be sorted by ascending time, and the value returned by f for their
+// non-NaN values. If all of the values are NaN, the point's value is NaN.
+// An empty point is returned if points is empty.
+func reducePoints(points []point, f func(values []float32) float32) point {
+	if len(points) == 0 {
+		return point{}
+	} else if len(points) == 1 {
+		return points[0]
+	}
+
+	values := make([]float32, 0, len(points))
+	for _, p := range points {
+		if !math.IsNaN(float64(p.value)) {
+			values = append(values, p.value)
+		}
+	}
+	v := float32(math.NaN())
+	if len(values) > 0 {
+		v = f(values)
+	}
+	elapsed := points[len(points)-1].timestamp.Sub(points[0].timestamp)
+	return point{
+		timestamp: points[0].timestamp.Add(elapsed / time.Duration(2)),
+		value:     v,
+		err:       nil,
+	}
+}
+
+// averagePoints returns a point containing the midpoint time and average value
+// of points, which must be sorted by ascending time.
+func averagePoints(points []point) point {
+	return reducePoints(points, func(values []float32) float32 {
+		var total float32
+		for _, v := range values {
+			total += v
+		}
+		return total / float32(len(values))
+	})
+}
+
+// minPoints is like averagePoints but returns the minimum value.
+func minPoints(points []point) point {
+	return reducePoints(points, func(values []float32) float32 {
+		min := values[0]
+		for _, v := range values[1:] {
+			if v < min {
+				min = v
+			}
+		}
+		return min
+	})
+}
+
+// maxPoints is like averagePoints but returns the maximum value.
+func maxPoints(points []point) point {
+	return reducePoints(points, func(values []float32) float32 {
+		max := values[0]
+		for _, v := range values[1:] {
+			if v > max {
+				max = v
+			}
+		}
+		return max
+	})
+}
+
+// medianPoints is like averagePoints but returns the median value. The
+// average of the two middle values is used when there are an even number.
+func medianPoints(points []point) point {
+	return reducePoints(points, func(values []float32) float32 {
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		n := len(values)
+		if n%2 == 1 {
+			return values[n/2]
+		}
+		return (values[n/2-1] + values[n/2]) / 2
+	})
+}
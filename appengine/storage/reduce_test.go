@@ -0,0 +1,102 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAveragePoints(t *testing.T) {
+	f := func(p point) string {
+		return fmt.Sprintf("%v|%.1f", p.timestamp.Unix(), p.value)
+	}
+
+	nan := float32(math.NaN())
+	for _, tc := range []struct {
+		in  []point
+		exp point
+	}{
+		{[]point{}, point{}},
+		{[]point{point{time.Unix(10, 0), 5.0, nil}}, point{time.Unix(10, 0), 5.0, nil}},
+		{[]point{
+			point{time.Unix(10, 0), 1.0, nil},
+			point{time.Unix(20, 0), 2.0, nil},
+			point{time.Unix(30, 0), 3.0, nil},
+			point{time.Unix(40, 0), 4.0, nil},
+		}, point{time.Unix(25, 0), 2.5, nil}},
+		{[]point{
+			point{time.Unix(10, 0), 1.0, nil},
+			point{time.Unix(20, 0), nan, nil},
+			point{time.Unix(30, 0), 3.0, nil},
+		}, point{time.Unix(20, 0), 2.0, nil}},
+		{[]point{
+			point{time.Unix(10, 0), nan, nil},
+			point{time.Unix(20, 0), nan, nil},
+		}, point{time.Unix(15, 0), nan, nil}},
+	} {
+		a := f(averagePoints(tc.in))
+		e := f(tc.exp)
+		if a != e {
+			t.Errorf("Expected %v, got %v", e, a)
+		}
+	}
+}
+
+func TestReducers(t *testing.T) {
+	nan := float32(math.NaN())
+	for _, tc := range []struct {
+		values []float32
+		exp    map[QueryReducer]float32
+	}{
+		{[]float32{3}, map[QueryReducer]float32{
+			AverageReducer: 3, MinReducer: 3, MaxReducer: 3, MedianReducer: 3}},
+		{[]float32{4, 1, 7}, map[QueryReducer]float32{
+			AverageReducer: 4, MinReducer: 1, MaxReducer: 7, MedianReducer: 4}},
+		{[]float32{4, 1, 9, 2}, map[QueryReducer]float32{
+			AverageReducer: 4, MinReducer: 1, MaxReducer: 9, MedianReducer: 3}},
+		{[]float32{nan, 5, nan, 1}, map[QueryReducer]float32{
+			AverageReducer: 3, MinReducer: 1, MaxReducer: 5, MedianReducer: 3}},
+		{[]float32{nan, nan}, map[QueryReducer]float32{
+			AverageReducer: nan, MinReducer: nan, MaxReducer: nan, MedianReducer: nan}},
+	} {
+		points := make([]point, len(tc.values))
+		for i, v := range tc.values {
+			points[i] = makePoint(10*(i+1), v)
+		}
+		expTime := points[0].timestamp.Add(points[len(points)-1].timestamp.Sub(points[0].timestamp) / 2)
+		for r, exp := range tc.exp {
+			p := r.reducer()(points)
+			if !p.timestamp.Equal(expTime) {
+				t.Errorf("%v of %v returned time %v; expected %v", r, tc.values, p.timestamp, expTime)
+			}
+			if (math.IsNaN(float64(exp)) && !math.IsNaN(float64(p.value))) ||
+				(!math.IsNaN(float64(exp)) && p.value != exp) {
+				t.Errorf("%v of %v returned %v; expected %v", r, tc.values, p.value, exp)
+			}
+		}
+	}
+
+	// The reducers shouldn't modify their input.
+	points := []point{makePoint(10, 3), makePoint(20, 1), makePoint(30, 2)}
+	medianPoints(points)
+	if points[0].value != 3 || points[1].value != 1 || points[2].value != 2 {
+		t.Errorf("medianPoints modified its input: %v", points)
+	}
+}
+
+func TestParseQueryReducer(t *testing.T) {
+	for _, r := range []QueryReducer{AverageReducer, MinReducer, MaxReducer, MedianReducer} {
+		if act, err := ParseQueryReducer(r.String()); err != nil {
+			t.Errorf("Failed to parse %q: %v", r.String(), err)
+		} else if act != r {
+			t.Errorf("Parsed %q as %v; expected %v", r.String(), act, r)
+		}
+	}
+	if _, err := ParseQueryReducer("bogus"); err == nil {
+		t.Errorf("Didn't get error for bogus reducer")
+	}
+}
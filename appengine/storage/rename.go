@@ -0,0 +1,206 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/derat/home/common"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+// RenameSeries moves all samples and summaries belonging to the series
+// identified by oldSource and oldName to newSource and newName.
+//
+// Entities are processed in batches: each batch is read, written under its new
+// key, and then deleted from the old series. Append-only samples (see
+// WriteSamples) are instead rewritten under their existing keys. Since entities
+// are only deleted after being copied, it's safe to call RenameSeries again
+// after it fails partway through. An error is returned if the new series already contains a
+// different entity with the same timestamp as one being moved.
+func RenameSeries(c context.Context, oldSource, oldName, newSource, newName string) error {
+	if oldSource == newSource && oldName == newName {
+		return nil
+	}
+
+	log.Debugf(c, "Renaming %s|%s to %s|%s", oldSource, oldName, newSource, newName)
+	if err := renameSamples(c, oldSource, oldName, newSource, newName); err != nil {
+		return err
+	}
+	for _, kind := range []string{hourSummaryKind, daySummaryKind} {
+		if err := renameSummaries(c, kind, oldSource, oldName, newSource, newName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getSeriesBatchQuery returns a query for the next batch of entities of the
+// supplied kind belonging to a series.
+func getSeriesBatchQuery(kind, source, name string) *datastore.Query {
+	// The batch size needs to be within the limits for both writes and
+	// deletes. Callers stop after a partial batch.
+	return datastore.NewQuery(kind).Filter("Source =", source).Filter("Name =", name).
+		Limit(summaryDeleteBatchSize)
+}
+
+// renameSamples performs RenameSeries's work for sample entities.
+func renameSamples(c context.Context, oldSource, oldName, newSource, newName string) error {
+	q := getSeriesBatchQuery(sampleKind, oldSource, oldName)
+	for {
+		var samples []common.Sample
+		oldKeys, err := q.GetAll(c, &samples)
+		if err != nil {
+			return err
+		} else if len(oldKeys) == 0 {
+			return nil
+		}
+
+		newKeys := make([]*datastore.Key, len(samples))
+		for i := range samples {
+			samples[i].Source = newSource
+			samples[i].Name = newName
+			if oldKeys[i].IntID() != 0 {
+				// Append-only samples' keys (see WriteSamples) don't depend on
+				// their series, so the samples are rewritten in place. This
+				// also ensures that a retried batch doesn't duplicate them.
+				newKeys[i] = oldKeys[i]
+			} else {
+				newKeys[i] = datastore.NewKey(c, sampleKind, getSampleId(&samples[i]), 0, nil)
+			}
+		}
+
+		// Append-only samples can't collide with existing samples, so only
+		// check the ones with string IDs.
+		var checkKeys []*datastore.Key
+		var checkSamples []common.Sample
+		for i, k := range newKeys {
+			if k.IntID() == 0 {
+				checkKeys = append(checkKeys, k)
+				checkSamples = append(checkSamples, samples[i])
+			}
+		}
+		existing := make([]common.Sample, len(checkSamples))
+		found, err := getExistingEntities(c, checkKeys, existing)
+		if err != nil {
+			return err
+		}
+		for i, s := range checkSamples {
+			e := existing[i]
+			if found[i] && (!e.Timestamp.Equal(s.Timestamp) || e.Value != s.Value) {
+				return fmt.Errorf("Sample %v already exists with different value %v",
+					checkKeys[i].StringID(), e.Value)
+			}
+		}
+
+		if err := moveEntities(c, oldKeys, newKeys, samples); err != nil {
+			return err
+		}
+		invalidateQueryCache(c, samples)
+		for i := range samples {
+			samples[i].Source = oldSource
+			samples[i].Name = oldName
+		}
+		invalidateQueryCache(c, samples)
+		if len(oldKeys) < summaryDeleteBatchSize {
+			return nil
+		}
+	}
+}
+
+// renameSummaries performs RenameSeries's work for summary entities of the
+// supplied kind.
+func renameSummaries(c context.Context, kind, oldSource, oldName, newSource, newName string) error {
+	q := getSeriesBatchQuery(kind, oldSource, oldName)
+	for {
+		var sums []summary
+		oldKeys, err := q.GetAll(c, &sums)
+		if err != nil {
+			return err
+		} else if len(oldKeys) == 0 {
+			return nil
+		}
+
+		newKeys := make([]*datastore.Key, len(sums))
+		for i := range sums {
+			sums[i].Source = newSource
+			sums[i].Name = newName
+			newKeys[i] = datastore.NewKey(c, kind, getSummaryId(&sums[i]), 0, nil)
+		}
+
+		existing := make([]summary, len(sums))
+		found, err := getExistingEntities(c, newKeys, existing)
+		if err != nil {
+			return err
+		}
+		for i, s := range sums {
+			e := existing[i]
+			if found[i] && (!e.Timestamp.Equal(s.Timestamp) || e.MinValue != s.MinValue ||
+				e.MaxValue != s.MaxValue || e.AvgValue != s.AvgValue) {
+				return fmt.Errorf("%v %v already exists with different values", kind, newKeys[i].StringID())
+			}
+		}
+
+		if err := moveEntities(c, oldKeys, newKeys, sums); err != nil {
+			return err
+		}
+		if len(oldKeys) < summaryDeleteBatchSize {
+			return nil
+		}
+	}
+}
+
+// getExistingEntities loads the entities identified by keys into dst, a slice
+// of the same length. The returned slice describes which entities were found.
+func getExistingEntities(c context.Context, keys []*datastore.Key, dst interface{}) ([]bool, error) {
+	found := make([]bool, len(keys))
+	if len(keys) == 0 {
+		return found, nil
+	}
+	err := datastore.GetMulti(c, keys, dst)
+	if me, ok := err.(appengine.MultiError); ok {
+		for i, e := range me {
+			if e == nil {
+				found[i] = true
+			} else if e != datastore.ErrNoSuchEntity {
+				return nil, e
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		for i := range found {
+			found[i] = true
+		}
+	}
+	return found, nil
+}
+
+// deleteMovedEntities is called by moveEntities to delete entities after
+// they've been written under their new keys. Tests replace it to simulate
+// failures.
+var deleteMovedEntities = datastore.DeleteMulti
+
+// moveEntities writes ents using newKeys and then deletes the entries in
+// oldKeys that weren't overwritten.
+func moveEntities(c context.Context, oldKeys, newKeys []*datastore.Key, ents interface{}) error {
+	log.Debugf(c, "Moving %v entities", len(oldKeys))
+	if _, err := datastore.PutMulti(c, newKeys, ents); err != nil {
+		return err
+	}
+	var del []*datastore.Key
+	for i, k := range oldKeys {
+		if !k.Equal(newKeys[i]) {
+			del = append(del, k)
+		}
+	}
+	if len(del) == 0 {
+		return nil
+	}
+	return deleteMovedEntities(c, del)
+}
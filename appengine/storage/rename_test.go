@@ -0,0 +1,109 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/derat/home/common"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+func TestRenameSeries(t *testing.T) {
+	c := initTest()
+
+	s0 := common.Sample{lt(2017, 1, 1, 0, 0, 0), "a", "b", 1.0}
+	s1 := common.Sample{lt(2017, 1, 1, 1, 0, 0), "a", "b", 2.0}
+	s2 := common.Sample{lt(2017, 1, 1, 0, 0, 0), "a", "c", 3.0}
+	if err := WriteSamples(c, []common.Sample{s0, s1, s2}, nil); err != nil {
+		t.Fatalf("Failed to insert samples: %v", err)
+	}
+	if err := GenerateSummaries(c, lt(2017, 1, 3, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+
+	if err := RenameSeries(c, "a", "b", "x", "y"); err != nil {
+		t.Fatalf("Failed to rename series: %v", err)
+	}
+	r0 := common.Sample{s0.Timestamp, "x", "y", s0.Value}
+	r1 := common.Sample{s1.Timestamp, "x", "y", s1.Value}
+	checkSamples(t, c, []common.Sample{s2, r0, r1})
+	checkSummaries(t, c, hourSummaryKind, []summary{
+		newSummary(lt(2017, 1, 1, 0, 0, 0), "a", "c", 3.0, 3.0, 3.0),
+		newSummary(lt(2017, 1, 1, 0, 0, 0), "x", "y", 1.0, 1.0, 1.0),
+		newSummary(lt(2017, 1, 1, 1, 0, 0), "x", "y", 2.0, 2.0, 2.0),
+	})
+	checkSummaries(t, c, daySummaryKind, []summary{
+		newSummary(ld(2017, 1, 1), "a", "c", 3.0, 3.0, 3.0),
+		newSummary(ld(2017, 1, 1), "x", "y", 1.0, 2.0, 1.5),
+	})
+
+	// Simulate an interrupted earlier rename by writing one of the old samples
+	// back. Renaming again should succeed since the new series already has an
+	// identical sample.
+	if err := WriteSamples(c, []common.Sample{s0}, nil); err != nil {
+		t.Fatalf("Failed to insert samples: %v", err)
+	}
+	if err := RenameSeries(c, "a", "b", "x", "y"); err != nil {
+		t.Fatalf("Failed to rename series again: %v", err)
+	}
+	checkSamples(t, c, []common.Sample{s2, r0, r1})
+
+	// Renaming onto a series that has a different value at the same time
+	// should fail without deleting anything.
+	if err := RenameSeries(c, "a", "c", "x", "y"); err == nil {
+		t.Errorf("Renaming onto existing series unexpectedly succeeded")
+	}
+	checkSamples(t, c, []common.Sample{s2, r0, r1})
+}
+
+func TestRenameSeriesRetry(t *testing.T) {
+	c := initTest()
+
+	e0 := common.Sample{lt(2017, 1, 1, 0, 0, 0), "a", "b", 1.0}
+	e1 := common.Sample{lt(2017, 1, 1, 0, 30, 0), "a", "b", 2.0}
+	s0 := common.Sample{lt(2017, 1, 1, 1, 0, 0), "a", "c", 3.0}
+	appendOnly := map[string]bool{"a|b": true}
+	if err := WriteSamples(c, []common.Sample{e0, e1, s0}, appendOnly); err != nil {
+		t.Fatalf("Failed to insert samples: %v", err)
+	}
+
+	// Fail after the renamed entities have been written but before the old
+	// ones have been deleted. Append-only samples are rewritten in place, so
+	// they don't need to be deleted.
+	deleteErr := errors.New("delete failed")
+	defer func(f func(context.Context, []*datastore.Key) error) {
+		deleteMovedEntities = f
+	}(deleteMovedEntities)
+	deleteMovedEntities = func(context.Context, []*datastore.Key) error { return deleteErr }
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{"b", nil},
+		{"c", deleteErr},
+	} {
+		if err := RenameSeries(c, "a", tc.name, "x", tc.name); err != tc.err {
+			t.Errorf("Renaming a|%v returned %v; expected %v", tc.name, err, tc.err)
+		}
+	}
+
+	// Retrying shouldn't duplicate any samples.
+	deleteMovedEntities = datastore.DeleteMulti
+	for _, name := range []string{"b", "c"} {
+		if err := RenameSeries(c, "a", name, "x", name); err != nil {
+			t.Fatalf("Failed to rename a|%v again: %v", name, err)
+		}
+	}
+	checkSamples(t, c, []common.Sample{
+		{e0.Timestamp, "x", "b", e0.Value},
+		{e1.Timestamp, "x", "b", e1.Value},
+		{s0.Timestamp, "x", "c", s0.Value},
+	})
+}
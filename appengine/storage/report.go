@@ -6,24 +6,114 @@ package storage
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/derat/home/common"
 
 	"google.golang.org/appengine/v2/datastore"
 )
 
-// WriteSamples writes samples to datastore.
-func WriteSamples(c context.Context, samples []common.Sample) error {
-	keys := make([]*datastore.Key, len(samples))
-	for i, s := range samples {
-		keys[i] = datastore.NewKey(c, sampleKind, getSampleId(&s), 0, nil)
+// WriteSamples writes samples to datastore. Large slices are split into
+// multiple writes, and writes that fail with transient errors are retried.
+//
+// Samples are normally keyed by timestamp, source, and name, so writing a
+// sample replaces any existing sample in the same series with the same
+// timestamp. Samples belonging to series in appendOnly (keyed by
+// "source|name") instead receive unique datastore-assigned IDs, so every
+// written sample is kept (e.g. for events that can occur multiple times per
+// second). Append-only samples aren't deduplicated: a report that is retried
+// after a partially-failed write will produce duplicates, and all copies are
+// included in summaries. They also can't be fetched using GetSample.
+func WriteSamples(c context.Context, samples []common.Sample, appendOnly map[string]bool) error {
+	for start := 0; start < len(samples); start += maxEntitiesPerWrite {
+		end := start + maxEntitiesPerWrite
+		if end > len(samples) {
+			end = len(samples)
+		}
+		batch := samples[start:end]
+		keys := make([]*datastore.Key, len(batch))
+		for i, s := range batch {
+			if appendOnly[s.Source+"|"+s.Name] {
+				keys[i] = datastore.NewIncompleteKey(c, sampleKind, nil)
+			} else {
+				keys[i] = datastore.NewKey(c, sampleKind, getSampleId(&s), 0, nil)
+			}
+		}
+		if err := retryDatastoreOp(c, "sample write", func() error {
+			_, err := datastore.PutMulti(c, keys, batch)
+			return err
+		}); err != nil {
+			return err
+		}
+		invalidateQueryCache(c, batch)
 	}
-	_, err := datastore.PutMulti(c, keys, samples)
-	return err
+	return nil
+}
+
+// GetSample returns the sample from the series identified by source and name
+// with timestamp ts, or nil if the sample doesn't exist.
+func GetSample(c context.Context, source, name string, ts time.Time) (*common.Sample, error) {
+	s := common.Sample{Timestamp: ts, Source: source, Name: name}
+	k := datastore.NewKey(c, sampleKind, getSampleId(&s), 0, nil)
+	if err := datastore.Get(c, k, &s); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GetRecentSamples returns up to max of the most-recent samples from the
+// series identified by source and name, sorted by descending time.
+func GetRecentSamples(c context.Context, source, name string, max int) ([]common.Sample, error) {
+	samples := make([]common.Sample, 0)
+	q := datastore.NewQuery(sampleKind).Filter("Source =", source).Filter("Name =", name).
+		Order("-Timestamp").Limit(max)
+	if _, err := q.GetAll(c, &samples); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// minSampleTime is the earliest timestamp accepted by CheckSampleTime. Samples
+// older than this almost certainly come from a device with an unset clock.
+var minSampleTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// FutureTimeError is returned by CheckSampleTime for samples with timestamps
+// that are too far in the future. Unlike samples with other errors, these
+// samples may be accepted later.
+type FutureTimeError struct {
+	Timestamp time.Time
+	MaxSkew   time.Duration
+}
+
+func (e *FutureTimeError) Error() string {
+	return fmt.Sprintf("timestamp %v is more than %v in the future", e.Timestamp.Unix(), e.MaxSkew)
+}
+
+// CheckSampleTime returns an error if s's timestamp is implausible, i.e. more
+// than maxFutureSkew after now or before the start of 2000. *FutureTimeError is
+// returned in the former case.
+func CheckSampleTime(s *common.Sample, now time.Time, maxFutureSkew time.Duration) error {
+	if s.Timestamp.After(now.Add(maxFutureSkew)) {
+		return &FutureTimeError{s.Timestamp, maxFutureSkew}
+	}
+	if s.Timestamp.Before(minSampleTime) {
+		return fmt.Errorf("timestamp %v is before %v", s.Timestamp.Unix(), minSampleTime.Format("2006-01-02"))
+	}
+	return nil
 }
 
 // getSampleId returns the ID that should be used for inserting s into
 // datastore. It cannot be changed.
+//
+// IDs originally only contained whole seconds ("123|source|name"), so a second
+// sample from the same series within the same second would overwrite the
+// first. Fractional seconds are now included when present
+// ("123.456|source|name"), truncated to the microsecond precision that
+// datastore uses for timestamps. Whole-second samples still receive the
+// original IDs, so existing entities don't need to be migrated.
 func getSampleId(s *common.Sample) string {
-	return fmt.Sprintf("%d|%s|%s", s.Timestamp.Unix(), s.Source, s.Name)
+	ts := common.FormatTimestamp(s.Timestamp.Truncate(time.Microsecond))
+	return fmt.Sprintf("%s|%s|%s", ts, s.Source, s.Name)
 }
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"github.com/derat/home/common"
+
+	"google.golang.org/appengine/v2"
 )
 
 func TestWriteSamples(t *testing.T) {
@@ -23,15 +25,166 @@ func TestWriteSamples(t *testing.T) {
 
 	s0 := common.Sample{time.Unix(t1, 0), s, n1, 1.0}
 	s1 := common.Sample{time.Unix(t1, 0), s, n2, 2.0}
-	if err := WriteSamples(c, []common.Sample{s0, s1}); err != nil {
+	if err := WriteSamples(c, []common.Sample{s0, s1}, nil); err != nil {
 		t.Errorf("failed to write samples: %v", err)
 	}
 
 	s0update := common.Sample{time.Unix(t1, 0), s, n1, 3.0}
 	s2 := common.Sample{time.Unix(t2, 0), s, n1, 4.0}
 	s3 := common.Sample{time.Unix(t2, 0), s, n2, 5.0}
-	if err := WriteSamples(c, []common.Sample{s0update, s2, s3}); err != nil {
+	if err := WriteSamples(c, []common.Sample{s0update, s2, s3}, nil); err != nil {
 		t.Errorf("failed to write samples: %v", err)
 	}
 	checkSamples(t, c, []common.Sample{s0update, s1, s2, s3})
+
+	// Samples with fractional timestamps within the same second shouldn't
+	// overwrite each other.
+	s4 := common.Sample{time.Unix(t2, int64(250*time.Millisecond)), s, n1, 6.0}
+	s5 := common.Sample{time.Unix(t2, int64(500*time.Millisecond)), s, n1, 7.0}
+	if err := WriteSamples(c, []common.Sample{s4, s5}, nil); err != nil {
+		t.Errorf("failed to write samples: %v", err)
+	}
+	checkSamples(t, c, []common.Sample{s0update, s1, s2, s3, s4, s5})
+}
+
+func TestGetSample(t *testing.T) {
+	c := initTest()
+
+	s0 := common.Sample{time.Unix(123, 0), "source", "name", 1.0}
+	s1 := common.Sample{time.Unix(123, int64(500*time.Millisecond)), "source", "name", 2.0}
+	if err := WriteSamples(c, []common.Sample{s0, s1}, nil); err != nil {
+		t.Fatalf("failed to write samples: %v", err)
+	}
+
+	for _, exp := range []common.Sample{s0, s1} {
+		if s, err := GetSample(c, exp.Source, exp.Name, exp.Timestamp); err != nil {
+			t.Errorf("failed to get %v: %v", exp, err)
+		} else if s == nil {
+			t.Errorf("didn't find %v", exp)
+		} else if s.String() != exp.String() {
+			t.Errorf("got %v instead of %v", s, exp)
+		}
+	}
+	if s, err := GetSample(c, "source", "name", time.Unix(456, 0)); err != nil {
+		t.Errorf("failed to get missing sample: %v", err)
+	} else if s != nil {
+		t.Errorf("got %v for missing sample", s)
+	}
+}
+
+func TestGetRecentSamples(t *testing.T) {
+	c := initTest()
+
+	s0 := common.Sample{time.Unix(100, 0), "source", "name", 1.0}
+	s1 := common.Sample{time.Unix(200, 0), "source", "name", 2.0}
+	s2 := common.Sample{time.Unix(300, 0), "source", "name", 3.0}
+	other := common.Sample{time.Unix(400, 0), "source", "other", 4.0}
+	if err := WriteSamples(c, []common.Sample{s0, s1, s2, other}, nil); err != nil {
+		t.Fatalf("failed to write samples: %v", err)
+	}
+
+	for _, tc := range []struct {
+		max int
+		exp []common.Sample
+	}{
+		{1, []common.Sample{s2}},
+		{2, []common.Sample{s2, s1}},
+		{10, []common.Sample{s2, s1, s0}},
+	} {
+		if samples, err := GetRecentSamples(c, "source", "name", tc.max); err != nil {
+			t.Errorf("failed to get %v recent sample(s): %v", tc.max, err)
+		} else if act, exp := common.JoinSamples(samples), common.JoinSamples(tc.exp); act != exp {
+			t.Errorf("got %q for %v recent sample(s); expected %q", act, tc.max, exp)
+		}
+	}
+}
+
+func TestWriteSamplesLargeBatch(t *testing.T) {
+	c := initTest()
+
+	// More samples than can be written in a single operation should be split
+	// into multiple writes.
+	samples := make([]common.Sample, maxEntitiesPerWrite+100)
+	for i := range samples {
+		samples[i] = common.Sample{time.Unix(int64(i), 0), "source", "name", float32(i)}
+	}
+	if err := WriteSamples(c, samples, nil); err != nil {
+		t.Fatalf("failed to write samples: %v", err)
+	}
+	checkSamples(t, c, samples)
+}
+
+func TestWriteSamplesNamespace(t *testing.T) {
+	c := initTest()
+	nc, err := appengine.Namespace(c, "test")
+	if err != nil {
+		t.Fatalf("failed to set namespace: %v", err)
+	}
+
+	// Samples written in a namespace shouldn't be visible outside of it.
+	s0 := common.Sample{time.Unix(123, 0), "source", "name", 1.0}
+	s1 := common.Sample{time.Unix(456, 0), "source", "name", 2.0}
+	if err := WriteSamples(c, []common.Sample{s0}, nil); err != nil {
+		t.Fatalf("failed to write samples: %v", err)
+	}
+	if err := WriteSamples(nc, []common.Sample{s1}, nil); err != nil {
+		t.Fatalf("failed to write samples: %v", err)
+	}
+	checkSamples(t, c, []common.Sample{s0})
+	checkSamples(t, nc, []common.Sample{s1})
+
+	if err := RenameSeries(nc, "source", "name", "source", "name2"); err != nil {
+		t.Fatalf("failed to rename series: %v", err)
+	}
+	checkSamples(t, c, []common.Sample{s0})
+	checkSamples(t, nc, []common.Sample{common.Sample{s1.Timestamp, "source", "name2", 2.0}})
+}
+
+func TestWriteSamplesAppendOnly(t *testing.T) {
+	c := initTest()
+	appendOnly := map[string]bool{"source|event": true}
+
+	// Samples in append-only series with identical timestamps should all be
+	// kept, while other series should still be overwritten.
+	e0 := common.Sample{time.Unix(123, 0), "source", "event", 1.0}
+	s0 := common.Sample{time.Unix(123, 0), "source", "name", 1.0}
+	s1 := common.Sample{time.Unix(123, 0), "source", "name", 2.0}
+	if err := WriteSamples(c, []common.Sample{e0, s0}, appendOnly); err != nil {
+		t.Fatalf("failed to write samples: %v", err)
+	}
+	if err := WriteSamples(c, []common.Sample{e0, s1}, appendOnly); err != nil {
+		t.Fatalf("failed to write samples: %v", err)
+	}
+	checkSamples(t, c, []common.Sample{e0, e0, s1})
+
+	// Renaming should preserve all of the samples.
+	if err := RenameSeries(c, "source", "event", "source", "event2"); err != nil {
+		t.Fatalf("failed to rename series: %v", err)
+	}
+	r0 := common.Sample{e0.Timestamp, "source", "event2", e0.Value}
+	checkSamples(t, c, []common.Sample{r0, r0, s1})
+}
+
+func TestCheckSampleTime(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	skew := time.Hour
+	for _, tc := range []struct {
+		ts time.Time
+		ok bool
+	}{
+		{now, true},
+		{now.Add(-365 * 24 * time.Hour), true},
+		{now.Add(skew), true},
+		{now.Add(skew + time.Second), false},
+		{now.Add(10 * 365 * 24 * time.Hour), false},
+		{time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{time.Unix(0, 0), false},
+	} {
+		s := common.Sample{tc.ts, "source", "name", 1.0}
+		if err := CheckSampleTime(&s, now, skew); err != nil && tc.ok {
+			t.Errorf("%v unexpectedly rejected: %v", tc.ts.Unix(), err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("%v unexpectedly accepted", tc.ts.Unix())
+		}
+	}
 }
@@ -0,0 +1,83 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/derat/home/common"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+// Status describes the state of stored data.
+type Status struct {
+	// Start of the last fully-summarized day, or zero if no day has been
+	// fully summarized.
+	LastFullDay time.Time `json:"lastFullDay"`
+
+	// Number of sample, hourly summary, and daily summary entities.
+	NumSamples       int `json:"numSamples"`
+	NumHourSummaries int `json:"numHourSummaries"`
+	NumDaySummaries  int `json:"numDaySummaries"`
+
+	// Last time at which alert conditions were evaluated, or zero if they
+	// haven't been.
+	LastAlertEval time.Time `json:"lastAlertEval"`
+
+	// Timestamps of the oldest and newest samples, or zero if there are no
+	// samples.
+	OldestSample time.Time `json:"oldestSample"`
+	NewestSample time.Time `json:"newestSample"`
+}
+
+// GetStatus returns the current status of stored data.
+func GetStatus(c context.Context) (*Status, error) {
+	st := &Status{}
+	var err error
+	if st.LastFullDay, err = getSummaryLastFullDay(c); err != nil {
+		return nil, err
+	}
+
+	for _, d := range []struct {
+		kind string
+		dst  *int
+	}{
+		{sampleKind, &st.NumSamples},
+		{hourSummaryKind, &st.NumHourSummaries},
+		{daySummaryKind, &st.NumDaySummaries},
+	} {
+		if *d.dst, err = datastore.NewQuery(d.kind).KeysOnly().Count(c); err != nil {
+			return nil, err
+		}
+	}
+
+	as := alertState{}
+	k := datastore.NewKey(c, alertStateKind, "", alertStateId, nil)
+	if err = datastore.Get(c, k, &as); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	st.LastAlertEval = as.LastEvalTime
+
+	if st.OldestSample, err = getEdgeSampleTime(c, "Timestamp"); err != nil {
+		return nil, err
+	}
+	if st.NewestSample, err = getEdgeSampleTime(c, "-Timestamp"); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// getEdgeSampleTime returns the timestamp of the first sample when sorted
+// using order, or a zero time if there are no samples.
+func getEdgeSampleTime(c context.Context, order string) (time.Time, error) {
+	var samples []common.Sample
+	if _, err := datastore.NewQuery(sampleKind).Order(order).Limit(1).GetAll(c, &samples); err != nil {
+		return time.Time{}, err
+	} else if len(samples) == 0 {
+		return time.Time{}, nil
+	}
+	return samples[0].Timestamp, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/derat/home/common"
+)
+
+func TestGetStatus(t *testing.T) {
+	c := initTest()
+
+	st, err := GetStatus(c)
+	if err != nil {
+		t.Fatalf("Failed to get status: %v", err)
+	}
+	if *st != (Status{}) {
+		t.Errorf("Got non-empty status %+v with empty datastore", *st)
+	}
+
+	s0 := common.Sample{lt(2017, 1, 1, 0, 0, 0), "a", "b", 1.0}
+	s1 := common.Sample{lt(2017, 1, 1, 1, 0, 0), "a", "b", 2.0}
+	s2 := common.Sample{lt(2017, 1, 2, 0, 0, 0), "a", "c", 3.0}
+	if err := WriteSamples(c, []common.Sample{s0, s1, s2}, nil); err != nil {
+		t.Fatalf("Failed to insert samples: %v", err)
+	}
+	if err := GenerateSummaries(c, lt(2017, 1, 3, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+	now := lt(2017, 1, 3, 0, 5, 0)
+	if err := EvaluateConds(c, []Condition{}, now, &AlertMessageConfig{}, 0,
+		DefaultAlertQueryConcurrency); err != nil {
+		t.Fatalf("Failed to evaluate conditions: %v", err)
+	}
+
+	if st, err = GetStatus(c); err != nil {
+		t.Fatalf("Failed to get status: %v", err)
+	}
+	exp := Status{
+		LastFullDay:      ld(2017, 1, 1),
+		NumSamples:       3,
+		NumHourSummaries: 3,
+		NumDaySummaries:  2,
+		LastAlertEval:    now,
+		OldestSample:     s0.Timestamp,
+		NewestSample:     s2.Timestamp,
+	}
+	if !st.LastFullDay.Equal(exp.LastFullDay) || st.NumSamples != exp.NumSamples ||
+		st.NumHourSummaries != exp.NumHourSummaries || st.NumDaySummaries != exp.NumDaySummaries ||
+		!st.LastAlertEval.Equal(exp.LastAlertEval) || !st.OldestSample.Equal(exp.OldestSample) ||
+		!st.NewestSample.Equal(exp.NewestSample) {
+		t.Errorf("Didn't get expected status:\nexpected: %+v\n  actual: %+v", exp, *st)
+	}
+}
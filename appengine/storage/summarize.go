@@ -5,8 +5,12 @@ package storage
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"math"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/derat/home/common"
@@ -16,8 +20,9 @@ import (
 )
 
 const (
-	// App Engine imposes a limit of 500 entities per write operation.
-	summaryUpdateBatchSize = 500
+	// DefaultSummaryWriteConcurrency is a reasonable maximum number of summary
+	// batches to write in parallel.
+	DefaultSummaryWriteConcurrency = 3
 
 	// Deleting 500 samples at once seems to hit the 5-second RPC deadline quite
 	// often, so delete smaller batches instead.
@@ -30,16 +35,49 @@ const (
 	// Datastore kind and ID for storing the summarization state.
 	summaryStateKind = "SummaryState"
 	summaryStateId   = 1
+
+	// Duration of the lease held while generating summaries. The lease is
+	// renewed after each day is summarized, so this just needs to be longer
+	// than it takes to summarize a day. It lets other summarizations proceed
+	// if one dies without releasing the lease.
+	summaryLeaseDuration = 10 * time.Minute
 )
 
+// ErrSummaryLeaseHeld is returned by GenerateSummaries if another call is
+// already generating summaries.
+var ErrSummaryLeaseHeld = errors.New("Summaries are already being generated")
+
+// errSummaryLeaseLost is returned if the summarization lease was taken by
+// another call while generating summaries.
+var errSummaryLeaseLost = errors.New("Lost summarization lease")
+
 // GenerateSummaries reads samples and inserts daily and hourly summary
-// entities. now.Location() is used to define day boundaries; hour boundaries
-// are computed based on UTC. fullDayDelay defines how long we wait after the
-// end of a day before assuming that we have all the data we're going to get
-// from it (and not re-summarizing it in the future).
-func GenerateSummaries(c context.Context, now time.Time, fullDayDelay time.Duration) error {
+// entities. now.Location() and dayStartHour (see getDayStart) are used to
+// define day boundaries; hour boundaries are computed based on UTC.
+// fullDayDelay defines how long we wait after the end of a day before assuming
+// that we have all the data we're going to get from it (and not re-summarizing
+// it in the future). writeConcurrency is the maximum number of batches of
+// summaries to write in parallel; 1 writes them sequentially.
+//
+// If dayStartHour is changed after days have been summarized, the existing
+// summaries aren't regenerated.
+//
+// Only one call can generate summaries at a time. ErrSummaryLeaseHeld is
+// returned if another call is already in progress.
+func GenerateSummaries(c context.Context, now time.Time, fullDayDelay time.Duration,
+	writeConcurrency, dayStartHour int) error {
+	leaseId, err := acquireSummaryLease(c)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := releaseSummaryLease(c, leaseId); err != nil {
+			log.Warningf(c, "Failed releasing summarization lease: %v", err)
+		}
+	}()
+
 	ct := now.Add(time.Duration(-1) * fullDayDelay)
-	partialDay := time.Date(ct.Year(), ct.Month(), ct.Day(), 0, 0, 0, 0, ct.Location())
+	partialDay := getDayStart(ct, ct.Location(), dayStartHour)
 
 	// This could all be much simpler if it were possible to do a single query
 	// to get all samples, iterate through them in-order, and insert summaries
@@ -52,20 +90,20 @@ func GenerateSummaries(c context.Context, now time.Time, fullDayDelay time.Durat
 	// parallel.
 	//
 	// To mostly sidestep all of this garbage, issue a separate query for each
-	// day, insert summaries using sequential operations after reading the whole
-	// day, and mark the day as complete after summarizing it. This makes it
-	// more likely that we'll make forward progress when summarizing multiple
-	// days even if/when we hit a write error midway through.
+	// day, insert summaries using a limited number of parallel operations
+	// (retrying transient failures) after reading the whole day, and mark the
+	// day as complete after summarizing it. This makes it more likely that
+	// we'll make forward progress when summarizing multiple days even if/when
+	// we hit a write error midway through.
 	dayStart := time.Time{}
 	if lfd, err := getSummaryLastFullDay(c); err != nil {
 		return err
 	} else if !lfd.IsZero() {
-		dayStart = lfd.In(now.Location()).AddDate(0, 0, 1)
+		dayStart = addDays(lfd.In(now.Location()), 1, dayStartHour)
 	}
 
 	for {
-		var err error
-		dayStart, err = summarizeDay(c, now.Location(), dayStart)
+		dayStart, err = summarizeDay(c, now.Location(), dayStartHour, dayStart, writeConcurrency)
 		if err != nil {
 			return err
 		} else if dayStart.IsZero() {
@@ -77,40 +115,108 @@ func GenerateSummaries(c context.Context, now time.Time, fullDayDelay time.Durat
 		if dayStart.Before(partialDay) {
 			log.Debugf(c, "Marking %4d-%02d-%02d as fully summarized",
 				dayStart.Year(), dayStart.Month(), dayStart.Day())
-			k := datastore.NewKey(c, summaryStateKind, "", summaryStateId, nil)
-			if _, err := datastore.Put(c, k, &summaryState{dayStart}); err != nil {
+			if err := setSummaryLastFullDay(c, leaseId, dayStart); err != nil {
 				return err
 			}
 		}
 
-		dayStart = dayStart.AddDate(0, 0, 1)
+		dayStart = addDays(dayStart, 1, dayStartHour)
 	}
 	return nil
 }
 
+// getDayStart returns the start of the day containing t. Days start at hour
+// (in the range [0, 23]) in loc, e.g. 6 for days that start at 06:00. If hour
+// is skipped by a DST transition, the day starts when the transition ends.
+func getDayStart(t time.Time, loc *time.Location, hour int) time.Time {
+	lt := t.In(loc)
+	ds := time.Date(lt.Year(), lt.Month(), lt.Day(), hour, 0, 0, 0, loc)
+	if ds.After(t) {
+		ds = time.Date(lt.Year(), lt.Month(), lt.Day()-1, hour, 0, 0, 0, loc)
+	}
+	return ds
+}
+
+// addDays returns the start of the day n days after the day starting at ds
+// (as returned by getDayStart for hour). time.Time.AddDate isn't used since
+// it would preserve the adjusted time of a day whose start was moved by a
+// DST transition.
+func addDays(ds time.Time, n, hour int) time.Time {
+	return time.Date(ds.Year(), ds.Month(), ds.Day()+n, hour, 0, 0, 0, ds.Location())
+}
+
+// SeriesRetention overrides the number of fully-summarized days for which a
+// series' samples are retained by DeleteSummarizedSamples. The series'
+// summaries are retained regardless.
+type SeriesRetention struct {
+	Source     string `json:"source"`
+	Name       string `json:"name"`
+	DaysToKeep int    `json:"daysToKeep"`
+}
+
 // DeleteSummarizedSamples deletes samples from days that have been "fully"
 // summarized (see GenerateSummaries). Samples from partially-summarized days
-// are never deleted. loc is used to determine day boundaries. daysToKeep
-// defines the number of fully-summarized days for which samples should be
-// retained.
-func DeleteSummarizedSamples(c context.Context, loc *time.Location, daysToKeep int) error {
+// are never deleted. loc and dayStartHour (see getDayStart) are used to
+// determine day boundaries. daysToKeep defines the number of fully-summarized
+// days for which samples should be retained. overrides optionally defines
+// different numbers of days for individual series.
+func DeleteSummarizedSamples(c context.Context, loc *time.Location, dayStartHour, daysToKeep int,
+	overrides []SeriesRetention) error {
 	lastFullDay, err := getSummaryLastFullDay(c)
 	if err != nil {
 		return err
 	} else if lastFullDay.IsZero() {
 		return nil
 	}
-	keepDay := lastFullDay.In(loc).AddDate(0, 0, 1-daysToKeep)
+	getKeepDay := func(days int) time.Time {
+		return addDays(lastFullDay.In(loc), 1-days, dayStartHour)
+	}
+	keepDay := getKeepDay(daysToKeep)
 	log.Debugf(c, "Deleting all samples earlier than %4d-%02d-%02d",
 		keepDay.Year(), keepDay.Month(), keepDay.Day())
 
-	q := datastore.NewQuery(sampleKind).KeysOnly().
-		Filter("Timestamp <", keepDay).Limit(summaryDeleteBatchSize)
+	// Series whose samples are retained longer than others need to be skipped
+	// when deleting samples from all series.
+	skip := make(map[string]bool)
+	for _, o := range overrides {
+		if o.DaysToKeep > daysToKeep {
+			skip[o.Source+"|"+o.Name] = true
+		}
+	}
+	if len(skip) == 0 {
+		q := datastore.NewQuery(sampleKind).KeysOnly().Filter("Timestamp <", keepDay)
+		if err := deleteSampleBatches(c, q); err != nil {
+			return err
+		}
+	} else if err := deleteSamplesExcept(c, keepDay, skip); err != nil {
+		return err
+	}
+
+	for _, o := range overrides {
+		if o.DaysToKeep == daysToKeep {
+			continue
+		}
+		kd := getKeepDay(o.DaysToKeep)
+		log.Debugf(c, "Deleting %v|%v samples earlier than %4d-%02d-%02d",
+			o.Source, o.Name, kd.Year(), kd.Month(), kd.Day())
+		q := datastore.NewQuery(sampleKind).KeysOnly().Filter("Source =", o.Source).
+			Filter("Name =", o.Name).Filter("Timestamp <", kd)
+		if err := deleteSampleBatches(c, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSampleBatches repeatedly runs q, a keys-only query, and deletes the
+// returned samples until no more are returned.
+func deleteSampleBatches(c context.Context, q *datastore.Query) error {
+	q = q.Limit(summaryDeleteBatchSize)
 	errors := 0
 	for {
-		var keys []*datastore.Key
 		log.Debugf(c, "Querying for samples")
-		if keys, err = q.GetAll(c, nil); err != nil {
+		keys, err := q.GetAll(c, nil)
+		if err != nil {
 			return err
 		} else if len(keys) == 0 {
 			break
@@ -140,11 +246,109 @@ func DeleteSummarizedSamples(c context.Context, loc *time.Location, daysToKeep i
 	return nil
 }
 
+// deleteSamplesExcept deletes samples earlier than end, skipping ones
+// belonging to series in skip (keyed by "source|name"). Each remaining series'
+// samples are deleted using a separate keys-only query so that the skipped
+// samples are never read. Samples earlier than end have already been
+// summarized, so all series containing them have summaries.
+func deleteSamplesExcept(c context.Context, end time.Time, skip map[string]bool) error {
+	series, err := getSummarizedSeries(c)
+	if err != nil {
+		return err
+	}
+	for _, sn := range series {
+		if skip[sn] {
+			continue
+		}
+		parts := strings.SplitN(sn, "|", 2)
+		q := datastore.NewQuery(sampleKind).KeysOnly().Filter("Source =", parts[0]).
+			Filter("Name =", parts[1]).Filter("Timestamp <", end)
+		if err := deleteSampleBatches(c, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // summaryState contains high-level information about the current state of
 // summarization.
 type summaryState struct {
 	// LastFullDay contains the starting time of the last fully-summarized day.
 	LastFullDay time.Time
+
+	// LeaseId contains a random ID identifying the GenerateSummaries call
+	// that's currently generating summaries, or is empty if none is.
+	LeaseId string `datastore:",noindex"`
+
+	// LeaseExpiration contains the time after which the lease can be taken
+	// by another call even if it hasn't been released.
+	LeaseExpiration time.Time `datastore:",noindex"`
+}
+
+// updateSummaryState passes the current summary state to f within a
+// transaction and saves the state if f returns nil. The transaction is
+// retried if it fails due to contention.
+func updateSummaryState(c context.Context, f func(s *summaryState) error) error {
+	k := datastore.NewKey(c, summaryStateKind, "", summaryStateId, nil)
+	return retryDatastoreOp(c, "summary state update", func() error {
+		return datastore.RunInTransaction(c, func(tc context.Context) error {
+			s := summaryState{}
+			if err := datastore.Get(tc, k, &s); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if err := f(&s); err != nil {
+				return err
+			}
+			_, err := datastore.Put(tc, k, &s)
+			return err
+		}, nil)
+	})
+}
+
+// acquireSummaryLease takes the summarization lease and returns its ID.
+// ErrSummaryLeaseHeld is returned if another unexpired lease is held.
+func acquireSummaryLease(c context.Context) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	now := time.Now()
+	return id, updateSummaryState(c, func(s *summaryState) error {
+		if s.LeaseId != "" && s.LeaseExpiration.After(now) {
+			return ErrSummaryLeaseHeld
+		}
+		s.LeaseId = id
+		s.LeaseExpiration = now.Add(summaryLeaseDuration)
+		return nil
+	})
+}
+
+// releaseSummaryLease releases the lease identified by id if it's still held.
+func releaseSummaryLease(c context.Context, id string) error {
+	return updateSummaryState(c, func(s *summaryState) error {
+		if s.LeaseId == id {
+			s.LeaseId = ""
+			s.LeaseExpiration = time.Time{}
+		}
+		return nil
+	})
+}
+
+// setSummaryLastFullDay records day as the last fully-summarized day (unless
+// a later day was already recorded) and renews the lease identified by id.
+// errSummaryLeaseLost is returned if the lease is no longer held.
+func setSummaryLastFullDay(c context.Context, id string, day time.Time) error {
+	return updateSummaryState(c, func(s *summaryState) error {
+		if s.LeaseId != id {
+			return errSummaryLeaseLost
+		}
+		if day.After(s.LastFullDay) {
+			s.LastFullDay = day
+		}
+		s.LeaseExpiration = time.Now().Add(summaryLeaseDuration)
+		return nil
+	})
 }
 
 // getSummaryId returns the ID that should be used for storing s in the
@@ -173,11 +377,17 @@ func updateSummary(sums map[string]*summary, sam *common.Sample, ts time.Time) {
 		if sum.Timestamp != ts {
 			panic(fmt.Sprintf("summary for %v starts at %v instead of %v", key, sum.Timestamp, ts))
 		}
-		sum.NumValues += 1
-		sum.MinValue = float32(math.Min(float64(sam.Value), float64(sum.MinValue)))
-		sum.MaxValue = float32(math.Max(float64(sam.Value), float64(sum.MaxValue)))
-		sum.AvgValue = sum.AvgValue*((float32(sum.NumValues)-1)/float32(sum.NumValues)) +
-			sam.Value*(1/float32(sum.NumValues))
+		if sam.Value < sum.MinValue {
+			sum.MinValue = sam.Value
+			sum.MinTime = sam.Timestamp
+		}
+		if sam.Value > sum.MaxValue {
+			sum.MaxValue = sam.Value
+			sum.MaxTime = sam.Timestamp
+		}
+		// Update the running average after counting the new sample.
+		sum.NumValues++
+		sum.AvgValue += (sam.Value - sum.AvgValue) / float32(sum.NumValues)
 	} else {
 		sums[key] = &summary{
 			Timestamp: ts,
@@ -187,68 +397,88 @@ func updateSummary(sums map[string]*summary, sam *common.Sample, ts time.Time) {
 			MinValue:  sam.Value,
 			MaxValue:  sam.Value,
 			AvgValue:  sam.Value,
+			MinTime:   sam.Timestamp,
+			MaxTime:   sam.Timestamp,
 		}
 	}
 }
 
 // writeSummaries performs batched datastore writes of hour and day summaries.
 // ds is keyed by "source|name", while hs's top-level keys are timestamps
-// describing the starts of summarized hourly ranges.
+// describing the starts of summarized hourly ranges. Up to concurrency batches
+// are written in parallel. If a batch can't be written, the remaining batches
+// are still written before the first error is returned.
 func writeSummaries(c context.Context, ds map[string]*summary,
-	hs map[time.Time]map[string]*summary) error {
-	keys := make([]*datastore.Key, 0, summaryUpdateBatchSize)
-	sums := make([]*summary, 0, summaryUpdateBatchSize)
-
-	writeAndClear := func() error {
-		if _, err := datastore.PutMulti(c, keys, sums); err != nil {
-			return err
-		}
-		keys = make([]*datastore.Key, 0, summaryUpdateBatchSize)
-		sums = make([]*summary, 0, summaryUpdateBatchSize)
-		return nil
+	hs map[time.Time]map[string]*summary, concurrency int) error {
+	type batch struct {
+		keys []*datastore.Key
+		sums []*summary
 	}
+	batches := make([]batch, 0)
 
 	numSummaries := 0
-	add := func(kind string, s *summary) error {
+	add := func(kind string, s *summary) {
 		numSummaries++
-		keys = append(keys, datastore.NewKey(c, kind, getSummaryId(s), 0, nil))
-		sums = append(sums, s)
-		if len(sums) == summaryUpdateBatchSize {
-			if err := writeAndClear(); err != nil {
-				return err
-			}
+		if len(batches) == 0 || len(batches[len(batches)-1].sums) == maxEntitiesPerWrite {
+			batches = append(batches, batch{
+				make([]*datastore.Key, 0, maxEntitiesPerWrite),
+				make([]*summary, 0, maxEntitiesPerWrite),
+			})
 		}
-		return nil
+		b := &batches[len(batches)-1]
+		b.keys = append(b.keys, datastore.NewKey(c, kind, getSummaryId(s), 0, nil))
+		b.sums = append(b.sums, s)
 	}
-
-	startTime := time.Now()
 	for _, s := range ds {
-		if err := add(daySummaryKind, s); err != nil {
-			return err
-		}
+		add(daySummaryKind, s)
 	}
 	for _, m := range hs {
 		for _, s := range m {
-			if err := add(hourSummaryKind, s); err != nil {
-				return err
-			}
+			add(hourSummaryKind, s)
 		}
 	}
-	if len(sums) != 0 {
-		if err := writeAndClear(); err != nil {
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	errs := make([]error, len(batches))
+	var wg sync.WaitGroup
+
+	startTime := time.Now()
+	for i := range batches {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			b := batches[i]
+			errs[i] = retryDatastoreOp(c, "summary write", func() error {
+				_, err := datastore.PutMulti(c, b.keys, b.sums)
+				return err
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
 			return err
 		}
 	}
-
-	log.Debugf(c, "Wrote %v summaries in %v ms",
-		numSummaries, getMsecSinceTime(startTime))
+	log.Debugf(c, "Wrote %v summaries in %v batch(es) in %v ms",
+		numSummaries, len(batches), getMsecSinceTime(startTime))
 	return nil
 }
 
 // summarizeDay reads samples starting at queryStart and generates summaries for
-// the first day it sees (as interpreted for loc). It returns the start of that
-// day, or a zero time if no samples were found.
-func summarizeDay(c context.Context, loc *time.Location, queryStart time.Time) (
+// the first day it sees (as interpreted for loc and dayStartHour). It returns
+// the start of that day, or a zero time if no samples were found.
+// writeConcurrency is passed to writeSummaries.
+func summarizeDay(c context.Context, loc *time.Location, dayStartHour int,
+	queryStart time.Time, writeConcurrency int) (
 	dayStart time.Time, err error) {
 	// Keyed by "source|name".
 	daySums := make(map[string]*summary)
@@ -271,8 +501,7 @@ func summarizeDay(c context.Context, loc *time.Location, queryStart time.Time) (
 		}
 		numSamples++
 
-		lt := s.Timestamp.In(loc)
-		ds := time.Date(lt.Year(), lt.Month(), lt.Day(), 0, 0, 0, 0, loc)
+		ds := getDayStart(s.Timestamp, loc, dayStartHour)
 		if dayStart.IsZero() {
 			dayStart = ds
 		} else if ds != dayStart {
@@ -296,5 +525,5 @@ func summarizeDay(c context.Context, loc *time.Location, queryStart time.Time) (
 
 	log.Debugf(c, "Processed %v samples in %v ms",
 		numSamples, getMsecSinceTime(startTime))
-	return dayStart, writeSummaries(c, daySums, hourSums)
+	return dayStart, writeSummaries(c, daySums, hourSums, writeConcurrency)
 }
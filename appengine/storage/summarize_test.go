@@ -15,21 +15,39 @@ import (
 	"google.golang.org/appengine/v2/datastore"
 )
 
+// newSummary returns a summary with the supplied fields. MinTime and MaxTime
+// are left zero so that they won't be compared by checkSummaries.
+func newSummary(ts time.Time, source, name string, min, max, avg float32) summary {
+	return summary{Timestamp: ts, Source: source, Name: name,
+		MinValue: min, MaxValue: max, AvgValue: avg}
+}
+
 func summariesToString(sums []summary) string {
 	strs := make([]string, len(sums))
 	for i, s := range sums {
 		strs[i] = fmt.Sprintf("%d|%s|%s|%.1f|%.1f|%.1f",
 			s.Timestamp.Unix(), s.Source, s.Name, s.MinValue, s.MaxValue, s.AvgValue)
+		if !s.MinTime.IsZero() || !s.MaxTime.IsZero() {
+			strs[i] += fmt.Sprintf("|%d|%d", s.MinTime.Unix(), s.MaxTime.Unix())
+		}
 	}
 	return strings.Join(strs, ",")
 }
 
+// checkSummaries checks that kind's summaries match es. The extremes' times
+// are only compared for expected summaries that include them.
 func checkSummaries(t *testing.T, c context.Context, kind string, es []summary) {
 	q := datastore.NewQuery(kind).Order("Timestamp").Order("Source").Order("Name")
 	as := make([]summary, 0)
 	if _, err := q.GetAll(c, &as); err != nil {
 		t.Fatalf("Failed to get summaries: %v", err)
 	}
+	for i := range as {
+		if i < len(es) && es[i].MinTime.IsZero() && es[i].MaxTime.IsZero() {
+			as[i].MinTime = time.Time{}
+			as[i].MaxTime = time.Time{}
+		}
+	}
 	e := summariesToString(es)
 	a := summariesToString(as)
 	if e != a {
@@ -66,42 +84,43 @@ func TestGenerateSummaries(t *testing.T) {
 		common.Sample{lt(2017, 1, 1, 1, 30, 0), "s0", "n0", 15.0},
 		common.Sample{lt(2017, 1, 2, 4, 6, 0), "s0", "n1", 8.0},
 		common.Sample{lt(2017, 1, 3, 0, 0, 0), "s0", "n1", 5.0},
-	}); err != nil {
+	}, nil); err != nil {
 		t.Fatalf("Failed to insert samples: %v", err)
 	}
 
-	if err := GenerateSummaries(c, lt(2017, 1, 4, 4, 0, 0), time.Hour); err != nil {
+	if err := GenerateSummaries(c, lt(2017, 1, 4, 4, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
 		t.Fatalf("Failed to generate summaries: %v", err)
 	}
-	checkSummaries(t, c, hourSummaryKind, []summary{summary{lt(2016, 3, 13, 0, 0, 0), "s0", "n0", 0, 1.0, 1.0, 1.0},
-		summary{lt(2016, 3, 13, 1, 0, 0), "s0", "n0", 0, 3.0, 3.0, 3.0},
-		summary{lt(2016, 3, 13, 3, 0, 0), "s0", "n0", 0, 5.0, 5.0, 5.0},
-		summary{lt(2016, 3, 13, 23, 0, 0), "s0", "n0", 0, 7.0, 7.0, 7.0},
-		summary{lt(2016, 3, 14, 0, 0, 0), "s0", "n0", 0, 9.0, 9.0, 9.0},
-		summary{lt(2016, 11, 6, 0, 0, 0), "s0", "n0", 0, 1.0, 1.0, 1.0},
-		summary{lt(2016, 11, 6, 1, 0, 0), "s0", "n0", 0, 3.0, 3.0, 3.0},
-		summary{lt(2016, 11, 6, 1, 0, 0).Add(time.Hour), "s0", "n0", 0, 5.0, 5.0, 5.0},
-		summary{lt(2016, 11, 6, 1, 0, 0).Add(twoh), "s0", "n0", 0, 7.0, 7.0, 7.0},
-		summary{lt(2016, 11, 6, 3, 0, 0), "s0", "n0", 0, 9.0, 9.0, 9.0},
-		summary{lt(2016, 11, 6, 23, 0, 0), "s0", "n0", 0, 11.0, 11.0, 11.0},
-		summary{lt(2016, 11, 7, 0, 0, 0), "s0", "n0", 0, 13.0, 13.0, 13.0},
-		summary{lt(2017, 1, 1, 0, 0, 0), "s0", "n0", 0, 1.0, 6.0, 3.0},
-		summary{lt(2017, 1, 1, 0, 0, 0), "s0", "n1", 0, 3.0, 3.0, 3.0},
-		summary{lt(2017, 1, 1, 0, 0, 0), "s1", "n0", 0, 1.2, 1.2, 1.2},
-		summary{lt(2017, 1, 1, 1, 0, 0), "s0", "n0", 0, 5.0, 15.0, 10.0},
-		summary{lt(2017, 1, 2, 4, 0, 0), "s0", "n1", 0, 8.0, 8.0, 8.0},
-		summary{lt(2017, 1, 3, 0, 0, 0), "s0", "n1", 0, 5.0, 5.0, 5.0},
+	checkSummaries(t, c, hourSummaryKind, []summary{newSummary(lt(2016, 3, 13, 0, 0, 0), "s0", "n0", 1.0, 1.0, 1.0),
+		newSummary(lt(2016, 3, 13, 1, 0, 0), "s0", "n0", 3.0, 3.0, 3.0),
+		newSummary(lt(2016, 3, 13, 3, 0, 0), "s0", "n0", 5.0, 5.0, 5.0),
+		newSummary(lt(2016, 3, 13, 23, 0, 0), "s0", "n0", 7.0, 7.0, 7.0),
+		newSummary(lt(2016, 3, 14, 0, 0, 0), "s0", "n0", 9.0, 9.0, 9.0),
+		newSummary(lt(2016, 11, 6, 0, 0, 0), "s0", "n0", 1.0, 1.0, 1.0),
+		newSummary(lt(2016, 11, 6, 1, 0, 0), "s0", "n0", 3.0, 3.0, 3.0),
+		newSummary(lt(2016, 11, 6, 1, 0, 0).Add(time.Hour), "s0", "n0", 5.0, 5.0, 5.0),
+		newSummary(lt(2016, 11, 6, 1, 0, 0).Add(twoh), "s0", "n0", 7.0, 7.0, 7.0),
+		newSummary(lt(2016, 11, 6, 3, 0, 0), "s0", "n0", 9.0, 9.0, 9.0),
+		newSummary(lt(2016, 11, 6, 23, 0, 0), "s0", "n0", 11.0, 11.0, 11.0),
+		newSummary(lt(2016, 11, 7, 0, 0, 0), "s0", "n0", 13.0, 13.0, 13.0),
+		newSummary(lt(2017, 1, 1, 0, 0, 0), "s0", "n0", 1.0, 6.0, 3.0),
+		newSummary(lt(2017, 1, 1, 0, 0, 0), "s0", "n1", 3.0, 3.0, 3.0),
+		newSummary(lt(2017, 1, 1, 0, 0, 0), "s1", "n0", 1.2, 1.2, 1.2),
+		newSummary(lt(2017, 1, 1, 1, 0, 0), "s0", "n0", 5.0, 15.0, 10.0),
+		newSummary(lt(2017, 1, 2, 4, 0, 0), "s0", "n1", 8.0, 8.0, 8.0),
+		newSummary(lt(2017, 1, 3, 0, 0, 0), "s0", "n1", 5.0, 5.0, 5.0),
 	})
 	checkSummaries(t, c, daySummaryKind, []summary{
-		summary{ld(2016, 3, 13), "s0", "n0", 0, 1.0, 7.0, 4.0},
-		summary{ld(2016, 3, 14), "s0", "n0", 0, 9.0, 9.0, 9.0},
-		summary{ld(2016, 11, 6), "s0", "n0", 0, 1.0, 11.0, 6.0},
-		summary{ld(2016, 11, 7), "s0", "n0", 0, 13.0, 13.0, 13.0},
-		summary{ld(2017, 1, 1), "s0", "n0", 0, 1.0, 15.0, 5.8},
-		summary{ld(2017, 1, 1), "s0", "n1", 0, 3.0, 3.0, 3.0},
-		summary{ld(2017, 1, 1), "s1", "n0", 0, 1.2, 1.2, 1.2},
-		summary{ld(2017, 1, 2), "s0", "n1", 0, 8.0, 8.0, 8.0},
-		summary{ld(2017, 1, 3), "s0", "n1", 0, 5.0, 5.0, 5.0},
+		newSummary(ld(2016, 3, 13), "s0", "n0", 1.0, 7.0, 4.0),
+		newSummary(ld(2016, 3, 14), "s0", "n0", 9.0, 9.0, 9.0),
+		newSummary(ld(2016, 11, 6), "s0", "n0", 1.0, 11.0, 6.0),
+		newSummary(ld(2016, 11, 7), "s0", "n0", 13.0, 13.0, 13.0),
+		newSummary(ld(2017, 1, 1), "s0", "n0", 1.0, 15.0, 5.8),
+		newSummary(ld(2017, 1, 1), "s0", "n1", 3.0, 3.0, 3.0),
+		newSummary(ld(2017, 1, 1), "s1", "n0", 1.2, 1.2, 1.2),
+		newSummary(ld(2017, 1, 2), "s0", "n1", 8.0, 8.0, 8.0),
+		newSummary(ld(2017, 1, 3), "s0", "n1", 5.0, 5.0, 5.0),
 	})
 }
 
@@ -118,16 +137,17 @@ func TestGenerateSummariesSaveProgress(t *testing.T) {
 		common.Sample{d1, "s", "n", 1.0},
 		common.Sample{d2, "s", "n", 2.0},
 		common.Sample{d3, "s", "n", 3.0},
-	}); err != nil {
+	}, nil); err != nil {
 		t.Fatalf("Failed to insert samples: %v", err)
 	}
-	if err := GenerateSummaries(c, d3.Add(time.Hour), time.Duration(2)*time.Hour); err != nil {
+	if err := GenerateSummaries(c, d3.Add(time.Hour), time.Duration(2)*time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
 		t.Fatalf("Failed to generate summaries: %v", err)
 	}
 	sums := []summary{
-		summary{d1, "s", "n", 0, 1.0, 1.0, 1.0},
-		summary{d2, "s", "n", 0, 2.0, 2.0, 2.0},
-		summary{d3, "s", "n", 0, 3.0, 3.0, 3.0},
+		newSummary(d1, "s", "n", 1.0, 1.0, 1.0),
+		newSummary(d2, "s", "n", 2.0, 2.0, 2.0),
+		newSummary(d3, "s", "n", 3.0, 3.0, 3.0),
 	}
 	checkSummaries(t, c, daySummaryKind, sums)
 	checkSummaries(t, c, hourSummaryKind, sums)
@@ -137,13 +157,14 @@ func TestGenerateSummariesSaveProgress(t *testing.T) {
 	if err := WriteSamples(c, []common.Sample{
 		common.Sample{d1.Add(time.Minute), "s", "n", 4.0},
 		common.Sample{d2.Add(time.Minute), "s", "n", 5.0},
-	}); err != nil {
+	}, nil); err != nil {
 		t.Fatalf("Failed to insert samples: %v", err)
 	}
-	if err := GenerateSummaries(c, d3.Add(time.Hour), time.Duration(2)*time.Hour); err != nil {
+	if err := GenerateSummaries(c, d3.Add(time.Hour), time.Duration(2)*time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
 		t.Fatalf("Failed to generate summaries: %v", err)
 	}
-	sums[1] = summary{d2, "s", "n", 0, 2.0, 5.0, 3.5}
+	sums[1] = newSummary(d2, "s", "n", 2.0, 5.0, 3.5)
 	checkSummaries(t, c, daySummaryKind, sums)
 	checkSummaries(t, c, hourSummaryKind, sums)
 
@@ -151,23 +172,25 @@ func TestGenerateSummariesSaveProgress(t *testing.T) {
 	// second day is considered full.
 	if err := WriteSamples(c, []common.Sample{
 		common.Sample{d2.Add(time.Duration(2) * time.Minute), "s", "n", 8.0},
-	}); err != nil {
+	}, nil); err != nil {
 		t.Fatalf("Failed to insert samples: %v", err)
 	}
-	if err := GenerateSummaries(c, d3.Add(time.Duration(3)*time.Hour), time.Duration(2)*time.Hour); err != nil {
+	if err := GenerateSummaries(c, d3.Add(time.Duration(3)*time.Hour), time.Duration(2)*time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
 		t.Fatalf("Failed to generate summaries: %v", err)
 	}
-	sums[1] = summary{d2, "s", "n", 0, 2.0, 8.0, 5.0}
+	sums[1] = newSummary(d2, "s", "n", 2.0, 8.0, 5.0)
 	checkSummaries(t, c, daySummaryKind, sums)
 	checkSummaries(t, c, hourSummaryKind, sums)
 
 	// Do the same again, and check that the second day isn't updated now.
 	if err := WriteSamples(c, []common.Sample{
 		common.Sample{d2.Add(time.Duration(3) * time.Minute), "s", "n", 15.0},
-	}); err != nil {
+	}, nil); err != nil {
 		t.Fatalf("Failed to insert samples: %v", err)
 	}
-	if err := GenerateSummaries(c, d3.Add(time.Duration(3)*time.Hour), time.Duration(2)*time.Hour); err != nil {
+	if err := GenerateSummaries(c, d3.Add(time.Duration(3)*time.Hour), time.Duration(2)*time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
 		t.Fatalf("Failed to generate summaries: %v", err)
 	}
 	checkSummaries(t, c, daySummaryKind, sums)
@@ -190,29 +213,193 @@ func TestDeleteSummarizedSamples(t *testing.T) {
 
 	// Generate summaries such that the 3rd is the last full day.
 	if err := WriteSamples(c,
-		[]common.Sample{s10, s11, s20, s21, s30, s31, s40, s41}); err != nil {
+		[]common.Sample{s10, s11, s20, s21, s30, s31, s40, s41}, nil); err != nil {
 		t.Fatalf("Failed to insert samples: %v", err)
 	}
-	if err := GenerateSummaries(c, t50, time.Hour); err != nil {
+	if err := GenerateSummaries(c, t50, time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
 		t.Fatalf("Failed to generate summaries: %v", err)
 	}
 
 	// Request keeping the last two fully-summarized days. Only the 1st should
 	// be deleted.
-	if err := DeleteSummarizedSamples(c, testLoc, 2); err != nil {
+	if err := DeleteSummarizedSamples(c, testLoc, 0, 2, nil); err != nil {
 		t.Fatalf("Failed to delete summarized samples: %v", err)
 	}
 	checkSamples(t, c, []common.Sample{s20, s21, s30, s31, s40, s41})
 
 	// Now only keep one day and check that the 2nd is also deleted.
-	if err := DeleteSummarizedSamples(c, testLoc, 1); err != nil {
+	if err := DeleteSummarizedSamples(c, testLoc, 0, 1, nil); err != nil {
 		t.Fatalf("Failed to delete summarized samples: %v", err)
 	}
 	checkSamples(t, c, []common.Sample{s30, s31, s40, s41})
 
 	// Keeping zero days should also delete the 3rd.
-	if err := DeleteSummarizedSamples(c, testLoc, 0); err != nil {
+	if err := DeleteSummarizedSamples(c, testLoc, 0, 0, nil); err != nil {
 		t.Fatalf("Failed to delete summarized samples: %v", err)
 	}
 	checkSamples(t, c, []common.Sample{s40, s41})
 }
+
+func TestDeleteSummarizedSamplesOverrides(t *testing.T) {
+	c := initTest()
+
+	var samples []common.Sample
+	for _, name := range []string{"a", "b", "c"} {
+		for day := 1; day <= 4; day++ {
+			samples = append(samples, common.Sample{lt(2017, 1, day, 12, 0, 0), "s", name, 1.0})
+		}
+	}
+	if err := WriteSamples(c, samples, nil); err != nil {
+		t.Fatalf("Failed to insert samples: %v", err)
+	}
+	// Make the 3rd the last full day.
+	if err := GenerateSummaries(c, lt(2017, 1, 5, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+
+	// Keep the last fully-summarized day by default, but keep all of "b"'s
+	// samples and delete all of "c"'s fully-summarized samples.
+	if err := DeleteSummarizedSamples(c, testLoc, 0, 1, []SeriesRetention{
+		{Source: "s", Name: "b", DaysToKeep: 10},
+		{Source: "s", Name: "c", DaysToKeep: 0},
+	}); err != nil {
+		t.Fatalf("Failed to delete summarized samples: %v", err)
+	}
+	checkSamples(t, c, []common.Sample{
+		samples[4],             // "b" on the 1st
+		samples[5],             // "b" on the 2nd
+		samples[2], samples[6], // "a" and "b" on the 3rd
+		samples[3], samples[7], samples[11], // "a", "b", and "c" on the 4th
+	})
+
+	// Summaries should be retained for all series.
+	for _, name := range []string{"a", "b", "c"} {
+		var sums []summary
+		if _, err := datastore.NewQuery(daySummaryKind).Filter("Name =", name).
+			GetAll(c, &sums); err != nil {
+			t.Fatalf("Failed to get %q summaries: %v", name, err)
+		} else if len(sums) != 4 {
+			t.Errorf("Got %v day summaries for %q; expected 4", len(sums), name)
+		}
+	}
+}
+
+func TestGenerateSummariesDayStartHour(t *testing.T) {
+	c := initTest()
+
+	// Days start at 06:00 and DST started on March 13, 2016, so the day
+	// beginning on the 12th is only 23 hours long.
+	if err := WriteSamples(c, []common.Sample{
+		common.Sample{lt(2016, 3, 12, 5, 0, 0), "s", "n", 1.0},
+		common.Sample{lt(2016, 3, 12, 7, 0, 0), "s", "n", 2.0},
+		common.Sample{lt(2016, 3, 13, 5, 30, 0), "s", "n", 3.0},
+		common.Sample{lt(2016, 3, 13, 7, 0, 0), "s", "n", 4.0},
+	}, nil); err != nil {
+		t.Fatalf("Failed to insert samples: %v", err)
+	}
+	if err := GenerateSummaries(c, lt(2016, 3, 15, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 6); err != nil {
+		t.Fatalf("Failed to generate summaries: %v", err)
+	}
+	checkSummaries(t, c, daySummaryKind, []summary{
+		newSummary(lt(2016, 3, 11, 6, 0, 0), "s", "n", 1.0, 1.0, 1.0),
+		newSummary(lt(2016, 3, 12, 6, 0, 0), "s", "n", 2.0, 3.0, 2.5),
+		newSummary(lt(2016, 3, 13, 6, 0, 0), "s", "n", 4.0, 4.0, 4.0),
+	})
+
+	// Keeping one day should only delete the samples from the first day.
+	if err := DeleteSummarizedSamples(c, testLoc, 6, 1, nil); err != nil {
+		t.Fatalf("Failed to delete summarized samples: %v", err)
+	}
+	checkSamples(t, c, []common.Sample{
+		common.Sample{lt(2016, 3, 12, 7, 0, 0), "s", "n", 2.0},
+		common.Sample{lt(2016, 3, 13, 5, 30, 0), "s", "n", 3.0},
+		common.Sample{lt(2016, 3, 13, 7, 0, 0), "s", "n", 4.0},
+	})
+}
+
+func TestGetDayStart(t *testing.T) {
+	for _, tc := range []struct {
+		t    time.Time
+		hour int
+		exp  time.Time
+	}{
+		{lt(2016, 3, 13, 5, 59, 0), 6, lt(2016, 3, 12, 6, 0, 0)},
+		{lt(2016, 3, 13, 6, 0, 0), 6, lt(2016, 3, 13, 6, 0, 0)},
+		{lt(2016, 11, 6, 23, 0, 0), 6, lt(2016, 11, 6, 6, 0, 0)},
+		{lt(2016, 3, 13, 5, 59, 0), 0, lt(2016, 3, 13, 0, 0, 0)},
+	} {
+		if act := getDayStart(tc.t, testLoc, tc.hour); !act.Equal(tc.exp) {
+			t.Errorf("getDayStart(%v, %v) = %v; expected %v", tc.t, tc.hour, act, tc.exp)
+		}
+	}
+
+	// Days containing DST transitions should be shorter or longer.
+	for _, tc := range []struct {
+		ds  time.Time
+		exp time.Duration
+	}{
+		{lt(2016, 3, 12, 6, 0, 0), 23 * time.Hour},
+		{lt(2016, 11, 5, 6, 0, 0), 25 * time.Hour},
+		{lt(2016, 11, 6, 6, 0, 0), 24 * time.Hour},
+	} {
+		if act := addDays(tc.ds, 1, 6).Sub(tc.ds); act != tc.exp {
+			t.Errorf("Day starting at %v lasted %v; expected %v", tc.ds, act, tc.exp)
+		}
+	}
+}
+
+func TestUpdateSummaryExtremes(t *testing.T) {
+	ts := time.Unix(0, 0)
+	sums := make(map[string]*summary)
+	for i, v := range []float32{3, 1, 5, 1, 5, 2} {
+		updateSummary(sums, &common.Sample{time.Unix(int64(i), 0), "s", "n", v}, ts)
+	}
+	// The earliest samples with the extreme values should be used.
+	exp := summary{Timestamp: ts, Source: "s", Name: "n", NumValues: 6,
+		MinValue: 1, MaxValue: 5, AvgValue: 17.0 / 6,
+		MinTime: time.Unix(1, 0), MaxTime: time.Unix(2, 0)}
+	if a, e := summariesToString([]summary{*sums["s|n"]}), summariesToString([]summary{exp}); a != e {
+		t.Errorf("Expected %v; got %v", e, a)
+	}
+}
+
+func TestSummaryLease(t *testing.T) {
+	c := initTest()
+
+	id, err := acquireSummaryLease(c)
+	if err != nil {
+		t.Fatalf("Failed to acquire lease: %v", err)
+	}
+	if _, err := acquireSummaryLease(c); err != ErrSummaryLeaseHeld {
+		t.Errorf("Acquiring held lease returned %v; expected %v", err, ErrSummaryLeaseHeld)
+	}
+	if err := GenerateSummaries(c, lt(2017, 1, 3, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != ErrSummaryLeaseHeld {
+		t.Errorf("Generating summaries with held lease returned %v; expected %v",
+			err, ErrSummaryLeaseHeld)
+	}
+	if err := setSummaryLastFullDay(c, "bogus", ld(2017, 1, 1)); err != errSummaryLeaseLost {
+		t.Errorf("Setting last full day without lease returned %v; expected %v",
+			err, errSummaryLeaseLost)
+	}
+	if err := setSummaryLastFullDay(c, id, ld(2017, 1, 1)); err != nil {
+		t.Errorf("Failed to set last full day: %v", err)
+	}
+	if err := releaseSummaryLease(c, id); err != nil {
+		t.Fatalf("Failed to release lease: %v", err)
+	}
+	if lfd, err := getSummaryLastFullDay(c); err != nil {
+		t.Errorf("Failed to get last full day: %v", err)
+	} else if exp := ld(2017, 1, 1); !lfd.Equal(exp) {
+		t.Errorf("Expected last full day %v; got %v", exp, lfd)
+	}
+
+	// After the lease is released, summaries should be generated.
+	if err := GenerateSummaries(c, lt(2017, 1, 3, 0, 0, 0), time.Hour,
+		DefaultSummaryWriteConcurrency, 0); err != nil {
+		t.Errorf("Failed to generate summaries after releasing lease: %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/derat/home/common"
+)
+
+const (
+	tempBackingFileExtension = ".new"
+
+	// The backing file is compacted when it contains more than this many
+	// records and more than twice as many records as queued samples.
+	minBackingCompactRecords = 1000
+)
+
+// backingRecord is a single line in the backing file. Lines either append a
+// sample to the end of the queue or drop samples from the start of the queue.
+// Sample records are encoded identically to bare common.Sample objects, so
+// files written before the file became a log are replayed correctly.
+type backingRecord struct {
+	common.Sample
+
+	// Number of samples to drop from the start of the queue. If positive, the
+	// record doesn't contain a sample.
+	Drop int `json:",omitempty"`
+}
+
+// backingDropRecord is used to encode records that drop samples.
+type backingDropRecord struct {
+	Drop int
+}
+
+// backingLog is an append-only log at path describing the reporter's queue of
+// unreported samples. Appending newly-queued samples and dropping reported
+// ones only requires writing the changes; the file is rewritten when it
+// accumulates too many stale records. backingLog isn't safe for concurrent
+// use.
+//
+// If compress is true, the file is gzip-compressed when it's compacted.
+// Records that are appended later are written uncompressed after the
+// compressed data, since a separate gzip member for each small batch would add
+// more overhead than it saves. Compressed data is detected when the file is
+// replayed.
+type backingLog struct {
+	path     string
+	compress bool
+
+	// Samples described by the file.
+	samples []common.Sample
+
+	// Number of records in the file.
+	records int
+
+	// True if the file is known to describe samples. Until then, the file
+	// is compacted rather than appended to.
+	valid bool
+}
+
+func newBackingLog(path string, compress bool) *backingLog {
+	return &backingLog{path: path, compress: compress, samples: make([]common.Sample, 0)}
+}
+
+// replay reads the file and returns the queued samples that it describes.
+// If the collector crashed while appending records, the file may end with a
+// partially-written record. All complete records are replayed and the
+// incomplete one is truncated from the file.
+func (b *backingLog) replay() ([]common.Sample, error) {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	samples := make([]common.Sample, 0)
+	records := 0
+	addRecord := func(line []byte) (bool, error) {
+		var rec backingRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return false, nil
+		}
+		records++
+		if rec.Drop > 0 {
+			if rec.Drop > len(samples) {
+				return false, fmt.Errorf("record %v drops %v of %v sample(s)",
+					records, rec.Drop, len(samples))
+			}
+			samples = samples[rec.Drop:]
+		} else {
+			samples = append(samples, rec.Sample)
+		}
+		return true, nil
+	}
+
+	br := bufio.NewReader(f)
+	offset := func() (int64, error) {
+		n, err := f.Seek(0, io.SeekCurrent)
+		return n - int64(br.Buffered()), err
+	}
+
+	var size int64 // length of the file's complete data
+	compressed := false
+	tornMember := false
+	for {
+		magic, _ := br.Peek(2)
+		if len(magic) == 0 {
+			break
+		}
+
+		if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+			// Read a single gzip member. Since br is an io.ByteReader, the
+			// gzip reader won't read past the end of the member.
+			if size == 0 {
+				compressed = true
+			}
+			tornMember = true
+			zr, err := gzip.NewReader(br)
+			if err != nil {
+				break
+			}
+			zr.Multistream(false)
+			lr := bufio.NewReader(zr)
+			for {
+				line, err := lr.ReadBytes('\n')
+				if err == io.EOF && len(line) == 0 {
+					tornMember = false
+					break
+				} else if err != nil {
+					break
+				}
+				if ok, err := addRecord(line); err != nil {
+					return nil, err
+				} else if !ok {
+					break
+				}
+			}
+			if tornMember {
+				break
+			}
+		} else {
+			line, err := br.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return nil, err
+			} else if err == io.EOF {
+				break // missing newline
+			}
+			if ok, err := addRecord(line); err != nil {
+				return nil, err
+			} else if !ok {
+				break
+			}
+		}
+
+		if size, err = offset(); err != nil {
+			return nil, err
+		}
+	}
+
+	b.samples = samples
+	b.records = records
+
+	// If the file doesn't use the requested format, rewrite it before
+	// appending anything to it. Records from an incomplete gzip member may
+	// have been replayed, so the file also needs to be rewritten in that case.
+	b.valid = (records == 0 || compressed == b.compress) && !tornMember
+	if st, err := f.Stat(); err != nil {
+		return nil, err
+	} else if st.Size() > size {
+		if err := os.Truncate(b.path, size); err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+// update updates the file to describe samples. Records are appended if
+// samples consists of a suffix of the file's current samples followed by
+// new samples; otherwise the file is compacted.
+func (b *backingLog) update(samples []common.Sample) error {
+	if b.path == "" || (b.valid && samplesEqual(b.samples, samples)) {
+		return nil
+	}
+	if !b.valid || len(samples) == 0 {
+		return b.compact(samples)
+	}
+
+	// Find the first sample in the file that starts a run matching the start
+	// of samples. Compact the file if none of its samples can be reused or if
+	// it would contain too many stale records.
+	drop := 0
+	for ; drop < len(b.samples); drop++ {
+		n := len(b.samples) - drop
+		if n <= len(samples) && samplesEqual(b.samples[drop:], samples[:n]) {
+			break
+		}
+	}
+	added := samples[len(b.samples)-drop:]
+	records := b.records + len(added) + 1
+	if (drop > 0 && drop == len(b.samples)) ||
+		(records > minBackingCompactRecords && records > 2*len(samples)) {
+		return b.compact(samples)
+	}
+	return b.append(drop, added)
+}
+
+// append appends records to the file dropping drop samples from the start
+// of the queue and then adding added to the end.
+func (b *backingLog) append(drop int, added []common.Sample) error {
+	f, err := os.OpenFile(b.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// The file may have been partially written, so compact it next time.
+	b.valid = false
+
+	var records []interface{}
+	if drop > 0 {
+		records = append(records, backingDropRecord{drop})
+	}
+	for _, s := range added {
+		records = append(records, s)
+	}
+	if err := writeRecords(f, records, false); err != nil {
+		return err
+	}
+
+	samples := make([]common.Sample, 0, len(b.samples)-drop+len(added))
+	samples = append(samples, b.samples[drop:]...)
+	b.samples = append(samples, added...)
+	b.records += len(records)
+	b.valid = true
+	return nil
+}
+
+// compact atomically replaces the file with one listing samples.
+func (b *backingLog) compact(samples []common.Sample) error {
+	p := b.path + tempBackingFileExtension
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	records := make([]interface{}, len(samples))
+	for i, s := range samples {
+		records[i] = s
+	}
+	if err := writeRecords(f, records, b.compress); err != nil {
+		return err
+	}
+	if err = os.Rename(p, b.path); err != nil {
+		return err
+	}
+
+	b.samples = append(make([]common.Sample, 0, len(samples)), samples...)
+	b.records = len(samples)
+	b.valid = true
+	return nil
+}
+
+// writeRecords writes records to f, compressing them if requested, and closes
+// f. Nothing is written if records is empty.
+func writeRecords(f *os.File, records []interface{}, compress bool) error {
+	if len(records) == 0 {
+		return f.Close()
+	}
+
+	var zw *gzip.Writer
+	var w io.Writer = f
+	if compress {
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+	bw := bufio.NewWriter(w)
+	e := json.NewEncoder(bw)
+	for _, rec := range records {
+		if err := e.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// samplesEqual returns true if a and b contain the same samples.
+func samplesEqual(a, b []common.Sample) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Timestamp.Equal(b[i].Timestamp) || a[i].Source != b[i].Source ||
+			a[i].Name != b[i].Name || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/home/common"
+)
+
+func TestBackingLog(t *testing.T) {
+	p := createTempFile()
+	defer os.Remove(p)
+
+	s := make([]common.Sample, 5)
+	for i := range s {
+		s[i] = common.Sample{time.Unix(int64(i), 0), "SOURCE", "NAME", float32(i)}
+	}
+
+	countLines := func() int {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("Failed to read %v: %v", p, err)
+		}
+		return strings.Count(string(b), "\n")
+	}
+	checkReplay := func(exp []common.Sample) {
+		samples, err := newBackingLog(p, false).replay()
+		if err != nil {
+			t.Fatalf("Failed to replay %v: %v", p, err)
+		}
+		if act, exp := common.JoinSamples(samples), common.JoinSamples(exp); act != exp {
+			t.Errorf("Replayed %q; expected %q", act, exp)
+		}
+	}
+
+	l := newBackingLog(p, false)
+	if _, err := l.replay(); err != nil {
+		t.Fatalf("Failed to replay empty file: %v", err)
+	}
+	for i, tc := range []struct {
+		samples []common.Sample
+		lines   int // expected number of lines in the file
+	}{
+		{s[0:2], 2},
+		{s[0:3], 3}, // appended s2
+		{s[1:4], 5}, // dropped s0 and appended s3
+		{s[1:4], 5}, // unchanged
+		{s[3:5], 7}, // dropped s1 and s2 and appended s4
+		{s[2:3], 1}, // no shared samples, so compacted
+		{nil, 0},    // emptied
+	} {
+		if err := l.update(tc.samples); err != nil {
+			t.Fatalf("Update %v failed: %v", i, err)
+		}
+		if n := countLines(); n != tc.lines {
+			t.Errorf("File has %v line(s) after update %v; expected %v", n, i, tc.lines)
+		}
+		checkReplay(tc.samples)
+	}
+}
+
+func TestBackingLogCompact(t *testing.T) {
+	p := createTempFile()
+	defer os.Remove(p)
+
+	l := newBackingLog(p, false)
+	var samples []common.Sample
+	for i := 0; i < 2*minBackingCompactRecords; i++ {
+		samples = append(samples, common.Sample{time.Unix(int64(i), 0), "SOURCE", "NAME", 1.0})
+		if len(samples) > 5 {
+			samples = samples[1:]
+		}
+		if err := l.update(samples); err != nil {
+			t.Fatalf("Update %v failed: %v", i, err)
+		}
+	}
+	if l.records > minBackingCompactRecords {
+		t.Errorf("File has %v records; expected at most %v", l.records, minBackingCompactRecords)
+	}
+	replayed, err := newBackingLog(p, false).replay()
+	if err != nil {
+		t.Fatalf("Failed to replay %v: %v", p, err)
+	}
+	if act, exp := common.JoinSamples(replayed), common.JoinSamples(samples); act != exp {
+		t.Errorf("Replayed %q; expected %q", act, exp)
+	}
+}
+
+func TestBackingLogCompress(t *testing.T) {
+	p := createTempFile()
+	defer os.Remove(p)
+
+	s0 := common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 1.0}
+	s1 := common.Sample{time.Unix(1, 0), "SOURCE", "NAME", 2.0}
+	s2 := common.Sample{time.Unix(2, 0), "SOURCE", "NAME", 3.0}
+
+	isCompressed := func() bool {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("Failed to read %v: %v", p, err)
+		}
+		return len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b
+	}
+	checkReplay := func(compress bool, exp []common.Sample) *backingLog {
+		l := newBackingLog(p, compress)
+		samples, err := l.replay()
+		if err != nil {
+			t.Fatalf("Failed to replay %v: %v", p, err)
+		}
+		if act, exp := common.JoinSamples(samples), common.JoinSamples(exp); act != exp {
+			t.Errorf("Replayed %q; expected %q", act, exp)
+		}
+		return l
+	}
+
+	// Write an uncompressed file.
+	l := newBackingLog(p, false)
+	if err := l.update([]common.Sample{s0, s1}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if isCompressed() {
+		t.Errorf("File unexpectedly compressed")
+	}
+
+	// After enabling compression, the existing file should still be readable
+	// and should be rewritten in compressed form by the next update.
+	l = checkReplay(true, []common.Sample{s0, s1})
+	if err := l.update([]common.Sample{s1, s2}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if !isCompressed() {
+		t.Errorf("File not compressed after update")
+	}
+	checkReplay(true, []common.Sample{s1, s2})
+
+	// Records appended to a compressed file should be written uncompressed
+	// after the compressed data.
+	if err := l.update([]common.Sample{s2, s0}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if l.records <= 2 {
+		t.Errorf("File has %v records; expected records to be appended", l.records)
+	}
+	if b, err := ioutil.ReadFile(p); err != nil {
+		t.Fatalf("Failed to read %v: %v", p, err)
+	} else if !strings.HasSuffix(string(b), "}\n") {
+		t.Errorf("Appended records weren't written uncompressed")
+	}
+	checkReplay(true, []common.Sample{s2, s0})
+
+	// Uncompressed collectors should also be able to read the file.
+	checkReplay(false, []common.Sample{s2, s0})
+
+	// Clearing the queue should leave an empty file.
+	if err := l.update(nil); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if n := getFileSize(p); n != 0 {
+		t.Errorf("File has %v byte(s) after clearing; expected 0", n)
+	}
+}
+
+func TestBackingLogTornRecord(t *testing.T) {
+	p := createTempFile()
+	defer os.Remove(p)
+
+	s0 := common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 1.0}
+	s1 := common.Sample{time.Unix(1, 0), "SOURCE", "NAME", 2.0}
+	s2 := common.Sample{time.Unix(2, 0), "SOURCE", "NAME", 3.0}
+
+	l := newBackingLog(p, false)
+	if err := l.update([]common.Sample{s0, s1}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	size := getFileSize(p)
+
+	// Simulate a crash partway through appending a record.
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open %v: %v", p, err)
+	}
+	if _, err := f.WriteString(`{"Timestamp":"1970-01-01T00:00:02Z","Sou`); err != nil {
+		t.Fatalf("Failed to write to %v: %v", p, err)
+	}
+	f.Close()
+
+	// The complete records should be replayed and the partial one truncated.
+	l = newBackingLog(p, false)
+	samples, err := l.replay()
+	if err != nil {
+		t.Fatalf("Failed to replay %v: %v", p, err)
+	}
+	if act, exp := common.JoinSamples(samples), common.JoinSamples([]common.Sample{s0, s1}); act != exp {
+		t.Errorf("Replayed %q; expected %q", act, exp)
+	}
+	if n := getFileSize(p); n != size {
+		t.Errorf("File has %v byte(s) after replay; expected %v", n, size)
+	}
+
+	// Subsequent records should be appended to the truncated file.
+	if err := l.update([]common.Sample{s0, s1, s2}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if l.records != 3 {
+		t.Errorf("File has %v records; expected 3", l.records)
+	}
+	if samples, err = newBackingLog(p, false).replay(); err != nil {
+		t.Fatalf("Failed to replay %v: %v", p, err)
+	}
+	if act, exp := common.JoinSamples(samples), common.JoinSamples([]common.Sample{s0, s1, s2}); act != exp {
+		t.Errorf("Replayed %q; expected %q", act, exp)
+	}
+}
+
+func TestBackingLogTornGzipMember(t *testing.T) {
+	p := createTempFile()
+	defer os.Remove(p)
+
+	s0 := common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 1.0}
+	s1 := common.Sample{time.Unix(1, 0), "SOURCE", "NAME", 2.0}
+	s2 := common.Sample{time.Unix(2, 0), "SOURCE", "NAME", 3.0}
+
+	l := newBackingLog(p, true)
+	if err := l.update([]common.Sample{s0, s1}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	// Append a truncated gzip member, as written by older collectors.
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(s2); err != nil {
+		t.Fatalf("Failed to encode sample: %v", err)
+	}
+	zw.Close()
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open %v: %v", p, err)
+	}
+	if _, err := f.Write(buf.Bytes()[:12]); err != nil {
+		t.Fatalf("Failed to write to %v: %v", p, err)
+	}
+	f.Close()
+
+	l = newBackingLog(p, true)
+	samples, err := l.replay()
+	if err != nil {
+		t.Fatalf("Failed to replay %v: %v", p, err)
+	}
+	if act, exp := common.JoinSamples(samples), common.JoinSamples([]common.Sample{s0, s1}); act != exp {
+		t.Errorf("Replayed %q; expected %q", act, exp)
+	}
+
+	// The file should be rewritten by the next update.
+	if err := l.update([]common.Sample{s1, s2}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if l.records != 2 {
+		t.Errorf("File has %v records; expected 2", l.records)
+	}
+	if samples, err = newBackingLog(p, true).replay(); err != nil {
+		t.Fatalf("Failed to replay %v: %v", p, err)
+	}
+	if act, exp := common.JoinSamples(samples), common.JoinSamples([]common.Sample{s1, s2}); act != exp {
+		t.Errorf("Replayed %q; expected %q", act, exp)
+	}
+}
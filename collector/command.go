@@ -0,0 +1,87 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derat/home/common"
+)
+
+// commandConfig describes a command that's run periodically to produce
+// samples.
+type commandConfig struct {
+	// Path to the command to run.
+	Command string `json:"command"`
+
+	// Arguments to pass to the command.
+	Args []string `json:"args"`
+
+	// Time between runs of the command, in seconds.
+	IntervalSec int `json:"intervalSec"`
+
+	// Optional prefix prepended to the names of the command's samples.
+	NamePrefix string `json:"namePrefix"`
+}
+
+// keyValue is a single key-value pair from a command's output.
+type keyValue struct {
+	key string
+	val float64
+}
+
+// parseKeyValueOutput parses out, containing lines of whitespace-separated
+// key-value pairs, e.g. "temperature 21.5". Malformed lines are logged and
+// skipped. desc describes the output's source in log messages.
+func parseKeyValueOutput(cfg *config, out, desc string) []keyValue {
+	var kvs []keyValue
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			if len(parts) != 0 {
+				cfg.logger.Printf("Skipping bad %v line %q", desc, line)
+			}
+			continue
+		}
+		val, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			cfg.logger.Printf("Unable to parse value %q for %v key %q", parts[1], desc, parts[0])
+			continue
+		}
+		kvs = append(kvs, keyValue{parts[0], val})
+	}
+	return kvs
+}
+
+// getCommandSamples converts out, the output of a command run at time now,
+// to samples. prefix is prepended to the samples' names.
+func getCommandSamples(cfg *config, out, prefix string, now time.Time) []common.Sample {
+	var samples []common.Sample
+	for _, kv := range parseKeyValueOutput(cfg, out, "command") {
+		samples = append(samples, common.Sample{now, cfg.Source, prefix + kv.key, float32(kv.val)})
+	}
+	return samples
+}
+
+func runCommandLoop(cfg *config, cc commandConfig, r *reporter) {
+	for {
+		start := time.Now()
+
+		out, err := exec.Command(cc.Command, cc.Args...).Output()
+		if err != nil {
+			cfg.logger.Printf("Command %q failed: %v", cc.Command, err)
+		} else if samples := getCommandSamples(cfg, string(out), cc.NamePrefix, start); len(samples) > 0 {
+			r.reportSamples(samples)
+		}
+
+		next := start.Add(time.Duration(cc.IntervalSec) * time.Second)
+		now := time.Now()
+		if now.Before(next) {
+			time.Sleep(next.Sub(now))
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/derat/home/common"
+)
+
+func TestGetCommandSamples(t *testing.T) {
+	lo := ioutil.Discard
+	if testVerbose {
+		lo = os.Stderr
+	}
+	cfg := &config{
+		Source: "SOURCE",
+		logger: log.New(lo, "", log.LstdFlags),
+	}
+
+	now := time.Unix(100, 0)
+	o := `
+co2_ppm 415
+soil_moisture 0.35
+bad line here
+temp abc
+
+`
+	exp := common.JoinSamples([]common.Sample{
+		{now, "SOURCE", "co2_ppm", 415},
+		{now, "SOURCE", "soil_moisture", 0.35},
+	})
+	if act := common.JoinSamples(getCommandSamples(cfg, o, "", now)); act != exp {
+		t.Errorf("Expected %q; got %q", exp, act)
+	}
+
+	exp = common.JoinSamples([]common.Sample{
+		{now, "SOURCE", "greenhouse_co2_ppm", 415},
+		{now, "SOURCE", "greenhouse_soil_moisture", 0.35},
+	})
+	if act := common.JoinSamples(getCommandSamples(cfg, o, "greenhouse_", now)); act != exp {
+		t.Errorf("Expected %q; got %q", exp, act)
+	}
+}
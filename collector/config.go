@@ -5,8 +5,12 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
 	"os"
+	"strings"
+	"sync"
+
+	"github.com/derat/home/common"
 )
 
 type config struct {
@@ -17,15 +21,68 @@ type config struct {
 	// Address used to listen for reports, e.g. ":8080".
 	ListenAddress string `json:"listenAddress"`
 
+	// Timeouts for reading requests (including bodies), writing responses,
+	// and keeping idle connections open while listening, in milliseconds.
+	ListenReadTimeoutMs  int `json:"listenReadTimeoutMs"`
+	ListenWriteTimeoutMs int `json:"listenWriteTimeoutMs"`
+	ListenIdleTimeoutMs  int `json:"listenIdleTimeoutMs"`
+
+	// Optional shared secret used to verify reports posted to the listener.
+	// If set, reports must include "n" and "s" parameters containing a nonce
+	// and signature created by common.NewReportNonce and common.SignReport,
+	// just like the reports that the collector sends to the server.
+	ListenSecret string `json:"listenSecret"`
+
+	// Maximum difference between the time embedded in a signed report's nonce
+	// and the current time, in seconds. Nonces are remembered for this long so
+	// replayed reports can be rejected.
+	ListenNonceWindowSec int `json:"listenNonceWindowSec"`
+
+	// Optional username and password that must be supplied via HTTP basic
+	// auth in all requests to the listener.
+	ListenUsername string `json:"listenUsername"`
+	ListenPassword string `json:"listenPassword"`
+
 	// Full URL to report samples, e.g. "http://example.com/report".
 	ReportURL string `json:"reportUrl"`
 
-	// Shared secret used to sign reports.
+	// Shared secret used to sign reports. Secrets are reloaded from the config
+	// file when the collector receives SIGHUP.
 	ReportSecret string `json:"reportSecret"`
 
-	// Path to JSON file storing not-yet-reported samples.
+	// Additional servers to send each report to, e.g. a local archival server
+	// in addition to the server at ReportURL.
+	ReportDestinations []reportDestination `json:"reportDestinations"`
+
+	// Number of destinations that must accept a batch of samples before it's
+	// considered to be reported. Each batch is sent to every destination, but
+	// destinations that fail are only retried until this many have succeeded.
+	// 0 requires all destinations to succeed.
+	ReportQuorum int `json:"reportQuorum"`
+
+	// If true, samples are logged instead of being reported, and the backing
+	// file is neither read nor written. This is also the case if no
+	// destinations are configured.
+	DryRun bool `json:"dryRun"`
+
+	// Path to file storing not-yet-reported samples.
 	BackingFile string `json:"backingFile"`
 
+	// If true, the backing file is compressed using gzip when it's compacted.
+	// Uncompressed files are still read and are rewritten in compressed form.
+	CompressBackingFile bool `json:"compressBackingFile"`
+
+	// Minimum time between writes of the backing file, in milliseconds. Changes
+	// made within this interval are coalesced into a single write. The file is
+	// always written immediately after a reporting error and when the collector
+	// exits. 0 writes the file whenever the queue changes.
+	BackingFlushIntervalMs int `json:"backingFlushIntervalMs"`
+
+	// If true, reports are sent using a binary encoding that supports sources
+	// and names containing '|' and newlines and preserves values' precision.
+	// All destinations must support the encoding.
+	ReportBinary bool `json:"reportBinary"`
+
 	// Maximum number of samples to report in a single request.
 	ReportBatchSize int `json:"reportBatchSize"`
 
@@ -35,13 +92,52 @@ type config struct {
 	// Time to wait before retrying on failure, in milliseconds.
 	ReportRetryMs int `json:"reportRetryMs"`
 
+	// Reports that take at least this many milliseconds to complete are
+	// logged. 0 disables logging.
+	ReportSlowMs int `json:"reportSlowMs"`
+
+	// Optional path to a PEM file containing CA certificates used to verify
+	// the server's certificate, e.g. for a server using a self-signed
+	// certificate. The system's CAs are used if empty.
+	ReportCAFile string `json:"reportCaFile"`
+
+	// Optional paths to a PEM client certificate and key to present to the
+	// server for mutual TLS.
+	ReportClientCertFile string `json:"reportClientCertFile"`
+	ReportClientKeyFile  string `json:"reportClientKeyFile"`
+
+	// If true, the server's certificate isn't verified at all. This allows
+	// anyone who can intercept the collector's traffic to impersonate the
+	// server and read reported samples; prefer ReportCAFile instead.
+	ReportInsecureSkipVerify bool `json:"reportInsecureSkipVerify"`
+
+	// If true, a new connection is made to the server for each report rather
+	// than reusing connections.
+	ReportDisableKeepAlives bool `json:"reportDisableKeepAlives"`
+
+	// User-Agent header sent with reports. If empty, a string containing
+	// Source and the collector's version is used.
+	ReportUserAgent string `json:"reportUserAgent"`
+
 	// Time between ping samples, in seconds.
 	PingSampleIntervalSec int `json:"pingSampleIntervalSec"`
 
+	// Optional prefix prepended to the names of ping samples, e.g. "wan_" to
+	// report "wan_ping_avg".
+	PingNamePrefix string `json:"pingNamePrefix"`
+
 	// Host to ping to test network connectivity, e.g. "www.google.com".
 	// Empty to disable pinging.
 	PingHost string `json:"pingHost"`
 
+	// Path to the ping command. Defaults to the first "ping" in $PATH.
+	PingBinary string `json:"pingBinary"`
+
+	// IP version to use when pinging PingHost: 4 or 6. If 0, IPv6 is used
+	// for IPv6 address literals and the ping command's default is used
+	// otherwise.
+	PingIPVersion int `json:"pingIpVersion"`
+
 	// Number of pings to send for each sample.
 	PingCount int `json:"pingCount"`
 
@@ -53,6 +149,11 @@ type config struct {
 	// seconds. See the ping command's -w flag for details.
 	PingTimeoutSec int `json:"pingTimeoutSec"`
 
+	// If true, the RTT of each individual reply is reported in addition to
+	// the summary stats. The ping command's -q flag isn't passed so that
+	// replies are printed.
+	PingReportIndividual bool `json:"pingReportIndividual"`
+
 	// Command to run to get information about the system's power state. The
 	// command should output lines of whitespace-separated key-value pairs:
 	//
@@ -65,18 +166,140 @@ type config struct {
 	// Time between power samples, in seconds.
 	PowerSampleIntervalSec int `json:"powerSampleIntervalSec"`
 
-	logger *log.Logger
+	// If true, PowerCommand's output must contain at least one of the above
+	// keys. Otherwise, a warning is logged and the command is reported as
+	// having failed (rather than reporting zero values).
+	PowerRequireStats bool `json:"powerRequireStats"`
+
+	// Optional prefix prepended to the names of power samples, e.g. "ups1_"
+	// to report "ups1_power_battery_percent".
+	PowerNamePrefix string `json:"powerNamePrefix"`
+
+	// Address of an MQTT broker to receive sensor readings from, e.g.
+	// "localhost:1883". Empty to disable MQTT.
+	MQTTBroker string `json:"mqttBroker"`
+
+	// Maps from MQTT topics to subscribe to to descriptions of how their
+	// messages should be reported. Wildcards aren't supported.
+	MQTTTopics map[string]mqttTopic `json:"mqttTopics"`
+
+	// Commands to run periodically to collect additional samples, e.g. from
+	// sensors. Each command should output lines of whitespace-separated sample
+	// names and values (e.g. "co2_ppm 415"), which are reported under Source.
+	Commands []commandConfig `json:"commands"`
+
+	// Time between samples describing the collector's own state (e.g. the
+	// number of queued samples), in seconds. 0 disables these samples.
+	SelfSampleIntervalSec int `json:"selfSampleIntervalSec"`
+
+	logger logger
+
+	// Protects ReportSecret, ReportDestinations' secrets, ListenSecret, and
+	// ListenPassword, which can be updated by reloadSecrets.
+	secretMu sync.RWMutex
 }
 
-func readConfig(path string, logger *log.Logger) (*config, error) {
+// reportDestination describes a server that samples are reported to.
+type reportDestination struct {
+	// Full URL to report samples, e.g. "http://example.com/report".
+	URL string `json:"url"`
+
+	// Shared secret used to sign reports. Config.ReportSecret is used if empty.
+	Secret string `json:"secret"`
+}
+
+// getReportDestinations returns all of the servers that samples should be
+// reported to.
+func (cfg *config) getReportDestinations() []reportDestination {
+	cfg.secretMu.RLock()
+	defer cfg.secretMu.RUnlock()
+
+	var dests []reportDestination
+	if cfg.ReportURL != "" {
+		dests = append(dests, reportDestination{cfg.ReportURL, cfg.ReportSecret})
+	}
+	for _, d := range cfg.ReportDestinations {
+		if d.Secret == "" {
+			d.Secret = cfg.ReportSecret
+		}
+		dests = append(dests, d)
+	}
+	return dests
+}
+
+// getUserAgent returns the User-Agent header to send with reports.
+func (cfg *config) getUserAgent() string {
+	if cfg.ReportUserAgent != "" {
+		return cfg.ReportUserAgent
+	}
+	return fmt.Sprintf("home-collector/%s (%s)", common.Version, cfg.Source)
+}
+
+// isDryRun returns true if samples should be logged rather than reported.
+func (cfg *config) isDryRun() bool {
+	return cfg.DryRun || len(cfg.getReportDestinations()) == 0
+}
+
+// getListenSecrets returns ListenSecret and ListenPassword.
+func (cfg *config) getListenSecrets() (secret, password string) {
+	cfg.secretMu.RLock()
+	defer cfg.secretMu.RUnlock()
+	return cfg.ListenSecret, cfg.ListenPassword
+}
+
+// reloadSecrets rereads the config file at path and updates cfg's report and
+// listen secrets to match it. Other settings are ignored. Samples are signed
+// when they're sent, so queued samples will use the new secrets.
+func (cfg *config) reloadSecrets(path string) error {
+	ncfg, err := readConfig(path, cfg.logger)
+	if err != nil {
+		return err
+	}
+
+	cfg.secretMu.Lock()
+	defer cfg.secretMu.Unlock()
+	cfg.ReportSecret = ncfg.ReportSecret
+	cfg.ListenSecret = ncfg.ListenSecret
+	cfg.ListenPassword = ncfg.ListenPassword
+	for i := range cfg.ReportDestinations {
+		d := &cfg.ReportDestinations[i]
+		d.Secret = ""
+		for _, nd := range ncfg.ReportDestinations {
+			if nd.URL == d.URL {
+				d.Secret = nd.Secret
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// getReportQuorum returns the number of destinations that must accept a batch
+// of samples.
+func (cfg *config) getReportQuorum() int {
+	if n := len(cfg.getReportDestinations()); cfg.ReportQuorum <= 0 || cfg.ReportQuorum > n {
+		return n
+	}
+	return cfg.ReportQuorum
+}
+
+// Default value for commandConfig.IntervalSec.
+const defaultCommandIntervalSec = 60
+
+func readConfig(path string, logger logger) (*config, error) {
 	cfg := &config{}
 	cfg.Source = "collector"
 	cfg.ListenAddress = ":8123"
+	cfg.ListenReadTimeoutMs = 10000
+	cfg.ListenWriteTimeoutMs = 10000
+	cfg.ListenIdleTimeoutMs = 60000
+	cfg.ListenNonceWindowSec = 300
 	cfg.ReportBatchSize = 10
 	cfg.ReportTimeoutMs = 10000
 	cfg.ReportRetryMs = 10000
 	cfg.PingSampleIntervalSec = 60
 	cfg.PingHost = "8.8.8.8"
+	cfg.PingBinary = findPingBinary()
 	cfg.PingCount = 5
 	cfg.PingDelayMs = 1000
 	cfg.PingTimeoutSec = 20
@@ -97,5 +320,60 @@ func readConfig(path string, logger *log.Logger) (*config, error) {
 		}
 	}
 
+	if cfg.PingIPVersion != 0 && cfg.PingIPVersion != 4 && cfg.PingIPVersion != 6 {
+		return nil, fmt.Errorf("invalid IP version %v", cfg.PingIPVersion)
+	}
+	if (cfg.ListenUsername == "") != (cfg.ListenPassword == "") {
+		return nil, fmt.Errorf("listen username and password must be supplied together")
+	}
+	if cfg.ListenNonceWindowSec <= 0 {
+		return nil, fmt.Errorf("invalid listen nonce window %v", cfg.ListenNonceWindowSec)
+	}
+	if (cfg.ReportClientCertFile == "") != (cfg.ReportClientKeyFile == "") {
+		return nil, fmt.Errorf("client cert and key must be supplied together")
+	}
+	if cfg.MQTTBroker != "" && len(cfg.MQTTTopics) == 0 {
+		return nil, fmt.Errorf("no MQTT topics supplied")
+	}
+	for topic, tc := range cfg.MQTTTopics {
+		if tc.Name == "" {
+			return nil, fmt.Errorf("MQTT topic %q missing sample name", topic)
+		}
+	}
+	for _, p := range []string{cfg.PingNamePrefix, cfg.PowerNamePrefix} {
+		if err := checkNamePrefix(p); err != nil {
+			return nil, err
+		}
+	}
+	for i := range cfg.Commands {
+		cc := &cfg.Commands[i]
+		if cc.Command == "" {
+			return nil, fmt.Errorf("command %v missing path", i)
+		}
+		if err := checkNamePrefix(cc.NamePrefix); err != nil {
+			return nil, err
+		}
+		if cc.IntervalSec <= 0 {
+			cc.IntervalSec = defaultCommandIntervalSec
+		}
+	}
+	for _, d := range cfg.ReportDestinations {
+		if d.URL == "" {
+			return nil, fmt.Errorf("report destination missing URL")
+		}
+	}
+	if n := len(cfg.getReportDestinations()); cfg.ReportQuorum < 0 || cfg.ReportQuorum > n {
+		return nil, fmt.Errorf("invalid report quorum %v", cfg.ReportQuorum)
+	}
+
 	return cfg, nil
 }
+
+// checkNamePrefix returns an error if p can't be used as a prefix of sample
+// names.
+func checkNamePrefix(p string) error {
+	if strings.ContainsAny(p, "|\t\n\r ") {
+		return fmt.Errorf("invalid sample name prefix %q", p)
+	}
+	return nil
+}
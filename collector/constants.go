@@ -9,12 +9,24 @@ const (
 
 	// Names of samples generated by the collector.
 	samplePingFailed          = "ping_failed"
+	samplePingDNSError        = "ping_dns_error"
+	samplePingUnreachable     = "ping_unreachable"
 	samplePingMin             = "ping_min"
 	samplePingAvg             = "ping_avg"
 	samplePingMax             = "ping_max"
+	samplePingMdev            = "ping_mdev"
+	samplePingRTT             = "ping_rtt"
 	samplePingPacketLoss      = "ping_packet_loss"
+	samplePowerFailed         = "power_failed"
 	samplePowerOnLine         = "power_on_line"
 	samplePowerLineVoltage    = "power_line_voltage"
 	samplePowerLoadPercent    = "power_load_percent"
 	samplePowerBatteryPercent = "power_battery_percent"
+	sampleQueueDepth          = "queue_depth"
+	sampleReportErrorsTotal   = "report_errors_total"
+	sampleBackingFileBytes    = "backing_file_bytes"
+	sampleClockSkewSec        = "clock_skew_sec"
+	sampleReportLatencyMinMs  = "report_latency_min_ms"
+	sampleReportLatencyAvgMs  = "report_latency_avg_ms"
+	sampleReportLatencyMaxMs  = "report_latency_max_ms"
 )
@@ -4,8 +4,13 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/derat/home/common"
@@ -14,12 +19,33 @@ import (
 type listener struct {
 	cfg *config
 	rep *reporter
+
+	// Nonces from signed reports, mapped to the times after which they'd be
+	// rejected as stale. Protected by nonceMu.
+	nonces  map[string]time.Time
+	nonceMu sync.Mutex
 }
 
 func (l *listener) run() error {
-	http.HandleFunc("/report", l.handleReport)
 	l.cfg.logger.Printf("Listening at %v", l.cfg.ListenAddress)
-	return http.ListenAndServe(l.cfg.ListenAddress, nil)
+	return l.newServer().ListenAndServe()
+}
+
+// newServer returns a server that handles requests using l.
+func (l *listener) newServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flush", l.requireAuth(l.handleFlush))
+	mux.HandleFunc("/queue", l.requireAuth(l.handleQueue))
+	mux.HandleFunc("/report", l.requireAuth(l.handleReport))
+
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	return &http.Server{
+		Addr:         l.cfg.ListenAddress,
+		Handler:      mux,
+		ReadTimeout:  ms(l.cfg.ListenReadTimeoutMs),
+		WriteTimeout: ms(l.cfg.ListenWriteTimeoutMs),
+		IdleTimeout:  ms(l.cfg.ListenIdleTimeoutMs),
+	}
 }
 
 func (l *listener) handleReport(w http.ResponseWriter, r *http.Request) {
@@ -30,21 +56,142 @@ func (l *listener) handleReport(w http.ResponseWriter, r *http.Request) {
 	}
 
 	now := time.Now()
-	lines := strings.Split(r.PostFormValue("d"), "\n")
-	samples := make([]common.Sample, len(lines))
-	for i, line := range lines {
-		if err := samples[i].Parse(line, now); err != nil {
+	data := r.PostFormValue("d")
+	if secret, _ := l.cfg.getListenSecrets(); secret != "" {
+		if err := l.checkSignature(data, r.FormValue("n"), r.FormValue("s"), secret, now); err != nil {
+			l.cfg.logger.Printf("Rejecting report: %v", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	var samples []common.Sample
+	for _, line := range strings.Split(data, "\n") {
+		// Skip blank lines, e.g. after a trailing newline.
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var s common.Sample
+		if err := s.Parse(line, now); err != nil {
 			l.cfg.logger.Printf("Report has unparseable sample %q: %v", line, err)
 			http.Error(w, "Bad request", http.StatusBadRequest)
 			return
 		}
+		samples = append(samples, s)
 	}
 
 	if len(samples) == 0 {
 		l.cfg.logger.Printf("Report doesn't contain any samples")
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		http.Error(w, "No samples", http.StatusBadRequest)
+		return
 	}
 
 	l.rep.reportSamples(samples)
 	w.Write([]byte("LGTM"))
 }
+
+// requireAuth wraps h to check the HTTP basic auth credentials supplied in
+// requests if ListenUsername and ListenPassword are set.
+func (l *listener) requireAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, password := l.cfg.getListenSecrets(); password != "" {
+			user, pass, ok := r.BasicAuth()
+			if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(l.cfg.ListenUsername)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+				l.cfg.logger.Printf("Rejecting %v request from %v with bad credentials",
+					r.URL.Path, r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Basic realm="collector"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// checkSignature returns an error if sig isn't a valid signature of data and
+// nonce, or if nonce is stale or was already used by a previous report.
+func (l *listener) checkSignature(data, nonce, sig, secret string, now time.Time) error {
+	if nonce == "" || sig == "" {
+		return errors.New("missing nonce or signature")
+	}
+	if !common.VerifyReport(data, nonce, secret, sig) {
+		return errors.New("bad signature")
+	}
+	t, err := common.ParseReportNonce(nonce)
+	if err != nil {
+		return err
+	}
+	window := time.Duration(l.cfg.ListenNonceWindowSec) * time.Second
+	if d := now.Sub(t); d > window || d < -window {
+		return fmt.Errorf("nonce %q outside of %v window", nonce, window)
+	}
+
+	l.nonceMu.Lock()
+	defer l.nonceMu.Unlock()
+	if l.nonces == nil {
+		l.nonces = make(map[string]time.Time)
+	}
+	for n, exp := range l.nonces {
+		if now.After(exp) {
+			delete(l.nonces, n)
+		}
+	}
+	if _, ok := l.nonces[nonce]; ok {
+		return fmt.Errorf("reused nonce %q", nonce)
+	}
+	l.nonces[nonce] = t.Add(window)
+	return nil
+}
+
+// handleFlush makes the reporter immediately try to report queued samples,
+// e.g. to check connectivity after changing the config.
+func (l *listener) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		l.cfg.logger.Printf("Flush has non-POST method %v", r.Method)
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	n := l.rep.queueLength()
+	l.rep.flush()
+	fmt.Fprintf(w, "Flushing %v sample(s)\n", n)
+}
+
+// queueInfo is returned as JSON by handleQueue.
+type queueInfo struct {
+	// Count contains the number of queued samples.
+	Count int `json:"count"`
+
+	// Oldest and Newest contain the earliest and latest timestamps of the
+	// queued samples. They're omitted if the queue is empty.
+	Oldest *time.Time `json:"oldest,omitempty"`
+	Newest *time.Time `json:"newest,omitempty"`
+
+	// Samples contains the queued samples in the order they'll be reported.
+	Samples []common.Sample `json:"samples"`
+}
+
+// handleQueue returns a queueInfo describing the reporter's queued samples.
+func (l *listener) handleQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		l.cfg.logger.Printf("Queue request has non-GET method %v", r.Method)
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	samples := l.rep.queuedSamplesSnapshot()
+	info := queueInfo{Count: len(samples), Samples: samples}
+	for i := range samples {
+		ts := samples[i].Timestamp
+		if info.Oldest == nil || ts.Before(*info.Oldest) {
+			info.Oldest = &ts
+		}
+		if info.Newest == nil || ts.After(*info.Newest) {
+			info.Newest = &ts
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		l.cfg.logger.Printf("Failed writing queue: %v", err)
+	}
+}
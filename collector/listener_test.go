@@ -0,0 +1,187 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/home/common"
+)
+
+func TestListenerHandleReport(t *testing.T) {
+	for _, tc := range []struct {
+		data   string
+		status int
+		queued int
+	}{
+		{"", http.StatusBadRequest, 0},
+		{"\n\n", http.StatusBadRequest, 0},
+		{"123|SOURCE|NAME|1.0", http.StatusOK, 1},
+		{"123|SOURCE|NAME|1.0\n", http.StatusOK, 1},
+		{"123|SOURCE|NAME|1.0\n\n456|SOURCE|NAME|2.0\n", http.StatusOK, 2},
+		{"123|SOURCE|NAME|1.0\nbogus", http.StatusBadRequest, 0},
+	} {
+		cfg := createConfig()
+		r, err := newReporter(cfg)
+		if err != nil {
+			t.Fatalf("Unable to create reporter: %v", err)
+		}
+		l := &listener{cfg: cfg, rep: r}
+
+		req := httptest.NewRequest("POST", "/report", strings.NewReader(url.Values{"d": {tc.data}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		l.handleReport(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("Report %q got status %v; expected %v", tc.data, rec.Code, tc.status)
+		}
+		if n := r.queueLength(); n != tc.queued {
+			t.Errorf("Report %q queued %v sample(s); expected %v", tc.data, n, tc.queued)
+		}
+	}
+}
+
+func TestListenerAuth(t *testing.T) {
+	const (
+		secret = "listen secret"
+		user   = "user"
+		pass   = "pass"
+		data   = "123|SOURCE|NAME|1.0"
+	)
+	cfg := createConfig()
+	cfg.ListenSecret = secret
+	cfg.ListenUsername = user
+	cfg.ListenPassword = pass
+	r, err := newReporter(cfg)
+	if err != nil {
+		t.Fatalf("Unable to create reporter: %v", err)
+	}
+	h := (&listener{cfg: cfg, rep: r}).newServer().Handler
+
+	now := time.Now()
+	nonce := common.NewReportNonce(now)
+	oldNonce := common.NewReportNonce(now.Add(-time.Hour))
+	for _, tc := range []struct {
+		desc       string
+		user, pass string
+		nonce, sig string
+		status     int
+	}{
+		{"valid", user, pass, nonce, common.SignReport(data, nonce, secret), http.StatusOK},
+		{"reused nonce", user, pass, nonce, common.SignReport(data, nonce, secret), http.StatusForbidden},
+		{"stale nonce", user, pass, oldNonce, common.SignReport(data, oldNonce, secret), http.StatusForbidden},
+		{"bad signature", user, pass, nonce, common.SignReport(data, nonce, "bogus"), http.StatusForbidden},
+		{"unsigned", user, pass, "", "", http.StatusForbidden},
+		{"bad password", user, "bogus", nonce, common.SignReport(data, nonce, secret), http.StatusUnauthorized},
+		{"no credentials", "", "", nonce, common.SignReport(data, nonce, secret), http.StatusUnauthorized},
+	} {
+		vals := url.Values{"d": {data}, "n": {tc.nonce}, "s": {tc.sig}}
+		req := httptest.NewRequest("POST", "/report", strings.NewReader(vals.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.pass)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%v report got status %v; expected %v", tc.desc, rec.Code, tc.status)
+		}
+	}
+	if n := r.queueLength(); n != 1 {
+		t.Errorf("Reports queued %v sample(s); expected 1", n)
+	}
+
+	// Other endpoints should also require credentials.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/queue", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Unauthenticated queue request got status %v; expected %v",
+			rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestListenerHandleQueue(t *testing.T) {
+	cfg := createConfig()
+	r, err := newReporter(cfg)
+	if err != nil {
+		t.Fatalf("Unable to create reporter: %v", err)
+	}
+	l := &listener{cfg: cfg, rep: r}
+
+	getInfo := func() queueInfo {
+		rec := httptest.NewRecorder()
+		l.handleQueue(rec, httptest.NewRequest("GET", "/queue", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Queue request got status %v", rec.Code)
+		}
+		var info queueInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatalf("Failed to unmarshal %q: %v", rec.Body.String(), err)
+		}
+		return info
+	}
+
+	if info := getInfo(); info.Count != 0 || info.Oldest != nil || info.Newest != nil {
+		t.Errorf("Got %+v for empty queue", info)
+	}
+
+	samples := []common.Sample{
+		{time.Unix(200, 0), "SOURCE", "NAME", 2.0},
+		{time.Unix(100, 0), "SOURCE", "NAME", 1.0},
+		{time.Unix(300, 0), "SOURCE", "NAME", 3.0},
+	}
+	r.reportSamples(samples)
+	info := getInfo()
+	if info.Count != len(samples) {
+		t.Errorf("Got count %v; expected %v", info.Count, len(samples))
+	}
+	if info.Oldest == nil || info.Oldest.Unix() != 100 {
+		t.Errorf("Got oldest time %v; expected 100", info.Oldest)
+	}
+	if info.Newest == nil || info.Newest.Unix() != 300 {
+		t.Errorf("Got newest time %v; expected 300", info.Newest)
+	}
+	if act, exp := common.JoinSamples(info.Samples), common.JoinSamples(samples); act != exp {
+		t.Errorf("Got samples %q; expected %q", act, exp)
+	}
+
+	rec := httptest.NewRecorder()
+	l.handleQueue(rec, httptest.NewRequest("POST", "/queue", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST got status %v; expected %v", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestListenerNewServer(t *testing.T) {
+	cfg := createConfig()
+	cfg.ListenReadTimeoutMs = 1000
+	cfg.ListenWriteTimeoutMs = 2000
+	cfg.ListenIdleTimeoutMs = 3000
+	r, err := newReporter(cfg)
+	if err != nil {
+		t.Fatalf("Unable to create reporter: %v", err)
+	}
+	srv := (&listener{cfg: cfg, rep: r}).newServer()
+	if srv.Addr != cfg.ListenAddress {
+		t.Errorf("Server has address %q; expected %q", srv.Addr, cfg.ListenAddress)
+	}
+	if srv.ReadTimeout != time.Second || srv.WriteTimeout != 2*time.Second ||
+		srv.IdleTimeout != 3*time.Second {
+		t.Errorf("Server has timeouts %v/%v/%v; expected 1s/2s/3s",
+			srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+
+	// Requests should be routed to the listener's handlers.
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/queue", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /queue got status %v; expected %v", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// logger is used to write log messages. It is implemented by *log.Logger.
+type logger interface {
+	Printf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// jsonLogger implements logger by writing one JSON object per message, which
+// is easier for log aggregators to ingest than free-form lines.
+type jsonLogger struct {
+	w      io.Writer
+	source string
+	mu     sync.Mutex // protects w
+}
+
+// jsonLogEntry is written by jsonLogger for each message.
+type jsonLogEntry struct {
+	Time   string `json:"time"`
+	Level  string `json:"level"`
+	Source string `json:"source"`
+	Msg    string `json:"msg"`
+}
+
+// newJSONLogger returns a jsonLogger that writes to w. source is included in
+// each message.
+func newJSONLogger(w io.Writer, source string) *jsonLogger {
+	return &jsonLogger{w: w, source: source}
+}
+
+func (l *jsonLogger) Printf(format string, args ...interface{}) {
+	l.write("info", fmt.Sprintf(format, args...))
+}
+
+func (l *jsonLogger) Fatalf(format string, args ...interface{}) {
+	l.write("fatal", fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func (l *jsonLogger) write(level, msg string) {
+	b, err := json.Marshal(&jsonLogEntry{
+		Time:   time.Now().Format(time.RFC3339Nano),
+		Level:  level,
+		Source: l.source,
+		Msg:    msg,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal log entry: %v", err))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(b, '\n'))
+}
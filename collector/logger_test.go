@@ -0,0 +1,37 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var b bytes.Buffer
+	l := newJSONLogger(&b, "collector")
+	l.Printf("Reported %v sample(s)", 3)
+	l.Printf("Got \"quoted\"\nmessage")
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Got %v line(s) instead of 2: %q", len(lines), b.String())
+	}
+	for i, exp := range []string{"Reported 3 sample(s)", "Got \"quoted\"\nmessage"} {
+		var e jsonLogEntry
+		if err := json.Unmarshal([]byte(lines[i]), &e); err != nil {
+			t.Errorf("Failed to unmarshal line %v (%q): %v", i, lines[i], err)
+			continue
+		}
+		if e.Msg != exp || e.Level != "info" || e.Source != "collector" {
+			t.Errorf("Line %v has unexpected entry %+v", i, e)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, e.Time); err != nil {
+			t.Errorf("Line %v has bad time %q: %v", i, e.Time, err)
+		}
+	}
+}
@@ -9,36 +9,85 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+
+	"github.com/derat/home/common"
 )
 
 func main() {
 	var configPath string
+	var jsonLogs bool
+	var dryRun bool
+	var printVersion bool
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [option]...\n\nOptions:\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.StringVar(&configPath, "config", filepath.Join(os.Getenv("HOME"), ".home_collector.json"), "Path to JSON config file")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log samples instead of reporting them")
+	flag.BoolVar(&jsonLogs, "json-logs", false, "Write log messages as JSON objects")
+	flag.BoolVar(&printVersion, "version", false, "Print version and exit")
 	flag.Parse()
 
+	if printVersion {
+		fmt.Println(common.Version)
+		os.Exit(0)
+	}
+
 	// TODO: Log to syslog instead using log/syslog:
 	// syslog.NewLogger(syslog.LOG_INFO|syslog.LOG_DAEMON, log.LstdFlags)
-	logger := log.New(os.Stderr, "", log.LstdFlags)
+	var logger logger = log.New(os.Stderr, "", log.LstdFlags)
+	if jsonLogs {
+		logger = newJSONLogger(os.Stderr, "")
+	}
 	cfg, err := readConfig(configPath, logger)
 	if err != nil {
 		logger.Fatalf("Unable to read config from %v: %v", configPath, err)
 	}
+	if jsonLogs {
+		logger = newJSONLogger(os.Stderr, cfg.Source)
+		cfg.logger = logger
+	}
+	if dryRun {
+		cfg.DryRun = true
+	}
 
-	r := newReporter(cfg)
+	r, err := newReporter(cfg)
+	if err != nil {
+		logger.Fatalf("Unable to create reporter: %v", err)
+	}
 	r.start()
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := cfg.reloadSecrets(configPath); err != nil {
+				logger.Printf("Unable to reload secrets from %v: %v", configPath, err)
+			} else {
+				logger.Printf("Reloaded secrets from %v", configPath)
+			}
+		}
+	}()
+
 	if cfg.PingHost != "" {
 		go runPingLoop(cfg, r)
 	}
 	if cfg.PowerCommand != "" {
 		go runPowerLoop(cfg, r)
 	}
+	if cfg.MQTTBroker != "" {
+		go runMQTTLoop(cfg, r)
+	}
+	for _, cc := range cfg.Commands {
+		go runCommandLoop(cfg, cc, r)
+	}
+	if cfg.SelfSampleIntervalSec > 0 {
+		go runSelfLoop(cfg, r)
+	}
 
 	l := &listener{cfg: cfg, rep: r}
 	if err = l.run(); err != nil {
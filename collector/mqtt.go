@@ -0,0 +1,274 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derat/home/common"
+)
+
+// This file contains a minimal MQTT 3.1.1 client that subscribes to topics at
+// QoS 0. See http://docs.oasis-open.org/mqtt/mqtt/v3.1.1/mqtt-v3.1.1.html.
+
+const (
+	// MQTT control packet types.
+	mqttConnect   = 1
+	mqttConnack   = 2
+	mqttPublish   = 3
+	mqttSubscribe = 8
+	mqttSuback    = 9
+	mqttPingreq   = 12
+	mqttPingresp  = 13
+
+	// Protocol level for MQTT 3.1.1.
+	mqttProtocolLevel = 4
+
+	// Keep-alive interval sent to the broker.
+	mqttKeepAlive = 60 * time.Second
+
+	// Multiple of the keep-alive interval after which the connection is
+	// considered dead if no packets (including PINGRESPs) have been received.
+	mqttReadTimeoutFactor = 1.5
+
+	// Time to wait before reconnecting to the broker after an error.
+	mqttRetryDelay = 10 * time.Second
+)
+
+// mqttTopic describes how messages published to an MQTT topic are converted
+// to samples.
+type mqttTopic struct {
+	// Sample source. Config.Source is used if empty.
+	Source string `json:"source"`
+
+	// Sample name.
+	Name string `json:"name"`
+
+	// Dot-separated path to a numeric field within a JSON object payload,
+	// e.g. "sensor.temperature". If empty, the payload should be a number.
+	Field string `json:"field"`
+}
+
+// getMQTTSample converts payload, received for topic at time now, to a sample.
+func getMQTTSample(cfg *config, topic mqttTopic, payload []byte, now time.Time) (common.Sample, error) {
+	s := common.Sample{Timestamp: now, Source: topic.Source, Name: topic.Name}
+	if s.Source == "" {
+		s.Source = cfg.Source
+	}
+
+	if topic.Field == "" {
+		v, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 32)
+		if err != nil {
+			return s, fmt.Errorf("bad value %q", payload)
+		}
+		s.Value = float32(v)
+		return s, nil
+	}
+
+	var val interface{}
+	if err := json.Unmarshal(payload, &val); err != nil {
+		return s, err
+	}
+	for _, p := range strings.Split(topic.Field, ".") {
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return s, fmt.Errorf("no field %q in %q", topic.Field, payload)
+		}
+		if val, ok = obj[p]; !ok {
+			return s, fmt.Errorf("no field %q in %q", topic.Field, payload)
+		}
+	}
+	v, ok := val.(float64)
+	if !ok {
+		return s, fmt.Errorf("field %q in %q isn't a number", topic.Field, payload)
+	}
+	s.Value = float32(v)
+	return s, nil
+}
+
+// writeMQTTPacket writes a packet of type typ with the supplied flags and body.
+func writeMQTTPacket(w io.Writer, typ, flags byte, body []byte) error {
+	b := []byte{typ<<4 | flags}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(b, body...))
+	return err
+}
+
+// readMQTTPacket reads a packet and returns its type, flags, and body.
+func readMQTTPacket(r *bufio.Reader) (typ, flags byte, body []byte, err error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, 0, nil, errors.New("bad remaining length")
+		}
+		d, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		n += int(d&0x7f) * mult
+		mult *= 128
+		if d&0x80 == 0 {
+			break
+		}
+	}
+	body = make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return h >> 4, h & 0xf, body, nil
+}
+
+// appendMQTTString appends s to b as a length-prefixed string.
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// runMQTTSession connects to the broker over conn, subscribes to all of the
+// topics in cfg.MQTTTopics, and reports received messages to r. PINGREQs are
+// sent every keepAlive/2, and the session fails if nothing is received from
+// the broker for mqttReadTimeoutFactor*keepAlive. It returns when an error is
+// encountered.
+func runMQTTSession(cfg *config, conn net.Conn, r *reporter, keepAlive time.Duration) error {
+	var mu sync.Mutex // serializes writes to conn
+	br := bufio.NewReader(conn)
+
+	// A dead broker may not close the connection, so time out if it stops
+	// responding to pings.
+	readTimeout := time.Duration(float64(keepAlive) * mqttReadTimeoutFactor)
+	read := func() (typ, flags byte, body []byte, err error) {
+		if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			return 0, 0, nil, err
+		}
+		return readMQTTPacket(br)
+	}
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, mqttProtocolLevel, 0x02) // clean session
+	body = append(body, byte(keepAlive/time.Second>>8), byte(keepAlive/time.Second))
+	body = appendMQTTString(body, "home-collector-"+cfg.Source)
+	if err := writeMQTTPacket(conn, mqttConnect, 0, body); err != nil {
+		return err
+	}
+	if typ, _, body, err := read(); err != nil {
+		return err
+	} else if typ != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("got packet type %v instead of CONNACK", typ)
+	} else if body[1] != 0 {
+		return fmt.Errorf("connection refused with code %v", body[1])
+	}
+
+	body = []byte{0, 1} // packet ID
+	for topic := range cfg.MQTTTopics {
+		body = appendMQTTString(body, topic)
+		body = append(body, 0) // QoS 0
+	}
+	if err := writeMQTTPacket(conn, mqttSubscribe, 0x2, body); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(keepAlive / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				mu.Lock()
+				err := writeMQTTPacket(conn, mqttPingreq, 0, nil)
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		typ, flags, body, err := read()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case mqttSuback:
+			if len(body) < 2 {
+				return errors.New("short SUBACK packet")
+			}
+			for _, rc := range body[2:] {
+				if rc == 0x80 {
+					return errors.New("subscription rejected")
+				}
+			}
+			cfg.logger.Printf("Subscribed to %v MQTT topic(s)", len(cfg.MQTTTopics))
+		case mqttPublish:
+			if len(body) < 2 {
+				return errors.New("short PUBLISH packet")
+			}
+			n := int(binary.BigEndian.Uint16(body))
+			if len(body) < 2+n {
+				return errors.New("short PUBLISH packet")
+			}
+			topic := string(body[2 : 2+n])
+			payload := body[2+n:]
+			if (flags>>1)&0x3 > 0 && len(payload) >= 2 {
+				payload = payload[2:] // skip packet ID
+			}
+			tc, ok := cfg.MQTTTopics[topic]
+			if !ok {
+				cfg.logger.Printf("Ignoring message for unknown MQTT topic %q", topic)
+				continue
+			}
+			s, err := getMQTTSample(cfg, tc, payload, time.Now())
+			if err != nil {
+				cfg.logger.Printf("Bad message for MQTT topic %q: %v", topic, err)
+				continue
+			}
+			r.reportSample(s)
+		case mqttPingresp:
+		default:
+			cfg.logger.Printf("Ignoring MQTT packet type %v", typ)
+		}
+	}
+}
+
+func runMQTTLoop(cfg *config, r *reporter) {
+	for {
+		if conn, err := net.DialTimeout("tcp", cfg.MQTTBroker, mqttRetryDelay); err != nil {
+			cfg.logger.Printf("Unable to connect to MQTT broker %v: %v", cfg.MQTTBroker, err)
+		} else {
+			err = runMQTTSession(cfg, conn, r, mqttKeepAlive)
+			cfg.logger.Printf("Lost connection to MQTT broker %v: %v", cfg.MQTTBroker, err)
+			conn.Close()
+		}
+		time.Sleep(mqttRetryDelay)
+	}
+}
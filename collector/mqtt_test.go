@@ -0,0 +1,132 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/derat/home/common"
+)
+
+func TestGetMQTTSample(t *testing.T) {
+	cfg := createConfig()
+	cfg.Source = "SOURCE"
+	now := time.Unix(100, 0)
+
+	for _, tc := range []struct {
+		topic   mqttTopic
+		payload string
+		exp     *common.Sample // nil if error expected
+	}{
+		{mqttTopic{Name: "temp"}, "21.5\n", &common.Sample{now, "SOURCE", "temp", 21.5}},
+		{mqttTopic{Source: "OTHER", Name: "temp"}, "3", &common.Sample{now, "OTHER", "temp", 3}},
+		{mqttTopic{Name: "temp", Field: "a.b"}, `{"a":{"b":4.5}}`, &common.Sample{now, "SOURCE", "temp", 4.5}},
+		{mqttTopic{Name: "temp"}, "abc", nil},
+		{mqttTopic{Name: "temp", Field: "a.c"}, `{"a":{"b":4.5}}`, nil},
+		{mqttTopic{Name: "temp", Field: "a"}, `{"a":"str"}`, nil},
+		{mqttTopic{Name: "temp", Field: "a"}, `not json`, nil},
+	} {
+		s, err := getMQTTSample(cfg, tc.topic, []byte(tc.payload), now)
+		if tc.exp == nil {
+			if err == nil {
+				t.Errorf("getMQTTSample(%v, %q) unexpectedly succeeded", tc.topic, tc.payload)
+			}
+		} else if err != nil {
+			t.Errorf("getMQTTSample(%v, %q) failed: %v", tc.topic, tc.payload, err)
+		} else if s.String() != tc.exp.String() {
+			t.Errorf("getMQTTSample(%v, %q) = %q; want %q", tc.topic, tc.payload, s.String(), tc.exp.String())
+		}
+	}
+}
+
+func TestRunMQTTSession(t *testing.T) {
+	cfg := createConfig()
+	cfg.Source = "SOURCE"
+	cfg.MQTTTopics = map[string]mqttTopic{"home/temp": {Name: "temp"}}
+	ts, r := initTest(t, cfg)
+	defer cleanUpTest(ts, r)
+
+	client, broker := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- runMQTTSession(cfg, client, r, mqttKeepAlive)
+	}()
+
+	// Act as the broker.
+	br := bufio.NewReader(broker)
+	if typ, _, _, err := readMQTTPacket(br); err != nil || typ != mqttConnect {
+		t.Fatalf("Didn't get CONNECT: type %v, err %v", typ, err)
+	}
+	writeMQTTPacket(broker, mqttConnack, 0, []byte{0, 0})
+	typ, _, body, err := readMQTTPacket(br)
+	if err != nil || typ != mqttSubscribe {
+		t.Fatalf("Didn't get SUBSCRIBE: type %v, err %v", typ, err)
+	}
+	if exp := append(appendMQTTString([]byte{0, 1}, "home/temp"), 0); string(body) != string(exp) {
+		t.Errorf("Got SUBSCRIBE body %q; want %q", body, exp)
+	}
+	writeMQTTPacket(broker, mqttSuback, 0, []byte{0, 1, 0})
+
+	writeMQTTPacket(broker, mqttPublish, 0, append(appendMQTTString(nil, "home/other"), "5"...))
+	writeMQTTPacket(broker, mqttPublish, 0, append(appendMQTTString(nil, "home/temp"), "21.5"...))
+	str := ts.waitForReport(t)
+	var s common.Sample
+	if err := s.Parse(str, time.Now()); err != nil {
+		t.Errorf("Unable to parse reported sample %q: %v", str, err)
+	} else if s.Source != "SOURCE" || s.Name != "temp" || s.Value != 21.5 {
+		t.Errorf("Got unexpected sample %q", str)
+	}
+
+	broker.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("runMQTTSession returned nil after broker closed connection")
+		}
+	case <-time.After(time.Duration(testReportTimeoutMs) * time.Millisecond):
+		t.Errorf("runMQTTSession didn't return after broker closed connection")
+	}
+}
+
+func TestRunMQTTSessionTimeout(t *testing.T) {
+	cfg := createConfig()
+	cfg.MQTTTopics = map[string]mqttTopic{"home/temp": {Name: "temp"}}
+	ts, r := initTest(t, cfg)
+	defer cleanUpTest(ts, r)
+
+	client, broker := net.Pipe()
+	defer broker.Close()
+	const keepAlive = time.Second
+	done := make(chan error, 1)
+	go func() {
+		done <- runMQTTSession(cfg, client, r, keepAlive)
+	}()
+
+	// Act as a broker that stops responding after the subscription.
+	br := bufio.NewReader(broker)
+	if typ, _, _, err := readMQTTPacket(br); err != nil || typ != mqttConnect {
+		t.Fatalf("Didn't get CONNECT: type %v, err %v", typ, err)
+	}
+	writeMQTTPacket(broker, mqttConnack, 0, []byte{0, 0})
+	go func() {
+		// Keep reading SUBSCRIBE and PINGREQ packets without replying.
+		for {
+			if _, _, _, err := readMQTTPacket(br); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("runMQTTSession returned nil after broker stopped responding")
+		}
+	case <-time.After(3 * keepAlive):
+		t.Errorf("runMQTTSession didn't return after broker stopped responding")
+	}
+}
@@ -4,6 +4,8 @@
 package main
 
 import (
+	"math"
+	"net"
 	"os/exec"
 	"regexp"
 	"strconv"
@@ -13,23 +15,67 @@ import (
 	"github.com/derat/home/common"
 )
 
-const pingPath = "/bin/ping"
+// Path to the ping command used if it isn't found in $PATH.
+const defaultPingPath = "/bin/ping"
 
-// Matches "3 packets transmitted, 3 received, 0% packet loss, time 401ms"
-var countRegexp *regexp.Regexp = regexp.MustCompile("(?m)^(\\d+) packets transmitted, (\\d+) received")
+// Matches "3 packets transmitted, 3 received, 0% packet loss, time 401ms" and
+// "3 packets transmitted, 3 packets received, 0.0% packet loss".
+var countRegexp *regexp.Regexp = regexp.MustCompile("(?m)^(\\d+) packets transmitted, (\\d+) (?:packets )?received")
 
-// Matches "rtt min/avg/max/mdev = 10.694/13.969/17.825/2.941 ms".
-var timeRegexp *regexp.Regexp = regexp.MustCompile("(?m)^rtt min/avg/max/mdev = (\\S+)\\s+(\\S+)")
+// Matches "rtt min/avg/max/mdev = 10.694/13.969/17.825/2.941 ms",
+// "round-trip min/avg/max/std-dev = 0.047/0.063/0.079/0.016 ms", and BusyBox's
+// "round-trip min/avg/max = 0.047/0.063/0.079 ms".
+var timeRegexp *regexp.Regexp = regexp.MustCompile("(?m)^(?:rtt|round-trip) min/avg/max(?:/(?:mdev|stddev|std-dev))? = (\\S+)\\s+(\\S+)")
+
+// Matches individual replies like "64 bytes from 127.0.0.1: icmp_seq=1 ttl=64
+// time=0.030 ms", "16 bytes from ::1, icmp_seq=0 hlim=64 time=0.047 ms", and
+// BusyBox's "64 bytes from 127.0.0.1: seq=0 ttl=64 time=0.030 ms".
+// Duplicate replies, which end with "(DUP!)", aren't matched.
+var replyRegexp *regexp.Regexp = regexp.MustCompile("(?m)^\\d+ bytes from .*\\b(?:icmp_)?seq=(\\d+)\\b.*\\btime=(\\S+) ms$")
+
+// Matches errors printed when the host's name can't be resolved, e.g.
+// "ping: foo.invalid: Name or service not known".
+var dnsErrorRegexp *regexp.Regexp = regexp.MustCompile("(?i)unknown host|name or service not known|" +
+	"temporary failure in name resolution|cannot resolve|no address associated with hostname")
+
+// Matches errors printed when the host is unreachable, e.g. "From 10.0.0.1
+// icmp_seq=1 Destination Host Unreachable", "connect: Network is unreachable",
+// or the "+3 errors" in the summary line that's printed instead when -q is
+// passed.
+var unreachableRegexp *regexp.Regexp = regexp.MustCompile("(?i)unreachable|time to live exceeded|" +
+	"packets transmitted, \\d+ received, \\+\\d+ errors")
 
 type pingStats struct {
 	// True if the command failed to produce usable output.
 	commandFailed bool
 
+	// True if the host's name couldn't be resolved.
+	dnsError bool
+
+	// True if ICMP errors reported that the host was unreachable.
+	unreachable bool
+
 	// Minimum, average, and maximum RTT, in milliseconds.
 	minReplyMs, avgReplyMs, maxReplyMs float32
 
+	// Mean deviation (i.e. jitter) of RTTs, in milliseconds. Some versions
+	// of ping (e.g. BusyBox's) don't report this, in which case mdevMissing
+	// is true.
+	mdevReplyMs float32
+	mdevMissing bool
+
 	// Fraction of pings not receiving responses in the range [0.0, 1.0].
 	packetLoss float32
+
+	// Individual replies, in the order in which they were received. This is
+	// only populated if the ping command was run without -q.
+	replies []pingReply
+}
+
+// pingReply describes a single reply printed by the ping command.
+type pingReply struct {
+	seq int     // ICMP sequence number
+	ms  float32 // RTT in milliseconds
 }
 
 func parseFloats(s []string) ([]float32, error) {
@@ -44,18 +90,56 @@ func parseFloats(s []string) ([]float32, error) {
 	return f, nil
 }
 
-func getPingStats(cfg *config) *pingStats {
+// findPingBinary returns the path to the ping command.
+func findPingBinary() string {
+	if p, err := exec.LookPath("ping"); err == nil {
+		return p
+	}
+	return defaultPingPath
+}
+
+// getPingArgs returns arguments that should be passed to the ping command.
+func getPingArgs(cfg *config) []string {
 	count := strconv.FormatInt(int64(cfg.PingCount), 10)
 	delaySec := strconv.FormatFloat(float64(cfg.PingDelayMs)/1000.0, 'f', 3, 32)
 	deadlineSec := strconv.FormatInt(int64(cfg.PingTimeoutSec), 10)
-	cmd := exec.Command(pingPath, "-c", count, "-i", delaySec, "-w", deadlineSec, "-q", cfg.PingHost)
+	args := []string{"-c", count, "-i", delaySec, "-w", deadlineSec}
+	if !cfg.PingReportIndividual {
+		args = append(args, "-q")
+	}
+
+	version := cfg.PingIPVersion
+	if version == 0 {
+		if ip := net.ParseIP(cfg.PingHost); ip != nil && ip.To4() == nil {
+			version = 6
+		}
+	}
+	switch version {
+	case 4:
+		args = append(args, "-4")
+	case 6:
+		args = append(args, "-6")
+	}
+
+	return append(args, cfg.PingHost)
+}
+
+func getPingStats(cfg *config) *pingStats {
+	cmd := exec.Command(cfg.PingBinary, getPingArgs(cfg)...)
 	out, _ := cmd.CombinedOutput()
+	return parsePingOutput(cfg, string(out))
+}
 
-	s := &pingStats{}
+// parsePingOutput parses the output of the ping command.
+func parsePingOutput(cfg *config, out string) *pingStats {
+	s := &pingStats{
+		dnsError:    dnsErrorRegexp.MatchString(out),
+		unreachable: unreachableRegexp.MatchString(out),
+	}
 
 	var tx, rx float32
-	if cm := countRegexp.FindStringSubmatch(string(out)); cm == nil {
-		cfg.logger.Printf("Didn't find ping count in %q", string(out))
+	if cm := countRegexp.FindStringSubmatch(out); cm == nil {
+		cfg.logger.Printf("Didn't find ping count in %q", out)
 		s.commandFailed = true
 		return s
 	} else if counts, err := parseFloats(cm[1:]); err != nil {
@@ -71,42 +155,111 @@ func getPingStats(cfg *config) *pingStats {
 
 	// The line with times only shows up if at least one reply was received.
 	if rx > 0.0 {
-		if tm := timeRegexp.FindStringSubmatch(string(out)); tm == nil {
-			cfg.logger.Printf("Didn't find ping times in %q", string(out))
+		if tm := timeRegexp.FindStringSubmatch(out); tm == nil {
+			cfg.logger.Printf("Didn't find ping times in %q", out)
 			s.commandFailed = true
 			return s
 		} else if times, err := parseFloats(strings.Split(tm[1], "/")); err != nil {
 			cfg.logger.Printf("Failed to parse ping times from %q: %v", tm[1], err)
 			s.commandFailed = true
 			return s
-		} else if len(times) != 4 {
-			cfg.logger.Printf("Expected 4 ping times from %q; got %v", tm[1], len(times))
+		} else if len(times) != 3 && len(times) != 4 {
+			cfg.logger.Printf("Expected 3 or 4 ping times from %q; got %v", tm[1], len(times))
 			s.commandFailed = true
 			return s
 		} else {
 			s.minReplyMs, s.avgReplyMs, s.maxReplyMs = times[0], times[1], times[2]
+			if len(times) == 4 {
+				s.mdevReplyMs = times[3]
+			} else {
+				s.mdevMissing = true
+			}
+		}
+	}
+
+	for _, m := range replyRegexp.FindAllStringSubmatch(out, -1) {
+		seq, err := strconv.Atoi(m[1])
+		if err != nil {
+			cfg.logger.Printf("Failed to parse ping sequence number from %q: %v", m[0], err)
+			continue
+		}
+		ms, err := strconv.ParseFloat(m[2], 32)
+		if err != nil {
+			cfg.logger.Printf("Failed to parse ping time from %q: %v", m[0], err)
+			continue
 		}
+		s.replies = append(s.replies, pingReply{seq, float32(ms)})
+	}
+
+	// If ping didn't report the jitter, compute it from the replies.
+	if s.mdevMissing && len(s.replies) > 0 {
+		s.mdevReplyMs = getReplyStdDev(s.replies)
+		s.mdevMissing = false
 	}
 
 	return s
 }
 
+// getReplyStdDev returns the standard deviation of replies' RTTs, which is what
+// ping reports as "mdev".
+func getReplyStdDev(replies []pingReply) float32 {
+	var sum, sumSq float64
+	for _, r := range replies {
+		sum += float64(r.ms)
+		sumSq += float64(r.ms) * float64(r.ms)
+	}
+	n := float64(len(replies))
+	mean := sum / n
+	return float32(math.Sqrt(math.Max(sumSq/n-mean*mean, 0)))
+}
+
+// getPingSamples converts stats, collected at time now, to samples. The
+// jitter sample is omitted if ping didn't report it. If PingReportIndividual
+// is set, a sample is also returned for each reply, timestamped based on its
+// sequence number and PingDelayMs.
+func getPingSamples(cfg *config, stats *pingStats, now time.Time) []common.Sample {
+	boolVal := func(b bool) float32 {
+		if b {
+			return 1.0
+		}
+		return 0.0
+	}
+	p := cfg.PingNamePrefix
+	samples := []common.Sample{
+		{now, cfg.Source, p + samplePingFailed, boolVal(stats.commandFailed)},
+		{now, cfg.Source, p + samplePingDNSError, boolVal(stats.dnsError)},
+		{now, cfg.Source, p + samplePingUnreachable, boolVal(stats.unreachable)},
+		{now, cfg.Source, p + samplePingMin, stats.minReplyMs},
+		{now, cfg.Source, p + samplePingAvg, stats.avgReplyMs},
+		{now, cfg.Source, p + samplePingMax, stats.maxReplyMs},
+		{now, cfg.Source, p + samplePingPacketLoss, stats.packetLoss},
+	}
+	if !stats.mdevMissing {
+		samples = append(samples, common.Sample{now, cfg.Source, p + samplePingMdev, stats.mdevReplyMs})
+	}
+
+	if cfg.PingReportIndividual {
+		// Linux's ping numbers requests starting at 1, while BSD's starts at 0.
+		base := 1
+		for _, r := range stats.replies {
+			if r.seq == 0 {
+				base = 0
+			}
+		}
+		delay := time.Duration(cfg.PingDelayMs) * time.Millisecond
+		for _, r := range stats.replies {
+			ts := now.Add(time.Duration(r.seq-base) * delay)
+			samples = append(samples, common.Sample{ts, cfg.Source, p + samplePingRTT, r.ms})
+		}
+	}
+	return samples
+}
+
 func runPingLoop(cfg *config, r *reporter) {
 	for {
 		start := time.Now()
 		stats := getPingStats(cfg)
-
-		failedVal := float32(0.0)
-		if stats.commandFailed {
-			failedVal = 1.0
-		}
-		r.reportSamples([]common.Sample{
-			{start, cfg.Source, samplePingFailed, failedVal},
-			{start, cfg.Source, samplePingMin, stats.minReplyMs},
-			{start, cfg.Source, samplePingAvg, stats.avgReplyMs},
-			{start, cfg.Source, samplePingMax, stats.maxReplyMs},
-			{start, cfg.Source, samplePingPacketLoss, stats.packetLoss},
-		})
+		r.reportSamples(getPingSamples(cfg, stats, start))
 
 		next := start.Add(time.Duration(cfg.PingSampleIntervalSec) * time.Second)
 		now := time.Now()
@@ -7,7 +7,12 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/derat/home/common"
 )
 
 func getConfig(host string, count, delayMs, timeoutSec int) *config {
@@ -16,6 +21,7 @@ func getConfig(host string, count, delayMs, timeoutSec int) *config {
 		out = os.Stderr
 	}
 	return &config{
+		PingBinary:     findPingBinary(),
 		PingHost:       host,
 		PingCount:      count,
 		PingDelayMs:    delayMs,
@@ -50,3 +56,156 @@ func TestPingTimeout(t *testing.T) {
 		t.Errorf("Got nonzero ping time(s) (min=%f avg=%f max=%f)", s.minReplyMs, s.avgReplyMs, s.maxReplyMs)
 	}
 }
+
+func TestPingIPv6(t *testing.T) {
+	s := getPingStats(getConfig("::1", 3, 200, 10))
+	if s.commandFailed {
+		t.Fatal("Ping command failed")
+	}
+	if s.packetLoss != 0.0 {
+		t.Errorf("Got nonzero packet loss %f", s.packetLoss)
+	}
+	if s.minReplyMs <= 0.0 || s.minReplyMs > s.avgReplyMs || s.avgReplyMs > s.maxReplyMs {
+		t.Errorf("Got invalid-seeming ping times (min=%f avg=%f max=%f)", s.minReplyMs, s.avgReplyMs, s.maxReplyMs)
+	}
+}
+
+func TestGetPingArgs(t *testing.T) {
+	for _, tc := range []struct {
+		host       string
+		version    int
+		individual bool
+		exp        string
+	}{
+		{"localhost", 0, false, "-c 3 -i 0.200 -w 10 -q localhost"},
+		{"127.0.0.1", 0, false, "-c 3 -i 0.200 -w 10 -q 127.0.0.1"},
+		{"::1", 0, false, "-c 3 -i 0.200 -w 10 -q -6 ::1"},
+		{"localhost", 4, false, "-c 3 -i 0.200 -w 10 -q -4 localhost"},
+		{"localhost", 6, false, "-c 3 -i 0.200 -w 10 -q -6 localhost"},
+		{"localhost", 0, true, "-c 3 -i 0.200 -w 10 localhost"},
+	} {
+		cfg := getConfig(tc.host, 3, 200, 10)
+		cfg.PingIPVersion = tc.version
+		cfg.PingReportIndividual = tc.individual
+		if act := strings.Join(getPingArgs(cfg), " "); act != tc.exp {
+			t.Errorf("Expected %q for %q with version %v; got %q", tc.exp, tc.host, tc.version, act)
+		}
+	}
+}
+
+func TestParsePingOutput(t *testing.T) {
+	cfg := getConfig("", 3, 200, 10)
+	for _, tc := range []struct {
+		desc string
+		out  string
+		exp  pingStats
+	}{
+		{"success", `PING localhost (127.0.0.1) 56(84) bytes of data.
+
+--- localhost ping statistics ---
+3 packets transmitted, 3 received, 0% packet loss, time 401ms
+rtt min/avg/max/mdev = 0.030/0.045/0.060/0.012 ms
+`, pingStats{minReplyMs: 0.03, avgReplyMs: 0.045, maxReplyMs: 0.06, mdevReplyMs: 0.012}},
+		{"bsd success", `PING6(56=40+8+8 bytes) ::1 --> ::1
+
+--- ::1 ping6 statistics ---
+3 packets transmitted, 3 packets received, 0.0% packet loss
+round-trip min/avg/max/std-dev = 0.047/0.063/0.079/0.016 ms
+`, pingStats{minReplyMs: 0.047, avgReplyMs: 0.063, maxReplyMs: 0.079, mdevReplyMs: 0.016}},
+		{"busybox success", `PING localhost (127.0.0.1): 56 data bytes
+
+--- localhost ping statistics ---
+3 packets transmitted, 3 packets received, 0% packet loss
+round-trip min/avg/max = 0.047/0.063/0.079 ms
+`, pingStats{minReplyMs: 0.047, avgReplyMs: 0.063, maxReplyMs: 0.079, mdevMissing: true}},
+		{"verbose success", `PING localhost (127.0.0.1) 56(84) bytes of data.
+64 bytes from localhost (127.0.0.1): icmp_seq=1 ttl=64 time=0.030 ms
+64 bytes from localhost (127.0.0.1): icmp_seq=1 ttl=64 time=0.040 ms (DUP!)
+64 bytes from localhost (127.0.0.1): icmp_seq=3 ttl=64 time=0.060 ms
+
+--- localhost ping statistics ---
+3 packets transmitted, 2 received, +1 duplicates, 33% packet loss, time 401ms
+rtt min/avg/max/mdev = 0.030/0.045/0.060/0.015 ms
+`, pingStats{minReplyMs: 0.03, avgReplyMs: 0.045, maxReplyMs: 0.06, mdevReplyMs: 0.015,
+			packetLoss: float32(1) / 3, replies: []pingReply{{1, 0.03}, {3, 0.06}}}},
+		{"verbose busybox success", `PING localhost (127.0.0.1): 56 data bytes
+64 bytes from 127.0.0.1: seq=0 ttl=64 time=1.000 ms
+64 bytes from 127.0.0.1: seq=1 ttl=64 time=3.000 ms
+
+--- localhost ping statistics ---
+2 packets transmitted, 2 packets received, 0% packet loss
+round-trip min/avg/max = 1.000/2.000/3.000 ms
+`, pingStats{minReplyMs: 1, avgReplyMs: 2, maxReplyMs: 3, mdevReplyMs: 1,
+			replies: []pingReply{{0, 1}, {1, 3}}}},
+		{"timeout", `PING 203.0.113.0 (203.0.113.0) 56(84) bytes of data.
+
+--- 203.0.113.0 ping statistics ---
+3 packets transmitted, 0 received, 100% packet loss, time 2047ms
+`, pingStats{packetLoss: 1.0}},
+		{"host unreachable", `PING 192.168.1.250 (192.168.1.250) 56(84) bytes of data.
+
+--- 192.168.1.250 ping statistics ---
+3 packets transmitted, 0 received, +3 errors, 100% packet loss, time 2035ms
+`, pingStats{unreachable: true, packetLoss: 1.0}},
+		{"verbose host unreachable", `PING 192.168.1.250 (192.168.1.250) 56(84) bytes of data.
+From 192.168.1.2 icmp_seq=1 Destination Host Unreachable
+
+--- 192.168.1.250 ping statistics ---
+1 packets transmitted, 0 received, +1 errors, 100% packet loss, time 0ms
+`, pingStats{unreachable: true, packetLoss: 1.0}},
+		{"network unreachable", "connect: Network is unreachable\n",
+			pingStats{commandFailed: true, unreachable: true}},
+		{"unknown host", "ping: unknown host foo.invalid\n",
+			pingStats{commandFailed: true, dnsError: true}},
+		{"name not known", "ping: foo.invalid: Name or service not known\n",
+			pingStats{commandFailed: true, dnsError: true}},
+		{"temporary dns failure", "ping: www.google.com: Temporary failure in name resolution\n",
+			pingStats{commandFailed: true, dnsError: true}},
+		{"bsd unknown host", "ping: cannot resolve foo.invalid: Unknown host\n",
+			pingStats{commandFailed: true, dnsError: true}},
+	} {
+		if act := parsePingOutput(cfg, tc.out); !reflect.DeepEqual(*act, tc.exp) {
+			t.Errorf("Got %+v for %v output; expected %+v", *act, tc.desc, tc.exp)
+		}
+	}
+}
+
+func TestGetPingSamples(t *testing.T) {
+	cfg := getConfig("", 3, 200, 10)
+	cfg.Source = "SOURCE"
+	cfg.PingNamePrefix = "wan_"
+	now := time.Unix(100, 0)
+	stats := &pingStats{unreachable: true, minReplyMs: 1, avgReplyMs: 2, maxReplyMs: 3,
+		mdevReplyMs: 0.5, packetLoss: 0.5}
+	exp := common.JoinSamples([]common.Sample{
+		{now, "SOURCE", "wan_ping_failed", 0},
+		{now, "SOURCE", "wan_ping_dns_error", 0},
+		{now, "SOURCE", "wan_ping_unreachable", 1},
+		{now, "SOURCE", "wan_ping_min", 1},
+		{now, "SOURCE", "wan_ping_avg", 2},
+		{now, "SOURCE", "wan_ping_max", 3},
+		{now, "SOURCE", "wan_ping_packet_loss", 0.5},
+		{now, "SOURCE", "wan_ping_mdev", 0.5},
+	})
+	if act := common.JoinSamples(getPingSamples(cfg, stats, now)); act != exp {
+		t.Errorf("Expected %q; got %q", exp, act)
+	}
+
+	// The jitter sample should be omitted if ping didn't report it.
+	stats.mdevMissing = true
+	if act := getPingSamples(cfg, stats, now); len(act) != 7 {
+		t.Errorf("Got %v sample(s) without jitter; expected 7", len(act))
+	}
+
+	// Individual replies should be timestamped using their sequence numbers.
+	cfg.PingReportIndividual = true
+	stats.replies = []pingReply{{1, 4}, {3, 5}}
+	act := getPingSamples(cfg, stats, now)[7:]
+	exp = common.JoinSamples([]common.Sample{
+		{now, "SOURCE", "wan_ping_rtt", 4},
+		{now.Add(400 * time.Millisecond), "SOURCE", "wan_ping_rtt", 5},
+	})
+	if act := common.JoinSamples(act); act != exp {
+		t.Errorf("Expected %q for replies; got %q", exp, act)
+	}
+}
@@ -5,8 +5,6 @@ package main
 
 import (
 	"os/exec"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/derat/home/common"
@@ -23,32 +21,59 @@ type powerStats struct {
 	batteryPercent float32
 }
 
-func parsePowerCommandOutput(cfg *config, out string, stats *powerStats) {
-	for _, line := range strings.Split(out, "\n") {
-		parts := strings.Fields(line)
-		if len(parts) != 2 {
-			if len(parts) != 0 {
-				cfg.logger.Printf("Skipping bad power stats line %q", line)
-			}
-			continue
-		}
-		key := parts[0]
-		val, err := strconv.ParseFloat(parts[1], 64)
-		if err != nil {
-			cfg.logger.Printf("Unable to parse value %q for power stat %q", parts[1], key)
-		}
-		if key == "on_line" {
-			stats.onLine = val > 0.0
-		} else if key == "line_voltage" {
-			stats.lineVoltage = float32(val)
-		} else if key == "load_percent" {
-			stats.loadPercent = float32(val)
-		} else if key == "battery_percent" {
-			stats.batteryPercent = float32(val)
+// parsePowerCommandOutput parses out, the output of cfg.PowerCommand, into
+// stats. The number of recognized stats is returned.
+func parsePowerCommandOutput(cfg *config, out string, stats *powerStats) int {
+	found := 0
+	for _, kv := range parseKeyValueOutput(cfg, out, "power stats") {
+		found++
+		if kv.key == "on_line" {
+			stats.onLine = kv.val > 0.0
+		} else if kv.key == "line_voltage" {
+			stats.lineVoltage = float32(kv.val)
+		} else if kv.key == "load_percent" {
+			stats.loadPercent = float32(kv.val)
+		} else if kv.key == "battery_percent" {
+			stats.batteryPercent = float32(kv.val)
 		} else {
-			cfg.logger.Printf("Ignoring unknown power stat %q", key)
+			cfg.logger.Printf("Ignoring unknown power stat %q", kv.key)
+			found--
 		}
 	}
+	return found
+}
+
+// getPowerSamples converts out, the output of cfg.PowerCommand run at time
+// now, to samples. cmdErr is the error returned when running the command. A
+// power_failed sample is always returned; it's 1 if the command failed or if
+// cfg.PowerRequireStats is set and out doesn't contain any recognized stats,
+// in which case no other samples are returned.
+func getPowerSamples(cfg *config, out string, cmdErr error, now time.Time) []common.Sample {
+	p := cfg.PowerNamePrefix
+	failed := func() []common.Sample {
+		return []common.Sample{{now, cfg.Source, p + samplePowerFailed, 1.0}}
+	}
+	if cmdErr != nil {
+		cfg.logger.Printf("Power command %q failed: %v", cfg.PowerCommand, cmdErr)
+		return failed()
+	}
+
+	stats := powerStats{}
+	if parsePowerCommandOutput(cfg, out, &stats) == 0 && cfg.PowerRequireStats {
+		cfg.logger.Printf("Power command %q didn't output any power stats", cfg.PowerCommand)
+		return failed()
+	}
+	onLineVal := float32(0.0)
+	if stats.onLine {
+		onLineVal = 1.0
+	}
+	return []common.Sample{
+		{now, cfg.Source, p + samplePowerFailed, 0.0},
+		{now, cfg.Source, p + samplePowerOnLine, onLineVal},
+		{now, cfg.Source, p + samplePowerLineVoltage, stats.lineVoltage},
+		{now, cfg.Source, p + samplePowerLoadPercent, stats.loadPercent},
+		{now, cfg.Source, p + samplePowerBatteryPercent, stats.batteryPercent},
+	}
 }
 
 func runPowerLoop(cfg *config, r *reporter) {
@@ -56,25 +81,10 @@ func runPowerLoop(cfg *config, r *reporter) {
 	for {
 		start := time.Now()
 
-		stats := powerStats{}
 		// TODO: Split into arguments?
 		cmd := exec.Command(cfg.PowerCommand)
 		out, err := cmd.CombinedOutput()
-		if err != nil {
-			cfg.logger.Printf("Power command %q failed", cfg.PowerCommand)
-		} else {
-			parsePowerCommandOutput(cfg, string(out), &stats)
-			onLineVal := float32(0.0)
-			if stats.onLine {
-				onLineVal = 1.0
-			}
-			r.reportSamples([]common.Sample{
-				{start, cfg.Source, samplePowerOnLine, onLineVal},
-				{start, cfg.Source, samplePowerLineVoltage, stats.lineVoltage},
-				{start, cfg.Source, samplePowerLoadPercent, stats.loadPercent},
-				{start, cfg.Source, samplePowerBatteryPercent, stats.batteryPercent},
-			})
-		}
+		r.reportSamples(getPowerSamples(cfg, string(out), err, start))
 
 		next := start.Add(time.Duration(cfg.PowerSampleIntervalSec) * time.Second)
 		now := time.Now()
@@ -5,10 +5,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/derat/home/common"
 )
 
 func getPowerStatsJSON(t *testing.T, stats *powerStats) string {
@@ -88,3 +92,62 @@ abc
 		t.Errorf("Expected %v; got %v", ej, aj)
 	}
 }
+
+func TestGetPowerSamples(t *testing.T) {
+	lo := ioutil.Discard
+	if testVerbose {
+		lo = os.Stderr
+	}
+	cfg := &config{
+		Source: "src",
+		logger: log.New(lo, "", log.LstdFlags),
+	}
+	now := time.Unix(1000, 0)
+	failed := []common.Sample{{now, cfg.Source, samplePowerFailed, 1.0}}
+	samples := func(onLine, voltage, load, battery float32) []common.Sample {
+		return []common.Sample{
+			{now, cfg.Source, samplePowerFailed, 0.0},
+			{now, cfg.Source, samplePowerOnLine, onLine},
+			{now, cfg.Source, samplePowerLineVoltage, voltage},
+			{now, cfg.Source, samplePowerLoadPercent, load},
+			{now, cfg.Source, samplePowerBatteryPercent, battery},
+		}
+	}
+
+	const (
+		good = "on_line 1\nload_percent 17.5\n"
+		bad  = "foo 2\nblah blah 5\n"
+	)
+	for _, tc := range []struct {
+		out     string
+		err     error
+		require bool
+		exp     []common.Sample
+	}{
+		{good, nil, false, samples(1, 0, 17.5, 0)},
+		{good, nil, true, samples(1, 0, 17.5, 0)},
+		{bad, nil, false, samples(0, 0, 0, 0)},
+		{bad, nil, true, failed},
+		{"", nil, true, failed},
+		{good, errors.New("exit status 1"), false, failed},
+	} {
+		cfg.PowerRequireStats = tc.require
+		act := common.JoinSamples(getPowerSamples(cfg, tc.out, tc.err, now))
+		if exp := common.JoinSamples(tc.exp); act != exp {
+			t.Errorf("Got %q for %q (err=%v, require=%v); expected %q",
+				act, tc.out, tc.err, tc.require, exp)
+		}
+	}
+
+	cfg.PowerNamePrefix = "ups1_"
+	exp := common.JoinSamples([]common.Sample{
+		{now, cfg.Source, "ups1_power_failed", 0},
+		{now, cfg.Source, "ups1_power_on_line", 1},
+		{now, cfg.Source, "ups1_power_line_voltage", 0},
+		{now, cfg.Source, "ups1_power_load_percent", 17.5},
+		{now, cfg.Source, "ups1_power_battery_percent", 0},
+	})
+	if act := common.JoinSamples(getPowerSamples(cfg, good, nil, now)); act != exp {
+		t.Errorf("Got %q with prefix; expected %q", act, exp)
+	}
+}
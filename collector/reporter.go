@@ -4,21 +4,32 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"math"
 	"net/http"
 	"net/url"
 	"os"
-	"reflect"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/derat/home/common"
 )
 
-const tempBackingFileExtension = ".new"
+const (
+	// Number of errors buffered by the reporter's error channel.
+	reportErrorChannelSize = 10
+
+	// Reply body (after trimming whitespace) sent by older servers that don't
+	// return JSON after accepting a report.
+	legacyReportReply = "got it"
+)
 
 type reporter struct {
 	cfg *config
@@ -28,16 +39,55 @@ type reporter struct {
 	// Samples that have not yet been sent to the server.
 	queuedSamples []common.Sample
 
-	// Samples that are listed in the backing file.
-	backingFileSamples []common.Sample
+	// Log persisting queuedSamples across restarts.
+	backing *backingLog
+
+	// Time at which the backing file was last written.
+	lastBackingFlush time.Time
+
+	// Fires when a deferred write of the backing file is due, or nil if no
+	// write is pending.
+	backingFlushTimer *time.Timer
+
+	// Set by backingFlushTimer to tell the reporter goroutine to write the
+	// backing file.
+	backingFlushDue bool
+
+	// Number of times that reporting samples to the server has failed.
+	numReportErrors int
+
+	// Difference between the server's clock and the local clock (positive if
+	// the server is ahead) as of the last successful report, and whether it's
+	// been computed yet.
+	clockSkew    time.Duration
+	hasClockSkew bool
+
+	// Round-trip times of successful reports since takeReportLatency was last
+	// called.
+	latency latencyStats
 
 	// Used to signal the reporter goroutine when samples is non-empty.
-	// Protects samples and stopping.
+	// Protects samples, backingFlushTimer, backingFlushDue, numReportErrors,
+	// clockSkew, hasClockSkew, latency, and stopping.
 	cond *sync.Cond
 
 	// Used by the reporter goroutine to delay retries after errors.
 	retryTimeout chan bool
 
+	// Receives errors encountered while reporting samples. Errors are dropped
+	// if the channel is full.
+	errCh chan error
+
+	// Samples (as returned by common.JoinSamples or common.EncodeSamples) in
+	// the batch that's currently being reported, the indexes into
+	// cfg.getReportDestinations() of the destinations that have already
+	// accepted it, and the indexes of samples within the batch that were
+	// rejected or reported as invalid by those destinations. Only accessed by the reporter goroutine.
+	pendingData      string
+	pendingDelivered map[int]bool
+	pendingRejected  map[int]bool
+	pendingInvalid   map[int]bool
+
 	// Set to true to tell the reporter goroutine should exit.
 	stopping bool
 
@@ -45,27 +95,71 @@ type reporter struct {
 	wg sync.WaitGroup
 }
 
-func newReporter(cfg *config) *reporter {
+func newReporter(cfg *config) (*reporter, error) {
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Leave the backing file alone in dry-run mode so its samples can be
+	// reported later.
+	backingFile := cfg.BackingFile
+	if cfg.isDryRun() {
+		cfg.logger.Printf("Running in dry-run mode; samples won't be reported")
+		backingFile = ""
+	}
+
 	r := &reporter{
-		cfg:                cfg,
-		client:             &http.Client{Timeout: time.Duration(cfg.ReportTimeoutMs) * time.Millisecond},
-		queuedSamples:      make([]common.Sample, 0),
-		backingFileSamples: make([]common.Sample, 0),
-		cond:               sync.NewCond(new(sync.Mutex)),
-		retryTimeout:       make(chan bool, 2),
+		cfg:           cfg,
+		client:        client,
+		queuedSamples: make([]common.Sample, 0),
+		backing:       newBackingLog(backingFile, cfg.CompressBackingFile),
+		cond:          sync.NewCond(new(sync.Mutex)),
+		retryTimeout:  make(chan bool, 2),
+		errCh:         make(chan error, reportErrorChannelSize),
 	}
 
-	if _, err := os.Stat(cfg.BackingFile); err == nil {
-		samples, err := r.readSamplesFromBackingFile()
+	if _, err := os.Stat(backingFile); backingFile != "" && err == nil {
+		samples, err := r.backing.replay()
 		if err != nil {
 			r.cfg.logger.Printf("Failed to read samples from %v: %v", cfg.BackingFile, err)
 		} else {
-			r.queuedSamples = samples
-			r.backingFileSamples = samples
+			r.queuedSamples = append(r.queuedSamples, samples...)
 		}
 	}
 
-	return r
+	return r, nil
+}
+
+// newHTTPClient returns a client for communicating with the server as
+// described by cfg.
+func newHTTPClient(cfg *config) (*http.Client, error) {
+	tc := &tls.Config{InsecureSkipVerify: cfg.ReportInsecureSkipVerify}
+	if cfg.ReportCAFile != "" {
+		b, err := ioutil.ReadFile(cfg.ReportCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %v", cfg.ReportCAFile)
+		}
+	}
+	if cfg.ReportClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ReportClientCertFile, cfg.ReportClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tc
+	tr.DisableKeepAlives = cfg.ReportDisableKeepAlives
+	return &http.Client{
+		Transport: tr,
+		Timeout:   time.Duration(cfg.ReportTimeoutMs) * time.Millisecond,
+	}, nil
 }
 
 func (r *reporter) start() {
@@ -76,6 +170,10 @@ func (r *reporter) start() {
 func (r *reporter) stop() {
 	r.cond.L.Lock()
 	r.stopping = true
+	if r.backingFlushTimer != nil {
+		r.backingFlushTimer.Stop()
+		r.backingFlushTimer = nil
+	}
 	r.cond.L.Unlock()
 	r.cond.Signal()
 	r.triggerRetryTimeout()
@@ -87,33 +185,112 @@ func (r *reporter) reportSample(s common.Sample) {
 }
 
 func (r *reporter) reportSamples(samples []common.Sample) {
+	valid := make([]common.Sample, 0, len(samples))
 	for _, s := range samples {
+		// The server would reject these, and they'd corrupt the report.
+		if err := s.CheckSeries(); err != nil {
+			r.cfg.logger.Printf("Dropping sample with bad series: %v", err)
+			select {
+			case r.errCh <- fmt.Errorf("dropping sample: %v", err):
+			default:
+			}
+			continue
+		}
 		r.cfg.logger.Printf("Queuing %v", s.String())
+		valid = append(valid, s)
 	}
 	r.cond.L.Lock()
-	r.queuedSamples = append(r.queuedSamples, samples...)
+	r.queuedSamples = append(r.queuedSamples, valid...)
 	r.cond.L.Unlock()
 	r.cond.Signal()
 }
 
+// queueLength returns the number of samples that haven't yet been reported.
+// Samples that are currently being sent to the server aren't included.
+func (r *reporter) queueLength() int {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	return len(r.queuedSamples)
+}
+
+// queuedSamplesSnapshot returns a copy of the samples that haven't yet been
+// reported. Like queueLength, samples that are currently being sent to the
+// server aren't included.
+func (r *reporter) queuedSamplesSnapshot() []common.Sample {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	return append(make([]common.Sample, 0, len(r.queuedSamples)), r.queuedSamples...)
+}
+
+// errorCount returns the total number of failed attempts to report samples.
+func (r *reporter) errorCount() int {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	return r.numReportErrors
+}
+
+// errors returns a channel that receives errors encountered while reporting
+// samples. Reading from the channel is optional: if it fills, later errors are
+// dropped rather than blocking the reporter.
+func (r *reporter) errors() <-chan error {
+	return r.errCh
+}
+
+// serverClockSkew returns the difference between the server's clock and the
+// local clock as of the last successful report. false is returned if no
+// reports have succeeded.
+func (r *reporter) serverClockSkew() (time.Duration, bool) {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	return r.clockSkew, r.hasClockSkew
+}
+
+// takeReportLatency returns the round-trip times of reports that have
+// succeeded since the previous call.
+func (r *reporter) takeReportLatency() latencyStats {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	ls := r.latency
+	r.latency = latencyStats{}
+	return ls
+}
+
+// flush asks the reporter goroutine to immediately try to report queued
+// samples instead of waiting to retry after an earlier failure.
+func (r *reporter) flush() {
+	r.cfg.logger.Printf("Flushing %v queued sample(s)", r.queueLength())
+	r.triggerRetryTimeout()
+}
+
 func (r *reporter) triggerRetryTimeout() {
-	r.retryTimeout <- true
+	// If the channel is full, the reporter goroutine will already wake up.
+	select {
+	case r.retryTimeout <- true:
+	default:
+	}
 }
 
 func (r *reporter) processSamples() {
 	for {
 		r.cond.L.Lock()
-		for len(r.queuedSamples) == 0 && !r.stopping {
+		for len(r.queuedSamples) == 0 && !r.stopping && !r.backingFlushDue {
 			r.cond.Wait()
 		}
 		if r.stopping {
 			r.cfg.logger.Printf("Reporter loop exiting")
-			if err := r.writeSamplesToBackingFile(r.queuedSamples); err != nil {
+			if err := r.backing.update(r.queuedSamples); err != nil {
 				r.cfg.logger.Printf("Failed to write samples: %v", err)
 			}
+			r.cond.L.Unlock()
 			r.wg.Done()
 			return
 		}
+		if len(r.queuedSamples) == 0 {
+			// We were only woken up to write the backing file.
+			r.cond.L.Unlock()
+			r.flushBackingFile(false)
+			continue
+		}
 		samples := r.queuedSamples
 		r.queuedSamples = make([]common.Sample, 0)
 		r.cond.L.Unlock()
@@ -121,109 +298,326 @@ func (r *reporter) processSamples() {
 		r.cfg.logger.Printf("Took %v sample(s) from queue", len(samples))
 
 		gotError := false
+		var rejected []common.Sample
 		for len(samples) > 0 {
+			// If we're being stopped, leave the remaining samples for the
+			// backing file instead of sending more batches.
+			if r.isStopping() {
+				break
+			}
 			n := int(math.Min(float64(len(samples)), float64(r.cfg.ReportBatchSize)))
 			s := samples[:n]
-			if err := r.sendSamplesToServer(s); err != nil {
+			rej, inv, err := r.sendSamplesToServer(s)
+			if err != nil {
 				r.cfg.logger.Printf("Got error when reporting samples: %v", err)
+				select {
+				case r.errCh <- fmt.Errorf("reporting %v sample(s): %v", len(s), err):
+				default:
+				}
 				gotError = true
 				break
 			}
-			r.cfg.logger.Printf("Successfully reported %v sample(s)", len(s))
+			for _, bad := range inv {
+				// Retrying invalid samples would just fail again.
+				r.cfg.logger.Printf("Dropping invalid sample %v", bad.String())
+			}
+			if len(inv) > 0 {
+				select {
+				case r.errCh <- fmt.Errorf("server reported %v of %v sample(s) as invalid", len(inv), len(s)):
+				default:
+				}
+			}
+			if len(rej) > 0 {
+				// Keep sending later batches, but retry the rejected samples
+				// after the usual delay.
+				r.cfg.logger.Printf("Server rejected %v of %v sample(s)", len(rej), len(s))
+				select {
+				case r.errCh <- fmt.Errorf("server rejected %v of %v sample(s)", len(rej), len(s)):
+				default:
+				}
+				rejected = append(rejected, rej...)
+				gotError = true
+			} else if len(inv) == 0 {
+				r.cfg.logger.Printf("Successfully reported %v sample(s)", len(s))
+			}
 			samples = samples[n:]
 		}
+		samples = append(rejected, samples...)
 
 		r.cond.L.Lock()
 		if gotError {
+			r.numReportErrors++
+		}
+		if len(samples) > 0 {
 			// Return any samples that weren't forwarded successfully back to the
-			// beginning of the queue.
+			// beginning of the queue. If we're stopping, they'll be written to
+			// the backing file at the top of the loop.
 			r.cfg.logger.Printf("Returning %v unreported sample(s) to queue", len(samples))
 			r.queuedSamples = append(samples, r.queuedSamples...)
 		}
-		var newBackingFileSamples []common.Sample
-		if !reflect.DeepEqual(r.backingFileSamples, r.queuedSamples) {
-			newBackingFileSamples = r.queuedSamples
-		}
 		r.cond.L.Unlock()
 
-		if newBackingFileSamples != nil {
-			r.cfg.logger.Printf("Writing %v sample(s) to backing file", len(newBackingFileSamples))
-			if err := r.writeSamplesToBackingFile(newBackingFileSamples); err != nil {
-				r.cfg.logger.Printf("Failed to write samples: %v", err)
-			}
-		}
+		// Write unreported samples to disk immediately after an error so
+		// they won't be lost if we crash while waiting to retry.
+		r.flushBackingFile(gotError)
 
-		if gotError {
+		if gotError && !r.isStopping() {
 			r.cfg.logger.Printf("Sleeping for %v ms after failure", r.cfg.ReportRetryMs)
-			go func(ch chan bool) {
-				time.Sleep(time.Duration(r.cfg.ReportRetryMs) * time.Millisecond)
-				ch <- true
-			}(r.retryTimeout)
-
 			select {
+			case <-time.After(time.Duration(r.cfg.ReportRetryMs) * time.Millisecond):
 			case <-r.retryTimeout:
 			}
 		}
 	}
-
 }
 
-func (r *reporter) sendSamplesToServer(samples []common.Sample) error {
-	data := common.JoinSamples(samples)
-	sig := common.HashStringWithSHA256(fmt.Sprintf("%s|%s", data, r.cfg.ReportSecret))
-	resp, err := r.client.PostForm(r.cfg.ReportURL, url.Values{"d": {data}, "s": {sig}})
-	if err != nil {
-		return err
-	} else if resp.StatusCode != 200 {
-		return fmt.Errorf("Got %v", resp.Status)
+// flushBackingFile updates the backing file to list the queued samples if
+// they differ from its current contents. Unless force is true, the write is
+// deferred if the file was written less than BackingFlushIntervalMs ago.
+// This must only be called from the reporter goroutine.
+func (r *reporter) flushBackingFile(force bool) {
+	r.cond.L.Lock()
+	r.backingFlushDue = false
+	if samplesEqual(r.backing.samples, r.queuedSamples) {
+		r.cond.L.Unlock()
+		return
+	}
+	if !force && r.cfg.BackingFlushIntervalMs > 0 {
+		interval := time.Duration(r.cfg.BackingFlushIntervalMs) * time.Millisecond
+		if wait := r.lastBackingFlush.Add(interval).Sub(time.Now()); wait > 0 {
+			if r.backingFlushTimer == nil {
+				r.backingFlushTimer = time.AfterFunc(wait, func() {
+					r.cond.L.Lock()
+					r.backingFlushTimer = nil
+					r.backingFlushDue = true
+					r.cond.L.Unlock()
+					r.cond.Signal()
+				})
+			}
+			r.cond.L.Unlock()
+			return
+		}
 	}
-	return nil
+	samples := r.queuedSamples
+	if r.backingFlushTimer != nil {
+		r.backingFlushTimer.Stop()
+		r.backingFlushTimer = nil
+	}
+	r.cond.L.Unlock()
+
+	r.cfg.logger.Printf("Writing %v sample(s) to backing file", len(samples))
+	if err := r.backing.update(samples); err != nil {
+		r.cfg.logger.Printf("Failed to write samples: %v", err)
+	}
+	r.lastBackingFlush = time.Now()
 }
 
-func (r *reporter) readSamplesFromBackingFile() ([]common.Sample, error) {
-	f, err := os.Open(r.cfg.BackingFile)
-	if err != nil {
-		return nil, err
+// isStopping returns true if stop has been called.
+func (r *reporter) isStopping() bool {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	return r.stopping
+}
+
+// sendSamplesToServer sends samples to each destination that hasn't already
+// accepted them. Every destination is tried even after the quorum has been
+// reached. Once the quorum has been reached, the samples that were rejected by
+// any of the accepting destinations are returned. Samples that were reported
+// as invalid by any of the destinations are returned separately in invalid
+// rather than in rejected. In dry-run mode, samples are logged instead.
+func (r *reporter) sendSamplesToServer(samples []common.Sample) (
+	rejected, invalid []common.Sample, err error) {
+	if r.cfg.isDryRun() {
+		for _, s := range samples {
+			r.cfg.logger.Printf("Would report %v", s.String())
+		}
+		return nil, nil, nil
 	}
-	defer f.Close()
 
-	samples := make([]common.Sample, 0)
-	d := json.NewDecoder(f)
-	for {
-		var s common.Sample
-		if err = d.Decode(&s); err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
+	var data string
+	if r.cfg.ReportBinary {
+		data = string(common.EncodeSamples(samples))
+	} else {
+		data = common.JoinSamples(samples)
+	}
+	if data != r.pendingData {
+		r.pendingData = data
+		r.pendingDelivered = make(map[int]bool)
+		r.pendingRejected = make(map[int]bool)
+		r.pendingInvalid = make(map[int]bool)
+	}
+
+	dests := r.cfg.getReportDestinations()
+	quorum := r.cfg.getReportQuorum()
+	var errs []string
+	for i, d := range dests {
+		if r.pendingDelivered[i] {
+			continue
+		}
+		rej, inv, err := r.sendSamplesToDestination(d, data, len(samples), i == 0)
+		if err != nil {
+			r.cfg.logger.Printf("Failed reporting to %v: %v", d.URL, err)
+			errs = append(errs, fmt.Sprintf("%v: %v", d.URL, err))
+			continue
+		}
+		r.pendingDelivered[i] = true
+		for _, j := range rej {
+			r.pendingRejected[j] = true
+		}
+		for _, j := range inv {
+			r.pendingInvalid[j] = true
 		}
-		samples = append(samples, s)
 	}
 
-	return samples, nil
+	if len(r.pendingDelivered) < quorum {
+		return nil, nil, fmt.Errorf("%v of %v required destination(s) succeeded (%v)",
+			len(r.pendingDelivered), quorum, strings.Join(errs, "; "))
+	}
+	for i, s := range samples {
+		if r.pendingInvalid[i] {
+			invalid = append(invalid, s)
+		} else if r.pendingRejected[i] {
+			rejected = append(rejected, s)
+		}
+	}
+	r.pendingData = ""
+	r.pendingDelivered = nil
+	r.pendingRejected = nil
+	r.pendingInvalid = nil
+	return rejected, invalid, nil
 }
 
-func (r *reporter) writeSamplesToBackingFile(samples []common.Sample) error {
-	if r.cfg.BackingFile == "" {
-		return nil
+// sendSamplesToDestination posts data (containing numSamples samples, encoded
+// as requested by cfg.ReportBinary) to d and returns the indexes of samples
+// that were rejected by the server and the subset of them that the server
+// reported as invalid. If updateSkew is true, the server's clock skew is recorded.
+func (r *reporter) sendSamplesToDestination(d reportDestination, data string, numSamples int,
+	updateSkew bool) (rejected, invalid []int, err error) {
+	nonce := common.NewReportNonce(time.Now())
+	sig := common.SignReport(data, nonce, d.Secret)
+	var req *http.Request
+	if r.cfg.ReportBinary {
+		u, err := url.Parse(d.URL)
+		if err != nil {
+			return nil, nil, err
+		}
+		q := u.Query()
+		q.Set("n", nonce)
+		q.Set("s", sig)
+		u.RawQuery = q.Encode()
+		if req, err = http.NewRequest("POST", u.String(), strings.NewReader(data)); err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", common.BinaryReportContentType)
+	} else {
+		body := url.Values{"d": {data}, "n": {nonce}, "s": {sig}}.Encode()
+		if req, err = http.NewRequest("POST", d.URL, strings.NewReader(body)); err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	reqId, err := newRequestId()
+	if err != nil {
+		return nil, nil, err
 	}
+	req.Header.Set("User-Agent", r.cfg.getUserAgent())
+	req.Header.Set(common.ReportRequestIdHeader, reqId)
 
-	p := r.cfg.BackingFile + tempBackingFileExtension
-	f, err := os.Create(p)
+	start := time.Now()
+	resp, err := r.client.Do(req)
 	if err != nil {
-		return err
+		return nil, nil, fmt.Errorf("request %v: %v", reqId, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("Got %v for request %v", resp.Status, reqId)
 	}
-	defer f.Close()
 
-	e := json.NewEncoder(f)
-	for _, s := range samples {
-		if err = e.Encode(s); err != nil {
-			return err
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read reply: %v", err)
+	}
+	var reply common.ReportReply
+	if err := json.Unmarshal(body, &reply); err != nil {
+		// Older servers reply with "got it" after storing all of the samples.
+		str := strings.TrimSpace(string(body))
+		if str != legacyReportReply {
+			return nil, nil, fmt.Errorf("Got unexpected reply %q for request %v", str, reqId)
+		}
+		r.cfg.logger.Printf("Got legacy reply from %v; assuming samples were accepted", d.URL)
+		reply = common.ReportReply{Accepted: numSamples}
+	}
+	elapsed := time.Since(start)
+	if r.cfg.ReportSlowMs > 0 && elapsed >= time.Duration(r.cfg.ReportSlowMs)*time.Millisecond {
+		r.cfg.logger.Printf("Slow report to %v took %v", d.URL, elapsed)
+	}
+	r.cond.L.Lock()
+	r.latency.add(elapsed)
+	r.cond.L.Unlock()
+
+	if reply.Accepted+len(reply.Rejected) != numSamples {
+		return nil, nil, fmt.Errorf("Server accepted %v and rejected %v of %v sample(s)",
+			reply.Accepted, len(reply.Rejected), numSamples)
+	}
+	rej := make(map[int]bool, len(reply.Rejected))
+	for _, i := range reply.Rejected {
+		if i < 0 || i >= numSamples {
+			return nil, nil, fmt.Errorf("Server rejected invalid sample %v", i)
+		}
+		rej[i] = true
+	}
+	for _, i := range reply.Invalid {
+		if !rej[i] {
+			return nil, nil, fmt.Errorf("Server reported unrejected sample %v as invalid", i)
 		}
 	}
-	if err = os.Rename(p, r.cfg.BackingFile); err != nil {
-		return err
+
+	if !updateSkew {
+		return reply.Rejected, reply.Invalid, nil
+	}
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		// The Date header only has second resolution.
+		skew := date.Sub(time.Now().Truncate(time.Second))
+		r.cfg.logger.Printf("Server clock is %v ahead of local clock", skew)
+		r.cond.L.Lock()
+		r.clockSkew = skew
+		r.hasClockSkew = true
+		r.cond.L.Unlock()
+	}
+	return reply.Rejected, reply.Invalid, nil
+}
+
+// latencyStats accumulates the durations of requests.
+type latencyStats struct {
+	min, max, total time.Duration
+	count           int
+}
+
+// add incorporates a request that took d.
+func (ls *latencyStats) add(d time.Duration) {
+	if ls.count == 0 || d < ls.min {
+		ls.min = d
+	}
+	if ls.count == 0 || d > ls.max {
+		ls.max = d
+	}
+	ls.total += d
+	ls.count++
+}
+
+// avg returns the average request duration.
+func (ls *latencyStats) avg() time.Duration {
+	if ls.count == 0 {
+		return 0
 	}
+	return ls.total / time.Duration(ls.count)
+}
 
-	r.backingFileSamples = samples
-	return nil
+// newRequestId returns a random ID identifying a report request.
+func newRequestId() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
@@ -4,13 +4,18 @@
 package main
 
 import (
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -29,6 +34,40 @@ type testServer struct {
 	ch            chan string
 	responseCode  int
 	responseDelay time.Duration
+
+	// Number of samples to omit from the accepted count in successful replies.
+	missingAccepted int
+
+	// Indexes of samples to reject in successful replies, and the subset of
+	// them to report as invalid.
+	rejected []int
+	invalid  []int
+
+	// If non-empty, successful replies contain this string instead of JSON.
+	legacyReply string
+
+	// If non-empty, supplies status codes to use for upcoming requests
+	// instead of responseCode.
+	responseCodes chan int
+
+	// Secret used to verify reports.
+	secret string
+
+	// Receives the headers of report requests.
+	headers chan http.Header
+}
+
+// newTestServer creates and starts a new testServer.
+func newTestServer(t *testing.T) *testServer {
+	ts := &testServer{
+		ch:            make(chan string, testReportChannelSize),
+		responseCode:  http.StatusOK,
+		responseCodes: make(chan int, testReportChannelSize),
+		secret:        testReportSecret,
+		headers:       make(chan http.Header, testReportChannelSize),
+	}
+	ts.start(t)
+	return ts
 }
 
 func (ts *testServer) getReportURL() string {
@@ -67,17 +106,54 @@ func (ts *testServer) waitForReport(t *testing.T) string {
 func (ts *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/report":
-		data := r.PostFormValue("d")
-		if r.PostFormValue("s") != common.HashStringWithSHA256(fmt.Sprintf("%s|%s", data, testReportSecret)) {
-			http.Error(w, "Bad signature", http.StatusBadRequest)
-			return
+		var data string
+		if r.Header.Get("Content-Type") == common.BinaryReportContentType {
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "Failed reading body", http.StatusBadRequest)
+				return
+			}
+			q := r.URL.Query()
+			if q.Get("s") != common.SignReport(string(b), q.Get("n"), ts.secret) {
+				http.Error(w, "Bad signature", http.StatusBadRequest)
+				return
+			}
+			samples, err := common.DecodeSamples(b)
+			if err != nil {
+				http.Error(w, "Bad samples", http.StatusBadRequest)
+				return
+			}
+			data = common.JoinSamples(samples)
+		} else {
+			data = r.PostFormValue("d")
+			if r.PostFormValue("s") != common.SignReport(data, r.PostFormValue("n"), ts.secret) {
+				http.Error(w, "Bad signature", http.StatusBadRequest)
+				return
+			}
+		}
+
+		code := ts.responseCode
+		select {
+		case code = <-ts.responseCodes:
+		default:
+		}
+		select {
+		case ts.headers <- r.Header:
+		default:
 		}
 
 		ts.ch <- data
 		if ts.responseDelay > 0 {
 			time.Sleep(ts.responseDelay)
 		}
-		w.WriteHeader(ts.responseCode)
+		w.WriteHeader(code)
+		if code == http.StatusOK && ts.legacyReply != "" {
+			io.WriteString(w, ts.legacyReply)
+		} else if code == http.StatusOK {
+			n := len(strings.Split(data, "\n")) - ts.missingAccepted - len(ts.rejected)
+			json.NewEncoder(w).Encode(common.ReportReply{
+				Accepted: n, Rejected: ts.rejected, Invalid: ts.invalid})
+		}
 	default:
 		http.NotFound(w, r)
 	}
@@ -112,14 +188,12 @@ func getFileSize(p string) int64 {
 }
 
 func initTest(t *testing.T, cfg *config) (*testServer, *reporter) {
-	ts := &testServer{
-		ch:           make(chan string, testReportChannelSize),
-		responseCode: http.StatusOK,
-	}
-	ts.start(t)
-
+	ts := newTestServer(t)
 	cfg.ReportURL = ts.getReportURL()
-	r := newReporter(cfg)
+	r, err := newReporter(cfg)
+	if err != nil {
+		t.Fatalf("Unable to create reporter: %v", err)
+	}
 	r.start()
 
 	return ts, r
@@ -152,6 +226,62 @@ func TestReport(t *testing.T) {
 	}
 }
 
+func TestReportBadSeries(t *testing.T) {
+	ts, r := initTest(t, createConfig())
+	defer cleanUpTest(ts, r)
+
+	good := common.Sample{time.Unix(456, 0), "SOURCE", "NAME", 20.0}
+	r.reportSamples([]common.Sample{
+		common.Sample{time.Unix(123, 0), "SOURCE", "A|B", 10.0},
+		good,
+		common.Sample{time.Unix(789, 0), "SOURCE\n", "NAME", 30.0},
+	})
+	if str := ts.waitForReport(t); str != good.String() {
+		t.Errorf("Expected %q to be reported; saw %q", good.String(), str)
+	}
+}
+
+func TestReportHeaders(t *testing.T) {
+	cfg := createConfig()
+	cfg.Source = "SOURCE"
+	ts, r := initTest(t, cfg)
+	defer cleanUpTest(ts, r)
+
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		r.reportSample(common.Sample{time.Unix(int64(i), 0), "SOURCE", "NAME", 10.0})
+		ts.waitForReport(t)
+		h := <-ts.headers
+		if ua := h.Get("User-Agent"); ua != cfg.getUserAgent() || !strings.Contains(ua, "SOURCE") {
+			t.Errorf("Report %v has User-Agent %q; expected %q", i, ua, cfg.getUserAgent())
+		}
+		id := h.Get(common.ReportRequestIdHeader)
+		if id == "" || ids[id] {
+			t.Errorf("Report %v has missing or reused request ID %q", i, id)
+		}
+		ids[id] = true
+	}
+}
+
+func TestReportBinary(t *testing.T) {
+	cfg := createConfig()
+	cfg.ReportBinary = true
+	ts, r := initTest(t, cfg)
+	defer cleanUpTest(ts, r)
+
+	samples := []common.Sample{
+		common.Sample{time.Unix(123, 0), "INSIDE", "HUMIDITY", 35.5},
+		common.Sample{time.Unix(456, 0), "OUTSIDE", "TEMP", 65.0},
+	}
+	r.reportSamples(samples)
+	if str := ts.waitForReport(t); str != common.JoinSamples(samples) {
+		t.Errorf("Expected %q to be reported; saw %q", common.JoinSamples(samples), str)
+	}
+	if ct := (<-ts.headers).Get("Content-Type"); ct != common.BinaryReportContentType {
+		t.Errorf("Report has Content-Type %q; expected %q", ct, common.BinaryReportContentType)
+	}
+}
+
 func TestBatching(t *testing.T) {
 	cfg := createConfig()
 	cfg.ReportBatchSize = 3
@@ -196,6 +326,178 @@ func TestRetry(t *testing.T) {
 	}
 }
 
+func TestFlush(t *testing.T) {
+	cfg := createConfig()
+	cfg.ReportRetryMs = 60 * 1000
+	ts, r := initTest(t, cfg)
+	defer cleanUpTest(ts, r)
+
+	ts.responseCode = http.StatusInternalServerError
+	s := common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0}
+	r.reportSample(s)
+	ts.waitForReport(t)
+
+	// Flushing via the listener should retry immediately instead of waiting
+	// for the retry delay.
+	ts.responseCode = http.StatusOK
+	l := &listener{cfg: cfg, rep: r}
+	rec := httptest.NewRecorder()
+	l.handleFlush(rec, httptest.NewRequest("POST", "/flush", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Flush got status %v; expected %v", rec.Code, http.StatusOK)
+	}
+	if str := ts.waitForReport(t); str != s.String() {
+		t.Errorf("Expected %q after flush; saw %q", s.String(), str)
+	}
+
+	rec = httptest.NewRecorder()
+	l.handleFlush(rec, httptest.NewRequest("GET", "/flush", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET flush got status %v; expected %v", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ts, r := initTest(t, createConfig())
+	defer cleanUpTest(ts, r)
+
+	ts.responseCode = http.StatusInternalServerError
+	r.reportSample(common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0})
+	ts.waitForReport(t)
+
+	select {
+	case err := <-r.errors():
+		if !strings.Contains(err.Error(), "500") {
+			t.Errorf("Error %q doesn't describe status", err)
+		}
+	case <-time.After(time.Duration(testReportTimeoutMs) * time.Millisecond):
+		t.Errorf("Timed out waiting for error")
+	}
+
+	// Unread errors shouldn't block the reporter.
+	for i := 0; i < reportErrorChannelSize+1; i++ {
+		r.triggerRetryTimeout()
+		ts.waitForReport(t)
+	}
+	ts.responseCode = http.StatusOK
+	r.triggerRetryTimeout()
+	ts.waitForReport(t)
+}
+
+func TestPartialAccept(t *testing.T) {
+	ts, r := initTest(t, createConfig())
+	defer cleanUpTest(ts, r)
+
+	// If the server doesn't accept all of the samples, they should be sent
+	// again.
+	ts.missingAccepted = 1
+	samples := []common.Sample{
+		common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0},
+		common.Sample{time.Unix(1, 0), "SOURCE", "NAME", 10.0},
+	}
+	r.reportSamples(samples)
+	ts.waitForReport(t)
+
+	ts.missingAccepted = 0
+	r.triggerRetryTimeout()
+	str := ts.waitForReport(t)
+	if exp := common.JoinSamples(samples); str != exp {
+		t.Errorf("Expected %q on retry; saw %q", exp, str)
+	}
+}
+
+func TestRejectedSamples(t *testing.T) {
+	ts, r := initTest(t, createConfig())
+	defer cleanUpTest(ts, r)
+
+	// Only the samples that the server rejected should be sent again.
+	ts.rejected = []int{0, 2}
+	samples := []common.Sample{
+		common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0},
+		common.Sample{time.Unix(1, 0), "SOURCE", "NAME", 10.0},
+		common.Sample{time.Unix(2, 0), "SOURCE", "NAME", 10.0},
+	}
+	r.reportSamples(samples)
+	ts.waitForReport(t)
+
+	ts.rejected = nil
+	r.triggerRetryTimeout()
+	str := ts.waitForReport(t)
+	if exp := common.JoinSamples([]common.Sample{samples[0], samples[2]}); str != exp {
+		t.Errorf("Expected %q on retry; saw %q", exp, str)
+	}
+	if n := r.errorCount(); n != 1 {
+		t.Errorf("Expected 1 error; got %v", n)
+	}
+}
+
+func TestLegacyReply(t *testing.T) {
+	ts, r := initTest(t, createConfig())
+	defer cleanUpTest(ts, r)
+
+	// The "got it" reply from older servers should be treated as accepting
+	// all of the samples.
+	ts.legacyReply = "got it\n"
+	s0 := common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0}
+	r.reportSample(s0)
+	if str := ts.waitForReport(t); str != s0.String() {
+		t.Errorf("Expected %q; saw %q", s0.String(), str)
+	}
+	s1 := common.Sample{time.Unix(1, 0), "SOURCE", "NAME", 10.0}
+	r.reportSample(s1)
+	if str := ts.waitForReport(t); str != s1.String() {
+		t.Errorf("Expected %q; saw %q", s1.String(), str)
+	}
+	if n := r.errorCount(); n != 0 {
+		t.Errorf("Got %v error(s); expected 0", n)
+	}
+}
+
+func TestUnexpectedReply(t *testing.T) {
+	ts, r := initTest(t, createConfig())
+	defer cleanUpTest(ts, r)
+
+	// Other non-JSON replies (e.g. an HTML page from a proxy) shouldn't be
+	// treated as success, so the samples should be sent again.
+	ts.legacyReply = "<html><body>Sign in</body></html>"
+	s := common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0}
+	r.reportSample(s)
+	ts.waitForReport(t)
+
+	ts.legacyReply = ""
+	r.triggerRetryTimeout()
+	if str := ts.waitForReport(t); str != s.String() {
+		t.Errorf("Expected %q on retry; saw %q", s.String(), str)
+	}
+	if n := r.errorCount(); n != 1 {
+		t.Errorf("Expected 1 error; got %v", n)
+	}
+}
+
+func TestInvalidSamples(t *testing.T) {
+	ts, r := initTest(t, createConfig())
+	defer cleanUpTest(ts, r)
+
+	// Samples that the server reported as invalid should be dropped instead
+	// of being sent again.
+	ts.rejected = []int{0, 2}
+	ts.invalid = []int{2}
+	samples := []common.Sample{
+		common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0},
+		common.Sample{time.Unix(1, 0), "SOURCE", "NAME", 10.0},
+		common.Sample{time.Unix(2, 0), "SOURCE", "NAME", 10.0},
+	}
+	r.reportSamples(samples)
+	ts.waitForReport(t)
+
+	ts.rejected = nil
+	ts.invalid = nil
+	r.triggerRetryTimeout()
+	if str := ts.waitForReport(t); str != samples[0].String() {
+		t.Errorf("Expected %q on retry; saw %q", samples[0].String(), str)
+	}
+}
+
 func TestTimeout(t *testing.T) {
 	cfg := createConfig()
 	cfg.ReportTimeoutMs = 100
@@ -221,6 +523,7 @@ func TestBackingFile(t *testing.T) {
 	defer os.Remove(cfg.BackingFile)
 	ts, r := initTest(t, cfg)
 	defer ts.stop()
+	var err error
 
 	ts.responseCode = http.StatusInternalServerError
 	s0 := common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0}
@@ -235,7 +538,9 @@ func TestBackingFile(t *testing.T) {
 
 	// A new reporter should load the backing file and try to report the sample
 	// again immediately.
-	r = newReporter(cfg)
+	if r, err = newReporter(cfg); err != nil {
+		t.Fatalf("Unable to create reporter: %v", err)
+	}
 	r.start()
 	str := ts.waitForReport(t)
 	if str != s0.String() {
@@ -261,7 +566,9 @@ func TestBackingFile(t *testing.T) {
 
 	// A new reporter should report all three samples.
 	ts.responseCode = http.StatusOK
-	r = newReporter(cfg)
+	if r, err = newReporter(cfg); err != nil {
+		t.Fatalf("Unable to create reporter: %v", err)
+	}
 	r.start()
 	str = ts.waitForReport(t)
 	exp = common.JoinSamples([]common.Sample{s0, s1, s2})
@@ -273,3 +580,329 @@ func TestBackingFile(t *testing.T) {
 		t.Errorf("Backing file not cleared after successful write")
 	}
 }
+
+func TestBackingFlushInterval(t *testing.T) {
+	cfg := createConfig()
+	cfg.BackingFile = createTempFile()
+	cfg.BackingFlushIntervalMs = 500
+	defer os.Remove(cfg.BackingFile)
+	ts, r := initTest(t, cfg)
+	defer cleanUpTest(ts, r)
+
+	// The backing file should be written immediately after a failure.
+	ts.responseCode = http.StatusInternalServerError
+	r.reportSample(common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0})
+	ts.waitForReport(t)
+	deadline := time.Now().Add(time.Duration(testReportTimeoutMs) * time.Millisecond)
+	for getFileSize(cfg.BackingFile) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if getFileSize(cfg.BackingFile) == 0 {
+		t.Fatalf("Backing file not written after failure")
+	}
+
+	// After the sample is reported successfully, clearing the file should be
+	// deferred until the flush interval has elapsed.
+	ts.responseCode = http.StatusOK
+	start := time.Now()
+	r.triggerRetryTimeout()
+	ts.waitForReport(t)
+	for getFileSize(cfg.BackingFile) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if getFileSize(cfg.BackingFile) != 0 {
+		t.Errorf("Backing file not cleared after successful report")
+	} else if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Backing file cleared after %v; expected flush to be delayed", elapsed)
+	}
+}
+
+func TestBackingFlushIntervalStop(t *testing.T) {
+	cfg := createConfig()
+	cfg.BackingFile = createTempFile()
+	cfg.BackingFlushIntervalMs = 3600 * 1000
+	defer os.Remove(cfg.BackingFile)
+	ts, r := initTest(t, cfg)
+	defer ts.stop()
+
+	ts.responseCode = http.StatusInternalServerError
+	r.reportSample(common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0})
+	ts.waitForReport(t)
+	ts.responseCode = http.StatusOK
+	r.triggerRetryTimeout()
+	ts.waitForReport(t)
+
+	// Stopping the reporter should flush the pending change immediately.
+	r.stop()
+	if getFileSize(cfg.BackingFile) != 0 {
+		t.Errorf("Backing file not cleared on stop")
+	}
+}
+
+func TestReloadSecrets(t *testing.T) {
+	cfg := createConfig()
+	ts, r := initTest(t, cfg)
+	defer cleanUpTest(ts, r)
+
+	// Make the server expect a new secret so the collector's report is
+	// rejected.
+	const newSecret = "new secret"
+	ts.secret = newSecret
+	s := common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0}
+	r.reportSample(s)
+	deadline := time.Now().Add(time.Duration(testReportTimeoutMs) * time.Millisecond)
+	for r.errorCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.errorCount() == 0 {
+		t.Fatalf("Report with old secret wasn't rejected")
+	}
+
+	// After the secret is reloaded, the queued sample should be signed with
+	// it when it's retried.
+	p := createTempFile()
+	defer os.Remove(p)
+	b, _ := json.Marshal(map[string]string{"reportUrl": cfg.ReportURL, "reportSecret": newSecret})
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatalf("Failed writing config: %v", err)
+	}
+	if err := cfg.reloadSecrets(p); err != nil {
+		t.Fatalf("Failed reloading secrets: %v", err)
+	}
+	r.triggerRetryTimeout()
+	if str := ts.waitForReport(t); str != s.String() {
+		t.Errorf("Expected %q after reloading secret; saw %q", s.String(), str)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	cfg := createConfig()
+	cfg.BackingFile = createTempFile()
+	cfg.DryRun = true
+	defer os.Remove(cfg.BackingFile)
+
+	// The backing file shouldn't be read or rewritten in dry-run mode.
+	s0 := common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0}
+	if err := newBackingLog(cfg.BackingFile, cfg.CompressBackingFile).update([]common.Sample{s0}); err != nil {
+		t.Fatalf("Failed to write backing file: %v", err)
+	}
+	size := getFileSize(cfg.BackingFile)
+
+	ts, r := initTest(t, cfg)
+	defer ts.stop()
+	r.reportSample(common.Sample{time.Unix(1, 0), "SOURCE", "NAME", 10.0})
+	deadline := time.Now().Add(time.Duration(testReportTimeoutMs) * time.Millisecond)
+	for r.queueLength() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := r.queueLength(); n != 0 {
+		t.Errorf("Queue has %v sample(s); expected 0", n)
+	}
+	r.stop()
+
+	select {
+	case str := <-ts.ch:
+		t.Errorf("Got report %q in dry-run mode", str)
+	default:
+	}
+	if act := getFileSize(cfg.BackingFile); act != size {
+		t.Errorf("Backing file has %v byte(s); expected %v", act, size)
+	}
+}
+
+func TestStopAfterPartialFailure(t *testing.T) {
+	cfg := createConfig()
+	cfg.BackingFile = createTempFile()
+	cfg.ReportBatchSize = 1
+	defer os.Remove(cfg.BackingFile)
+	ts, r := initTest(t, cfg)
+	defer ts.stop()
+
+	// Make the first batch succeed and the second fail.
+	ts.responseCodes <- http.StatusOK
+	ts.responseCodes <- http.StatusInternalServerError
+	ts.responseCode = http.StatusInternalServerError
+	s0 := common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0}
+	s1 := common.Sample{time.Unix(1, 0), "SOURCE", "NAME", 10.0}
+	s2 := common.Sample{time.Unix(2, 0), "SOURCE", "NAME", 10.0}
+	r.reportSamples([]common.Sample{s0, s1, s2})
+	ts.waitForReport(t)
+	ts.waitForReport(t)
+
+	// Stop the reporter while it's waiting to retry. The unreported samples
+	// should be written to the backing file.
+	done := make(chan bool)
+	go func() {
+		r.stop()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(testReportTimeoutMs) * time.Millisecond):
+		t.Fatalf("Timed out waiting for reporter to stop")
+	}
+	samples, err := newBackingLog(cfg.BackingFile, cfg.CompressBackingFile).replay()
+	if err != nil {
+		t.Fatalf("Failed to read backing file: %v", err)
+	}
+	if act, exp := common.JoinSamples(samples), common.JoinSamples([]common.Sample{s1, s2}); act != exp {
+		t.Errorf("Backing file contains %q; expected %q", act, exp)
+	}
+
+	// Queuing more samples after stopping shouldn't block.
+	go func() {
+		r.reportSample(s0)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(testReportTimeoutMs) * time.Millisecond):
+		t.Errorf("Timed out queuing sample after stopping")
+	}
+}
+
+func TestMultipleDestinations(t *testing.T) {
+	ts2 := newTestServer(t)
+	defer ts2.stop()
+	ts2.secret = "another secret"
+	ts2.responseCode = http.StatusInternalServerError
+
+	cfg := createConfig()
+	cfg.ReportDestinations = []reportDestination{{ts2.getReportURL(), ts2.secret}}
+	ts, r := initTest(t, cfg)
+	defer cleanUpTest(ts, r)
+
+	s0 := common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0}
+	r.reportSample(s0)
+	if str := ts.waitForReport(t); str != s0.String() {
+		t.Errorf("Expected %q at first destination; saw %q", s0.String(), str)
+	}
+	ts2.waitForReport(t)
+
+	// Only the failed destination should be retried.
+	ts2.responseCode = http.StatusOK
+	r.triggerRetryTimeout()
+	if str := ts2.waitForReport(t); str != s0.String() {
+		t.Errorf("Expected %q on retry; saw %q", s0.String(), str)
+	}
+	s1 := common.Sample{time.Unix(1, 0), "SOURCE", "NAME", 10.0}
+	r.reportSample(s1)
+	if str := ts.waitForReport(t); str != s1.String() {
+		t.Errorf("Expected %q at first destination; saw %q", s1.String(), str)
+	}
+	if str := ts2.waitForReport(t); str != s1.String() {
+		t.Errorf("Expected %q at second destination; saw %q", s1.String(), str)
+	}
+}
+
+func TestReportQuorum(t *testing.T) {
+	ts2 := newTestServer(t)
+	ts2.stop()
+	ts3 := newTestServer(t)
+	defer ts3.stop()
+
+	cfg := createConfig()
+	cfg.ReportDestinations = []reportDestination{
+		{ts2.getReportURL(), ""},
+		{ts3.getReportURL(), ts3.secret},
+	}
+	cfg.ReportQuorum = 1
+	ts, r := initTest(t, cfg)
+	defer cleanUpTest(ts, r)
+
+	// Samples should be reported successfully even though the second
+	// destination is unreachable. They should still be sent to the third
+	// destination after the quorum has been reached.
+	for i := 0; i < 2; i++ {
+		s := common.Sample{time.Unix(int64(i), 0), "SOURCE", "NAME", 10.0}
+		r.reportSample(s)
+		if str := ts.waitForReport(t); str != s.String() {
+			t.Errorf("Expected %q; saw %q", s.String(), str)
+		}
+		if str := ts3.waitForReport(t); str != s.String() {
+			t.Errorf("Expected %q at third destination; saw %q", s.String(), str)
+		}
+	}
+	if n := r.errorCount(); n != 0 {
+		t.Errorf("Got %v error(s); expected 0", n)
+	}
+}
+
+func TestReadConfigReportQuorum(t *testing.T) {
+	p := createTempFile()
+	defer os.Remove(p)
+
+	for _, tc := range []struct {
+		data string
+		ok   bool
+	}{
+		{`{"reportUrl": "https://a/", "reportQuorum": 1}`, true},
+		{`{"reportUrl": "https://a/", "reportQuorum": 2}`, false},
+		{`{"reportDestinations": [{"url": "https://b/"}], "reportQuorum": 1}`, true},
+		{`{"reportDestinations": [{"url": "https://b/"}], "reportQuorum": 2}`, false},
+		{`{"reportUrl": "https://a/", "reportDestinations": [{"url": "https://b/"}],
+		   "reportQuorum": 2}`, true},
+		{`{"reportQuorum": -1}`, false},
+	} {
+		if err := ioutil.WriteFile(p, []byte(tc.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConfig(p, log.New(ioutil.Discard, "", 0)); err != nil && tc.ok {
+			t.Errorf("Config %q unexpectedly rejected: %v", tc.data, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("Config %q unexpectedly accepted", tc.data)
+		}
+	}
+}
+
+func TestNewHTTPClientTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	caFile := createTempFile()
+	defer os.Remove(caFile)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(cfg *config) error {
+		client, err := newHTTPClient(cfg)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// The server's self-signed certificate should be rejected by default.
+	cfg := createConfig()
+	if err := get(cfg); err == nil {
+		t.Errorf("Request unexpectedly succeeded without CA")
+	}
+
+	cfg = createConfig()
+	cfg.ReportCAFile = caFile
+	cfg.ReportDisableKeepAlives = true
+	if err := get(cfg); err != nil {
+		t.Errorf("Request failed with CA: %v", err)
+	}
+
+	cfg = createConfig()
+	cfg.ReportInsecureSkipVerify = true
+	if err := get(cfg); err != nil {
+		t.Errorf("Request failed when skipping verification: %v", err)
+	}
+
+	// A CA file without any certificates should be rejected.
+	cfg = createConfig()
+	cfg.ReportCAFile = createTempFile()
+	defer os.Remove(cfg.ReportCAFile)
+	if _, err := newHTTPClient(cfg); err == nil {
+		t.Errorf("Client unexpectedly created with empty CA file")
+	}
+}
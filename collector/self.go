@@ -0,0 +1,52 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/derat/home/common"
+)
+
+// getSelfSamples returns samples describing the current state of r. Report
+// latency samples cover the reports that have succeeded since the previous
+// call.
+func getSelfSamples(cfg *config, r *reporter, now time.Time) []common.Sample {
+	var backingFileBytes int64
+	if cfg.BackingFile != "" {
+		if fi, err := os.Stat(cfg.BackingFile); err == nil {
+			backingFileBytes = fi.Size()
+		}
+	}
+	samples := []common.Sample{
+		{now, cfg.Source, sampleQueueDepth, float32(r.queueLength())},
+		{now, cfg.Source, sampleReportErrorsTotal, float32(r.errorCount())},
+		{now, cfg.Source, sampleBackingFileBytes, float32(backingFileBytes)},
+	}
+	if skew, ok := r.serverClockSkew(); ok {
+		samples = append(samples, common.Sample{now, cfg.Source, sampleClockSkewSec, float32(skew.Seconds())})
+	}
+	if ls := r.takeReportLatency(); ls.count > 0 {
+		ms := func(d time.Duration) float32 { return float32(d.Seconds() * 1000) }
+		samples = append(samples,
+			common.Sample{now, cfg.Source, sampleReportLatencyMinMs, ms(ls.min)},
+			common.Sample{now, cfg.Source, sampleReportLatencyAvgMs, ms(ls.avg())},
+			common.Sample{now, cfg.Source, sampleReportLatencyMaxMs, ms(ls.max)})
+	}
+	return samples
+}
+
+func runSelfLoop(cfg *config, r *reporter) {
+	for {
+		start := time.Now()
+		r.reportSamples(getSelfSamples(cfg, r, start))
+
+		next := start.Add(time.Duration(cfg.SelfSampleIntervalSec) * time.Second)
+		now := time.Now()
+		if now.Before(next) {
+			time.Sleep(next.Sub(now))
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/derat/home/common"
+)
+
+func TestGetSelfSamples(t *testing.T) {
+	cfg := createConfig()
+	cfg.BackingFile = createTempFile()
+	defer os.Remove(cfg.BackingFile)
+	ts, r := initTest(t, cfg)
+	defer cleanUpTest(ts, r)
+
+	ts.responseCode = http.StatusInternalServerError
+	r.reportSample(common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0})
+	ts.waitForReport(t)
+
+	// The reporter updates its state asynchronously after receiving the reply,
+	// so wait for the error to be counted and the sample to be written to the
+	// backing file.
+	now := time.Unix(100, 0)
+	deadline := time.Now().Add(time.Duration(testReportTimeoutMs) * time.Millisecond)
+	var samples []common.Sample
+	for {
+		samples = getSelfSamples(cfg, r, now)
+		if (samples[1].Value > 0 && samples[2].Value > 0) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	exp := common.JoinSamples([]common.Sample{
+		{now, cfg.Source, sampleQueueDepth, 1},
+		{now, cfg.Source, sampleReportErrorsTotal, 1},
+		{now, cfg.Source, sampleBackingFileBytes, float32(getFileSize(cfg.BackingFile))},
+	})
+	if act := common.JoinSamples(samples); act != exp {
+		t.Errorf("Expected %q; got %q", exp, act)
+	}
+}
+
+func TestGetSelfSamplesClockSkew(t *testing.T) {
+	cfg := createConfig()
+	ts, r := initTest(t, cfg)
+	defer cleanUpTest(ts, r)
+
+	// The skew shouldn't be reported until a report has succeeded.
+	if samples := getSelfSamples(cfg, r, time.Unix(100, 0)); len(samples) != 3 {
+		t.Errorf("Got %v sample(s) before reporting; expected 3", len(samples))
+	}
+
+	r.reportSample(common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0})
+	ts.waitForReport(t)
+
+	deadline := time.Now().Add(time.Duration(testReportTimeoutMs) * time.Millisecond)
+	for {
+		if _, ok := r.serverClockSkew(); ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The test server uses the local clock, so the skew should be tiny.
+	samples := getSelfSamples(cfg, r, time.Unix(100, 0))
+	if len(samples) != 7 {
+		t.Fatalf("Got %v sample(s) after reporting; expected 7", len(samples))
+	}
+	if s := samples[3]; s.Name != sampleClockSkewSec || s.Value < -2 || s.Value > 2 {
+		t.Errorf("Got unexpected skew sample %v", s)
+	}
+}
+
+func TestGetSelfSamplesReportLatency(t *testing.T) {
+	cfg := createConfig()
+	ts, r := initTest(t, cfg)
+	defer cleanUpTest(ts, r)
+
+	r.reportSample(common.Sample{time.Unix(0, 0), "SOURCE", "NAME", 10.0})
+	ts.waitForReport(t)
+
+	// The latency is recorded before the clock skew.
+	deadline := time.Now().Add(time.Duration(testReportTimeoutMs) * time.Millisecond)
+	for {
+		if _, ok := r.serverClockSkew(); ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	samples := getSelfSamples(cfg, r, time.Unix(100, 0))
+	if len(samples) != 7 {
+		t.Fatalf("Got %v sample(s) after reporting; expected 7", len(samples))
+	}
+	min, avg, max := samples[4], samples[5], samples[6]
+	if min.Name != sampleReportLatencyMinMs || avg.Name != sampleReportLatencyAvgMs ||
+		max.Name != sampleReportLatencyMaxMs {
+		t.Errorf("Got unexpected latency samples %v, %v, %v", min, avg, max)
+	} else if min.Value < 0 || min.Value > avg.Value || avg.Value > max.Value {
+		t.Errorf("Got inconsistent latencies %v, %v, %v", min.Value, avg.Value, max.Value)
+	}
+
+	// The latency should be reset after being reported.
+	if samples := getSelfSamples(cfg, r, time.Unix(200, 0)); len(samples) != 4 {
+		t.Errorf("Got %v sample(s) on second call; expected 4", len(samples))
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// BinaryReportContentType is the Content-Type of reports whose bodies
+	// contain samples encoded by EncodeSamples. The report's nonce and
+	// signature are passed as "n" and "s" query parameters. Reports are
+	// otherwise form-encoded, with samples (as returned by JoinSamples) in
+	// the "d" parameter.
+	BinaryReportContentType = "application/x-home-samples"
+
+	// Version of the format written by EncodeSamples.
+	binarySamplesVersion = 1
+)
+
+// EncodeSamples encodes samples in a length-prefixed binary format. Unlike
+// String and JoinSamples, sources and names may contain any characters and
+// values are encoded without any loss of precision.
+//
+// The encoding consists of a version byte followed by each sample's timestamp
+// as big-endian nanoseconds since the Unix epoch (8 bytes), its source and
+// name (each prefixed by its length as a uvarint), and its value as a
+// big-endian IEEE 754 float (4 bytes).
+func EncodeSamples(samples []Sample) []byte {
+	b := []byte{binarySamplesVersion}
+	for _, s := range samples {
+		b = binary.BigEndian.AppendUint64(b, uint64(s.Timestamp.UnixNano()))
+		b = binary.AppendUvarint(b, uint64(len(s.Source)))
+		b = append(b, s.Source...)
+		b = binary.AppendUvarint(b, uint64(len(s.Name)))
+		b = append(b, s.Name...)
+		b = binary.BigEndian.AppendUint32(b, math.Float32bits(s.Value))
+	}
+	return b
+}
+
+// DecodeSamples decodes samples previously encoded by EncodeSamples. Unlike
+// Parse, it doesn't check that the samples' values are finite.
+func DecodeSamples(b []byte) ([]Sample, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("Missing version")
+	} else if b[0] != binarySamplesVersion {
+		return nil, fmt.Errorf("Unsupported version %v", b[0])
+	}
+	b = b[1:]
+
+	readString := func() (string, error) {
+		n, size := binary.Uvarint(b)
+		if size <= 0 || n > uint64(len(b)-size) {
+			return "", fmt.Errorf("Bad string length")
+		}
+		s := string(b[size : size+int(n)])
+		b = b[size+int(n):]
+		return s, nil
+	}
+
+	samples := make([]Sample, 0)
+	for len(b) > 0 {
+		var s Sample
+		if len(b) < 8 {
+			return nil, fmt.Errorf("Truncated timestamp in sample %v", len(samples))
+		}
+		ns := int64(binary.BigEndian.Uint64(b))
+		s.Timestamp = time.Unix(ns/int64(time.Second), ns%int64(time.Second))
+		b = b[8:]
+
+		var err error
+		if s.Source, err = readString(); err != nil {
+			return nil, fmt.Errorf("%v for source in sample %v", err, len(samples))
+		}
+		if s.Name, err = readString(); err != nil {
+			return nil, fmt.Errorf("%v for name in sample %v", err, len(samples))
+		}
+		if len(b) < 4 {
+			return nil, fmt.Errorf("Truncated value in sample %v", len(samples))
+		}
+		s.Value = math.Float32frombits(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package common
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodeSamples(t *testing.T) {
+	samples := []Sample{
+		{time.Unix(123, 0), "BEDROOM", "TEMPERATURE", 55.5},
+		{time.Unix(456, 789), "A|B\nC", "", 0.1},
+		{time.Unix(-5, 0), "", "NEG", float32(math.Inf(-1))},
+	}
+	b := EncodeSamples(samples)
+	act, err := DecodeSamples(b)
+	if err != nil {
+		t.Fatalf("Failed to decode %v: %v", b, err)
+	}
+	if len(act) != len(samples) {
+		t.Fatalf("Decoded %v sample(s); expected %v", len(act), len(samples))
+	}
+	for i := range samples {
+		if e, a := samples[i], act[i]; !a.Timestamp.Equal(e.Timestamp) ||
+			a.Source != e.Source || a.Name != e.Name || a.Value != e.Value {
+			t.Errorf("Decoded sample %v as %+v; expected %+v", i, a, e)
+		}
+	}
+
+	if act, err := DecodeSamples(EncodeSamples(nil)); err != nil {
+		t.Errorf("Failed to decode empty samples: %v", err)
+	} else if !reflect.DeepEqual(act, []Sample{}) {
+		t.Errorf("Decoded %+v from empty samples", act)
+	}
+
+	for _, bad := range [][]byte{
+		nil,
+		[]byte{2},
+		b[:len(b)-1],
+		b[:5],
+		append([]byte{binarySamplesVersion, 0, 0, 0, 0, 0, 0, 0, 0}, 0xff),
+	} {
+		if _, err := DecodeSamples(bad); err == nil {
+			t.Errorf("Didn't get error when decoding %v", bad)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReportRequestIdHeader is the HTTP header containing a unique ID that
+// collectors include in each report request so it can be identified in the
+// server's logs.
+const ReportRequestIdHeader = "X-Request-Id"
+
+// ReportReply is returned as JSON by the server after it receives a report.
+type ReportReply struct {
+	// Accepted contains the number of samples that were stored.
+	Accepted int `json:"accepted"`
+
+	// Rejected contains the zero-based indexes of samples within the report
+	// that were not stored because they were invalid.
+	Rejected []int `json:"rejected,omitempty"`
+
+	// Invalid contains the subset of Rejected that will never be accepted,
+	// e.g. because the samples were malformed or were timestamped before the
+	// reporting device's clock was set. Collectors should drop these samples
+	// instead of retrying them.
+	Invalid []int `json:"invalid,omitempty"`
+}
+
+// NewReportNonce returns a unique string to include in a report's signature so
+// the server can detect replayed reports. now is embedded in the nonce so the
+// server can also reject old reports.
+func NewReportNonce(now time.Time) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return fmt.Sprintf("%d-%s", now.Unix(), hex.EncodeToString(b))
+}
+
+// ParseReportNonce returns the time embedded in a nonce created by
+// NewReportNonce.
+func ParseReportNonce(nonce string) (time.Time, error) {
+	parts := strings.Split(nonce, "-")
+	if len(parts) != 2 || parts[1] == "" {
+		return time.Time{}, fmt.Errorf("Malformed nonce %q", nonce)
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Bad time in nonce %q", nonce)
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// SignReport returns the HMAC-SHA256 signature for a report containing data
+// (as returned by JoinSamples) and nonce (as returned by NewReportNonce).
+func SignReport(data, nonce, secret string) string {
+	return SignWithHMACSHA256(data+"|"+nonce, secret)
+}
+
+// VerifyReport returns true if sig is the signature returned by SignReport for
+// data, nonce, and secret.
+func VerifyReport(data, nonce, secret, sig string) bool {
+	return VerifySignature(data+"|"+nonce, secret, sig)
+}
+
+// SignLegacyReport returns the signature that was used for reports before
+// SignReport switched to HMAC-SHA256. It's only needed by servers that still
+// accept reports from old collectors.
+func SignLegacyReport(data, nonce, secret string) string {
+	return HashStringWithSHA256(fmt.Sprintf("%s|%s|%s", data, nonce, secret))
+}
+
+// VerifyLegacyReport is like VerifyReport but for signatures returned by
+// SignLegacyReport.
+func VerifyLegacyReport(data, nonce, secret, sig string) bool {
+	return constantTimeEqual(SignLegacyReport(data, nonce, secret), sig)
+}
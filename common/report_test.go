@@ -0,0 +1,64 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReportNonce(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	n0 := NewReportNonce(now)
+	n1 := NewReportNonce(now)
+	if n0 == n1 {
+		t.Errorf("Got identical nonces %q", n0)
+	}
+	if ts, err := ParseReportNonce(n0); err != nil {
+		t.Errorf("Failed to parse %q: %v", n0, err)
+	} else if !ts.Equal(now) {
+		t.Errorf("Parsed time %v from %q; expected %v", ts.Unix(), n0, now.Unix())
+	}
+
+	for _, n := range []string{"", "123", "123-", "abc-def", "1-2-3"} {
+		if _, err := ParseReportNonce(n); err == nil {
+			t.Errorf("Didn't get expected error when parsing %q", n)
+		}
+	}
+}
+
+func TestSignReport(t *testing.T) {
+	sig := SignReport("data", "nonce", "secret")
+	const exp = "7108f27abcde975d6c07fb30179593ef78d23f7e442773a689d219a7d84ddb6e"
+	if sig != exp {
+		t.Errorf("Expected %q; got %q", exp, sig)
+	}
+	if sig == SignReport("data", "nonce2", "secret") {
+		t.Errorf("Signature doesn't depend on nonce")
+	}
+	if sig == SignReport("data", "nonce", "secret2") {
+		t.Errorf("Signature doesn't depend on secret")
+	}
+	if !VerifyReport("data", "nonce", "secret", sig) {
+		t.Errorf("Valid signature %q not verified", sig)
+	}
+	for _, bad := range []string{"", sig[1:], sig + "0", SignLegacyReport("data", "nonce", "secret")} {
+		if VerifyReport("data", "nonce", "secret", bad) {
+			t.Errorf("Invalid signature %q verified", bad)
+		}
+	}
+}
+
+func TestSignLegacyReport(t *testing.T) {
+	sig := SignLegacyReport("data", "nonce", "secret")
+	if sig != HashStringWithSHA256("data|nonce|secret") {
+		t.Errorf("Got unexpected signature %q", sig)
+	}
+	if !VerifyLegacyReport("data", "nonce", "secret", sig) {
+		t.Errorf("Valid signature %q not verified", sig)
+	}
+	if VerifyLegacyReport("data", "nonce", "secret", SignReport("data", "nonce", "secret")) {
+		t.Errorf("HMAC signature verified as legacy signature")
+	}
+}
@@ -5,6 +5,7 @@ package common
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -19,11 +20,67 @@ type Sample struct {
 
 // String serializes s to a string that can later be parsed using Parse.
 func (s *Sample) String() string {
-	return fmt.Sprintf("%d|%s|%s|%.1f", s.Timestamp.Unix(), s.Source, s.Name, s.Value)
+	return fmt.Sprintf("%s|%s|%s|%.1f", FormatTimestamp(s.Timestamp), s.Source, s.Name, s.Value)
+}
+
+// CheckSeries returns an error if s's source or name contains '|' or a
+// newline. Such characters are used as delimiters by String and JoinSamples
+// and aren't escaped.
+func (s *Sample) CheckSeries() error {
+	for _, f := range []string{s.Source, s.Name} {
+		if strings.ContainsAny(f, "|\r\n") {
+			return fmt.Errorf("%q contains '|' or newline", f)
+		}
+	}
+	return nil
+}
+
+// FormatTimestamp formats t as seconds since the Unix epoch. Fractional
+// seconds are only included if t isn't a whole second, e.g. "123" or "123.45".
+func FormatTimestamp(t time.Time) string {
+	sec, ns := t.Unix(), t.Nanosecond()
+	if ns == 0 {
+		return strconv.FormatInt(sec, 10)
+	}
+	sign := ""
+	if sec < 0 {
+		// Nanosecond counts forward from the (earlier) whole second, but the
+		// fractional part of a negative timestamp counts back from zero.
+		sign, sec, ns = "-", -(sec + 1), int(time.Second)-ns
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%09d", sign, sec, ns), "0")
+}
+
+// ParseTimestamp parses a string previously generated by FormatTimestamp. Up
+// to nine digits of fractional seconds are accepted.
+func ParseTimestamp(str string) (time.Time, error) {
+	parts := strings.SplitN(str, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsec int64
+	if len(parts) == 2 {
+		frac := parts[1]
+		if len(frac) == 0 || len(frac) > 9 || strings.Trim(frac, "0123456789") != "" {
+			return time.Time{}, fmt.Errorf("bad fractional seconds %q", frac)
+		}
+		if nsec, err = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+	// The fractional part has the same sign as the whole part, e.g. "-5.5" is
+	// 5.5 seconds before the epoch.
+	if strings.HasPrefix(parts[0], "-") {
+		nsec = -nsec
+	}
+	return time.Unix(sec, nsec), nil
 }
 
 // Parse deserializes str, previously generated by String, and fills s. If a
-// timestamp is not supplied, now will be used. On error, s may be left in a
+// timestamp is not supplied, now will be used. Timestamps may contain
+// fractional seconds. NaN and infinite values are rejected, as are sources and
+// names rejected by CheckSeries. On error, s may be left in a
 // partially-initialized state.
 func (s *Sample) Parse(str string, now time.Time) error {
 	parts := strings.Split(str, "|")
@@ -32,21 +89,28 @@ func (s *Sample) Parse(str string, now time.Time) error {
 	}
 
 	if len(parts) == 4 {
-		ut, err := strconv.ParseInt(parts[0], 10, 64)
+		ts, err := ParseTimestamp(parts[0])
 		if err != nil {
 			return fmt.Errorf("Failed to parse timestamp from %q", str)
 		}
-		s.Timestamp = time.Unix(ut, 0)
+		s.Timestamp = ts
 	} else {
 		s.Timestamp = now
 	}
 
 	s.Source = parts[len(parts)-3]
 	s.Name = parts[len(parts)-2]
-	if val, err := strconv.ParseFloat(parts[len(parts)-1], 64); err != nil {
+	if err := s.CheckSeries(); err != nil {
+		return err
+	}
+	val, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
 		return fmt.Errorf("Failed to parse value from %q", str)
-	} else {
-		s.Value = float32(val)
+	}
+	// Check the converted value, since finite float64s can overflow float32.
+	s.Value = float32(val)
+	if v := float64(s.Value); math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("Non-finite value in %q", str)
 	}
 	return nil
 }
@@ -40,6 +40,13 @@ func TestParse(t *testing.T) {
 		t.Error(err)
 	}
 
+	var s Sample
+	if err := s.Parse("123.25|KITCHEN|TEMPERATURE|70", time.Unix(DefaultTime, 0)); err != nil {
+		t.Error(err)
+	} else if exp := time.Unix(123, 250000000); !s.Timestamp.Equal(exp) {
+		t.Errorf("Expected timestamp %v; got %v", exp, s.Timestamp)
+	}
+
 	for _, str := range []string{
 		"",
 		"SOURCE",
@@ -49,6 +56,12 @@ func TestParse(t *testing.T) {
 		"123|SOURCE|NAME|100.0|5",
 		"FOO|SOURCE|NAME|100.0",
 		"123|SOURCE|NAME|FOO",
+		"123|S|N|NaN",
+		"123|S|N|Inf",
+		"123|S|N|-Inf",
+		"123|S|N|1e100",
+		"123.|SOURCE|NAME|100.0",
+		"123.x|SOURCE|NAME|100.0",
 	} {
 		var s Sample
 		if err := s.Parse(str, time.Unix(DefaultTime, 0)); err == nil {
@@ -63,4 +76,73 @@ func TestString(t *testing.T) {
 	if str := s.String(); str != exp {
 		t.Errorf("Expected %q; got %q", exp, str)
 	}
+
+	const fracExp = "890.025|SOURCE|NAME|75.5"
+	s.Timestamp = time.Unix(890, 25000000)
+	if str := s.String(); str != fracExp {
+		t.Errorf("Expected %q; got %q", fracExp, str)
+	}
+}
+
+func TestCheckSeries(t *testing.T) {
+	for _, tc := range []struct {
+		source, name string
+		ok           bool
+	}{
+		{"source", "name", true},
+		{"source 1", "name%", true},
+		{"a|b", "c", false},
+		{"a", "b|c", false},
+		{"a\nb", "c", false},
+		{"a", "b\r", false},
+	} {
+		s := Sample{time.Unix(890, 0), tc.source, tc.name, 1.0}
+		if err := s.CheckSeries(); err != nil && tc.ok {
+			t.Errorf("%q|%q unexpectedly rejected: %v", tc.source, tc.name, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("%q|%q unexpectedly accepted", tc.source, tc.name)
+		}
+	}
+
+	// Names with delimiters can't be round-tripped, so Parse should reject them.
+	s := Sample{time.Unix(890, 0), "a|b", "c", 1.0}
+	if err := parseString(s.String(), 890, "a|b", "c", 1.0); err == nil {
+		t.Errorf("Parsing %q unexpectedly succeeded", s.String())
+	}
+	if err := parseString("890|src|name\r|1.0", 890, "src", "name\r", 1.0); err == nil {
+		t.Error("Parsing name with carriage return unexpectedly succeeded")
+	}
+	// Percent signs aren't special.
+	if err := parseString("890|SRC|humidity_%7C|1.0", 890, "SRC", "humidity_%7C", 1.0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	for _, tc := range []struct {
+		str string
+		exp time.Time
+	}{
+		{"123", time.Unix(123, 0)},
+		{"123.5", time.Unix(123, 500000000)},
+		{"123.001", time.Unix(123, 1000000)},
+		{"123.000000001", time.Unix(123, 1)},
+		{"-5", time.Unix(-5, 0)},
+		{"-5.5", time.Unix(-5, -500000000)},
+		{"-0.25", time.Unix(0, -250000000)},
+	} {
+		if ts, err := ParseTimestamp(tc.str); err != nil {
+			t.Errorf("Failed to parse %q: %v", tc.str, err)
+		} else if !ts.Equal(tc.exp) {
+			t.Errorf("Parsed %q as %v; expected %v", tc.str, ts, tc.exp)
+		} else if str := FormatTimestamp(ts); str != tc.str {
+			t.Errorf("Formatted %v as %q; expected %q", ts, str, tc.str)
+		}
+	}
+
+	for _, str := range []string{"", ".5", "abc", "123.", "123.-5", "123.5.5", "123.1234567890"} {
+		if _, err := ParseTimestamp(str); err == nil {
+			t.Errorf("Didn't get expected error when parsing %q", str)
+		}
+	}
 }
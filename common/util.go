@@ -4,7 +4,9 @@
 package common
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 )
 
@@ -13,3 +15,23 @@ func HashStringWithSHA256(s string) string {
 	h.Write([]byte(s))
 	return hex.EncodeToString(h.Sum(nil))
 }
+
+// SignWithHMACSHA256 returns the hex-encoded HMAC-SHA256 of data keyed by
+// secret.
+func SignWithHMACSHA256(data, secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifySignature returns true if provided is the signature returned by
+// SignWithHMACSHA256 for data and secret. The comparison takes constant time.
+func VerifySignature(data, secret, provided string) bool {
+	return hmac.Equal([]byte(SignWithHMACSHA256(data, secret)), []byte(provided))
+}
+
+// constantTimeEqual returns true if a and b are equal without leaking timing
+// information about where they differ.
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,8 @@
+// Copyright 2017 Daniel Erat <dan@erat.org>
+// All rights reserved.
+
+package common
+
+// Version describes the build of the code. It can be set at build time, e.g.
+// via -ldflags "-X github.com/derat/home/common.Version=$(git rev-parse --short HEAD)".
+var Version = "dev"
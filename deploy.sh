@@ -2,6 +2,18 @@
 
 project=$(./project_id.sh)
 
+# App Engine builds the app itself, so pass the version reported by /version
+# (see common.Version) to the buildpack's linker flags via a copy of app.yaml.
+# The copy needs to be in the same directory as go.mod.
+version=$(git describe --always --dirty 2>/dev/null || echo dev)
+config=app.deploy.yaml
+trap 'rm -f "$config"' EXIT
+cat app.yaml - >"$config" <<EOF
+
+build_env_variables:
+  GOOGLE_GOLDFLAGS: -X github.com/derat/home/common.Version=${version}
+EOF
+
 # As of November 2021, 'beta' is required here to use App Engine bundled
 # services (e.g. memcache) from the go115 runtime. Without it, the 'deploy'
 # command prints 'WARNING: There is a dependency on App Engine APIs, but they
@@ -10,7 +22,7 @@ project=$(./project_id.sh)
 #
 # Surprisingly, --quiet only disables yes/no prompts (which we want) rather than
 # suppressing output (which we don't want).
-gcloud beta app --project="$project" --quiet deploy "$@"
+gcloud beta app --project="$project" --quiet deploy "$config" "$@"
 
 # Clean up stale versions of the app so they aren't sitting around.
 versions=$(
@@ -2,6 +2,7 @@ module github.com/derat/home
 
 go 1.19
 
-require google.golang.org/appengine/v2 v2.0.1
-
-require github.com/golang/protobuf v1.3.1 // indirect
+require (
+	github.com/golang/protobuf v1.3.1
+	google.golang.org/appengine/v2 v2.0.1
+)